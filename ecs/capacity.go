@@ -0,0 +1,106 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+)
+
+// These are the capacity providers AWS makes available to all clusters which
+// use Fargate.
+const (
+	capacityProviderFargate     = "FARGATE"
+	capacityProviderFargateSpot = "FARGATE_SPOT"
+)
+
+// usesFargate returns whether the task runs on Fargate, either via the launch
+// type or the Fargate capacity providers.
+func (c ECSTaskConfig) usesFargate() bool {
+	if c.LaunchType == "FARGATE" {
+		return true
+	}
+	for _, s := range c.CapacityProviderStrategy {
+		if s.CapacityProvider == capacityProviderFargate || s.CapacityProvider == capacityProviderFargateSpot {
+			return true
+		}
+	}
+	return false
+}
+
+// usesFargateSpot returns whether the capacity provider strategy includes
+// Fargate Spot.
+func (c ECSTaskConfig) usesFargateSpot() bool {
+	for _, s := range c.CapacityProviderStrategy {
+		if s.CapacityProvider == capacityProviderFargateSpot {
+			return true
+		}
+	}
+	return false
+}
+
+// isCapacityUnavailable returns whether the RunTask error was caused by ECS
+// not having the capacity to place the task.
+func isCapacityUnavailable(err error) bool {
+	var runErr *runTaskError
+	if !errors.As(err, &runErr) {
+		return false
+	}
+	for _, f := range runErr.Failures {
+		if strings.HasPrefix(f.Reason, ecsFailureReasonCapacity) {
+			return true
+		}
+	}
+	return false
+}
+
+// runTaskFunc runs a single ECS task.
+type runTaskFunc func(ctx context.Context, cfg TaskConfig) (*ecs.Task, error)
+
+// runTaskResult is the outcome of running an ECS task, including the
+// capacity provider used when it is known.
+type runTaskResult struct {
+	Task             *ecs.Task
+	CapacityProvider string
+	FellBack         bool
+}
+
+// runTaskWithFallback runs the ECS task and, when enabled and Fargate Spot
+// does not have the capacity to place it, runs the task again using on-demand
+// Fargate. The onFallback function is called with the Fargate Spot error
+// before running the task again.
+func runTaskWithFallback(ctx context.Context, run runTaskFunc, cfg TaskConfig,
+	onFallback func(error)) (*runTaskResult, error) {
+	task, err := run(ctx, cfg)
+	if err == nil {
+		return &runTaskResult{Task: task, CapacityProvider: aws.StringValue(task.CapacityProviderName)}, nil
+	}
+
+	if !cfg.Task.FargateSpotFallback || !cfg.Task.usesFargateSpot() || !isCapacityUnavailable(err) {
+		return nil, err
+	}
+	if onFallback != nil {
+		onFallback(err)
+	}
+
+	fallback := cfg
+	fallback.Task.CapacityProviderStrategy = []TaskCapacityProviderStrategy{
+		{CapacityProvider: capacityProviderFargate, Weight: 1},
+	}
+
+	// The fallback request differs from the original, so must not reuse its
+	// client tokens.
+	if fallback.idempotencyKey != "" {
+		fallback.idempotencyKey += "/" + capacityProviderFargate
+	}
+	task, err = run(ctx, fallback)
+	if err != nil {
+		return nil, err
+	}
+	return &runTaskResult{Task: task, CapacityProvider: capacityProviderFargate, FellBack: true}, nil
+}
@@ -0,0 +1,123 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_runTaskWithFallback(t *testing.T) {
+	spotStrategy := []TaskCapacityProviderStrategy{
+		{CapacityProvider: capacityProviderFargateSpot, Weight: 1},
+	}
+	capacityErr := newRunTaskError([]ecs.Failure{
+		{Reason: aws.String("Capacity is unavailable at this time. Please try again later.")},
+	})
+	configErr := newRunTaskError([]ecs.Failure{{Reason: aws.String("MISSING")}})
+
+	testCases := []struct {
+		name             string
+		inputFallback    bool
+		inputErrs        []error
+		expectedProvider string
+		expectedFellBack bool
+		expectedCalls    int
+		expectedError    bool
+	}{
+		{
+			name:             "spot placed",
+			inputFallback:    true,
+			expectedProvider: capacityProviderFargateSpot,
+			expectedCalls:    1,
+		},
+		{
+			name:             "spot capacity unavailable",
+			inputFallback:    true,
+			inputErrs:        []error{capacityErr},
+			expectedProvider: capacityProviderFargate,
+			expectedFellBack: true,
+			expectedCalls:    2,
+		},
+		{
+			name:          "fallback disabled",
+			inputFallback: false,
+			inputErrs:     []error{capacityErr},
+			expectedCalls: 1,
+			expectedError: true,
+		},
+		{
+			name:          "non capacity failure",
+			inputFallback: true,
+			inputErrs:     []error{configErr},
+			expectedCalls: 1,
+			expectedError: true,
+		},
+		{
+			name:          "request error",
+			inputFallback: true,
+			inputErrs:     []error{errors.New("connection reset")},
+			expectedCalls: 1,
+			expectedError: true,
+		},
+		{
+			name:          "fargate capacity unavailable",
+			inputFallback: true,
+			inputErrs:     []error{capacityErr, capacityErr},
+			expectedCalls: 2,
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newMockECSClient()
+			client.runTaskErrs = tc.inputErrs
+
+			cfg := TaskConfig{Task: ECSTaskConfig{
+				TaskDefinition:           "web:1",
+				CapacityProviderStrategy: spotStrategy,
+				FargateSpotFallback:      tc.inputFallback,
+			}}
+
+			fellBack := false
+			result, err := runTaskWithFallback(context.Background(), client.RunTask, cfg, func(error) { fellBack = true })
+			assert.Len(t, client.runTaskInputs, tc.expectedCalls)
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedProvider, result.CapacityProvider)
+			assert.Equal(t, tc.expectedFellBack, result.FellBack)
+			assert.Equal(t, tc.expectedFellBack, fellBack)
+
+			// The fallback must not modify the original strategy.
+			assert.Equal(t, capacityProviderFargateSpot, cfg.Task.CapacityProviderStrategy[0].CapacityProvider)
+		})
+	}
+}
+
+func Test_buildTaskInput_capacityProviderStrategy(t *testing.T) {
+	client := awsEcsClient{cluster: "nomad"}
+	input := client.buildTaskInput(TaskConfig{Task: ECSTaskConfig{
+		TaskDefinition: "web:1",
+		CapacityProviderStrategy: []TaskCapacityProviderStrategy{
+			{CapacityProvider: capacityProviderFargate, Base: 1, Weight: 1},
+			{CapacityProvider: capacityProviderFargateSpot, Weight: 4},
+		},
+	}})
+
+	assert.Equal(t, ecs.LaunchType(""), input.LaunchType)
+	require.Len(t, input.CapacityProviderStrategy, 2)
+	assert.Equal(t, capacityProviderFargate, aws.StringValue(input.CapacityProviderStrategy[0].CapacityProvider))
+	assert.Equal(t, int64(1), aws.Int64Value(input.CapacityProviderStrategy[0].Base))
+	assert.Equal(t, int64(4), aws.Int64Value(input.CapacityProviderStrategy[1].Weight))
+}
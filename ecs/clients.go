@@ -0,0 +1,135 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+)
+
+// clusterRef identifies an ECS cluster within a region.
+type clusterRef struct {
+	Region  string
+	Cluster string
+}
+
+func (r clusterRef) String() string {
+	return r.Region + "/" + r.Cluster
+}
+
+// ecsClientPool holds an ECS client for each cluster and region tasks are run
+// in, creating them as they are first used.
+type ecsClientPool struct {
+	// defaults is the cluster and region of the plugin config, used when
+	// a task does not set them.
+	defaults clusterRef
+
+	// newClient creates a client of the cluster, using the credentials if
+	// set or otherwise those of the plugin config.
+	newClient func(ref clusterRef, creds aws.CredentialsProvider) ecsClientInterface
+
+	// lock syncs access to all fields below
+	lock    sync.Mutex
+	clients map[clusterRef]ecsClientInterface
+}
+
+func newECSClientPool(cfg aws.Config, cluster string) *ecsClientPool {
+	return &ecsClientPool{
+		defaults: clusterRef{Region: cfg.Region, Cluster: cluster},
+		newClient: func(ref clusterRef, creds aws.CredentialsProvider) ecsClientInterface {
+			regionCfg := cfg.Copy()
+			regionCfg.Region = ref.Region
+			if creds != nil {
+				regionCfg.Credentials = creds
+			}
+			return awsEcsClient{cluster: ref.Cluster, ecsClient: ecs.New(regionCfg)}
+		},
+		clients: make(map[clusterRef]ecsClientInterface),
+	}
+}
+
+// resolve fills in the default cluster and region where they are not set.
+func (p *ecsClientPool) resolve(ref clusterRef) clusterRef {
+	if ref.Region == "" {
+		ref.Region = p.defaults.Region
+	}
+	if ref.Cluster == "" {
+		ref.Cluster = p.defaults.Cluster
+	}
+	return ref
+}
+
+// get returns the client of the cluster, which is resolved using the
+// defaults.
+func (p *ecsClientPool) get(ref clusterRef) ecsClientInterface {
+	ref = p.resolve(ref)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if client, ok := p.clients[ref]; ok {
+		return client
+	}
+	client := p.newClient(ref, nil)
+	p.clients[ref] = client
+	return client
+}
+
+// withCredentials returns a new client of the cluster, which is resolved
+// using the defaults, that uses the credentials. The client is not cached,
+// as the credentials belong to a single task.
+func (p *ecsClientPool) withCredentials(ref clusterRef, creds aws.CredentialsProvider) ecsClientInterface {
+	return p.newClient(p.resolve(ref), creds)
+}
+
+// taskCluster returns the cluster and region the task config selects, which
+// must either be those of the plugin config or within the allowlists. Empty
+// fields select the plugin defaults.
+func (c *DriverConfig) taskCluster(t ECSTaskConfig) (clusterRef, error) {
+	if t.Cluster != "" && t.Cluster != c.Cluster && !containsString(c.AllowedClusters, t.Cluster) {
+		return clusterRef{}, fmt.Errorf("cluster %q is not within the plugin allowed_clusters", t.Cluster)
+	}
+	if t.Region != "" && t.Region != c.Region && !containsString(c.AllowedRegions, t.Region) {
+		return clusterRef{}, fmt.Errorf("region %q is not within the plugin allowed_regions", t.Region)
+	}
+	return clusterRef{Region: t.Region, Cluster: t.Cluster}, nil
+}
+
+// allowedClusters returns every combination of the clusters and regions tasks
+// may select, with empty fields selecting the plugin defaults.
+func (c *DriverConfig) allowedClusters() []clusterRef {
+	clusters := append([]string{""}, c.AllowedClusters...)
+	regions := append([]string{""}, c.AllowedRegions...)
+
+	refs := make([]clusterRef, 0, len(clusters)*len(regions))
+	for _, region := range regions {
+		for _, cluster := range clusters {
+			refs = append(refs, clusterRef{Region: region, Cluster: cluster})
+		}
+	}
+	return refs
+}
+
+// arnRegion returns the region of an ECS resource ARN, such as us-east-1 from
+// arn:aws:ecs:us-east-1:123456789012:task-definition/web:1.
+func arnRegion(arn string) string {
+	parts := strings.SplitN(arn, ":", 5)
+	if len(parts) < 5 || parts[0] != "arn" {
+		return ""
+	}
+	return parts[3]
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ecsClientPool_get(t *testing.T) {
+	var created []clusterRef
+	pool := &ecsClientPool{
+		defaults: clusterRef{Region: "us-east-1", Cluster: "default"},
+		newClient: func(ref clusterRef, _ aws.CredentialsProvider) ecsClientInterface {
+			created = append(created, ref)
+			return &mockECSClient{}
+		},
+		clients: make(map[clusterRef]ecsClientInterface),
+	}
+
+	// The defaults and explicitly set defaults share a single client.
+	defaultClient := pool.get(clusterRef{})
+	assert.Same(t, defaultClient, pool.get(clusterRef{Region: "us-east-1", Cluster: "default"}))
+
+	// Each other cluster and region gets its own client.
+	otherCluster := pool.get(clusterRef{Cluster: "batch"})
+	otherRegion := pool.get(clusterRef{Region: "eu-west-1"})
+	assert.NotSame(t, defaultClient, otherCluster)
+	assert.NotSame(t, defaultClient, otherRegion)
+	assert.Same(t, otherRegion, pool.get(clusterRef{Region: "eu-west-1", Cluster: "default"}))
+
+	assert.Equal(t, []clusterRef{
+		{Region: "us-east-1", Cluster: "default"},
+		{Region: "us-east-1", Cluster: "batch"},
+		{Region: "eu-west-1", Cluster: "default"},
+	}, created)
+}
+
+func Test_DriverConfig_taskCluster(t *testing.T) {
+	config := DriverConfig{
+		Cluster:         "default",
+		Region:          "us-east-1",
+		AllowedClusters: []string{"batch"},
+		AllowedRegions:  []string{"eu-west-1"},
+	}
+
+	testCases := []struct {
+		name          string
+		inputConfig   ECSTaskConfig
+		expectedError string
+		expectedRef   clusterRef
+	}{
+		{
+			name:        "plugin defaults",
+			inputConfig: ECSTaskConfig{},
+			expectedRef: clusterRef{},
+		},
+		{
+			name:        "plugin cluster and region",
+			inputConfig: ECSTaskConfig{Cluster: "default", Region: "us-east-1"},
+			expectedRef: clusterRef{Region: "us-east-1", Cluster: "default"},
+		},
+		{
+			name:        "allowed cluster and region",
+			inputConfig: ECSTaskConfig{Cluster: "batch", Region: "eu-west-1"},
+			expectedRef: clusterRef{Region: "eu-west-1", Cluster: "batch"},
+		},
+		{
+			name:          "disallowed cluster",
+			inputConfig:   ECSTaskConfig{Cluster: "prod"},
+			expectedError: `cluster "prod" is not within the plugin allowed_clusters`,
+		},
+		{
+			name:          "disallowed region",
+			inputConfig:   ECSTaskConfig{Region: "ap-south-1"},
+			expectedError: `region "ap-south-1" is not within the plugin allowed_regions`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ref, err := config.taskCluster(tc.inputConfig)
+			if tc.expectedError != "" {
+				require.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedRef, ref)
+		})
+	}
+}
+
+func Test_DriverConfig_allowedClusters(t *testing.T) {
+	config := DriverConfig{AllowedClusters: []string{"batch"}, AllowedRegions: []string{"eu-west-1"}}
+	assert.Equal(t, []clusterRef{
+		{},
+		{Cluster: "batch"},
+		{Region: "eu-west-1"},
+		{Region: "eu-west-1", Cluster: "batch"},
+	}, config.allowedClusters())
+}
+
+func Test_arnRegion(t *testing.T) {
+	assert.Equal(t, "eu-west-1", arnRegion("arn:aws:ecs:eu-west-1:123456789012:task-definition/web:1"))
+	assert.Equal(t, "", arnRegion("web:1"))
+	assert.Equal(t, "", arnRegion(""))
+}
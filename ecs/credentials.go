@@ -0,0 +1,315 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/external"
+	"github.com/aws/aws-sdk-go-v2/aws/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+const (
+	// credentialsExpiryWindow is how long before temporary credentials
+	// expire that they are refreshed, so requests are not signed with
+	// credentials which expire before ECS receives them.
+	credentialsExpiryWindow = 5 * time.Minute
+
+	// defaultAssumeRoleDuration and maxAssumeRoleDuration bound the duration
+	// of assumed role sessions, as permitted by STS.
+	defaultAssumeRoleDuration = 15 * time.Minute
+	maxAssumeRoleDuration     = 12 * time.Hour
+
+	// defaultRoleSessionName is the session name of assumed roles which do
+	// not configure one.
+	defaultRoleSessionName = "nomad-ecs-driver"
+
+	// staticCredentialsSource is the source of credentials set within the
+	// plugin config.
+	staticCredentialsSource = "PluginConfig"
+
+	// webIdentityCredentialsSource is the source of credentials retrieved
+	// using a web identity token.
+	webIdentityCredentialsSource = "WebIdentityRoleProvider"
+)
+
+// AssumeRoleConfig is the configuration of the IAM role the driver assumes.
+// The role is only assumed if the block is present, in which case the role
+// ARN is always set as it is required.
+type AssumeRoleConfig struct {
+	RoleARN     string `codec:"role_arn"`
+	ExternalID  string `codec:"external_id"`
+	SessionName string `codec:"session_name"`
+	Duration    string `codec:"duration"`
+
+	duration time.Duration
+}
+
+// enabled returns whether the assume_role block is present.
+func (c *AssumeRoleConfig) enabled() bool {
+	return c.RoleARN != ""
+}
+
+// parse validates the assume role configuration, parsing any values which
+// cannot be decoded directly.
+func (c *AssumeRoleConfig) parse() error {
+	c.duration = defaultAssumeRoleDuration
+	if c.Duration != "" {
+		duration, err := time.ParseDuration(c.Duration)
+		if err != nil {
+			return fmt.Errorf("failed to parse assume_role duration: %v", err)
+		}
+		if duration < defaultAssumeRoleDuration || duration > maxAssumeRoleDuration {
+			return fmt.Errorf("assume_role duration must be between %s and %s",
+				defaultAssumeRoleDuration, maxAssumeRoleDuration)
+		}
+		c.duration = duration
+	}
+
+	if c.SessionName == "" {
+		c.SessionName = defaultRoleSessionName
+	}
+	return nil
+}
+
+// parseCredentials validates the credential options of the plugin config.
+// Credentials are read from at most one of the static keys, the shared
+// config and credential files, or the web identity token file, falling back
+// to the default credential chain of the Nomad agent environment.
+func (c *DriverConfig) parseCredentials() error {
+	if (c.AccessKey == "") != (c.SecretKey == "") {
+		return errors.New("access_key and secret_key must be set together")
+	}
+	if c.SessionToken != "" && c.AccessKey == "" {
+		return errors.New("session_token requires access_key and secret_key")
+	}
+
+	static := c.AccessKey != ""
+	shared := c.Profile != "" || c.SharedCredentialsFile != ""
+	if static && shared {
+		return errors.New("access_key cannot be set with profile or shared_credentials_file")
+	}
+
+	if c.WebIdentityTokenFile != "" {
+		if static || shared {
+			return errors.New("web_identity_token_file cannot be set with access_key, profile or shared_credentials_file")
+		}
+		if !c.AssumeRole.enabled() {
+			return errors.New("web_identity_token_file requires an assume_role block with the role_arn to assume")
+		}
+	}
+
+	if c.AssumeRole.enabled() {
+		return c.AssumeRole.parse()
+	}
+	return nil
+}
+
+// loadAWSConfig loads the AWS SDK config, including the credentials, set by
+// the plugin config.
+func (c *DriverConfig) loadAWSConfig() (aws.Config, error) {
+	var configs external.Configs
+
+	// The shared config is loaded ahead of the defaults, so that its
+	// credentials take precedence over those of the environment.
+	if c.Profile != "" || c.SharedCredentialsFile != "" {
+		if c.Profile != "" {
+			configs = append(configs, external.WithSharedConfigProfile(c.Profile))
+		}
+		if c.SharedCredentialsFile != "" {
+			configs = append(configs, external.WithSharedConfigFiles{
+				c.SharedCredentialsFile,
+				external.DefaultSharedConfigFilename(),
+			})
+		}
+		shared, err := external.LoadSharedConfig(configs)
+		if err != nil {
+			return aws.Config{}, fmt.Errorf("failed to load shared config: %v", err)
+		}
+		configs = append(configs, shared)
+	}
+
+	if c.AccessKey != "" {
+		configs = append(configs, external.WithCredentialsValue{
+			AccessKeyID:     c.AccessKey,
+			SecretAccessKey: c.SecretKey,
+			SessionToken:    c.SessionToken,
+			Source:          staticCredentialsSource,
+		})
+	}
+
+	awsCfg, err := external.LoadDefaultAWSConfig(configs...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("unable to load SDK config: %v", err)
+	}
+	if c.Region != "" {
+		awsCfg.Region = c.Region
+	}
+
+	if c.AssumeRole.enabled() {
+		stsClient := sts.New(awsCfg.Copy())
+		if c.WebIdentityTokenFile != "" {
+			awsCfg.Credentials = newWebIdentityRoleProvider(stsClient, c.AssumeRole,
+				webIdentityTokenFile(c.WebIdentityTokenFile))
+		} else {
+			provider := stscreds.NewAssumeRoleProvider(stsClient, c.AssumeRole.RoleARN)
+			provider.RoleSessionName = c.AssumeRole.SessionName
+			provider.Duration = c.AssumeRole.duration
+			provider.ExpiryWindow = credentialsExpiryWindow
+			if c.AssumeRole.ExternalID != "" {
+				provider.ExternalID = aws.String(c.AssumeRole.ExternalID)
+			}
+			awsCfg.Credentials = provider
+		}
+	}
+	return awsCfg, nil
+}
+
+// webIdentityRoler is the subset of the STS client used to exchange web
+// identity tokens for role credentials.
+type webIdentityRoler interface {
+	AssumeRoleWithWebIdentityRequest(input *sts.AssumeRoleWithWebIdentityInput) sts.AssumeRoleWithWebIdentityRequest
+}
+
+// webIdentityRoleProvider retrieves temporary credentials for an IAM role by
+// exchanging a web identity token using STS, refreshing them before they
+// expire. The token is read again for each exchange, as it may be rotated.
+type webIdentityRoleProvider struct {
+	aws.SafeCredentialsProvider
+
+	client      webIdentityRoler
+	roleARN     string
+	sessionName string
+	duration    time.Duration
+	token       func() (string, error)
+}
+
+func newWebIdentityRoleProvider(client webIdentityRoler, cfg AssumeRoleConfig,
+	token func() (string, error)) *webIdentityRoleProvider {
+	p := &webIdentityRoleProvider{
+		client:      client,
+		roleARN:     cfg.RoleARN,
+		sessionName: cfg.SessionName,
+		duration:    cfg.duration,
+		token:       token,
+	}
+	p.RetrieveFn = p.retrieveFn
+	return p
+}
+
+func (p *webIdentityRoleProvider) retrieveFn(ctx context.Context) (aws.Credentials, error) {
+	token, err := p.token()
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to read web identity token: %v", err)
+	}
+
+	input := sts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          aws.String(p.roleARN),
+		RoleSessionName:  aws.String(p.sessionName),
+		WebIdentityToken: aws.String(token),
+	}
+	if p.duration > 0 {
+		input.DurationSeconds = aws.Int64(int64(p.duration / time.Second))
+	}
+
+	resp, err := p.client.AssumeRoleWithWebIdentityRequest(&input).Send(ctx)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to assume role %s with web identity: %v", p.roleARN, err)
+	}
+	if resp.Credentials == nil {
+		return aws.Credentials{}, fmt.Errorf("failed to assume role %s with web identity: no credentials returned", p.roleARN)
+	}
+
+	return aws.Credentials{
+		AccessKeyID:     aws.StringValue(resp.Credentials.AccessKeyId),
+		SecretAccessKey: aws.StringValue(resp.Credentials.SecretAccessKey),
+		SessionToken:    aws.StringValue(resp.Credentials.SessionToken),
+		Source:          webIdentityCredentialsSource,
+		CanExpire:       true,
+		Expires:         aws.TimeValue(resp.Credentials.Expiration).Add(-credentialsExpiryWindow),
+	}, nil
+}
+
+// webIdentityTokenFile returns a token function which reads the token from
+// the file.
+func webIdentityTokenFile(path string) func() (string, error) {
+	return func() (string, error) {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+}
+
+// credentialsTracker wraps a credentials provider, recording the outcome of
+// the latest retrieval so credential errors and expiry can be reported by
+// the fingerprint.
+type credentialsTracker struct {
+	provider aws.CredentialsProvider
+
+	// lock syncs access to all fields below
+	lock sync.Mutex
+
+	// expires is when the latest credentials retrieved expire, or zero if
+	// they do not
+	expires time.Time
+}
+
+func newCredentialsTracker(provider aws.CredentialsProvider) *credentialsTracker {
+	return &credentialsTracker{provider: provider}
+}
+
+// Retrieve satisfies the aws.CredentialsProvider Retrieve interface
+// function.
+func (t *credentialsTracker) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	creds, err := t.provider.Retrieve(ctx)
+	if err != nil {
+		return creds, err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if creds.CanExpire {
+		t.expires = creds.Expires
+	} else {
+		t.expires = time.Time{}
+	}
+	return creds, nil
+}
+
+// check retrieves the credentials, refreshing them if they are due to
+// expire, and returns an error describing why they cannot be used.
+func (t *credentialsTracker) check(ctx context.Context) error {
+	creds, err := t.Retrieve(ctx)
+	if err != nil {
+		t.lock.Lock()
+		expires := t.expires
+		t.lock.Unlock()
+
+		switch {
+		case expires.IsZero():
+			return fmt.Errorf("failed to retrieve AWS credentials: %v", err)
+		case !expires.After(time.Now()):
+			return fmt.Errorf("AWS credentials expired at %s and could not be refreshed: %v",
+				expires.Format(time.RFC3339), err)
+		default:
+			return fmt.Errorf("failed to refresh AWS credentials, which expire at %s: %v",
+				expires.Format(time.RFC3339), err)
+		}
+	}
+	if creds.Expired() {
+		return fmt.Errorf("AWS credentials from %s expired at %s",
+			creds.Source, creds.Expires.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,346 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stsStandIn is a local stand-in for STS which exchanges web identity tokens
+// accepted by verify for role credentials, recording the requests it
+// receives.
+type stsStandIn struct {
+	*httptest.Server
+
+	verify  func(token, roleARN string) *stsFault
+	expires time.Duration
+
+	lock     sync.Mutex
+	requests []map[string]string
+}
+
+// stsFault is an error returned by the STS stand-in.
+type stsFault struct {
+	Code    string
+	Message string
+}
+
+// expectToken returns an STS stand-in verifier which only accepts the token.
+func expectToken(token string) func(string, string) *stsFault {
+	return func(got, _ string) *stsFault {
+		if got != token {
+			return &stsFault{Code: "InvalidIdentityToken", Message: "invalid token"}
+		}
+		return nil
+	}
+}
+
+func newSTSStandIn(t *testing.T, verify func(token, roleARN string) *stsFault) *stsStandIn {
+	s := &stsStandIn{verify: verify, expires: time.Hour}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *stsStandIn) handle(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := make(map[string]string)
+	for k := range r.PostForm {
+		req[k] = r.PostForm.Get(k)
+	}
+
+	s.lock.Lock()
+	s.requests = append(s.requests, req)
+	n := len(s.requests)
+	s.lock.Unlock()
+
+	w.Header().Set("Content-Type", "text/xml")
+	if fault := s.verify(req["WebIdentityToken"], req["RoleArn"]); fault != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `<ErrorResponse><Error><Type>Sender</Type><Code>%s</Code>`+
+			`<Message>%s</Message></Error><RequestId>req</RequestId></ErrorResponse>`, fault.Code, fault.Message)
+		return
+	}
+
+	expiration := time.Now().Add(s.expires).UTC().Format(time.RFC3339)
+	fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials>`+
+		`<AccessKeyId>AKID%d</AccessKeyId><SecretAccessKey>SECRET</SecretAccessKey>`+
+		`<SessionToken>SESSION</SessionToken><Expiration>%s</Expiration>`+
+		`</Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`,
+		n, expiration)
+}
+
+func (s *stsStandIn) Requests() []map[string]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]map[string]string(nil), s.requests...)
+}
+
+// mockCredentialsProvider returns the configured credentials or error.
+type mockCredentialsProvider struct {
+	creds aws.Credentials
+	err   error
+}
+
+func (m *mockCredentialsProvider) Retrieve(context.Context) (aws.Credentials, error) {
+	return m.creds, m.err
+}
+
+func Test_DriverConfig_parseCredentials(t *testing.T) {
+	testCases := []struct {
+		name             string
+		inputConfig      DriverConfig
+		expectedError    string
+		expectedDuration time.Duration
+	}{
+		{
+			name:        "default chain",
+			inputConfig: DriverConfig{},
+		},
+		{
+			name:        "static keys",
+			inputConfig: DriverConfig{AccessKey: "AKID", SecretKey: "SECRET", SessionToken: "TOKEN"},
+		},
+		{
+			name:          "partial static keys",
+			inputConfig:   DriverConfig{AccessKey: "AKID"},
+			expectedError: "access_key and secret_key must be set together",
+		},
+		{
+			name:          "session token without keys",
+			inputConfig:   DriverConfig{SessionToken: "TOKEN"},
+			expectedError: "session_token requires access_key and secret_key",
+		},
+		{
+			name:          "static keys and profile",
+			inputConfig:   DriverConfig{AccessKey: "AKID", SecretKey: "SECRET", Profile: "nomad"},
+			expectedError: "access_key cannot be set with profile or shared_credentials_file",
+		},
+		{
+			name: "assume role",
+			inputConfig: DriverConfig{
+				Profile:    "nomad",
+				AssumeRole: AssumeRoleConfig{RoleARN: "arn:aws:iam::123456789012:role/ecs", Duration: "1h"},
+			},
+			expectedDuration: time.Hour,
+		},
+		{
+			name: "assume role duration too long",
+			inputConfig: DriverConfig{
+				AssumeRole: AssumeRoleConfig{RoleARN: "arn:aws:iam::123456789012:role/ecs", Duration: "13h"},
+			},
+			expectedError: "assume_role duration must be between 15m0s and 12h0m0s",
+		},
+		{
+			name: "web identity",
+			inputConfig: DriverConfig{
+				WebIdentityTokenFile: "/var/run/token",
+				AssumeRole:           AssumeRoleConfig{RoleARN: "arn:aws:iam::123456789012:role/ecs", Duration: "15m"},
+			},
+			expectedDuration: 15 * time.Minute,
+		},
+		{
+			name:          "web identity without role",
+			inputConfig:   DriverConfig{WebIdentityTokenFile: "/var/run/token"},
+			expectedError: "web_identity_token_file requires an assume_role block with the role_arn to assume",
+		},
+		{
+			name: "web identity and profile",
+			inputConfig: DriverConfig{
+				WebIdentityTokenFile: "/var/run/token",
+				Profile:              "nomad",
+				AssumeRole:           AssumeRoleConfig{RoleARN: "arn:aws:iam::123456789012:role/ecs"},
+			},
+			expectedError: "web_identity_token_file cannot be set with access_key, profile or shared_credentials_file",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.inputConfig.parseCredentials()
+			if tc.expectedError != "" {
+				require.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedDuration, tc.inputConfig.AssumeRole.duration)
+			if tc.inputConfig.AssumeRole.enabled() {
+				assert.Equal(t, defaultRoleSessionName, tc.inputConfig.AssumeRole.SessionName)
+			}
+		})
+	}
+}
+
+func Test_DriverConfig_loadAWSConfig(t *testing.T) {
+	dir := t.TempDir()
+	credentialsFile := filepath.Join(dir, "credentials")
+	require.NoError(t, ioutil.WriteFile(credentialsFile, []byte(`
+[nomad]
+aws_access_key_id = AKIDSHARED
+aws_secret_access_key = SECRETSHARED
+`), 0600))
+
+	// Credentials within the environment must not take precedence over
+	// those of the plugin config.
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDENV")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "SECRETENV")
+	t.Setenv("HOME", dir)
+
+	t.Run("static keys", func(t *testing.T) {
+		cfg := DriverConfig{Region: "eu-west-1", AccessKey: "AKID", SecretKey: "SECRET"}
+		awsCfg, err := cfg.loadAWSConfig()
+		require.NoError(t, err)
+		assert.Equal(t, "eu-west-1", awsCfg.Region)
+
+		creds, err := awsCfg.Credentials.Retrieve(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "AKID", creds.AccessKeyID)
+		assert.Equal(t, staticCredentialsSource, creds.Source)
+	})
+
+	t.Run("shared credentials file", func(t *testing.T) {
+		cfg := DriverConfig{Profile: "nomad", SharedCredentialsFile: credentialsFile}
+		awsCfg, err := cfg.loadAWSConfig()
+		require.NoError(t, err)
+
+		creds, err := awsCfg.Credentials.Retrieve(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "AKIDSHARED", creds.AccessKeyID)
+	})
+
+	t.Run("missing profile", func(t *testing.T) {
+		cfg := DriverConfig{Profile: "missing", SharedCredentialsFile: credentialsFile}
+		_, err := cfg.loadAWSConfig()
+		assert.Error(t, err)
+	})
+
+	t.Run("assume role", func(t *testing.T) {
+		cfg := DriverConfig{
+			AccessKey: "AKID",
+			SecretKey: "SECRET",
+			AssumeRole: AssumeRoleConfig{
+				RoleARN:    "arn:aws:iam::123456789012:role/ecs",
+				ExternalID: "nomad",
+			},
+		}
+		require.NoError(t, cfg.parseCredentials())
+		awsCfg, err := cfg.loadAWSConfig()
+		require.NoError(t, err)
+
+		provider, ok := awsCfg.Credentials.(*stscreds.AssumeRoleProvider)
+		require.True(t, ok)
+		assert.Equal(t, "arn:aws:iam::123456789012:role/ecs", provider.RoleARN)
+		assert.Equal(t, "nomad", aws.StringValue(provider.ExternalID))
+		assert.Equal(t, defaultRoleSessionName, provider.RoleSessionName)
+		assert.Equal(t, defaultAssumeRoleDuration, provider.Duration)
+		assert.Equal(t, credentialsExpiryWindow, provider.ExpiryWindow)
+	})
+}
+
+func Test_webIdentityRoleProvider(t *testing.T) {
+	srv := newSTSStandIn(t, expectToken("token-1"))
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("token-1\n"), 0600))
+
+	cfg := AssumeRoleConfig{RoleARN: "arn:aws:iam::123456789012:role/ecs", SessionName: "nomad", duration: time.Hour}
+	provider := newWebIdentityRoleProvider(sts.New(testAWSConfig(srv.URL)), cfg, webIdentityTokenFile(tokenFile))
+
+	creds, err := provider.Retrieve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "AKID1", creds.AccessKeyID)
+	assert.Equal(t, webIdentityCredentialsSource, creds.Source)
+	assert.True(t, creds.CanExpire)
+	assert.WithinDuration(t, time.Now().Add(time.Hour-credentialsExpiryWindow), creds.Expires, time.Minute)
+
+	require.Len(t, srv.Requests(), 1)
+	req := srv.Requests()[0]
+	assert.Equal(t, "AssumeRoleWithWebIdentity", req["Action"])
+	assert.Equal(t, "arn:aws:iam::123456789012:role/ecs", req["RoleArn"])
+	assert.Equal(t, "nomad", req["RoleSessionName"])
+	assert.Equal(t, "3600", req["DurationSeconds"])
+
+	// Credentials are cached until they are due to expire.
+	_, err = provider.Retrieve(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, srv.Requests(), 1)
+
+	// The token is read again for each exchange.
+	provider.Invalidate()
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("token-2"), 0600))
+	_, err = provider.Retrieve(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "InvalidIdentityToken")
+	assert.Equal(t, "token-2", srv.Requests()[1]["WebIdentityToken"])
+}
+
+func Test_credentialsTracker_check(t *testing.T) {
+	provider := &mockCredentialsProvider{}
+	tracker := newCredentialsTracker(provider)
+
+	provider.err = errors.New("no EC2 IMDS role found")
+	assert.EqualError(t, tracker.check(context.Background()),
+		"failed to retrieve AWS credentials: no EC2 IMDS role found")
+
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	provider.err = nil
+	provider.creds = aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "SECRET", CanExpire: true, Expires: expires}
+	assert.NoError(t, tracker.check(context.Background()))
+
+	// Refresh errors include when the current credentials expire.
+	provider.err = errors.New("AccessDenied")
+	assert.EqualError(t, tracker.check(context.Background()), fmt.Sprintf(
+		"failed to refresh AWS credentials, which expire at %s: AccessDenied", expires.Format(time.RFC3339)))
+
+	tracker.expires = time.Now().Add(-time.Minute).Truncate(time.Second)
+	assert.EqualError(t, tracker.check(context.Background()), fmt.Sprintf(
+		"AWS credentials expired at %s and could not be refreshed: AccessDenied", tracker.expires.Format(time.RFC3339)))
+
+	// Providers which do not refresh their credentials report them expired.
+	expired := time.Now().Add(-time.Minute).Truncate(time.Second)
+	provider.err = nil
+	provider.creds = aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "SECRET", Source: "Static",
+		CanExpire: true, Expires: expired}
+	assert.EqualError(t, tracker.check(context.Background()), fmt.Sprintf(
+		"AWS credentials from Static expired at %s", expired.Format(time.RFC3339)))
+}
+
+func Test_Driver_buildFingerprint_credentials(t *testing.T) {
+	d := &Driver{
+		config:      &DriverConfig{Enabled: true},
+		client:      &mockECSClient{},
+		logger:      hclog.NewNullLogger(),
+		credentials: newCredentialsTracker(&mockCredentialsProvider{err: errors.New("AccessDenied")}),
+	}
+
+	fp := d.buildFingerprint(context.Background())
+	assert.Equal(t, drivers.HealthStateUnhealthy, fp.Health)
+	assert.Equal(t, "failed to retrieve AWS credentials: AccessDenied", fp.HealthDescription)
+
+	d.credentials = newCredentialsTracker(&mockCredentialsProvider{
+		creds: aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "SECRET"},
+	})
+	fp = d.buildFingerprint(context.Background())
+	assert.Equal(t, drivers.HealthStateHealthy, fp.Health)
+}
@@ -4,16 +4,26 @@
 package ecs
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws/external"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/nomad-driver-ecs/version"
 	"github.com/hashicorp/nomad/client/structs"
 	"github.com/hashicorp/nomad/drivers/shared/eventer"
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	nstructs "github.com/hashicorp/nomad/nomad/structs"
 	"github.com/hashicorp/nomad/plugins/base"
 	"github.com/hashicorp/nomad/plugins/drivers"
 	"github.com/hashicorp/nomad/plugins/shared/hclspec"
@@ -48,6 +58,93 @@ var (
 		"enabled": hclspec.NewAttr("enabled", "bool", false),
 		"cluster": hclspec.NewAttr("cluster", "string", false),
 		"region":  hclspec.NewAttr("region", "string", false),
+		"poll_interval": hclspec.NewDefault(
+			hclspec.NewAttr("poll_interval", "string", false),
+			hclspec.NewLiteral(`"5s"`),
+		),
+		"poll_jitter": hclspec.NewDefault(
+			hclspec.NewAttr("poll_jitter", "string", false),
+			hclspec.NewLiteral(`"1s"`),
+		),
+		"event_queue":                 hclspec.NewBlock("event_queue", false, eventQueueConfigSpec),
+		"deregister_task_definitions": hclspec.NewAttr("deregister_task_definitions", "bool", false),
+		"enable_execute_command":      hclspec.NewAttr("enable_execute_command", "bool", false),
+		"started_by":                  hclspec.NewAttr("started_by", "string", false),
+		"orphan_reconciler":           hclspec.NewBlock("orphan_reconciler", false, orphanReconcilerConfigSpec),
+		"stats":                       hclspec.NewBlock("stats", false, statsConfigSpec),
+		"allowed_clusters":            hclspec.NewAttr("allowed_clusters", "list(string)", false),
+		"allowed_regions":             hclspec.NewAttr("allowed_regions", "list(string)", false),
+		"profile":                     hclspec.NewAttr("profile", "string", false),
+		"shared_credentials_file":     hclspec.NewAttr("shared_credentials_file", "string", false),
+		"access_key":                  hclspec.NewAttr("access_key", "string", false),
+		"secret_key":                  hclspec.NewAttr("secret_key", "string", false),
+		"session_token":               hclspec.NewAttr("session_token", "string", false),
+		"assume_role":                 hclspec.NewBlock("assume_role", false, assumeRoleConfigSpec),
+		"web_identity_token_file":     hclspec.NewAttr("web_identity_token_file", "string", false),
+		"workload_identity":           hclspec.NewBlock("workload_identity", false, workloadIdentityConfigSpec),
+	})
+
+	// workloadIdentityConfigSpec is the configuration of the IAM roles which
+	// tasks assume using their Nomad workload identity.
+	workloadIdentityConfigSpec = hclspec.NewObject(map[string]*hclspec.Spec{
+		"role_arn": hclspec.NewAttr("role_arn", "string", false),
+		"duration": hclspec.NewDefault(
+			hclspec.NewAttr("duration", "string", false),
+			hclspec.NewLiteral(`"1h"`),
+		),
+	})
+
+	// assumeRoleConfigSpec is the configuration of the IAM role the driver
+	// assumes to make all AWS requests.
+	assumeRoleConfigSpec = hclspec.NewObject(map[string]*hclspec.Spec{
+		"role_arn":     hclspec.NewAttr("role_arn", "string", true),
+		"external_id":  hclspec.NewAttr("external_id", "string", false),
+		"session_name": hclspec.NewAttr("session_name", "string", false),
+		"duration": hclspec.NewDefault(
+			hclspec.NewAttr("duration", "string", false),
+			hclspec.NewLiteral(`"15m"`),
+		),
+	})
+
+	// statsConfigSpec is the configuration of the collector which reads task
+	// resource usage from CloudWatch Container Insights.
+	statsConfigSpec = hclspec.NewObject(map[string]*hclspec.Spec{
+		"interval": hclspec.NewDefault(
+			hclspec.NewAttr("interval", "string", false),
+			hclspec.NewLiteral(`"1m"`),
+		),
+	})
+
+	// orphanReconcilerConfigSpec is the configuration of the reconciler which
+	// stops ECS tasks run by the driver but no longer owned by a Nomad task.
+	orphanReconcilerConfigSpec = hclspec.NewObject(map[string]*hclspec.Spec{
+		"interval": hclspec.NewDefault(
+			hclspec.NewAttr("interval", "string", false),
+			hclspec.NewLiteral(`"5m"`),
+		),
+		"grace_period": hclspec.NewDefault(
+			hclspec.NewAttr("grace_period", "string", false),
+			hclspec.NewLiteral(`"10m"`),
+		),
+		"dry_run": hclspec.NewAttr("dry_run", "bool", false),
+	})
+
+	// eventQueueConfigSpec is the configuration of the SQS queue which
+	// receives ECS task state change events from EventBridge.
+	eventQueueConfigSpec = hclspec.NewObject(map[string]*hclspec.Spec{
+		"queue_url": hclspec.NewAttr("queue_url", "string", true),
+		"wait_time": hclspec.NewDefault(
+			hclspec.NewAttr("wait_time", "string", false),
+			hclspec.NewLiteral(`"20s"`),
+		),
+		"quiet_period": hclspec.NewDefault(
+			hclspec.NewAttr("quiet_period", "string", false),
+			hclspec.NewLiteral(`"1m"`),
+		),
+		"max_receive_count": hclspec.NewDefault(
+			hclspec.NewAttr("max_receive_count", "number", false),
+			hclspec.NewLiteral(`5`),
+		),
 	})
 
 	// taskConfigSpec represents an ECS task configuration object.
@@ -59,9 +156,110 @@ var (
 	// awsECSTaskConfigSpec are the high level configuration options for
 	// configuring and ECS task.
 	awsECSTaskConfigSpec = hclspec.NewObject(map[string]*hclspec.Spec{
-		"launch_type":           hclspec.NewAttr("launch_type", "string", false),
-		"task_definition":       hclspec.NewAttr("task_definition", "string", false),
-		"network_configuration": hclspec.NewBlock("network_configuration", false, awsECSNetworkConfigSpec),
+		"cluster":                    hclspec.NewAttr("cluster", "string", false),
+		"region":                     hclspec.NewAttr("region", "string", false),
+		"launch_type":                hclspec.NewAttr("launch_type", "string", false),
+		"capacity_provider_strategy": hclspec.NewBlockList("capacity_provider_strategy", awsECSCapacityProviderStrategySpec),
+		"placement_constraint":       hclspec.NewBlockList("placement_constraint", awsECSPlacementConstraintSpec),
+		"placement_strategy":         hclspec.NewBlockList("placement_strategy", awsECSPlacementStrategySpec),
+		"fargate_spot_fallback":      hclspec.NewAttr("fargate_spot_fallback", "bool", false),
+		"task_definition":            hclspec.NewAttr("task_definition", "string", false),
+		"container_definition":       hclspec.NewBlockList("container_definition", awsECSContainerDefinitionSpec),
+		"container_override":         hclspec.NewBlockList("container_override", awsECSContainerOverrideSpec),
+		"cpu":                        hclspec.NewAttr("cpu", "number", false),
+		"memory":                     hclspec.NewAttr("memory", "number", false),
+		"inject_nomad_task":          hclspec.NewAttr("inject_nomad_task", "bool", false),
+		"stop_timeout":               hclspec.NewAttr("stop_timeout", "number", false),
+		"startup_timeout":            hclspec.NewAttr("startup_timeout", "string", false),
+		"wait_for_healthy":           hclspec.NewAttr("wait_for_healthy", "bool", false),
+		"unhealthy_threshold":        hclspec.NewAttr("unhealthy_threshold", "number", false),
+		"enable_execute_command":     hclspec.NewAttr("enable_execute_command", "bool", false),
+		"exec_container":             hclspec.NewAttr("exec_container", "string", false),
+		"signal_container":           hclspec.NewAttr("signal_container", "string", false),
+		"role_arn":                   hclspec.NewAttr("role_arn", "string", false),
+		"identity":                   hclspec.NewAttr("identity", "string", false),
+		"tags":                       hclspec.NewAttr("tags", "list(map(string))", false),
+		"enable_ecs_managed_tags":    hclspec.NewAttr("enable_ecs_managed_tags", "bool", false),
+		"propagate_tags":             hclspec.NewAttr("propagate_tags", "string", false),
+		"execution_role_arn":         hclspec.NewAttr("execution_role_arn", "string", false),
+		"task_role_arn":              hclspec.NewAttr("task_role_arn", "string", false),
+		"network_configuration":      hclspec.NewBlock("network_configuration", false, awsECSNetworkConfigSpec),
+	})
+
+	// awsECSCapacityProviderStrategySpec is a single capacity provider used to
+	// place the task.
+	awsECSCapacityProviderStrategySpec = hclspec.NewObject(map[string]*hclspec.Spec{
+		"capacity_provider": hclspec.NewAttr("capacity_provider", "string", true),
+		"weight":            hclspec.NewAttr("weight", "number", false),
+		"base":              hclspec.NewAttr("base", "number", false),
+	})
+
+	// awsECSPlacementConstraintSpec is a rule considered when placing the task
+	// on an EC2 container instance.
+	awsECSPlacementConstraintSpec = hclspec.NewObject(map[string]*hclspec.Spec{
+		"type":       hclspec.NewAttr("type", "string", true),
+		"expression": hclspec.NewAttr("expression", "string", false),
+	})
+
+	// awsECSPlacementStrategySpec is a strategy used to select the EC2
+	// container instance on which the task is placed.
+	awsECSPlacementStrategySpec = hclspec.NewObject(map[string]*hclspec.Spec{
+		"type":  hclspec.NewAttr("type", "string", true),
+		"field": hclspec.NewAttr("field", "string", false),
+	})
+
+	// awsECSContainerOverrideSpec overrides the configuration of a container
+	// within the task definition when the task is run.
+	awsECSContainerOverrideSpec = hclspec.NewObject(map[string]*hclspec.Spec{
+		"name":               hclspec.NewAttr("name", "string", true),
+		"command":            hclspec.NewAttr("command", "list(string)", false),
+		"entrypoint":         hclspec.NewAttr("entrypoint", "list(string)", false),
+		"environment":        hclspec.NewAttr("environment", "list(map(string))", false),
+		"environment_files":  hclspec.NewAttr("environment_files", "list(string)", false),
+		"cpu":                hclspec.NewAttr("cpu", "number", false),
+		"memory":             hclspec.NewAttr("memory", "number", false),
+		"memory_reservation": hclspec.NewAttr("memory_reservation", "number", false),
+	})
+
+	// awsECSContainerDefinitionSpec describes a container of a task
+	// definition which the driver registers on behalf of the job.
+	awsECSContainerDefinitionSpec = hclspec.NewObject(map[string]*hclspec.Spec{
+		"name":  hclspec.NewAttr("name", "string", true),
+		"image": hclspec.NewAttr("image", "string", true),
+		"essential": hclspec.NewDefault(
+			hclspec.NewAttr("essential", "bool", false),
+			hclspec.NewLiteral("true"),
+		),
+		"cpu":                hclspec.NewAttr("cpu", "number", false),
+		"memory":             hclspec.NewAttr("memory", "number", false),
+		"memory_reservation": hclspec.NewAttr("memory_reservation", "number", false),
+		"environment":        hclspec.NewAttr("environment", "list(map(string))", false),
+		"port_mapping":       hclspec.NewBlockList("port_mapping", awsECSPortMappingSpec),
+		"log_configuration":  hclspec.NewBlock("log_configuration", false, awsECSLogConfigSpec),
+		"health_check":       hclspec.NewBlock("health_check", false, awsECSHealthCheckSpec),
+	})
+
+	// awsECSPortMappingSpec is a container port exposed by the task.
+	awsECSPortMappingSpec = hclspec.NewObject(map[string]*hclspec.Spec{
+		"container_port": hclspec.NewAttr("container_port", "number", true),
+		"host_port":      hclspec.NewAttr("host_port", "number", false),
+		"protocol":       hclspec.NewAttr("protocol", "string", false),
+	})
+
+	// awsECSLogConfigSpec is the log driver configuration of a container.
+	awsECSLogConfigSpec = hclspec.NewObject(map[string]*hclspec.Spec{
+		"log_driver": hclspec.NewAttr("log_driver", "string", true),
+		"options":    hclspec.NewAttr("options", "list(map(string))", false),
+	})
+
+	// awsECSHealthCheckSpec is the container health check, with all durations
+	// specified in seconds.
+	awsECSHealthCheckSpec = hclspec.NewObject(map[string]*hclspec.Spec{
+		"command":      hclspec.NewAttr("command", "list(string)", true),
+		"interval":     hclspec.NewAttr("interval", "number", false),
+		"timeout":      hclspec.NewAttr("timeout", "number", false),
+		"retries":      hclspec.NewAttr("retries", "number", false),
+		"start_period": hclspec.NewAttr("start_period", "number", false),
 	})
 
 	// awsECSNetworkConfigSpec is the network configuration for the task.
@@ -78,10 +276,9 @@ var (
 	})
 
 	// capabilities is returned by the Capabilities RPC and indicates what
-	// optional features this driver supports
+	// optional features this driver supports. Signals and exec are only
+	// supported when the plugin config enables ECS Exec.
 	capabilities = &drivers.Capabilities{
-		SendSignals: false,
-		Exec:        false,
 		FSIsolation: drivers.FSIsolationImage,
 		RemoteTasks: true,
 	}
@@ -114,7 +311,61 @@ type Driver struct {
 	logger hclog.Logger
 
 	// ecsClientInterface is the interface used for communicating with AWS ECS
+	// within the cluster and region of the plugin config
 	client ecsClientInterface
+
+	// clients holds the ECS client of each cluster and region tasks are run
+	// in, including the plugin default
+	clients *ecsClientPool
+
+	// credentials are the AWS credentials of all clients, tracked so that
+	// credential errors are reported by the fingerprint
+	credentials *credentialsTracker
+
+	// stsClient exchanges the workload identities of tasks for the
+	// credentials of their roles
+	stsClient webIdentityRoler
+
+	// logsClient is used for reading container logs from AWS CloudWatch,
+	// deriving a client with the credentials and region of each task
+	logsClient *awsLogsClient
+
+	// poller describes the status of all ECS tasks in batches, delivering
+	// the results to the task handles
+	poller *taskPoller
+
+	// stopEvents stops the consumer of the ECS task state change event
+	// queue, if one is running
+	stopEvents context.CancelFunc
+
+	// stopReconciler stops the orphaned ECS task reconciler, if one is
+	// running
+	stopReconciler context.CancelFunc
+
+	// stats reads the resource usage of the ECS tasks from CloudWatch
+	// Container Insights, if enabled, and stopStats stops it
+	stats     *statsCollector
+	stopStats context.CancelFunc
+
+	// nodeID is the ID of the Nomad node, which is not included within the
+	// plugin config so is learnt from the tasks started or recovered
+	nodeID atomic.Value
+
+	// runner runs ECS tasks idempotently, retrying transient errors
+	runner *taskRunner
+
+	// starting holds the ARNs of the ECS tasks which StartTask has run but
+	// not yet created a handle for, so they are not considered orphaned
+	startingLock sync.Mutex
+	starting     map[string]struct{}
+
+	// taskDefinitions counts the tasks on this node which use each task
+	// definition registered by the driver, including those still being
+	// started. The lock is held while a task definition is resolved and
+	// while one is deregistered, so one cannot be deregistered between
+	// StartTask resolving it and running the task.
+	taskDefinitionsLock sync.Mutex
+	taskDefinitions     map[string]int
 }
 
 // DriverConfig is the driver configuration set by the SetConfig RPC call
@@ -122,17 +373,494 @@ type DriverConfig struct {
 	Enabled bool   `codec:"enabled"`
 	Cluster string `codec:"cluster"`
 	Region  string `codec:"region"`
+
+	// AllowedClusters and AllowedRegions are the clusters and regions, in
+	// addition to those above, which tasks may select within their config.
+	AllowedClusters []string `codec:"allowed_clusters"`
+	AllowedRegions  []string `codec:"allowed_regions"`
+
+	// Profile, SharedCredentialsFile, the static keys and
+	// WebIdentityTokenFile select the AWS credentials of the driver in place
+	// of the default credential chain. AssumeRole optionally exchanges them
+	// for those of an IAM role.
+	Profile               string           `codec:"profile"`
+	SharedCredentialsFile string           `codec:"shared_credentials_file"`
+	AccessKey             string           `codec:"access_key"`
+	SecretKey             string           `codec:"secret_key"`
+	SessionToken          string           `codec:"session_token"`
+	AssumeRole            AssumeRoleConfig `codec:"assume_role"`
+	WebIdentityTokenFile  string           `codec:"web_identity_token_file"`
+
+	WorkloadIdentity WorkloadIdentityConfig `codec:"workload_identity"`
+
+	PollInterval string `codec:"poll_interval"`
+	PollJitter   string `codec:"poll_jitter"`
+
+	EventQueue EventQueueConfig `codec:"event_queue"`
+
+	// DeregisterTaskDefinitions controls whether task definitions registered
+	// by the driver, from inline container definitions or entrypoint
+	// overrides, are deregistered once no task run by the driver uses them.
+	DeregisterTaskDefinitions bool `codec:"deregister_task_definitions"`
+
+	// EnableExecuteCommand enables ECS Exec for tasks which do not disable
+	// it, and is required for the driver to advertise signal and exec
+	// support, as Nomad assumes they apply to every task of the driver.
+	EnableExecuteCommand bool `codec:"enable_execute_command"`
+
+	// StartedBy is a template rendered for each task to set the ECS task
+	// startedBy field. It defaults to nomad-ecs-driver.
+	StartedBy string `codec:"started_by"`
+
+	OrphanReconciler OrphanReconcilerConfig `codec:"orphan_reconciler"`
+
+	Stats StatsConfig `codec:"stats"`
+
+	pollInterval time.Duration
+	pollJitter   time.Duration
+	startedBy    *template.Template
+}
+
+// EventQueueConfig is the configuration of the SQS queue which receives ECS
+// task state change events from EventBridge.
+type EventQueueConfig struct {
+	QueueURL    string `codec:"queue_url"`
+	WaitTime    string `codec:"wait_time"`
+	QuietPeriod string `codec:"quiet_period"`
+
+	// MaxReceiveCount is the number of times the event of a task which no
+	// consumer of the queue owns is received before it is deleted.
+	MaxReceiveCount int `codec:"max_receive_count"`
+
+	waitTime    time.Duration
+	quietPeriod time.Duration
+}
+
+// parse validates the event queue configuration, parsing any values which
+// cannot be decoded directly.
+func (c *EventQueueConfig) parse() error {
+	c.waitTime = defaultQueueWaitTime
+	if c.WaitTime != "" {
+		wait, err := time.ParseDuration(c.WaitTime)
+		if err != nil {
+			return fmt.Errorf("failed to parse event_queue wait_time: %v", err)
+		}
+		if wait < 0 || wait > defaultQueueWaitTime {
+			return fmt.Errorf("event_queue wait_time must be between 0s and %s", defaultQueueWaitTime)
+		}
+		c.waitTime = wait
+	}
+
+	c.quietPeriod = defaultQueueQuietPeriod
+	if c.QuietPeriod != "" {
+		period, err := time.ParseDuration(c.QuietPeriod)
+		if err != nil {
+			return fmt.Errorf("failed to parse event_queue quiet_period: %v", err)
+		}
+		if period <= 0 {
+			return fmt.Errorf("event_queue quiet_period must be greater than zero")
+		}
+		c.quietPeriod = period
+	}
+
+	if c.MaxReceiveCount == 0 {
+		c.MaxReceiveCount = defaultQueueMaxReceiveCount
+	}
+	if c.MaxReceiveCount < 0 {
+		return fmt.Errorf("event_queue max_receive_count must be greater than zero")
+	}
+	return nil
+}
+
+// OrphanReconcilerConfig is the configuration of the orphaned ECS task
+// reconciler. The reconciler is only enabled if the block is present, in
+// which case the interval is always set due to its default.
+type OrphanReconcilerConfig struct {
+	Interval    string `codec:"interval"`
+	GracePeriod string `codec:"grace_period"`
+	DryRun      bool   `codec:"dry_run"`
+
+	interval    time.Duration
+	gracePeriod time.Duration
+}
+
+// enabled returns whether the orphan_reconciler block is present.
+func (c *OrphanReconcilerConfig) enabled() bool {
+	return c.Interval != ""
+}
+
+// parse validates the orphan reconciler configuration, parsing any values
+// which cannot be decoded directly.
+func (c *OrphanReconcilerConfig) parse() error {
+	c.interval = defaultOrphanInterval
+	if c.Interval != "" {
+		interval, err := time.ParseDuration(c.Interval)
+		if err != nil {
+			return fmt.Errorf("failed to parse orphan_reconciler interval: %v", err)
+		}
+		if interval <= 0 {
+			return fmt.Errorf("orphan_reconciler interval must be greater than zero")
+		}
+		c.interval = interval
+	}
+
+	c.gracePeriod = defaultOrphanGracePeriod
+	if c.GracePeriod != "" {
+		period, err := time.ParseDuration(c.GracePeriod)
+		if err != nil {
+			return fmt.Errorf("failed to parse orphan_reconciler grace_period: %v", err)
+		}
+		// Tasks being started are tracked from when RunTask returns, so the
+		// grace period only needs to cover the RunTask requests themselves.
+		if period <= 0 {
+			return fmt.Errorf("orphan_reconciler grace_period must be greater than zero")
+		}
+		c.gracePeriod = period
+	}
+	return nil
+}
+
+// StatsConfig is the configuration of the task resource usage collector. The
+// collector is only enabled if the block is present, in which case the
+// interval is always set due to its default.
+type StatsConfig struct {
+	Interval string `codec:"interval"`
+
+	interval time.Duration
+}
+
+// enabled returns whether the stats block is present.
+func (c *StatsConfig) enabled() bool {
+	return c.Interval != ""
+}
+
+// parse validates the stats configuration, parsing any values which cannot be
+// decoded directly.
+func (c *StatsConfig) parse() error {
+	c.interval = defaultStatsInterval
+	if c.Interval != "" {
+		interval, err := time.ParseDuration(c.Interval)
+		if err != nil {
+			return fmt.Errorf("failed to parse stats interval: %v", err)
+		}
+		// Container Insights publishes metrics once a minute.
+		if interval < defaultStatsInterval {
+			return fmt.Errorf("stats interval must be at least %s", defaultStatsInterval)
+		}
+		c.interval = interval
+	}
+	return nil
+}
+
+// parse validates the driver configuration, parsing any values which cannot
+// be decoded directly.
+func (c *DriverConfig) parse() error {
+	c.pollInterval = defaultPollInterval
+	if c.PollInterval != "" {
+		interval, err := time.ParseDuration(c.PollInterval)
+		if err != nil {
+			return fmt.Errorf("failed to parse poll_interval: %v", err)
+		}
+		if interval <= 0 {
+			return fmt.Errorf("poll_interval must be greater than zero")
+		}
+		c.pollInterval = interval
+	}
+
+	c.pollJitter = defaultPollJitter
+	if c.PollJitter != "" {
+		jitter, err := time.ParseDuration(c.PollJitter)
+		if err != nil {
+			return fmt.Errorf("failed to parse poll_jitter: %v", err)
+		}
+		if jitter < 0 {
+			return fmt.Errorf("poll_jitter must not be negative")
+		}
+		c.pollJitter = jitter
+	}
+
+	if err := c.parseCredentials(); err != nil {
+		return err
+	}
+
+	if c.StartedBy != "" {
+		tmpl, err := parseStartedByTemplate(c.StartedBy)
+		if err != nil {
+			return err
+		}
+		c.startedBy = tmpl
+	}
+
+	if c.OrphanReconciler.enabled() {
+		if err := c.OrphanReconciler.parse(); err != nil {
+			return err
+		}
+	}
+
+	if c.Stats.enabled() {
+		if err := c.Stats.parse(); err != nil {
+			return err
+		}
+	}
+
+	if c.WorkloadIdentity.enabled() {
+		if err := c.WorkloadIdentity.parse(); err != nil {
+			return err
+		}
+	}
+
+	if c.EventQueue.QueueURL != "" {
+		return c.EventQueue.parse()
+	}
+	return nil
 }
 
 // TaskConfig is the driver configuration of a task within a job
 type TaskConfig struct {
 	Task ECSTaskConfig `codec:"task"`
+
+	// startedBy and nomadTags identify the Nomad task running the ECS task.
+	// They are set by the driver rather than decoded from the jobspec.
+	startedBy string
+	nomadTags map[string]string
+
+	// idempotencyKey identifies the Nomad task and clientToken is the RunTask
+	// client token derived from it, so that retried requests cannot run more
+	// than one ECS task. They are set by the driver when running the task.
+	idempotencyKey string
+	clientToken    string
+}
+
+// validate checks the task configuration for missing or conflicting options
+// which cannot be expressed within the HCL specification.
+func (c *TaskConfig) validate() error {
+	t := c.Task
+
+	if t.TaskDefinition == "" && len(t.ContainerDefinitions) == 0 {
+		return errors.New("one of task_definition or container_definition must be set")
+	}
+	if t.TaskDefinition != "" && len(t.ContainerDefinitions) > 0 {
+		return errors.New("task_definition and container_definition cannot both be set")
+	}
+
+	names := make(map[string]struct{}, len(t.ContainerDefinitions))
+	for _, cd := range t.ContainerDefinitions {
+		if _, ok := names[cd.Name]; ok {
+			return fmt.Errorf("duplicate container_definition name %q", cd.Name)
+		}
+		names[cd.Name] = struct{}{}
+
+		for _, pm := range cd.PortMappings {
+			if pm.Protocol != "" && pm.Protocol != "tcp" && pm.Protocol != "udp" {
+				return fmt.Errorf("container_definition %q port_mapping protocol must be tcp or udp", cd.Name)
+			}
+		}
+	}
+
+	if t.CPU < 0 || t.Memory < 0 {
+		return errors.New("cpu and memory must not be negative")
+	}
+	if t.StopTimeout < 0 || t.StopTimeout > maxStopTimeout {
+		return fmt.Errorf("stop_timeout must be between 0 and %d seconds", maxStopTimeout)
+	}
+	if t.StartupTimeout != "" {
+		timeout, err := time.ParseDuration(t.StartupTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to parse startup_timeout: %v", err)
+		}
+		if timeout <= 0 {
+			return errors.New("startup_timeout must be positive")
+		}
+	}
+	if t.WaitForHealthy && len(t.ContainerDefinitions) > 0 && !hasHealthCheck(t.ContainerDefinitions) {
+		return errors.New("wait_for_healthy requires a container_definition with a health_check")
+	}
+	if t.UnhealthyThreshold < 0 {
+		return errors.New("unhealthy_threshold must not be negative")
+	}
+	if t.UnhealthyThreshold > 0 && len(t.ContainerDefinitions) > 0 && !hasHealthCheck(t.ContainerDefinitions) {
+		return errors.New("unhealthy_threshold requires a container_definition with a health_check")
+	}
+	for option, container := range map[string]string{
+		"exec_container":   t.ExecContainer,
+		"signal_container": t.SignalContainer,
+	} {
+		if container != "" && !t.executeCommand() {
+			return fmt.Errorf("%s requires enable_execute_command", option)
+		}
+		if container != "" && len(t.ContainerDefinitions) > 0 {
+			if _, ok := names[container]; !ok {
+				return fmt.Errorf("%s %q does not match a container_definition", option, container)
+			}
+		}
+	}
+
+	if t.LaunchType != "" && t.LaunchType != "EC2" && t.LaunchType != "FARGATE" {
+		return fmt.Errorf("launch_type must be EC2 or FARGATE, got %q", t.LaunchType)
+	}
+	if t.LaunchType != "" && len(t.CapacityProviderStrategy) > 0 {
+		return errors.New("launch_type and capacity_provider_strategy cannot both be set")
+	}
+
+	providers := make(map[string]struct{}, len(t.CapacityProviderStrategy))
+	withBase := 0
+	for _, s := range t.CapacityProviderStrategy {
+		if _, ok := providers[s.CapacityProvider]; ok {
+			return fmt.Errorf("duplicate capacity_provider_strategy provider %q", s.CapacityProvider)
+		}
+		providers[s.CapacityProvider] = struct{}{}
+
+		if s.Weight < 0 || s.Weight > 1000 {
+			return fmt.Errorf("capacity_provider_strategy %q weight must be between 0 and 1000", s.CapacityProvider)
+		}
+		if s.Base < 0 || s.Base > 100000 {
+			return fmt.Errorf("capacity_provider_strategy %q base must be between 0 and 100000", s.CapacityProvider)
+		}
+		if s.Base > 0 {
+			withBase++
+		}
+	}
+	if withBase > 1 {
+		return errors.New("only one capacity_provider_strategy can set base")
+	}
+	if t.FargateSpotFallback && !t.usesFargateSpot() {
+		return fmt.Errorf("fargate_spot_fallback requires a %s capacity_provider_strategy", capacityProviderFargateSpot)
+	}
+
+	if err := validatePlacement(t); err != nil {
+		return err
+	}
+
+	if err := validateTags(t.Tags); err != nil {
+		return err
+	}
+	if t.PropagateTags != "" && t.PropagateTags != string(ecs.PropagateTagsTaskDefinition) {
+		return fmt.Errorf("propagate_tags must be %s, got %q", ecs.PropagateTagsTaskDefinition, t.PropagateTags)
+	}
+
+	overrides := make(map[string]struct{}, len(t.ContainerOverrides))
+	for _, co := range t.ContainerOverrides {
+		if _, ok := overrides[co.Name]; ok {
+			return fmt.Errorf("duplicate container_override name %q", co.Name)
+		}
+		overrides[co.Name] = struct{}{}
+
+		// The containers of an existing task definition are only known to
+		// ECS, so can only be checked against inline definitions.
+		if _, ok := names[co.Name]; !ok && len(t.ContainerDefinitions) > 0 {
+			return fmt.Errorf("container_override %q does not match a container_definition", co.Name)
+		}
+		if co.CPU < 0 || co.Memory < 0 || co.MemoryReservation < 0 {
+			return fmt.Errorf("container_override %q cpu and memory must not be negative", co.Name)
+		}
+		if co.Memory > 0 && co.MemoryReservation > co.Memory {
+			return fmt.Errorf("container_override %q memory_reservation must not exceed memory", co.Name)
+		}
+		for _, f := range co.EnvironmentFiles {
+			if !isS3ObjectARN(f) {
+				return fmt.Errorf("container_override %q environment_files must be S3 object ARNs, got %q", co.Name, f)
+			}
+		}
+	}
+	return nil
+}
+
+// isS3ObjectARN returns whether the string is the ARN of an S3 object, for
+// example arn:aws:s3:::bucket/path/file.env.
+func isS3ObjectARN(s string) bool {
+	parts := strings.SplitN(s, ":", 6)
+	return len(parts) == 6 && parts[0] == "arn" && parts[2] == "s3" &&
+		strings.Contains(parts[5], "/")
 }
 
 type ECSTaskConfig struct {
-	LaunchType           string                   `codec:"launch_type"`
-	TaskDefinition       string                   `codec:"task_definition"`
-	NetworkConfiguration TaskNetworkConfiguration `codec:"network_configuration"`
+	Cluster                  string                         `codec:"cluster"`
+	Region                   string                         `codec:"region"`
+	LaunchType               string                         `codec:"launch_type"`
+	CapacityProviderStrategy []TaskCapacityProviderStrategy `codec:"capacity_provider_strategy"`
+	FargateSpotFallback      bool                           `codec:"fargate_spot_fallback"`
+	PlacementConstraints     []TaskPlacementConstraint      `codec:"placement_constraint"`
+	PlacementStrategies      []TaskPlacementStrategy        `codec:"placement_strategy"`
+	TaskDefinition           string                         `codec:"task_definition"`
+	ContainerDefinitions     []TaskContainerDefinition      `codec:"container_definition"`
+	ContainerOverrides       []TaskContainerOverride        `codec:"container_override"`
+	CPU                      int64                          `codec:"cpu"`
+	Memory                   int64                          `codec:"memory"`
+	InjectNomadTask          bool                           `codec:"inject_nomad_task"`
+	StopTimeout              int64                          `codec:"stop_timeout"`
+	StartupTimeout           string                         `codec:"startup_timeout"`
+	WaitForHealthy           bool                           `codec:"wait_for_healthy"`
+	UnhealthyThreshold       int                            `codec:"unhealthy_threshold"`
+	EnableExecuteCommand     *bool                          `codec:"enable_execute_command"`
+	ExecContainer            string                         `codec:"exec_container"`
+	SignalContainer          string                         `codec:"signal_container"`
+	RoleARN                  string                         `codec:"role_arn"`
+	Identity                 string                         `codec:"identity"`
+	Tags                     hclutils.MapStrStr             `codec:"tags"`
+	EnableECSManagedTags     bool                           `codec:"enable_ecs_managed_tags"`
+	PropagateTags            string                         `codec:"propagate_tags"`
+	ExecutionRoleARN         string                         `codec:"execution_role_arn"`
+	TaskRoleARN              string                         `codec:"task_role_arn"`
+	NetworkConfiguration     TaskNetworkConfiguration       `codec:"network_configuration"`
+}
+
+type TaskContainerOverride struct {
+	Name              string             `codec:"name"`
+	Command           []string           `codec:"command"`
+	EntryPoint        []string           `codec:"entrypoint"`
+	Environment       hclutils.MapStrStr `codec:"environment"`
+	EnvironmentFiles  []string           `codec:"environment_files"`
+	CPU               int64              `codec:"cpu"`
+	Memory            int64              `codec:"memory"`
+	MemoryReservation int64              `codec:"memory_reservation"`
+}
+
+type TaskContainerDefinition struct {
+	Name              string                 `codec:"name"`
+	Image             string                 `codec:"image"`
+	Essential         bool                   `codec:"essential"`
+	CPU               int64                  `codec:"cpu"`
+	Memory            int64                  `codec:"memory"`
+	MemoryReservation int64                  `codec:"memory_reservation"`
+	Environment       hclutils.MapStrStr     `codec:"environment"`
+	PortMappings      []TaskPortMapping      `codec:"port_mapping"`
+	LogConfiguration  *TaskLogConfiguration  `codec:"log_configuration"`
+	HealthCheck       *TaskHealthCheckConfig `codec:"health_check"`
+}
+
+type TaskPortMapping struct {
+	ContainerPort int64  `codec:"container_port"`
+	HostPort      int64  `codec:"host_port"`
+	Protocol      string `codec:"protocol"`
+}
+
+type TaskLogConfiguration struct {
+	LogDriver string             `codec:"log_driver"`
+	Options   hclutils.MapStrStr `codec:"options"`
+}
+
+type TaskHealthCheckConfig struct {
+	Command     []string `codec:"command"`
+	Interval    int64    `codec:"interval"`
+	Timeout     int64    `codec:"timeout"`
+	Retries     int64    `codec:"retries"`
+	StartPeriod int64    `codec:"start_period"`
+}
+
+type TaskCapacityProviderStrategy struct {
+	CapacityProvider string `codec:"capacity_provider"`
+	Weight           int64  `codec:"weight"`
+	Base             int64  `codec:"base"`
+}
+
+type TaskPlacementConstraint struct {
+	Type       string `codec:"type"`
+	Expression string `codec:"expression"`
+}
+
+type TaskPlacementStrategy struct {
+	Type  string `codec:"type"`
+	Field string `codec:"field"`
 }
 
 type TaskNetworkConfiguration struct {
@@ -152,21 +880,79 @@ type TaskState struct {
 	TaskConfig    *drivers.TaskConfig
 	ContainerName string
 	ARN           string
+	Cluster       string
 	StartedAt     time.Time
+
+	// Region is the region of the cluster. It is empty for tasks started by
+	// older versions of the driver, which only ran tasks in the configured
+	// region.
+	Region string
+
+	// Network is the driver network built from the ECS task ENI. It is nil
+	// if the task does not use the awsvpc network mode.
+	Network *drivers.DriverNetwork
+
+	// RegisteredTaskDefinition is the ARN of the task definition registered
+	// from the inline container definitions or entrypoint overrides. It is
+	// empty if the task was run using an existing task definition.
+	RegisteredTaskDefinition string
+
+	// CapacityProvider is the capacity provider ECS used to place the task,
+	// which is FARGATE if the driver fell back from Fargate Spot. It is empty
+	// if the task was run using a launch type.
+	CapacityProvider string
+
+	// LogCursorPath is the file used to persist the position up to which
+	// the container logs have been forwarded, allowing log forwarding to
+	// resume after recovery without duplicating or dropping lines. The
+	// position is kept in a file, rather than within this state, as Nomad
+	// only persists the driver state returned by StartTask.
+	LogCursorPath string
+
+	// UnhealthyThreshold is the number of consecutive times ECS may report
+	// the task as UNHEALTHY before the driver fails it. Zero disables this.
+	UnhealthyThreshold int
+
+	// EnableExecuteCommand records whether the ECS task was run with ECS
+	// Exec enabled, ExecContainer is the container commands are run in, and
+	// SignalContainer is the container signals are sent to.
+	EnableExecuteCommand bool
+	ExecContainer        string
+	SignalContainer      string
+
+	// RoleARN is the role the task assumes using its workload identity, and
+	// Identity the name of the identity, to make the requests for the ECS
+	// task. RoleARN is empty if the task uses the credentials of the driver.
+	RoleARN  string
+	Identity string
+
+	// StopTimeout is the time, in seconds, ECS waits for the containers to
+	// exit after being stopped, if set by the task stop_timeout.
+	StopTimeout int64
 }
 
 // NewECSDriver returns a new DriverPlugin implementation
 func NewPlugin(logger hclog.Logger) drivers.DriverPlugin {
 	ctx, cancel := context.WithCancel(context.Background())
 	logger = logger.Named(pluginName)
-	return &Driver{
+
+	poller := newTaskPoller(logger)
+	go poller.run(ctx)
+
+	d := &Driver{
 		eventer:        eventer.NewEventer(ctx, logger),
 		config:         &DriverConfig{},
 		tasks:          newTaskStore(),
 		ctx:            ctx,
 		signalShutdown: cancel,
 		logger:         logger,
+		poller:         poller,
+		starting:       make(map[string]struct{}),
+
+		taskDefinitions: make(map[string]int),
 	}
+	d.runner = newTaskRunner(logger, d.ownsTask)
+	return d
 }
 
 func (d *Driver) PluginInfo() (*base.PluginInfoResponse, error) {
@@ -185,34 +971,161 @@ func (d *Driver) SetConfig(cfg *base.Config) error {
 		}
 	}
 
+	if err := config.parse(); err != nil {
+		return err
+	}
+
 	d.config = &config
+	d.poller.SetInterval(config.pollInterval, config.pollJitter)
 	if cfg.AgentConfig != nil {
 		d.nomadConfig = cfg.AgentConfig.Driver
 	}
 
-	client, err := d.getAwsSdk(config.Cluster)
+	awsCfg, err := config.loadAWSConfig()
 	if err != nil {
 		return fmt.Errorf("failed to get AWS SDK client: %v", err)
 	}
-	d.client = client
+	d.credentials = newCredentialsTracker(awsCfg.Credentials)
+	awsCfg.Credentials = d.credentials
+	d.stsClient = sts.New(awsCfg)
+	d.clients = newECSClientPool(awsCfg, config.Cluster)
+	d.client = d.clients.get(clusterRef{})
+	d.logsClient = newAwsLogsClient(awsCfg)
+
+	if d.stopEvents != nil {
+		d.stopEvents()
+		d.stopEvents = nil
+	}
+	d.poller.SetQuietPeriod(0)
+
+	if config.EventQueue.QueueURL != "" {
+		queueClient := awsQueueClient{
+			queueURL:  config.EventQueue.QueueURL,
+			sqsClient: sqs.New(awsCfg),
+		}
+		d.startEventConsumer(queueClient, config.EventQueue)
+	}
+
+	if d.stopReconciler != nil {
+		d.stopReconciler()
+		d.stopReconciler = nil
+	}
+	if config.OrphanReconciler.enabled() {
+		d.startOrphanReconciler(config)
+	}
+
+	if d.stopStats != nil {
+		d.stopStats()
+		d.stopStats = nil
+		d.stats = nil
+	}
+	if config.Stats.enabled() {
+		d.startStatsCollector(newAwsMetricsClient(awsCfg), config.Stats)
+	}
 
 	return nil
 }
 
-func (d *Driver) getAwsSdk(cluster string) (ecsClientInterface, error) {
-	awsCfg, err := external.LoadDefaultAWSConfig()
-	if err != nil {
-		return nil, fmt.Errorf("unable to load SDK config: %v", err)
+// startEventConsumer starts consuming ECS task state change events from the
+// queue, routing them to the task handles via the poller.
+func (d *Driver) startEventConsumer(client queueClientInterface, cfg EventQueueConfig) {
+	ctx, cancel := context.WithCancel(d.ctx)
+	d.stopEvents = cancel
+	d.poller.SetQuietPeriod(cfg.quietPeriod)
+
+	// Only the default startedBy is the same for all tasks, allowing it to
+	// identify the events of tasks not run by the driver.
+	var startedBy string
+	if d.config.StartedBy == "" {
+		startedBy = defaultStartedBy
 	}
 
-	if d.config.Region != "" {
-		awsCfg.Region = d.config.Region
+	consumer := newEventConsumer(d.logger, client, d.poller, cfg, startedBy)
+	go consumer.run(ctx)
+}
+
+// startOrphanReconciler starts periodically stopping the ECS tasks run by the
+// driver on this node which are not owned by any task handle.
+func (d *Driver) startOrphanReconciler(config DriverConfig) {
+	ctx, cancel := context.WithCancel(d.ctx)
+	d.stopReconciler = cancel
+
+	// Only the default startedBy is the same for all tasks, allowing it to
+	// be used to filter the listed tasks.
+	var startedBy string
+	if config.StartedBy == "" {
+		startedBy = defaultStartedBy
 	}
 
-	return awsEcsClient{
-		cluster:   cluster,
-		ecsClient: ecs.New(awsCfg),
-	}, nil
+	// Check every cluster tasks may run in, resolving the defaults so each
+	// cluster is only checked once.
+	var clusters []clusterRef
+	seen := make(map[clusterRef]struct{})
+	for _, ref := range config.allowedClusters() {
+		ref = d.clients.resolve(ref)
+		if _, ok := seen[ref]; !ok {
+			seen[ref] = struct{}{}
+			clusters = append(clusters, ref)
+		}
+	}
+
+	reconciler := newOrphanReconciler(d.logger, clusters, d.clients.get, d.eventer, d.ownsOrStartingTask,
+		d.getNodeID, startedBy, config.OrphanReconciler)
+	go reconciler.run(ctx, config.OrphanReconciler.interval)
+}
+
+// startStatsCollector starts periodically reading the resource usage of the
+// ECS tasks for which Nomad requests stats.
+func (d *Driver) startStatsCollector(client metricsClientInterface, cfg StatsConfig) {
+	ctx, cancel := context.WithCancel(d.ctx)
+	d.stopStats = cancel
+
+	d.stats = newStatsCollector(d.logger, client)
+	go d.stats.run(ctx, cfg.interval)
+}
+
+// ownsTask returns whether the ECS task is owned by a task handle.
+func (d *Driver) ownsTask(arn string) bool {
+	for _, h := range d.tasks.List() {
+		if h.arn == arn {
+			return true
+		}
+	}
+	return false
+}
+
+// ownsOrStartingTask returns whether the ECS task is owned by a task handle,
+// or is being started and does not yet have one.
+func (d *Driver) ownsOrStartingTask(arn string) bool {
+	d.startingLock.Lock()
+	_, ok := d.starting[arn]
+	d.startingLock.Unlock()
+	return ok || d.ownsTask(arn)
+}
+
+// setStarting records whether the ECS task is being started.
+func (d *Driver) setStarting(arn string, starting bool) {
+	d.startingLock.Lock()
+	defer d.startingLock.Unlock()
+	if starting {
+		d.starting[arn] = struct{}{}
+	} else {
+		delete(d.starting, arn)
+	}
+}
+
+// setNodeID records the Nomad node ID from a task config.
+func (d *Driver) setNodeID(cfg *drivers.TaskConfig) {
+	if cfg != nil && cfg.NodeID != "" {
+		d.nodeID.Store(cfg.NodeID)
+	}
+}
+
+// getNodeID returns the Nomad node ID, or an empty string if no task has
+// been started or recovered yet.
+func (d *Driver) getNodeID() string {
+	id, _ := d.nodeID.Load().(string)
+	return id
 }
 
 func (d *Driver) Shutdown(ctx context.Context) error {
@@ -225,7 +1138,10 @@ func (d *Driver) TaskConfigSchema() (*hclspec.Spec, error) {
 }
 
 func (d *Driver) Capabilities() (*drivers.Capabilities, error) {
-	return capabilities, nil
+	caps := *capabilities
+	caps.SendSignals = d.config.EnableExecuteCommand
+	caps.Exec = d.config.EnableExecuteCommand
+	return &caps, nil
 }
 
 func (d *Driver) Fingerprint(ctx context.Context) (<-chan *drivers.Fingerprint, error) {
@@ -256,7 +1172,11 @@ func (d *Driver) buildFingerprint(ctx context.Context) *drivers.Fingerprint {
 	attrs := map[string]*pstructs.Attribute{}
 
 	if d.config.Enabled {
-		if err := d.client.DescribeCluster(ctx); err != nil {
+		if err := d.checkCredentials(ctx); err != nil {
+			health = drivers.HealthStateUnhealthy
+			desc = err.Error()
+			attrs["driver.ecs"] = pstructs.NewBoolAttribute(false)
+		} else if err := d.client.DescribeCluster(ctx); err != nil {
 			health = drivers.HealthStateUnhealthy
 			desc = err.Error()
 			attrs["driver.ecs"] = pstructs.NewBoolAttribute(false)
@@ -277,6 +1197,15 @@ func (d *Driver) buildFingerprint(ctx context.Context) *drivers.Fingerprint {
 	}
 }
 
+// checkCredentials returns an error if the AWS credentials of the driver
+// cannot be retrieved or have expired.
+func (d *Driver) checkCredentials(ctx context.Context) error {
+	if d.credentials == nil {
+		return nil
+	}
+	return d.credentials.check(ctx)
+}
+
 func (d *Driver) RecoverTask(handle *drivers.TaskHandle) error {
 	d.logger.Info("recovering ecs task", "version", handle.Version,
 		"task_config.id", handle.Config.ID, "task_state", handle.State,
@@ -285,6 +1214,8 @@ func (d *Driver) RecoverTask(handle *drivers.TaskHandle) error {
 		return fmt.Errorf("handle cannot be nil")
 	}
 
+	d.setNodeID(handle.Config)
+
 	// If already attached to handle there's nothing to recover.
 	if _, ok := d.tasks.Get(handle.Config.ID); ok {
 		d.logger.Info("no ecs task to recover; task already exists",
@@ -304,8 +1235,33 @@ func (d *Driver) RecoverTask(handle *drivers.TaskHandle) error {
 	d.logger.Info("ecs task recovered", "arn", taskState.ARN,
 		"started_at", taskState.StartedAt)
 
-	h := newTaskHandle(d.logger, taskState, handle.Config, d.client)
+	// Task state written by older versions of the driver will not include
+	// the cluster or region, which can only have been those configured.
+	ref := d.clients.resolve(clusterRef{Region: taskState.Region, Cluster: taskState.Cluster})
+	taskState.Cluster = ref.Cluster
+	taskState.Region = ref.Region
+	// The credentials of tasks with a role are retrieved on their first use,
+	// so a failure to assume the role does not prevent the task from being
+	// recovered.
+	client, creds := d.taskClient(ref, handle.Config, taskState.RoleARN, taskState.Identity)
+
+	// Task state written by older versions of the driver will not include
+	// the network, so look it up to ensure the handle has it available. The
+	// task has usually been running for some time, so its ENI is looked up
+	// once rather than waited for, which would delay the client restoring
+	// its other tasks.
+	if taskState.Network == nil {
+		net, err := lookupNetwork(d.ctx, client, taskState.ARN)
+		if err != nil {
+			d.logger.Warn("failed to discover ecs task network", "arn", taskState.ARN, "error", err)
+		}
+		taskState.Network = net
+	}
+
+	h := newTaskHandle(d.logger, taskState, handle.Config, client, d.taskLogsClient(ref.Region, creds),
+		d.eventer, d.poller)
 
+	d.retainTaskDefinition(taskState.RegisteredTaskDefinition)
 	d.tasks.Set(handle.Config.ID, h)
 
 	go h.run()
@@ -325,36 +1281,203 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 	if err := cfg.DecodeDriverConfig(&driverConfig); err != nil {
 		return nil, nil, fmt.Errorf("failed to decode driver config: %v", err)
 	}
+	execEnabled, err := d.config.taskExecuteCommand(driverConfig.Task)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid driver config: %v", err)
+	}
+	driverConfig.Task.EnableExecuteCommand = &execEnabled
+	if err := driverConfig.validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid driver config: %v", err)
+	}
 
-	d.logger.Info("starting ecs task", "driver_cfg", hclog.Fmt("%+v", driverConfig))
+	ref, err := d.config.taskCluster(driverConfig.Task)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid driver config: %v", err)
+	}
+	ref = d.clients.resolve(ref)
+
+	role, err := d.config.WorkloadIdentity.taskRole(driverConfig.Task, cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid driver config: %v", err)
+	}
+	client, creds := d.taskClient(ref, cfg, role, driverConfig.Task.Identity)
+	if creds != nil {
+		if _, err := creds.Retrieve(d.ctx); err != nil {
+			return nil, nil, fmt.Errorf("failed to retrieve workload identity credentials: %v", err)
+		}
+	}
+
+	d.logger.Info("starting ecs task", "cluster", ref.Cluster, "region", ref.Region, "role", role,
+		"driver_cfg", hclog.Fmt("%+v", driverConfig))
 	handle := drivers.NewTaskHandle(taskHandleVersion)
 	handle.Config = cfg
 
-	arn, err := d.client.RunTask(context.Background(), driverConfig)
+	d.setNodeID(cfg)
+
+	startedBy, err := renderStartedBy(d.config.startedBy, cfg)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to start ECS task: %v", err)
+		return nil, nil, err
+	}
+	driverConfig.startedBy = startedBy
+	driverConfig.nomadTags = nomadTaskTags(cfg)
+	driverConfig.idempotencyKey = idempotencyKey(cfg.AllocID, cfg.Name)
+
+	// Copy the Nomad task environment and resources into the overrides, so
+	// the job file is the single source of truth for both.
+	if driverConfig.Task.InjectNomadTask {
+		if err := injectNomadTask(context.Background(), client, cfg, &driverConfig.Task); err != nil {
+			return nil, nil, fmt.Errorf("failed to inject nomad task: %v", err)
+		}
+	}
+
+	// Register, or reuse, the task definition described inline within the
+	// jobspec, or derived to override container entrypoints, and run the task
+	// using it.
+	taskDefinition, registered, err := d.acquireTaskDefinition(func() (string, bool, error) {
+		return resolveTaskDefinition(context.Background(), client, cfg.JobName, cfg.Name, driverConfig.Task)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	var registeredTaskDefinition string
+	if registered {
+		d.logger.Info("using registered ecs task definition", "arn", taskDefinition)
+		driverConfig.Task.TaskDefinition = taskDefinition
+		registeredTaskDefinition = taskDefinition
+	}
+
+	run := func(ctx context.Context, cfg TaskConfig) (*ecs.Task, error) {
+		return d.runner.run(ctx, client, cfg)
+	}
+	result, err := runTaskWithFallback(d.ctx, run, driverConfig, func(err error) {
+		d.logger.Warn("fargate spot capacity unavailable, falling back to fargate", "error", err)
+		msg := fmt.Sprintf("Fargate Spot capacity unavailable, running ECS task on %s", capacityProviderFargate)
+		if err := emitTaskEvent(d.eventer, cfg, msg, nil); err != nil {
+			d.logger.Warn("failed to emit task event", "error", err)
+		}
+	})
+	if err != nil {
+		d.releaseTaskDefinition(registeredTaskDefinition)
+		return nil, nil, d.handleRunTaskError(cfg, err)
+	}
+	arn := aws.StringValue(result.Task.TaskArn)
+
+	// Only report the task as running once the ECS task is, so that Nomad
+	// does not consider a task stuck provisioning as healthy. A task which
+	// does not become ready is stopped, so a restart does not adopt it.
+	d.setStarting(arn, true)
+	defer d.setStarting(arn, false)
+
+	// Emit the lifecycle transitions of the ECS task while waiting, as the
+	// task handle only observes the task once it is ready.
+	var observation *taskObservation
+	observe := func(task *ecs.Task) {
+		cur := newTaskObservation(task)
+		for _, msg := range transitionMessages(observation, cur) {
+			if err := emitTaskEvent(d.eventer, cfg, msg, taskEventAnnotations(arn, task)); err != nil {
+				d.logger.Warn("failed to emit task event", "message", msg, "error", err)
+			}
+		}
+		observation = &cur
+	}
+
+	if _, err := newReadinessGate(driverConfig.Task).wait(d.ctx, client, arn, observe); err != nil {
+		d.logger.Error("ecs task did not become ready, stopping it", "arn", arn, "error", err)
+		if stopErr := client.StopTask(d.ctx, arn); stopErr != nil {
+			d.logger.Warn("failed to stop ecs task", "arn", arn, "error", stopErr)
+		}
+		d.releaseTaskDefinition(registeredTaskDefinition)
+		return nil, nil, nstructs.NewRecoverableError(fmt.Errorf("failed to start ECS task: %v", err), true)
 	}
 
 	driverState := TaskState{
-		TaskConfig: cfg,
-		StartedAt:  time.Now(),
-		ARN:        arn,
+		TaskConfig:       cfg,
+		StartedAt:        time.Now(),
+		ARN:              arn,
+		Cluster:          ref.Cluster,
+		Region:           ref.Region,
+		LogCursorPath:    logCursorPath(cfg.TaskDir().Dir),
+		CapacityProvider: result.CapacityProvider,
+
+		UnhealthyThreshold:   driverConfig.Task.UnhealthyThreshold,
+		EnableExecuteCommand: execEnabled,
+		ExecContainer:        driverConfig.Task.ExecContainer,
+		SignalContainer:      driverConfig.Task.SignalContainer,
+		RoleARN:              role,
+		Identity:             driverConfig.Task.Identity,
+		StopTimeout:          driverConfig.Task.StopTimeout,
+
+		RegisteredTaskDefinition: registeredTaskDefinition,
+	}
+
+	// Reset the log cursors, which may remain from a previous ECS task of a
+	// restarted Nomad task, so that logs are forwarded from the start of the
+	// new task's streams.
+	if err := saveLogCursors(driverState.LogCursorPath, map[string]logCursor{}); err != nil {
+		d.logger.Warn("failed to create log cursor file", "path", driverState.LogCursorPath, "error", err)
 	}
 
-	d.logger.Info("ecs task started", "arn", driverState.ARN, "started_at", driverState.StartedAt)
+	d.logger.Info("ecs task started", "arn", driverState.ARN, "started_at", driverState.StartedAt,
+		"capacity_provider", driverState.CapacityProvider)
 
-	h := newTaskHandle(d.logger, driverState, cfg, d.client)
+	// Wait for the ECS task ENI so that Nomad services can advertise the task
+	// address. Failing to discover the network is not fatal as the ECS task
+	// is already running.
+	net, err := waitForNetwork(d.ctx, client, arn)
+	if err != nil {
+		d.logger.Warn("failed to discover ecs task network", "arn", arn, "error", err)
+	}
+	driverState.Network = net
+
+	h := newTaskHandle(d.logger, driverState, cfg, client, d.taskLogsClient(ref.Region, creds),
+		d.eventer, d.poller)
+	h.lastObservation = observation
 
 	if err := handle.SetDriverState(&driverState); err != nil {
 		d.logger.Error("failed to start task, error setting driver state", "error", err)
-		h.stop(false)
+		h.stop(false, 0)
+		d.releaseTaskDefinition(registeredTaskDefinition)
 		return nil, nil, fmt.Errorf("failed to set driver state: %v", err)
 	}
 
 	d.tasks.Set(cfg.ID, h)
 
 	go h.run()
-	return handle, nil, nil
+	return handle, net, nil
+}
+
+// handleRunTaskError wraps an error returned by RunTask so that placement
+// failures caused by a lack of capacity are marked as recoverable, allowing
+// Nomad to retry or reschedule the task rather than failing it outright.
+func (d *Driver) handleRunTaskError(cfg *drivers.TaskConfig, err error) error {
+	// The task definition may have been deregistered by another node using
+	// the same revision, in which case restarting the task registers it again.
+	if isInactiveTaskDefinitionError(err) {
+		return nstructs.NewRecoverableError(fmt.Errorf("failed to start ECS task: %v", err), true)
+	}
+
+	var runErr *runTaskError
+	if !errors.As(err, &runErr) {
+		return fmt.Errorf("failed to start ECS task: %v", err)
+	}
+
+	for _, f := range runErr.Failures {
+		d.logger.Error("ECS failed to place task", "arn", f.ARN, "reason", f.Reason,
+			"detail", f.Detail, "retryable", f.Retryable())
+
+		annotations := map[string]string{eventAnnotationFailureReason: f.Reason}
+		if f.ARN != "" {
+			annotations[eventAnnotationARN] = f.ARN
+		}
+		if f.Detail != "" {
+			annotations[eventAnnotationFailureDetail] = f.Detail
+		}
+		if err := emitTaskEvent(d.eventer, cfg, "ECS failed to place task: "+f.Reason, annotations); err != nil {
+			d.logger.Warn("failed to emit task event", "error", err)
+		}
+	}
+	return nstructs.NewRecoverableError(
+		fmt.Errorf("failed to start ECS task: %v", runErr), runErr.Retryable())
 }
 
 func (d *Driver) WaitTask(ctx context.Context, taskID string) (<-chan *drivers.ExitResult, error) {
@@ -380,11 +1503,14 @@ func (d *Driver) handleWait(ctx context.Context, handle *taskHandle, ch chan *dr
 	case <-d.ctx.Done():
 		return
 	case <-handle.doneCh:
+		handle.stateLock.RLock()
 		result = &drivers.ExitResult{
-			ExitCode: handle.exitResult.ExitCode,
-			Signal:   handle.exitResult.Signal,
-			Err:      nil,
+			ExitCode:  handle.exitResult.ExitCode,
+			Signal:    handle.exitResult.Signal,
+			OOMKilled: handle.exitResult.OOMKilled,
+			Err:       handle.exitResult.Err,
 		}
+		handle.stateLock.RUnlock()
 	}
 
 	select {
@@ -405,16 +1531,24 @@ func (d *Driver) StopTask(taskID string, timeout time.Duration, signal string) e
 
 	// Detach is that's the signal, otherwise kill
 	detach := signal == drivers.DetachSignal
-	handle.stop(detach)
+	if !detach {
+		timeout = handle.stopTimeoutFor(timeout)
+	}
+	handle.stop(detach, timeout)
 
-	// Wait for handle to finish
+	// Wait for handle to finish. The handle bounds its own wait for the ECS
+	// task to stop, so this only guards against the run loop not exiting.
 	select {
 	case <-handle.doneCh:
-	case <-time.After(timeout):
+	case <-time.After(stopWait(timeout) + stopTaskPollInterval):
 		return fmt.Errorf("timed out waiting for ecs task (id=%s) to stop (detach=%t)",
 			taskID, detach)
 	}
 
+	if err := handle.getStopErr(); err != nil {
+		return fmt.Errorf("failed to stop ecs task (id=%s): %v", taskID, err)
+	}
+
 	d.logger.Info("ecs task stopped", "task_id", taskID, "timeout", timeout,
 		"signal", signal)
 	return nil
@@ -431,14 +1565,78 @@ func (d *Driver) DestroyTask(taskID string, force bool) error {
 		return fmt.Errorf("cannot destroy running task")
 	}
 
-	// Safe to always kill here as detaching will have already happened
-	handle.stop(false)
+	// Safe to always kill here as detaching will have already happened. Any
+	// ongoing wait for the ECS task to stop is abandoned, as the handle is
+	// being removed.
+	handle.stop(false, 0)
+	handle.destroy()
+	if d.stats != nil {
+		handle.unregisterStats(d.stats)
+	}
 
 	d.tasks.Delete(taskID)
+	d.releaseTaskDefinition(handle.registeredTaskDefinition)
 	d.logger.Info("ecs task destroyed", "task_id", taskID, "force", force)
 	return nil
 }
 
+// acquireTaskDefinition resolves the task definition of a task being started
+// and, if the driver registered it, counts the task as using it.
+func (d *Driver) acquireTaskDefinition(resolve func() (string, bool, error)) (string, bool, error) {
+	d.taskDefinitionsLock.Lock()
+	defer d.taskDefinitionsLock.Unlock()
+
+	arn, registered, err := resolve()
+	if err == nil && registered {
+		d.taskDefinitions[arn]++
+	}
+	return arn, registered, err
+}
+
+// retainTaskDefinition counts a recovered task as using the task definition
+// registered for it by the driver.
+func (d *Driver) retainTaskDefinition(arn string) {
+	if arn == "" {
+		return
+	}
+	d.taskDefinitionsLock.Lock()
+	defer d.taskDefinitionsLock.Unlock()
+	d.taskDefinitions[arn]++
+}
+
+// releaseTaskDefinition stops counting a task as using the task definition
+// registered for it by the driver, deregistering it once no task on this
+// node uses it if configured to do so.
+//
+// Task definitions are registered by content, so tasks on other nodes may
+// use the same revision. Deregistering it does not affect their running
+// tasks, and a task being started on another node with it fails with a
+// recoverable error, so that restarting it registers a new revision.
+func (d *Driver) releaseTaskDefinition(arn string) {
+	if arn == "" {
+		return
+	}
+	d.taskDefinitionsLock.Lock()
+	defer d.taskDefinitionsLock.Unlock()
+
+	if d.taskDefinitions[arn]--; d.taskDefinitions[arn] > 0 {
+		return
+	}
+	delete(d.taskDefinitions, arn)
+	if !d.config.DeregisterTaskDefinitions {
+		return
+	}
+
+	// Task definitions are regional, so deregister it using a client of the
+	// region it was registered in.
+	client := d.clients.get(clusterRef{Region: arnRegion(arn)})
+	if err := client.DeregisterTaskDefinition(d.ctx, arn); err != nil {
+		d.logger.Warn("failed to deregister ecs task definition", "arn", arn, "error", err)
+		return
+	}
+	d.logger.Info("deregistered unused ecs task definition", "arn", arn)
+}
+
 func (d *Driver) InspectTask(taskID string) (*drivers.TaskStatus, error) {
 	handle, ok := d.tasks.Get(taskID)
 	if !ok {
@@ -449,31 +1647,36 @@ func (d *Driver) InspectTask(taskID string) (*drivers.TaskStatus, error) {
 
 func (d *Driver) TaskStats(ctx context.Context, taskID string, interval time.Duration) (<-chan *structs.TaskResourceUsage, error) {
 	d.logger.Info("sending ecs task stats", "task_id", taskID)
-	_, ok := d.tasks.Get(taskID)
+	handle, ok := d.tasks.Get(taskID)
 	if !ok {
 		return nil, drivers.ErrTaskNotFound
 	}
 
 	ch := make(chan *drivers.TaskResourceUsage)
+	collector := d.stats
 
 	go func() {
 		defer d.logger.Info("stopped sending ecs task stats", "task_id", taskID)
 		defer close(ch)
+
 		for {
 			select {
 			case <-time.After(interval):
 
-				// Nomad core does not currently have any resource based
-				// support for remote drivers. Once this changes, we may be
-				// able to report actual usage here.
-				//
-				// This is required, otherwise the driver panics.
+				// Without the stats collector, or before Container Insights
+				// has published any metrics, zeroed usage is sent as
+				// otherwise the driver panics. The task is only removed
+				// from the collector when its handle is destroyed, as
+				// several streams may be open for it.
+				var metrics *taskMetrics
+				if collector != nil {
+					handle.registerStats(collector)
+					metrics = collector.Latest(handle.arn)
+				}
+
 				ch <- &structs.TaskResourceUsage{
-					ResourceUsage: &drivers.ResourceUsage{
-						MemoryStats: &drivers.MemoryStats{},
-						CpuStats:    &drivers.CpuStats{},
-					},
-					Timestamp: time.Now().UTC().UnixNano(),
+					ResourceUsage: metrics.resourceUsage(),
+					Timestamp:     time.Now().UTC().UnixNano(),
 				}
 			case <-ctx.Done():
 				return
@@ -490,10 +1693,54 @@ func (d *Driver) TaskEvents(ctx context.Context) (<-chan *drivers.TaskEvent, err
 	return d.eventer.TaskEvents(ctx)
 }
 
-func (d *Driver) SignalTask(_ string, _ string) error {
-	return fmt.Errorf("ECS driver does not support signals")
+func (d *Driver) SignalTask(taskID string, signal string) error {
+	handle, ok := d.tasks.Get(taskID)
+	if !ok {
+		return drivers.ErrTaskNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(d.ctx, signalTimeout)
+	defer cancel()
+	return handle.signal(ctx, signal)
 }
 
-func (d *Driver) ExecTask(_ string, _ []string, _ time.Duration) (*drivers.ExecTaskResult, error) {
-	return nil, fmt.Errorf("ECS driver does not support exec")
+func (d *Driver) ExecTask(taskID string, cmd []string, timeout time.Duration) (*drivers.ExecTaskResult, error) {
+	handle, ok := d.tasks.Get(taskID)
+	if !ok {
+		return nil, drivers.ErrTaskNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(d.ctx, timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	exitCode, err := handle.exec(ctx, &drivers.ExecOptions{
+		Command: cmd,
+		Stdout:  nopWriteCloser{&stdout},
+		Stderr:  nopWriteCloser{&stderr},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &drivers.ExecTaskResult{
+		Stdout:     stdout.Bytes(),
+		Stderr:     stderr.Bytes(),
+		ExitResult: &drivers.ExitResult{ExitCode: exitCode},
+	}, nil
+}
+
+// ExecTaskStreaming satisfies the drivers.ExecTaskStreamingDriver interface,
+// running the command in the ECS task container using ECS Exec.
+func (d *Driver) ExecTaskStreaming(ctx context.Context, taskID string, opts *drivers.ExecOptions) (*drivers.ExitResult, error) {
+	handle, ok := d.tasks.Get(taskID)
+	if !ok {
+		return nil, drivers.ErrTaskNotFound
+	}
+
+	exitCode, err := handle.exec(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &drivers.ExitResult{ExitCode: exitCode}, nil
 }
@@ -4,13 +4,31 @@
 package ecs
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
 )
 
+const (
+	// maxDescribeTasks is the maximum number of tasks which can be described
+	// within a single ECS DescribeTasks request.
+	maxDescribeTasks = 100
+
+	// maxTaskOverridesSize is the maximum size, in bytes, of the JSON encoded
+	// overrides of an ECS RunTask request.
+	maxTaskOverridesSize = 8192
+)
+
 // ecsClientInterface encapsulates all the required AWS functionality to
 // successfully run tasks via this plugin.
 type ecsClientInterface interface {
@@ -24,15 +42,60 @@ type ecsClientInterface interface {
 	// ECS task and should be used for health checking.
 	DescribeTaskStatus(ctx context.Context, taskARN string) (string, error)
 
+	// DescribeTask returns the full ECS description of the task, including
+	// the status and exit codes of its containers.
+	DescribeTask(ctx context.Context, taskARN string) (*ecs.Task, error)
+
+	// DescribeTasks returns the ECS description of each of the passed tasks
+	// using a single request, therefore no more than maxDescribeTasks ARNs
+	// should be passed. The returned map is keyed by task ARN. Any tasks which
+	// ECS could not describe are returned within the failures map, keyed by
+	// ARN, with the reason as the value.
+	DescribeTasks(ctx context.Context, taskARNs []string) (map[string]*ecs.Task, map[string]string, error)
+
+	// ListTasks returns the ARNs of all tasks within the cluster which have
+	// a desired status of RUNNING. If startedBy is not empty, only the tasks
+	// with a matching startedBy value are returned.
+	ListTasks(ctx context.Context, startedBy string) ([]string, error)
+
+	// DescribeTaskDefinition returns the ECS task definition identified by
+	// the family:revision or full ARN passed.
+	DescribeTaskDefinition(ctx context.Context, taskDefinition string) (*ecs.TaskDefinition, error)
+
+	// RegisterTaskDefinition registers a new task definition, or a new
+	// revision of an existing family, returning the registered definition.
+	RegisterTaskDefinition(ctx context.Context, input *ecs.RegisterTaskDefinitionInput) (*ecs.TaskDefinition, error)
+
+	// DescribeTaskDefinitionJSON returns the JSON object of the ECS task
+	// definition, including the fields the AWS SDK version used by the
+	// driver does not support, with its tags added as the tags field.
+	DescribeTaskDefinitionJSON(ctx context.Context, taskDefinition string) (map[string]interface{}, error)
+
+	// RegisterTaskDefinitionJSON registers a task definition using the JSON
+	// object as the request, so fields the AWS SDK version used by the driver
+	// does not support are preserved.
+	RegisterTaskDefinitionJSON(ctx context.Context, input map[string]interface{}) (*ecs.TaskDefinition, error)
+
+	// DeregisterTaskDefinition marks the task definition revision as
+	// inactive. Running tasks are not affected.
+	DeregisterTaskDefinition(ctx context.Context, taskDefinitionARN string) error
+
 	// RunTask is used to trigger the running of a new ECS task based on the
-	// provided configuration. The ARN of the task, as well as any errors are
-	// returned to the caller.
-	RunTask(ctx context.Context, cfg TaskConfig) (string, error)
+	// provided configuration. The ECS task, as well as any errors are
+	// returned to the caller. If ECS is unable to place the task, the error
+	// will be a *runTaskError detailing the failures.
+	RunTask(ctx context.Context, cfg TaskConfig) (*ecs.Task, error)
 
 	// StopTask stops the running ECS task, adding a custom message which can
 	// be viewed via the AWS console specifying it was this Nomad driver which
 	// performed the action.
 	StopTask(ctx context.Context, taskARN string) error
+
+	// ExecuteCommand starts an ECS Exec session running the command within
+	// the container of the task, returning the SSM session used to stream
+	// its input and output. The container may be empty if the task has only
+	// one container.
+	ExecuteCommand(ctx context.Context, taskARN, container, command string) (*execSession, error)
 }
 
 type awsEcsClient struct {
@@ -64,6 +127,16 @@ func (c awsEcsClient) DescribeCluster(ctx context.Context) error {
 // DescribeTaskStatus satisfies the ecs.ecsClientInterface DescribeTaskStatus
 // interface function.
 func (c awsEcsClient) DescribeTaskStatus(ctx context.Context, taskARN string) (string, error) {
+	task, err := c.DescribeTask(ctx, taskARN)
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(task.LastStatus), nil
+}
+
+// DescribeTask satisfies the ecs.ecsClientInterface DescribeTask interface
+// function.
+func (c awsEcsClient) DescribeTask(ctx context.Context, taskARN string) (*ecs.Task, error) {
 	input := ecs.DescribeTasksInput{
 		Cluster: aws.String(c.cluster),
 		Tasks:   []string{taskARN},
@@ -71,24 +144,207 @@ func (c awsEcsClient) DescribeTaskStatus(ctx context.Context, taskARN string) (s
 
 	resp, err := c.ecsClient.DescribeTasksRequest(&input).Send(ctx)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	if len(resp.Tasks) != 1 {
+		if len(resp.Failures) > 0 {
+			return nil, &describeTaskError{Reason: aws.StringValue(resp.Failures[0].Reason)}
+		}
+		return nil, fmt.Errorf("AWS returned %v ECS tasks, expected 1", len(resp.Tasks))
+	}
+	return &resp.Tasks[0], nil
+}
+
+// DescribeTasks satisfies the ecs.ecsClientInterface DescribeTasks interface
+// function.
+func (c awsEcsClient) DescribeTasks(ctx context.Context, taskARNs []string) (map[string]*ecs.Task, map[string]string, error) {
+	input := ecs.DescribeTasksInput{
+		Cluster: aws.String(c.cluster),
+		Tasks:   taskARNs,
+		Include: []ecs.TaskField{ecs.TaskFieldTags},
+	}
+
+	resp, err := c.ecsClient.DescribeTasksRequest(&input).Send(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tasks := make(map[string]*ecs.Task, len(resp.Tasks))
+	for i := range resp.Tasks {
+		tasks[aws.StringValue(resp.Tasks[i].TaskArn)] = &resp.Tasks[i]
+	}
+
+	failures := make(map[string]string, len(resp.Failures))
+	for _, f := range resp.Failures {
+		failures[aws.StringValue(f.Arn)] = aws.StringValue(f.Reason)
+	}
+	return tasks, failures, nil
+}
+
+// ListTasks satisfies the ecs.ecsClientInterface ListTasks interface function.
+func (c awsEcsClient) ListTasks(ctx context.Context, startedBy string) ([]string, error) {
+	input := ecs.ListTasksInput{
+		Cluster:       aws.String(c.cluster),
+		DesiredStatus: ecs.DesiredStatusRunning,
+	}
+	if startedBy != "" {
+		input.StartedBy = aws.String(startedBy)
+	}
+
+	var arns []string
+	p := ecs.NewListTasksPaginator(c.ecsClient.ListTasksRequest(&input))
+	for p.Next(ctx) {
+		arns = append(arns, p.CurrentPage().TaskArns...)
+	}
+	if err := p.Err(); err != nil {
+		return nil, err
+	}
+	return arns, nil
+}
+
+// DescribeTaskDefinition satisfies the ecs.ecsClientInterface
+// DescribeTaskDefinition interface function.
+func (c awsEcsClient) DescribeTaskDefinition(ctx context.Context, taskDefinition string) (*ecs.TaskDefinition, error) {
+	input := ecs.DescribeTaskDefinitionInput{TaskDefinition: aws.String(taskDefinition)}
+
+	resp, err := c.ecsClient.DescribeTaskDefinitionRequest(&input).Send(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.TaskDefinition == nil {
+		return nil, fmt.Errorf("AWS returned no ECS task definition for %q", taskDefinition)
+	}
+	return resp.TaskDefinition, nil
+}
+
+// RegisterTaskDefinition satisfies the ecs.ecsClientInterface
+// RegisterTaskDefinition interface function.
+func (c awsEcsClient) RegisterTaskDefinition(ctx context.Context, input *ecs.RegisterTaskDefinitionInput) (*ecs.TaskDefinition, error) {
+	if err := input.Validate(); err != nil {
+		return nil, fmt.Errorf("failed to validate: %w", err)
+	}
+
+	resp, err := c.ecsClient.RegisterTaskDefinitionRequest(input).Send(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.TaskDefinition == nil {
+		return nil, fmt.Errorf("AWS returned no registered ECS task definition")
 	}
-	return *resp.Tasks[0].LastStatus, nil
+	return resp.TaskDefinition, nil
+}
+
+// DescribeTaskDefinitionJSON satisfies the ecs.ecsClientInterface
+// DescribeTaskDefinitionJSON interface function.
+func (c awsEcsClient) DescribeTaskDefinitionJSON(ctx context.Context, taskDefinition string) (map[string]interface{}, error) {
+	input := ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: aws.String(taskDefinition),
+		Include:        []ecs.TaskDefinitionField{ecs.TaskDefinitionFieldTags},
+	}
+
+	// Keep a copy of the response body before the SDK decodes it, as the
+	// decoded output drops the fields the SDK does not support.
+	var body []byte
+	req := c.ecsClient.DescribeTaskDefinitionRequest(&input)
+	req.Handlers.Unmarshal.PushFront(func(r *aws.Request) {
+		if r.Error != nil {
+			return
+		}
+		b, err := ioutil.ReadAll(r.HTTPResponse.Body)
+		if err != nil {
+			r.Error = awserr.New("SerializationError", "failed to read DescribeTaskDefinition response", err)
+			return
+		}
+		r.HTTPResponse.Body = ioutil.NopCloser(bytes.NewReader(b))
+		body = b
+	})
+	if _, err := req.Send(ctx); err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		TaskDefinition map[string]interface{} `json:"taskDefinition"`
+		Tags           []interface{}          `json:"tags"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to decode task definition %q: %v", taskDefinition, err)
+	}
+
+	if resp.TaskDefinition == nil {
+		return nil, fmt.Errorf("AWS returned no ECS task definition for %q", taskDefinition)
+	}
+	if len(resp.Tags) > 0 {
+		resp.TaskDefinition["tags"] = resp.Tags
+	}
+	return resp.TaskDefinition, nil
+}
+
+// RegisterTaskDefinitionJSON satisfies the ecs.ecsClientInterface
+// RegisterTaskDefinitionJSON interface function.
+func (c awsEcsClient) RegisterTaskDefinitionJSON(ctx context.Context, input map[string]interface{}) (*ecs.TaskDefinition, error) {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode task definition: %v", err)
+	}
+
+	// The request is built from an empty input, which cannot pass the SDK
+	// validation, and the body then replaced by the JSON object.
+	req := c.ecsClient.RegisterTaskDefinitionRequest(&ecs.RegisterTaskDefinitionInput{})
+	req.Handlers.Validate.Clear()
+	req.Handlers.Build.PushBack(func(r *aws.Request) {
+		if r.Error == nil {
+			r.SetBufferBody(body)
+		}
+	})
+
+	resp, err := req.Send(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.TaskDefinition == nil {
+		return nil, fmt.Errorf("AWS returned no registered ECS task definition")
+	}
+	return resp.TaskDefinition, nil
+}
+
+// DeregisterTaskDefinition satisfies the ecs.ecsClientInterface
+// DeregisterTaskDefinition interface function.
+func (c awsEcsClient) DeregisterTaskDefinition(ctx context.Context, taskDefinitionARN string) error {
+	input := ecs.DeregisterTaskDefinitionInput{TaskDefinition: aws.String(taskDefinitionARN)}
+
+	_, err := c.ecsClient.DeregisterTaskDefinitionRequest(&input).Send(ctx)
+	return err
 }
 
 // RunTask satisfies the ecs.ecsClientInterface RunTask interface function.
-func (c awsEcsClient) RunTask(ctx context.Context, cfg TaskConfig) (string, error) {
+func (c awsEcsClient) RunTask(ctx context.Context, cfg TaskConfig) (*ecs.Task, error) {
 	input := c.buildTaskInput(cfg)
 
 	if err := input.Validate(); err != nil {
-		return "", fmt.Errorf("failed to validate: %w", err)
+		return nil, fmt.Errorf("failed to validate: %w", err)
 	}
 
-	resp, err := c.ecsClient.RunTaskRequest(input).Send(ctx)
+	req := c.ecsClient.RunTaskRequest(input)
+	req.Handlers.Build.PushBack(buildRunTaskExtensions(cfg))
+	req.Handlers.Build.PushBack(checkTaskOverridesSize)
+
+	resp, err := req.Send(ctx)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return *resp.RunTaskOutput.Tasks[0].TaskArn, nil
+
+	// ECS reports placement problems within the response rather than as an
+	// error, therefore check this before attempting to read the task.
+	if len(resp.RunTaskOutput.Failures) > 0 || len(resp.RunTaskOutput.Tasks) < 1 {
+		return nil, newRunTaskError(resp.RunTaskOutput.Failures)
+	}
+	return &resp.RunTaskOutput.Tasks[0], nil
 }
 
 // buildTaskInput is used to convert the jobspec supplied configuration input
@@ -97,10 +353,24 @@ func (c awsEcsClient) buildTaskInput(cfg TaskConfig) *ecs.RunTaskInput {
 	input := ecs.RunTaskInput{
 		Cluster:              aws.String(c.cluster),
 		Count:                aws.Int64(1),
-		StartedBy:            aws.String("nomad-ecs-driver"),
+		StartedBy:            aws.String(defaultStartedBy),
 		NetworkConfiguration: &ecs.NetworkConfiguration{AwsvpcConfiguration: &ecs.AwsVpcConfiguration{}},
 	}
 
+	if cfg.startedBy != "" {
+		input.StartedBy = aws.String(cfg.startedBy)
+	}
+
+	if tags := buildTags(cfg.nomadTags, cfg.Task.Tags); len(tags) > 0 {
+		input.Tags = tags
+	}
+	if cfg.Task.EnableECSManagedTags {
+		input.EnableECSManagedTags = aws.Bool(true)
+	}
+	if cfg.Task.PropagateTags != "" {
+		input.PropagateTags = ecs.PropagateTags(cfg.Task.PropagateTags)
+	}
+
 	if cfg.Task.LaunchType != "" {
 		if cfg.Task.LaunchType == "EC2" {
 			input.LaunchType = ecs.LaunchTypeEc2
@@ -109,10 +379,36 @@ func (c awsEcsClient) buildTaskInput(cfg TaskConfig) *ecs.RunTaskInput {
 		}
 	}
 
+	for _, s := range cfg.Task.CapacityProviderStrategy {
+		item := ecs.CapacityProviderStrategyItem{
+			CapacityProvider: aws.String(s.CapacityProvider),
+			Base:             aws.Int64(s.Base),
+			Weight:           aws.Int64(s.Weight),
+		}
+		input.CapacityProviderStrategy = append(input.CapacityProviderStrategy, item)
+	}
+
+	for _, c := range cfg.Task.PlacementConstraints {
+		constraint := ecs.PlacementConstraint{Type: ecs.PlacementConstraintType(c.Type)}
+		if c.Expression != "" {
+			constraint.Expression = aws.String(c.Expression)
+		}
+		input.PlacementConstraints = append(input.PlacementConstraints, constraint)
+	}
+	for _, s := range cfg.Task.PlacementStrategies {
+		strategy := ecs.PlacementStrategy{Type: ecs.PlacementStrategyType(s.Type)}
+		if s.Field != "" {
+			strategy.Field = aws.String(s.Field)
+		}
+		input.PlacementStrategy = append(input.PlacementStrategy, strategy)
+	}
+
 	if cfg.Task.TaskDefinition != "" {
 		input.TaskDefinition = aws.String(cfg.Task.TaskDefinition)
 	}
 
+	input.Overrides = buildTaskOverride(cfg.Task)
+
 	// Handle the task networking setup.
 	if cfg.Task.NetworkConfiguration.TaskAWSVPCConfiguration.AssignPublicIP != "" {
 		assignPublicIp := cfg.Task.NetworkConfiguration.TaskAWSVPCConfiguration.AssignPublicIP
@@ -132,6 +428,174 @@ func (c awsEcsClient) buildTaskInput(cfg TaskConfig) *ecs.RunTaskInput {
 	return &input
 }
 
+// buildTaskOverride converts the jobspec task level and container overrides
+// into the ecs.TaskOverride object. Nil is returned if nothing is overridden.
+func buildTaskOverride(cfg ECSTaskConfig) *ecs.TaskOverride {
+	var override ecs.TaskOverride
+	set := false
+
+	if cfg.CPU > 0 {
+		override.Cpu = aws.String(strconv.FormatInt(cfg.CPU, 10))
+		set = true
+	}
+	if cfg.Memory > 0 {
+		override.Memory = aws.String(strconv.FormatInt(cfg.Memory, 10))
+		set = true
+	}
+	if cfg.TaskRoleARN != "" {
+		override.TaskRoleArn = aws.String(cfg.TaskRoleARN)
+		set = true
+	}
+	if cfg.ExecutionRoleARN != "" {
+		override.ExecutionRoleArn = aws.String(cfg.ExecutionRoleARN)
+		set = true
+	}
+
+	for _, co := range cfg.ContainerOverrides {
+		container := ecs.ContainerOverride{
+			Name:    aws.String(co.Name),
+			Command: co.Command,
+		}
+		if co.CPU > 0 {
+			container.Cpu = aws.Int64(co.CPU)
+		}
+		if co.Memory > 0 {
+			container.Memory = aws.Int64(co.Memory)
+		}
+		if co.MemoryReservation > 0 {
+			container.MemoryReservation = aws.Int64(co.MemoryReservation)
+		}
+		container.Environment = sortedKeyValuePairs(co.Environment)
+
+		override.ContainerOverrides = append(override.ContainerOverrides, container)
+		set = true
+	}
+
+	if !set {
+		return nil
+	}
+	return &override
+}
+
+// sortedKeyValuePairs converts the map into ECS key value pairs, sorted by
+// key so the result is stable.
+func sortedKeyValuePairs(m map[string]string) []ecs.KeyValuePair {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []ecs.KeyValuePair
+	for _, k := range keys {
+		pairs = append(pairs, ecs.KeyValuePair{Name: aws.String(k), Value: aws.String(m[k])})
+	}
+	return pairs
+}
+
+// buildRunTaskExtensions returns a request build handler which adds the
+// RunTask fields that ECS supports, but the AWS SDK version used by the
+// driver does not, to the JSON request body.
+func buildRunTaskExtensions(cfg TaskConfig) func(*aws.Request) {
+	return func(r *aws.Request) {
+		envFiles := make(map[string][]string)
+		for _, co := range cfg.Task.ContainerOverrides {
+			if len(co.EnvironmentFiles) > 0 {
+				envFiles[co.Name] = co.EnvironmentFiles
+			}
+		}
+		if len(envFiles) == 0 && cfg.clientToken == "" && !cfg.Task.executeCommand() {
+			return
+		}
+
+		err := patchJSONBody(r, func(body map[string]interface{}) {
+			if cfg.clientToken != "" {
+				body["clientToken"] = cfg.clientToken
+			}
+			if cfg.Task.executeCommand() {
+				body["enableExecuteCommand"] = true
+			}
+
+			overrides, _ := body["overrides"].(map[string]interface{})
+			containers, _ := overrides["containerOverrides"].([]interface{})
+			for _, c := range containers {
+				container, _ := c.(map[string]interface{})
+				name, _ := container["name"].(string)
+
+				var files []interface{}
+				for _, f := range envFiles[name] {
+					files = append(files, map[string]interface{}{"type": "s3", "value": f})
+				}
+				if len(files) > 0 {
+					container["environmentFiles"] = files
+				}
+			}
+		})
+		if err != nil {
+			r.Error = awserr.New("SerializationError", "failed to add RunTask extensions", err)
+		}
+	}
+}
+
+// checkTaskOverridesSize is a request build handler which fails the RunTask
+// request if the encoded overrides exceed the size ECS accepts, so the error
+// describes the cause rather than being a generic ECS validation failure.
+func checkTaskOverridesSize(r *aws.Request) {
+	if r.Error != nil || r.Body == nil {
+		return
+	}
+	if _, err := r.Body.Seek(0, io.SeekStart); err != nil {
+		r.Error = err
+		return
+	}
+
+	var body struct {
+		Overrides json.RawMessage `json:"overrides"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		r.Error = awserr.New("SerializationError", "failed to decode RunTask request", err)
+		return
+	}
+	if _, err := r.Body.Seek(0, io.SeekStart); err != nil {
+		r.Error = err
+		return
+	}
+
+	if len(body.Overrides) > maxTaskOverridesSize {
+		r.Error = fmt.Errorf("ECS task overrides are %d bytes, exceeding the ECS limit of %d bytes: "+
+			"reduce the container_override environment or the environment added by inject_nomad_task",
+			len(body.Overrides), maxTaskOverridesSize)
+	}
+}
+
+// patchJSONBody decodes the JSON body of the request, passes it to the patch
+// function for modification and then replaces the body with the result.
+func patchJSONBody(r *aws.Request, patch func(map[string]interface{})) error {
+	if r.Error != nil || r.Body == nil {
+		return nil
+	}
+
+	if _, err := r.Body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	var body map[string]interface{}
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&body); err != nil {
+		return err
+	}
+
+	patch(body)
+
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	r.SetBufferBody(buf)
+	return nil
+}
+
 // StopTask satisfies the ecs.ecsClientInterface StopTask interface function.
 func (c awsEcsClient) StopTask(ctx context.Context, taskARN string) error {
 	input := ecs.StopTaskInput{
@@ -143,3 +607,63 @@ func (c awsEcsClient) StopTask(ctx context.Context, taskARN string) error {
 	_, err := c.ecsClient.StopTaskRequest(&input).Send(ctx)
 	return err
 }
+
+// opExecuteCommand is the ECS API operation which starts an ECS Exec session.
+// The AWS SDK version used by the driver predates ECS Exec, so the request
+// and response types are defined here.
+const opExecuteCommand = "ExecuteCommand"
+
+type executeCommandInput struct {
+	_ struct{} `type:"structure"`
+
+	Cluster     *string `locationName:"cluster" type:"string"`
+	Container   *string `locationName:"container" type:"string"`
+	Command     *string `locationName:"command" type:"string"`
+	Interactive *bool   `locationName:"interactive" type:"boolean"`
+	Task        *string `locationName:"task" type:"string"`
+}
+
+type executeCommandOutput struct {
+	_ struct{} `type:"structure"`
+
+	Session *execSession `locationName:"session" type:"structure"`
+}
+
+// execSession is the SSM session started by ECS Exec. The stream URL is the
+// websocket of the session data channel, which is opened using the token.
+type execSession struct {
+	_ struct{} `type:"structure"`
+
+	SessionID  *string `locationName:"sessionId" type:"string"`
+	StreamURL  *string `locationName:"streamUrl" type:"string"`
+	TokenValue *string `locationName:"tokenValue" type:"string"`
+}
+
+// ExecuteCommand satisfies the ecs.ecsClientInterface ExecuteCommand
+// interface function.
+func (c awsEcsClient) ExecuteCommand(ctx context.Context, taskARN, container, command string) (*execSession, error) {
+	input := executeCommandInput{
+		Cluster: aws.String(c.cluster),
+		Command: aws.String(command),
+		Task:    aws.String(taskARN),
+
+		// ECS only supports interactive sessions.
+		Interactive: aws.Bool(true),
+	}
+	if container != "" {
+		input.Container = aws.String(container)
+	}
+
+	op := aws.Operation{Name: opExecuteCommand, HTTPMethod: "POST", HTTPPath: "/"}
+	output := executeCommandOutput{}
+	req := c.ecsClient.NewRequest(&op, &input, &output)
+	req.SetContext(ctx)
+	if err := req.Send(); err != nil {
+		return nil, err
+	}
+
+	if output.Session == nil || aws.StringValue(output.Session.StreamURL) == "" {
+		return nil, errors.New("ECS did not return an exec session")
+	}
+	return output.Session, nil
+}
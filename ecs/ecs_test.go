@@ -0,0 +1,443 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/defaults"
+	"github.com/aws/aws-sdk-go-v2/private/protocol/json/jsonutil"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testAWSConfig returns an AWS SDK configuration which sends all requests to
+// the passed URL, such as that of a local stand-in for an AWS service.
+func testAWSConfig(url string) aws.Config {
+	cfg := defaults.Config()
+	cfg.Region = "us-east-1"
+	cfg.EndpointResolver = aws.ResolveWithEndpointURL(url)
+	cfg.Credentials = aws.NewStaticCredentialsProvider("AKIDEXAMPLE", "SECRET", "")
+	cfg.Retryer = aws.NoOpRetryer{}
+	return cfg
+}
+
+// mockECSClient is an in-memory implementation of ecsClientInterface which
+// serves the tasks it holds and records the calls made to it.
+type mockECSClient struct {
+	lock sync.Mutex
+
+	tasks           map[string]*ecs.Task
+	taskDefinitions map[string]*ecs.TaskDefinition
+
+	// describeTasksErr is returned by DescribeTasks when set.
+	describeTasksErr error
+
+	// listTasksErr is returned by ListTasks when set.
+	listTasksErr error
+
+	// runTaskErrs are returned by successive RunTask calls, a nil entry
+	// meaning the call succeeds.
+	runTaskErrs []error
+
+	// clientTokens maps the RunTask client tokens used to the ARN of the
+	// task run, so that repeated requests return the same task as ECS does.
+	clientTokens map[string]string
+
+	// taskProgressions are returned by successive DescribeTask calls for the
+	// ARN, the last description being repeated, to simulate a task moving
+	// through its lifecycle. A nil description is reported as missing.
+	taskProgressions map[string][]*ecs.Task
+
+	// ignoreStopTask leaves tasks running when stopped, as when containers
+	// ignore SIGTERM and ECS is slow to kill them.
+	ignoreStopTask bool
+
+	// execSession is returned by ExecuteCommand.
+	execSession *execSession
+
+	describeTasksCalls   [][]string
+	registerTaskInputs   []*ecs.RegisterTaskDefinitionInput
+	registerTaskJSON     []map[string]interface{}
+	deregisteredTaskDefs []string
+	runTaskInputs        []TaskConfig
+	stopTaskARNs         []string
+	execCommands         []string
+}
+
+func newMockECSClient() *mockECSClient {
+	return &mockECSClient{
+		tasks:           make(map[string]*ecs.Task),
+		taskDefinitions: make(map[string]*ecs.TaskDefinition),
+		clientTokens:    make(map[string]string),
+
+		taskProgressions: make(map[string][]*ecs.Task),
+	}
+}
+
+func (m *mockECSClient) DescribeCluster(_ context.Context) error { return nil }
+
+func (m *mockECSClient) DescribeTaskStatus(ctx context.Context, taskARN string) (string, error) {
+	task, err := m.DescribeTask(ctx, taskARN)
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(task.LastStatus), nil
+}
+
+func (m *mockECSClient) DescribeTask(_ context.Context, taskARN string) (*ecs.Task, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if seq := m.taskProgressions[taskARN]; len(seq) > 0 {
+		if seq[0] == nil {
+			delete(m.tasks, taskARN)
+		} else {
+			m.tasks[taskARN] = seq[0]
+		}
+		if len(seq) > 1 {
+			m.taskProgressions[taskARN] = seq[1:]
+		}
+	}
+
+	task, ok := m.tasks[taskARN]
+	if !ok {
+		return nil, &describeTaskError{Reason: ecsFailureReasonMissing}
+	}
+	return task, nil
+}
+
+func (m *mockECSClient) DescribeTasks(_ context.Context, taskARNs []string) (map[string]*ecs.Task, map[string]string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.describeTasksCalls = append(m.describeTasksCalls, taskARNs)
+	if m.describeTasksErr != nil {
+		return nil, nil, m.describeTasksErr
+	}
+
+	tasks := make(map[string]*ecs.Task)
+	failures := make(map[string]string)
+	for _, arn := range taskARNs {
+		if task, ok := m.tasks[arn]; ok {
+			tasks[arn] = task
+		} else {
+			failures[arn] = "MISSING"
+		}
+	}
+	return tasks, failures, nil
+}
+
+func (m *mockECSClient) ListTasks(_ context.Context, startedBy string) ([]string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.listTasksErr != nil {
+		return nil, m.listTasksErr
+	}
+
+	var arns []string
+	for arn, task := range m.tasks {
+		if aws.StringValue(task.DesiredStatus) != "RUNNING" {
+			continue
+		}
+		if startedBy != "" && aws.StringValue(task.StartedBy) != startedBy {
+			continue
+		}
+		arns = append(arns, arn)
+	}
+	sort.Strings(arns)
+	return arns, nil
+}
+
+func (m *mockECSClient) DescribeTaskDefinition(_ context.Context, taskDefinition string) (*ecs.TaskDefinition, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	def, ok := m.taskDefinitions[taskDefinition]
+	if !ok {
+		return nil, fmt.Errorf("task definition %q not found", taskDefinition)
+	}
+	return def, nil
+}
+
+func (m *mockECSClient) RegisterTaskDefinition(_ context.Context, input *ecs.RegisterTaskDefinitionInput) (*ecs.TaskDefinition, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.registerTaskInputs = append(m.registerTaskInputs, input)
+	return m.register(aws.StringValue(input.Family), input.ContainerDefinitions, input.NetworkMode), nil
+}
+
+// DescribeTaskDefinitionJSON returns the task definition in the same JSON
+// form ECS does, with only the fields the SDK supports.
+func (m *mockECSClient) DescribeTaskDefinitionJSON(ctx context.Context, taskDefinition string) (map[string]interface{}, error) {
+	def, err := m.DescribeTaskDefinition(ctx, taskDefinition)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := jsonutil.BuildJSON(def)
+	if err != nil {
+		return nil, err
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (m *mockECSClient) RegisterTaskDefinitionJSON(_ context.Context, input map[string]interface{}) (*ecs.TaskDefinition, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.registerTaskJSON = append(m.registerTaskJSON, input)
+	family, _ := input["family"].(string)
+	return m.register(family, nil, ""), nil
+}
+
+// register records a new revision of the task definition family. The caller
+// must hold the lock.
+func (m *mockECSClient) register(family string, containers []ecs.ContainerDefinition,
+	networkMode ecs.NetworkMode) *ecs.TaskDefinition {
+	revision := int64(1)
+	if existing, ok := m.taskDefinitions[family]; ok {
+		revision = aws.Int64Value(existing.Revision) + 1
+	}
+
+	def := &ecs.TaskDefinition{
+		Family:               aws.String(family),
+		Revision:             aws.Int64(revision),
+		TaskDefinitionArn:    aws.String(fmt.Sprintf("arn:aws:ecs:us-east-1:123456789012:task-definition/%s:%d", family, revision)),
+		Status:               ecs.TaskDefinitionStatusActive,
+		ContainerDefinitions: containers,
+		NetworkMode:          networkMode,
+	}
+	m.taskDefinitions[family] = def
+	m.taskDefinitions[aws.StringValue(def.TaskDefinitionArn)] = def
+	return def
+}
+
+func (m *mockECSClient) DeregisterTaskDefinition(_ context.Context, taskDefinitionARN string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.deregisteredTaskDefs = append(m.deregisteredTaskDefs, taskDefinitionARN)
+	if def, ok := m.taskDefinitions[taskDefinitionARN]; ok {
+		def.Status = ecs.TaskDefinitionStatusInactive
+	}
+	return nil
+}
+
+func (m *mockECSClient) RunTask(_ context.Context, cfg TaskConfig) (*ecs.Task, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.runTaskInputs = append(m.runTaskInputs, cfg)
+	if len(m.runTaskErrs) > 0 {
+		err := m.runTaskErrs[0]
+		m.runTaskErrs = m.runTaskErrs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if arn, ok := m.clientTokens[cfg.clientToken]; ok && cfg.clientToken != "" {
+		return m.tasks[arn], nil
+	}
+
+	arn := fmt.Sprintf("arn:aws:ecs:us-east-1:123456789012:task/nomad/%d", len(m.runTaskInputs)-1)
+	task := &ecs.Task{
+		TaskArn:       aws.String(arn),
+		LastStatus:    aws.String("PROVISIONING"),
+		DesiredStatus: aws.String("RUNNING"),
+		StartedBy:     aws.String(cfg.startedBy),
+		Tags:          buildTags(cfg.nomadTags, cfg.Task.Tags),
+		CreatedAt:     aws.Time(time.Now()),
+	}
+	if len(cfg.Task.CapacityProviderStrategy) > 0 {
+		task.CapacityProviderName = aws.String(cfg.Task.CapacityProviderStrategy[0].CapacityProvider)
+	}
+	m.tasks[arn] = task
+	if cfg.clientToken != "" {
+		m.clientTokens[cfg.clientToken] = arn
+	}
+	return task, nil
+}
+
+func (m *mockECSClient) StopTask(_ context.Context, taskARN string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.stopTaskARNs = append(m.stopTaskARNs, taskARN)
+	if task, ok := m.tasks[taskARN]; ok && !m.ignoreStopTask {
+		task.LastStatus = aws.String("STOPPED")
+		task.DesiredStatus = aws.String("STOPPED")
+	}
+	return nil
+}
+
+func (m *mockECSClient) ExecuteCommand(_ context.Context, taskARN, container, command string) (*execSession, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.execCommands = append(m.execCommands, fmt.Sprintf("%s/%s: %s", taskARN, container, command))
+	if m.execSession == nil {
+		return nil, errors.New("execute command is not enabled")
+	}
+	return m.execSession, nil
+}
+
+func Test_buildTaskOverride(t *testing.T) {
+	assert.Nil(t, buildTaskOverride(ECSTaskConfig{TaskDefinition: "web:1"}))
+
+	override := buildTaskOverride(ECSTaskConfig{
+		TaskDefinition: "web:1",
+		CPU:            512,
+		Memory:         1024,
+		TaskRoleARN:    "arn:aws:iam::123456789012:role/web",
+		ContainerOverrides: []TaskContainerOverride{
+			{
+				Name:              "web",
+				Command:           []string{"serve", "--port", "8080"},
+				Environment:       map[string]string{"B": "2", "A": "1"},
+				Memory:            512,
+				MemoryReservation: 256,
+			},
+		},
+	})
+	require.NotNil(t, override)
+	assert.Equal(t, "512", aws.StringValue(override.Cpu))
+	assert.Equal(t, "1024", aws.StringValue(override.Memory))
+	assert.Equal(t, "arn:aws:iam::123456789012:role/web", aws.StringValue(override.TaskRoleArn))
+	assert.Nil(t, override.ExecutionRoleArn)
+
+	require.Len(t, override.ContainerOverrides, 1)
+	co := override.ContainerOverrides[0]
+	assert.Equal(t, "web", aws.StringValue(co.Name))
+	assert.Equal(t, []string{"serve", "--port", "8080"}, co.Command)
+	assert.Nil(t, co.Cpu)
+	assert.Equal(t, int64(512), aws.Int64Value(co.Memory))
+	assert.Equal(t, int64(256), aws.Int64Value(co.MemoryReservation))
+	require.Len(t, co.Environment, 2)
+	assert.Equal(t, "A", aws.StringValue(co.Environment[0].Name))
+}
+
+func Test_awsEcsClient_RunTask_environmentFiles(t *testing.T) {
+	var body map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		_ = json.Unmarshal(data, &body)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		fmt.Fprint(w, `{"tasks":[{"taskArn":"arn:aws:ecs:us-east-1:123456789012:task/nomad/1"}]}`)
+	}))
+	defer srv.Close()
+
+	client := awsEcsClient{cluster: "nomad", ecsClient: ecs.New(testAWSConfig(srv.URL))}
+	task, err := client.RunTask(context.Background(), TaskConfig{Task: ECSTaskConfig{
+		TaskDefinition: "web:1",
+		NetworkConfiguration: TaskNetworkConfiguration{
+			TaskAWSVPCConfiguration: TaskAWSVPCConfiguration{Subnets: []string{"subnet-1"}},
+		},
+		ContainerOverrides: []TaskContainerOverride{
+			{Name: "web", EnvironmentFiles: []string{"arn:aws:s3:::bucket/web.env"}},
+			{Name: "sidecar", Command: []string{"run"}},
+		},
+		EnableExecuteCommand: aws.Bool(true),
+	}, clientToken: clientToken("6d9c1a3e/server", 0)})
+	require.NoError(t, err)
+	assert.Equal(t, "arn:aws:ecs:us-east-1:123456789012:task/nomad/1", aws.StringValue(task.TaskArn))
+
+	// The environment files are added to the matching container override
+	// only, alongside the fields set by the SDK.
+	containers := body["overrides"].(map[string]interface{})["containerOverrides"].([]interface{})
+	require.Len(t, containers, 2)
+
+	web := containers[0].(map[string]interface{})
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"type": "s3", "value": "arn:aws:s3:::bucket/web.env"},
+	}, web["environmentFiles"])
+
+	sidecar := containers[1].(map[string]interface{})
+	assert.NotContains(t, sidecar, "environmentFiles")
+	assert.Equal(t, []interface{}{"run"}, sidecar["command"])
+	assert.Equal(t, "nomad", body["cluster"])
+	assert.Equal(t, clientToken("6d9c1a3e/server", 0), body["clientToken"])
+	assert.Equal(t, true, body["enableExecuteCommand"])
+}
+
+func Test_awsEcsClient_RunTask_overridesSize(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		fmt.Fprint(w, `{"tasks":[{"taskArn":"arn:aws:ecs:us-east-1:123456789012:task/nomad/1"}]}`)
+	}))
+	defer srv.Close()
+
+	client := awsEcsClient{cluster: "nomad", ecsClient: ecs.New(testAWSConfig(srv.URL))}
+	_, err := client.RunTask(context.Background(), TaskConfig{Task: ECSTaskConfig{
+		TaskDefinition: "web:1",
+		NetworkConfiguration: TaskNetworkConfiguration{
+			TaskAWSVPCConfiguration: TaskAWSVPCConfiguration{Subnets: []string{"subnet-1"}},
+		},
+		ContainerOverrides: []TaskContainerOverride{
+			{Name: "web", Environment: map[string]string{"CERT": strings.Repeat("a", maxTaskOverridesSize)}},
+		},
+	}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "exceeding the ECS limit of 8192 bytes")
+	assert.Equal(t, 0, requests)
+}
+
+func Test_awsEcsClient_TaskDefinitionJSON(t *testing.T) {
+	var registered map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+
+		switch r.Header.Get("X-Amz-Target") {
+		case "AmazonEC2ContainerServiceV20141113.DescribeTaskDefinition":
+			assert.JSONEq(t, `{"taskDefinition":"web:3","include":["TAGS"]}`, string(data))
+			fmt.Fprint(w, `{"taskDefinition":{"family":"web","revision":3,"runtimePlatform":{"cpuArchitecture":"ARM64"},
+"containerDefinitions":[{"name":"web","image":"nginx:1.21"}]},"tags":[{"key":"team","value":"web"}]}`)
+		case "AmazonEC2ContainerServiceV20141113.RegisterTaskDefinition":
+			_ = json.Unmarshal(data, &registered)
+			fmt.Fprint(w, `{"taskDefinition":{"taskDefinitionArn":"arn:aws:ecs:us-east-1:123456789012:task-definition/web:4"}}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	client := awsEcsClient{cluster: "nomad", ecsClient: ecs.New(testAWSConfig(srv.URL))}
+	def, err := client.DescribeTaskDefinitionJSON(context.Background(), "web:3")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"cpuArchitecture": "ARM64"}, def["runtimePlatform"])
+	assert.Equal(t, json.Number("3"), def["revision"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"key": "team", "value": "web"}}, def["tags"])
+
+	// The object is sent as is, including fields the SDK does not support.
+	delete(def, "revision")
+	out, err := client.RegisterTaskDefinitionJSON(context.Background(), def)
+	require.NoError(t, err)
+	assert.Equal(t, "arn:aws:ecs:us-east-1:123456789012:task-definition/web:4", aws.StringValue(out.TaskDefinitionArn))
+	assert.Equal(t, map[string]interface{}{"cpuArchitecture": "ARM64"}, registered["runtimePlatform"])
+	assert.Equal(t, "web", registered["family"])
+	assert.NotContains(t, registered, "revision")
+}
@@ -0,0 +1,116 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/hashicorp/nomad/drivers/shared/eventer"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// These are the annotation keys added to task events emitted by the driver.
+const (
+	eventAnnotationARN               = "arn"
+	eventAnnotationAvailabilityZone  = "availability_zone"
+	eventAnnotationContainerInstance = "container_instance_arn"
+	eventAnnotationStopCode          = "stop_code"
+	eventAnnotationFailureReason     = "reason"
+	eventAnnotationFailureDetail     = "detail"
+)
+
+// taskObservation is the subset of an ECS task description which is tracked
+// between polls in order to detect lifecycle transitions.
+type taskObservation struct {
+	LastStatus    string
+	DesiredStatus string
+	HealthStatus  string
+	StoppedReason string
+
+	// ContainerHealth maps the name of each container with a health check
+	// to its health status.
+	ContainerHealth map[string]string
+}
+
+func newTaskObservation(task *ecs.Task) taskObservation {
+	return taskObservation{
+		LastStatus:      aws.StringValue(task.LastStatus),
+		DesiredStatus:   aws.StringValue(task.DesiredStatus),
+		HealthStatus:    string(task.HealthStatus),
+		StoppedReason:   aws.StringValue(task.StoppedReason),
+		ContainerHealth: newTaskHealth(task).Containers,
+	}
+}
+
+// transitionMessages returns the task event messages describing the changes
+// between the previous and current observations of an ECS task. A nil
+// previous observation indicates the task has not been observed before.
+func transitionMessages(prev *taskObservation, cur taskObservation) []string {
+	var msgs []string
+
+	switch {
+	case prev == nil && cur.LastStatus != "":
+		msgs = append(msgs, fmt.Sprintf("ECS task status is %s", cur.LastStatus))
+	case prev != nil && prev.LastStatus != cur.LastStatus:
+		msgs = append(msgs, fmt.Sprintf("ECS task status changed from %s to %s",
+			prev.LastStatus, cur.LastStatus))
+	}
+
+	if prev != nil && prev.DesiredStatus != cur.DesiredStatus {
+		msgs = append(msgs, fmt.Sprintf("ECS task desired status changed from %s to %s",
+			prev.DesiredStatus, cur.DesiredStatus))
+	}
+
+	if prev != nil && prev.HealthStatus != cur.HealthStatus && cur.HealthStatus != "" {
+		msgs = append(msgs, fmt.Sprintf("ECS task health changed from %s to %s",
+			prev.HealthStatus, cur.HealthStatus))
+	}
+	if prev != nil {
+		msgs = append(msgs, containerHealthMessages(prev.ContainerHealth, cur.ContainerHealth)...)
+	}
+
+	if cur.StoppedReason != "" && (prev == nil || prev.StoppedReason != cur.StoppedReason) {
+		msgs = append(msgs, fmt.Sprintf("ECS task stopping: %s", cur.StoppedReason))
+	}
+
+	return msgs
+}
+
+// taskEventAnnotations returns the annotations describing where the ECS task
+// is running, for inclusion in task events.
+func taskEventAnnotations(arn string, task *ecs.Task) map[string]string {
+	annotations := map[string]string{eventAnnotationARN: arn}
+	if task == nil {
+		return annotations
+	}
+
+	if az := aws.StringValue(task.AvailabilityZone); az != "" {
+		annotations[eventAnnotationAvailabilityZone] = az
+	}
+	if ci := aws.StringValue(task.ContainerInstanceArn); ci != "" {
+		annotations[eventAnnotationContainerInstance] = ci
+	}
+	if task.StopCode != "" {
+		annotations[eventAnnotationStopCode] = string(task.StopCode)
+	}
+	return annotations
+}
+
+// emitTaskEvent sends a task event for the passed task via the eventer.
+func emitTaskEvent(e *eventer.Eventer, cfg *drivers.TaskConfig, msg string, annotations map[string]string) error {
+	if e == nil {
+		return nil
+	}
+	return e.EmitEvent(&drivers.TaskEvent{
+		TaskID:      cfg.ID,
+		TaskName:    cfg.Name,
+		AllocID:     cfg.AllocID,
+		Timestamp:   time.Now(),
+		Message:     msg,
+		Annotations: annotations,
+	})
+}
@@ -0,0 +1,77 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_transitionMessages(t *testing.T) {
+	testCases := []struct {
+		name             string
+		inputPrev        *taskObservation
+		inputCur         taskObservation
+		expectedMessages []string
+	}{
+		{
+			name:             "first observation",
+			inputPrev:        nil,
+			inputCur:         taskObservation{LastStatus: "PROVISIONING", DesiredStatus: "RUNNING"},
+			expectedMessages: []string{"ECS task status is PROVISIONING"},
+		},
+		{
+			name:             "no change",
+			inputPrev:        &taskObservation{LastStatus: "RUNNING", DesiredStatus: "RUNNING"},
+			inputCur:         taskObservation{LastStatus: "RUNNING", DesiredStatus: "RUNNING"},
+			expectedMessages: nil,
+		},
+		{
+			name:      "status change",
+			inputPrev: &taskObservation{LastStatus: "PENDING", DesiredStatus: "RUNNING", HealthStatus: "UNKNOWN"},
+			inputCur:  taskObservation{LastStatus: "RUNNING", DesiredStatus: "RUNNING", HealthStatus: "HEALTHY"},
+			expectedMessages: []string{
+				"ECS task status changed from PENDING to RUNNING",
+				"ECS task health changed from UNKNOWN to HEALTHY",
+			},
+		},
+		{
+			name: "container health change",
+			inputPrev: &taskObservation{
+				LastStatus:      "RUNNING",
+				HealthStatus:    "HEALTHY",
+				ContainerHealth: map[string]string{"web": "HEALTHY", "sidecar": "HEALTHY"},
+			},
+			inputCur: taskObservation{
+				LastStatus:      "RUNNING",
+				HealthStatus:    "UNHEALTHY",
+				ContainerHealth: map[string]string{"web": "UNHEALTHY", "sidecar": "HEALTHY"},
+			},
+			expectedMessages: []string{
+				"ECS task health changed from HEALTHY to UNHEALTHY",
+				"ECS container web health changed from HEALTHY to UNHEALTHY",
+			},
+		},
+		{
+			name:      "stopping",
+			inputPrev: &taskObservation{LastStatus: "RUNNING", DesiredStatus: "RUNNING"},
+			inputCur: taskObservation{
+				LastStatus:    "RUNNING",
+				DesiredStatus: "STOPPED",
+				StoppedReason: "Essential container in task exited",
+			},
+			expectedMessages: []string{
+				"ECS task desired status changed from RUNNING to STOPPED",
+				"ECS task stopping: Essential container in task exited",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expectedMessages, transitionMessages(tc.inputPrev, tc.inputCur), tc.name)
+		})
+	}
+}
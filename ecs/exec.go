@@ -0,0 +1,147 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// errExecNotEnabled is returned when a command is run in an ECS task which
+// was not run with ECS Exec enabled.
+var errExecNotEnabled = errors.New("ECS Exec is not enabled for this task, see the plugin and task enable_execute_command options")
+
+// executeCommand returns whether the ECS task is run with ECS Exec enabled.
+func (c ECSTaskConfig) executeCommand() bool {
+	return c.EnableExecuteCommand != nil && *c.EnableExecuteCommand
+}
+
+// taskExecuteCommand returns whether the task is run with ECS Exec enabled,
+// which defaults to the plugin enable_execute_command. Tasks may disable it,
+// but may only enable it if the plugin does, as otherwise the driver does not
+// advertise signal and exec support to Nomad.
+func (c *DriverConfig) taskExecuteCommand(t ECSTaskConfig) (bool, error) {
+	if t.EnableExecuteCommand == nil {
+		return c.EnableExecuteCommand, nil
+	}
+	if *t.EnableExecuteCommand && !c.EnableExecuteCommand {
+		return false, errors.New("enable_execute_command requires the plugin enable_execute_command")
+	}
+	return *t.EnableExecuteCommand, nil
+}
+
+// exec runs the command in the ECS task container using ECS Exec, streaming
+// its input and output, and returns the exit code of the command. Commands
+// for which the agent closes the session, having delivered all output,
+// without reporting the exit code are treated as having succeeded.
+func (h *taskHandle) exec(ctx context.Context, opts *drivers.ExecOptions) (int, error) {
+	exitCode, err := h.execIn(ctx, h.execContainer, opts)
+	if errors.Is(err, errNoExitCode) {
+		return 0, nil
+	}
+	return exitCode, err
+}
+
+// signal sends the signal to the main process of the signal container by
+// running kill using ECS Exec.
+func (h *taskHandle) signal(ctx context.Context, sig string) error {
+	name, err := signalName(sig)
+	if err != nil {
+		return err
+	}
+	if !h.execEnabled {
+		return fmt.Errorf("cannot send %s: %v", sig, errExecNotEnabled)
+	}
+
+	container := h.signalContainer
+	if container == "" {
+		container = h.execContainer
+	}
+
+	var output bytes.Buffer
+	exitCode, err := h.execIn(ctx, container, &drivers.ExecOptions{
+		Command: []string{"kill", "-" + name, "1"},
+		Stdout:  nopWriteCloser{&output},
+		Stderr:  nopWriteCloser{&output},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send %s: %v", sig, err)
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("failed to send %s: kill exited with code %d: %s",
+			sig, exitCode, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+// execIn runs the command in the container, which may be empty if the task
+// has a single container.
+func (h *taskHandle) execIn(ctx context.Context, container string, opts *drivers.ExecOptions) (int, error) {
+	if !h.execEnabled {
+		return 0, errExecNotEnabled
+	}
+	if len(opts.Command) == 0 {
+		return 0, errors.New("command is required")
+	}
+
+	session, err := h.ecsClient.ExecuteCommand(ctx, h.arn, container, execCommandLine(opts.Command))
+	if err != nil {
+		return 0, fmt.Errorf("failed to execute command in ECS task: %v", err)
+	}
+
+	s, err := dialSSMSession(ctx, session)
+	if err != nil {
+		return 0, err
+	}
+	return s.run(ctx, opts)
+}
+
+// signalNames are the signals which can be sent to ECS tasks, using the
+// names accepted by kill.
+var signalNames = map[string]struct{}{
+	"HUP": {}, "INT": {}, "QUIT": {}, "ILL": {}, "TRAP": {}, "ABRT": {}, "BUS": {},
+	"FPE": {}, "KILL": {}, "USR1": {}, "SEGV": {}, "USR2": {}, "PIPE": {}, "ALRM": {},
+	"TERM": {}, "CHLD": {}, "CONT": {}, "STOP": {}, "TSTP": {}, "TTIN": {}, "TTOU": {},
+	"URG": {}, "XCPU": {}, "XFSZ": {}, "VTALRM": {}, "PROF": {}, "WINCH": {}, "IO": {},
+	"SYS": {},
+}
+
+// signalName returns the kill signal name of the Nomad signal, such as HUP
+// for SIGHUP.
+func signalName(sig string) (string, error) {
+	name := strings.TrimPrefix(strings.ToUpper(sig), "SIG")
+	if _, ok := signalNames[name]; !ok {
+		return "", fmt.Errorf("unsupported signal %q", sig)
+	}
+	return name, nil
+}
+
+// execCommandLine joins the command arguments into the single command line
+// which ECS Exec accepts, quoting any arguments which the SSM agent would
+// otherwise split or interpret.
+func execCommandLine(command []string) string {
+	args := make([]string, len(command))
+	for i, arg := range command {
+		if arg != "" && !strings.ContainsAny(arg, " \t\n'\"\\$`;&|<>()*?[]{}~#!") {
+			args[i] = arg
+			continue
+		}
+		args[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(args, " ")
+}
+
+// nopWriteCloser adds a no-op Close method to a writer, allowing buffers to
+// be used as exec output streams.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
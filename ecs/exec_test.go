@@ -0,0 +1,513 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+// testSSMToken is the session token which the stand-in agent accepts.
+const testSSMToken = "token"
+
+// These are the exit codes which change how the stand-in agent ends the
+// session.
+const (
+	standInNoExitCode = -1
+	standInDisconnect = -2
+)
+
+// ssmAgentStandIn is a local stand-in for the agent side of the SSM session
+// data channel. It performs the handshake and then runs the command: cat
+// echoes stdin until the end of transmission, and anything else writes the
+// command line to stdout and a warning to stderr, delivering them out of
+// order and duplicated, before exiting with the exit code. The exit code is
+// not reported if it is standInNoExitCode, and the connection is dropped
+// without closing the channel if it is standInDisconnect.
+type ssmAgentStandIn struct {
+	command  string
+	exitCode int
+
+	lock  sync.Mutex
+	acks  int
+	sizes []ssmTerminalSize
+}
+
+func newSSMAgentStandIn(t *testing.T, command string, exitCode int) (*ssmAgentStandIn, *httptest.Server) {
+	agent := &ssmAgentStandIn{command: command, exitCode: exitCode}
+	srv := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		if err := agent.serve(ws); err != nil {
+			t.Errorf("stand-in agent: %v", err)
+		}
+	}))
+	return agent, srv
+}
+
+func (a *ssmAgentStandIn) serve(ws *websocket.Conn) error {
+	defer ws.Close()
+
+	var open ssmOpenDataChannel
+	if err := websocket.JSON.Receive(ws, &open); err != nil {
+		return err
+	}
+	if open.TokenValue != testSSMToken {
+		return fmt.Errorf("unexpected token %q", open.TokenValue)
+	}
+
+	inputs := make(chan *ssmMessage)
+	go func() {
+		defer close(inputs)
+		for {
+			var buf []byte
+			if err := websocket.Message.Receive(ws, &buf); err != nil {
+				return
+			}
+			msg, err := unmarshalSSMMessage(buf)
+			if err != nil {
+				return
+			}
+			switch {
+			case msg.MessageType == ssmMessageAcknowledge:
+				a.lock.Lock()
+				a.acks++
+				a.lock.Unlock()
+			case msg.PayloadType == ssmPayloadSize:
+				var size ssmTerminalSize
+				_ = json.Unmarshal(msg.Payload, &size)
+				a.lock.Lock()
+				a.sizes = append(a.sizes, size)
+				a.lock.Unlock()
+			default:
+				inputs <- msg
+			}
+		}
+	}()
+
+	var sequence int64
+	send := func(payloadType uint32, payload string) *ssmMessage {
+		msg := &ssmMessage{
+			MessageType:    ssmMessageOutput,
+			SchemaVersion:  ssmSchemaVersion,
+			CreatedDate:    time.Now(),
+			SequenceNumber: sequence,
+			MessageID:      newUUID(),
+			PayloadType:    payloadType,
+			Payload:        []byte(payload),
+		}
+		sequence++
+		return msg
+	}
+	write := func(msgs ...*ssmMessage) error {
+		for _, msg := range msgs {
+			if err := websocket.Message.Send(ws, msg.marshal()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := write(send(ssmPayloadHandshakeRequest,
+		`{"AgentVersion":"3.1.0.0","RequestedClientActions":[{"ActionType":"SessionType"}]}`)); err != nil {
+		return err
+	}
+	resp := <-inputs
+	if resp == nil || resp.PayloadType != ssmPayloadHandshakeResponse {
+		return fmt.Errorf("expected handshake response, got %v", resp)
+	}
+	if err := write(send(ssmPayloadHandshakeComplete, `{}`)); err != nil {
+		return err
+	}
+
+	if a.command == "cat" {
+		for msg := range inputs {
+			if bytes.Equal(msg.Payload, []byte{ssmEndOfTransmission}) {
+				break
+			}
+			if err := write(send(ssmPayloadOutput, string(msg.Payload))); err != nil {
+				return err
+			}
+		}
+		return a.close(write, inputs)
+	}
+
+	stdout := send(ssmPayloadOutput, "ran "+a.command+"\r\n")
+	stderr := send(ssmPayloadStdErr, "warning\n")
+	msgs := []*ssmMessage{stderr, stdout, stdout}
+	if a.exitCode >= 0 {
+		msgs = append(msgs, send(ssmPayloadExitCode, strconv.Itoa(a.exitCode)))
+	}
+	if err := write(msgs...); err != nil {
+		return err
+	}
+	if a.exitCode == standInDisconnect {
+		return nil
+	}
+	return a.close(write, inputs)
+}
+
+// close closes the channel and waits for the client to disconnect, so that
+// all acknowledgements have been received.
+func (a *ssmAgentStandIn) close(write func(...*ssmMessage) error, inputs <-chan *ssmMessage) error {
+	if err := write(&ssmMessage{MessageType: ssmMessageChannelClosed, MessageID: newUUID()}); err != nil {
+		return err
+	}
+	for range inputs {
+	}
+	return nil
+}
+
+func (a *ssmAgentStandIn) acknowledged() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.acks
+}
+
+func (a *ssmAgentStandIn) terminalSizes() []ssmTerminalSize {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.sizes
+}
+
+func newExecTestDriver(client *mockECSClient, ts TaskState) *Driver {
+	d := &Driver{ctx: context.Background(), tasks: newTaskStore()}
+	ts.ARN = "arn"
+	h := newTaskHandle(hclog.NewNullLogger(), ts,
+		&drivers.TaskConfig{ID: "alloc/web/1", Name: "web"}, client, nil, nil, nil)
+	d.tasks.Set("alloc/web/1", h)
+	return d
+}
+
+func Test_execCommandLine(t *testing.T) {
+	testCases := []struct {
+		inputCommand []string
+		expected     string
+	}{
+		{inputCommand: []string{"/bin/sh"}, expected: "/bin/sh"},
+		{inputCommand: []string{"ls", "-la", "/tmp"}, expected: "ls -la /tmp"},
+		{inputCommand: []string{"sh", "-c", "echo $HOME"}, expected: "sh -c 'echo $HOME'"},
+		{inputCommand: []string{"echo", "it's"}, expected: `echo 'it'\''s'`},
+		{inputCommand: []string{"echo", ""}, expected: "echo ''"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(strings.Join(tc.inputCommand, " "), func(t *testing.T) {
+			assert.Equal(t, tc.expected, execCommandLine(tc.inputCommand))
+		})
+	}
+}
+
+func Test_Driver_ExecTask(t *testing.T) {
+	agent, srv := newSSMAgentStandIn(t, "ls -la", 3)
+	defer srv.Close()
+
+	client := newMockECSClient()
+	client.execSession = &execSession{
+		SessionID:  aws.String("ecs-execute-command-1"),
+		StreamURL:  aws.String("ws://" + srv.Listener.Addr().String() + "/v1/data-channel/ecs-execute-command-1"),
+		TokenValue: aws.String(testSSMToken),
+	}
+	d := newExecTestDriver(client, TaskState{EnableExecuteCommand: true, ExecContainer: "web"})
+
+	result, err := d.ExecTask("alloc/web/1", []string{"ls", "-la"}, 5*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"arn/web: ls -la"}, client.execCommands)
+	assert.Equal(t, "ran ls -la\r\n", string(result.Stdout))
+	assert.Equal(t, "warning\n", string(result.Stderr))
+	assert.Equal(t, 3, result.ExitResult.ExitCode)
+
+	// Every output message is acknowledged, including the duplicate.
+	require.Eventually(t, func() bool { return agent.acknowledged() == 6 }, time.Second, 10*time.Millisecond)
+
+	_, err = d.ExecTask("alloc/web/2", []string{"ls"}, time.Second)
+	assert.Equal(t, drivers.ErrTaskNotFound, err)
+}
+
+func Test_Driver_ExecTask_exitCode(t *testing.T) {
+	testCases := []struct {
+		name             string
+		inputExitCode    int
+		expectedExitCode int
+		expectedError    string
+	}{
+		{
+			name:             "closed without exit code",
+			inputExitCode:    standInNoExitCode,
+			expectedExitCode: 0,
+		},
+		{
+			name:          "disconnected before exit code",
+			inputExitCode: standInDisconnect,
+			expectedError: "exec session ecs-execute-command-1 disconnected before the command exited",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, srv := newSSMAgentStandIn(t, "ls", tc.inputExitCode)
+			defer srv.Close()
+
+			client := newMockECSClient()
+			client.execSession = &execSession{
+				SessionID:  aws.String("ecs-execute-command-1"),
+				StreamURL:  aws.String("ws://" + srv.Listener.Addr().String() + "/v1/data-channel/ecs-execute-command-1"),
+				TokenValue: aws.String(testSSMToken),
+			}
+			d := newExecTestDriver(client, TaskState{EnableExecuteCommand: true})
+
+			result, err := d.ExecTask("alloc/web/1", []string{"ls"}, 5*time.Second)
+			if tc.expectedError != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedExitCode, result.ExitResult.ExitCode)
+		})
+	}
+}
+
+func Test_Driver_ExecTaskStreaming(t *testing.T) {
+	agent, srv := newSSMAgentStandIn(t, "cat", 0)
+	defer srv.Close()
+
+	client := newMockECSClient()
+	client.execSession = &execSession{
+		SessionID:  aws.String("ecs-execute-command-1"),
+		StreamURL:  aws.String("ws://" + srv.Listener.Addr().String() + "/v1/data-channel/ecs-execute-command-1"),
+		TokenValue: aws.String(testSSMToken),
+	}
+	d := newExecTestDriver(client, TaskState{EnableExecuteCommand: true, ExecContainer: "web"})
+
+	resizeCh := make(chan drivers.TerminalSize, 1)
+	resizeCh <- drivers.TerminalSize{Width: 120, Height: 40}
+
+	var stdout bytes.Buffer
+	result, err := d.ExecTaskStreaming(context.Background(), "alloc/web/1", &drivers.ExecOptions{
+		Command:  []string{"cat"},
+		Tty:      true,
+		Stdin:    ioutil.NopCloser(strings.NewReader("hello\n")),
+		Stdout:   nopWriteCloser{&stdout},
+		Stderr:   nopWriteCloser{ioutil.Discard},
+		ResizeCh: resizeCh,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 0, result.ExitCode)
+	assert.Equal(t, "hello\n", stdout.String())
+	require.Eventually(t, func() bool { return len(agent.terminalSizes()) > 0 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []ssmTerminalSize{{Cols: 120, Rows: 40}}, agent.terminalSizes())
+}
+
+func Test_Driver_ExecTask_notEnabled(t *testing.T) {
+	client := newMockECSClient()
+	d := newExecTestDriver(client, TaskState{})
+
+	_, err := d.ExecTask("alloc/web/1", []string{"ls"}, time.Second)
+	assert.Equal(t, errExecNotEnabled, err)
+	assert.Empty(t, client.execCommands)
+}
+
+func Test_Driver_SignalTask(t *testing.T) {
+	testCases := []struct {
+		name             string
+		inputSignal      string
+		inputState       TaskState
+		inputExitCode    int
+		expectedCommands []string
+		expectedError    string
+	}{
+		{
+			name:             "exec container",
+			inputSignal:      "SIGHUP",
+			inputState:       TaskState{EnableExecuteCommand: true, ExecContainer: "web"},
+			expectedCommands: []string{"arn/web: kill -HUP 1"},
+		},
+		{
+			name:             "signal container",
+			inputSignal:      "SIGUSR1",
+			inputState:       TaskState{EnableExecuteCommand: true, ExecContainer: "web", SignalContainer: "app"},
+			expectedCommands: []string{"arn/app: kill -USR1 1"},
+		},
+		{
+			name:             "kill fails",
+			inputSignal:      "SIGTERM",
+			inputState:       TaskState{EnableExecuteCommand: true},
+			inputExitCode:    1,
+			expectedCommands: []string{"arn/: kill -TERM 1"},
+			expectedError:    "failed to send SIGTERM: kill exited with code 1: ran kill\r\nwarning",
+		},
+		{
+			name:             "exit code not reported",
+			inputSignal:      "SIGTERM",
+			inputState:       TaskState{EnableExecuteCommand: true},
+			inputExitCode:    standInNoExitCode,
+			expectedCommands: []string{"arn/: kill -TERM 1"},
+			expectedError:    "failed to send SIGTERM: " + errNoExitCode.Error(),
+		},
+		{
+			name:          "unsupported signal",
+			inputSignal:   "SIGHUP; rm -rf /",
+			inputState:    TaskState{EnableExecuteCommand: true},
+			expectedError: `unsupported signal "SIGHUP; rm -rf /"`,
+		},
+		{
+			name:          "exec not enabled",
+			inputSignal:   "SIGHUP",
+			expectedError: "cannot send SIGHUP: " + errExecNotEnabled.Error(),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, srv := newSSMAgentStandIn(t, "kill", tc.inputExitCode)
+			defer srv.Close()
+
+			client := newMockECSClient()
+			client.execSession = &execSession{
+				SessionID:  aws.String("ecs-execute-command-1"),
+				StreamURL:  aws.String("ws://" + srv.Listener.Addr().String() + "/v1/data-channel/ecs-execute-command-1"),
+				TokenValue: aws.String(testSSMToken),
+			}
+			d := newExecTestDriver(client, tc.inputState)
+
+			err := d.SignalTask("alloc/web/1", tc.inputSignal)
+			assert.Equal(t, tc.expectedCommands, client.execCommands)
+			if tc.expectedError == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tc.expectedError)
+		})
+	}
+}
+
+func Test_DriverConfig_taskExecuteCommand(t *testing.T) {
+	testCases := []struct {
+		name          string
+		inputPlugin   bool
+		inputTask     *bool
+		expected      bool
+		expectedError string
+	}{
+		{
+			name: "disabled by default",
+		},
+		{
+			name:        "plugin default",
+			inputPlugin: true,
+			expected:    true,
+		},
+		{
+			name:        "disabled by task",
+			inputPlugin: true,
+			inputTask:   aws.Bool(false),
+		},
+		{
+			name:          "enabled by task only",
+			inputTask:     aws.Bool(true),
+			expectedError: "enable_execute_command requires the plugin enable_execute_command",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := DriverConfig{EnableExecuteCommand: tc.inputPlugin}
+			enabled, err := config.taskExecuteCommand(ECSTaskConfig{EnableExecuteCommand: tc.inputTask})
+			if tc.expectedError != "" {
+				require.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, enabled)
+
+			// Signals and exec are only advertised when the plugin enables
+			// ECS Exec.
+			d := &Driver{config: &config}
+			caps, err := d.Capabilities()
+			require.NoError(t, err)
+			assert.Equal(t, tc.inputPlugin, caps.SendSignals)
+			assert.Equal(t, tc.inputPlugin, caps.Exec)
+		})
+	}
+}
+
+func Test_ssmMessage_marshal(t *testing.T) {
+	msg := &ssmMessage{
+		MessageType:    ssmMessageInput,
+		SchemaVersion:  ssmSchemaVersion,
+		CreatedDate:    time.Unix(1600000000, 123000000),
+		SequenceNumber: 7,
+		Flags:          1,
+		MessageID:      newUUID(),
+		PayloadType:    ssmPayloadSize,
+		Payload:        []byte(`{"cols":80,"rows":24}`),
+	}
+
+	buf := msg.marshal()
+	assert.Len(t, buf, 120+len(msg.Payload))
+	assert.Equal(t, "input_stream_data               ", string(buf[4:36]))
+
+	decoded, err := unmarshalSSMMessage(buf)
+	require.NoError(t, err)
+	assert.Equal(t, msg.MessageType, decoded.MessageType)
+	assert.True(t, msg.CreatedDate.Equal(decoded.CreatedDate))
+	assert.Equal(t, msg.SequenceNumber, decoded.SequenceNumber)
+	assert.Equal(t, msg.MessageID, decoded.MessageID)
+	assert.Equal(t, msg.PayloadType, decoded.PayloadType)
+	assert.Equal(t, msg.Payload, decoded.Payload)
+
+	// A corrupted payload fails the digest check.
+	buf[len(buf)-1] = '!'
+	_, err = unmarshalSSMMessage(buf)
+	assert.Error(t, err)
+
+	_, err = unmarshalSSMMessage(buf[:50])
+	assert.Error(t, err)
+}
+
+func Test_awsEcsClient_ExecuteCommand(t *testing.T) {
+	var target string
+	var body map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target = r.Header.Get("X-Amz-Target")
+		data, _ := ioutil.ReadAll(r.Body)
+		_ = json.Unmarshal(data, &body)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		fmt.Fprint(w, `{"session":{"sessionId":"s-1","streamUrl":"wss://ssmmessages/v1/data-channel/s-1","tokenValue":"token"}}`)
+	}))
+	defer srv.Close()
+
+	client := awsEcsClient{cluster: "nomad", ecsClient: ecs.New(testAWSConfig(srv.URL))}
+	session, err := client.ExecuteCommand(context.Background(), "arn", "web", "ls -la")
+	require.NoError(t, err)
+	assert.Equal(t, "s-1", aws.StringValue(session.SessionID))
+	assert.Equal(t, "wss://ssmmessages/v1/data-channel/s-1", aws.StringValue(session.StreamURL))
+	assert.Equal(t, "token", aws.StringValue(session.TokenValue))
+
+	assert.Equal(t, "AmazonEC2ContainerServiceV20141113.ExecuteCommand", target)
+	assert.Equal(t, map[string]interface{}{
+		"cluster":     "nomad",
+		"container":   "web",
+		"command":     "ls -la",
+		"interactive": true,
+		"task":        "arn",
+	}, body)
+}
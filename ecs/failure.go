@@ -0,0 +1,127 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+)
+
+// These represent the ECS RunTask failure reasons, or reason prefixes, which
+// indicate a lack of capacity rather than a problem with the task
+// configuration. Tasks which fail for these reasons may succeed if placed
+// again at a later time.
+const (
+	ecsFailureReasonResourcePrefix = "RESOURCE:"
+	ecsFailureReasonAgent          = "AGENT"
+	ecsFailureReasonCapacity       = "Capacity is unavailable"
+)
+
+// ecsFailureReasonMissing is the DescribeTasks failure reason of a task which
+// ECS does not know of. As ECS is eventually consistent, a task may briefly be
+// reported as missing after it was run.
+const ecsFailureReasonMissing = "MISSING"
+
+// runTaskFailure is a single failure returned by ECS within the RunTask
+// response.
+type runTaskFailure struct {
+	ARN    string
+	Reason string
+	Detail string
+}
+
+// newRunTaskFailure converts the AWS SDK failure object into a runTaskFailure.
+func newRunTaskFailure(f ecs.Failure) runTaskFailure {
+	var failure runTaskFailure
+	if f.Arn != nil {
+		failure.ARN = *f.Arn
+	}
+	if f.Reason != nil {
+		failure.Reason = *f.Reason
+	}
+	if f.Detail != nil {
+		failure.Detail = *f.Detail
+	}
+	return failure
+}
+
+// Retryable returns whether the failure was caused by a transient lack of
+// capacity, and therefore whether running the task again may succeed.
+func (f runTaskFailure) Retryable() bool {
+	switch {
+	case strings.HasPrefix(f.Reason, ecsFailureReasonResourcePrefix),
+		f.Reason == ecsFailureReasonAgent,
+		strings.HasPrefix(f.Reason, ecsFailureReasonCapacity):
+		return true
+	default:
+		return false
+	}
+}
+
+func (f runTaskFailure) String() string {
+	s := f.Reason
+	if f.Detail != "" {
+		s = fmt.Sprintf("%s (%s)", s, f.Detail)
+	}
+	if f.ARN != "" {
+		s = fmt.Sprintf("%s: %s", f.ARN, s)
+	}
+	return s
+}
+
+// runTaskError is returned by RunTask when ECS was unable to place the task.
+// It wraps all the failures reported by ECS so that callers can decide how to
+// handle the error.
+type runTaskError struct {
+	Failures []runTaskFailure
+}
+
+// newRunTaskError builds a runTaskError from the failures contained within an
+// ECS RunTask response.
+func newRunTaskError(failures []ecs.Failure) *runTaskError {
+	err := runTaskError{Failures: make([]runTaskFailure, 0, len(failures))}
+	for _, f := range failures {
+		err.Failures = append(err.Failures, newRunTaskFailure(f))
+	}
+	return &err
+}
+
+func (e *runTaskError) Error() string {
+	if len(e.Failures) == 0 {
+		return "ECS did not return a task or any failures"
+	}
+
+	reasons := make([]string, 0, len(e.Failures))
+	for _, f := range e.Failures {
+		reasons = append(reasons, f.String())
+	}
+	return fmt.Sprintf("ECS failed to place task: %s", strings.Join(reasons, "; "))
+}
+
+// Retryable returns true if every failure within the error is retryable. A
+// single permanent failure means running the task again will not succeed.
+func (e *runTaskError) Retryable() bool {
+	if len(e.Failures) == 0 {
+		return false
+	}
+	for _, f := range e.Failures {
+		if !f.Retryable() {
+			return false
+		}
+	}
+	return true
+}
+
+// describeTaskError is returned by DescribeTask when ECS reports a failure
+// describing the task within the response, such as the task being missing,
+// rather than the request failing.
+type describeTaskError struct {
+	Reason string
+}
+
+func (e *describeTaskError) Error() string {
+	return fmt.Sprintf("failed to describe ECS task: %s", e.Reason)
+}
@@ -0,0 +1,61 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_runTaskError(t *testing.T) {
+	testCases := []struct {
+		name              string
+		inputFailures     []ecs.Failure
+		expectedRetryable bool
+		expectedError     string
+	}{
+		{
+			name:              "no failures",
+			inputFailures:     nil,
+			expectedRetryable: false,
+			expectedError:     "ECS did not return a task or any failures",
+		},
+		{
+			name: "memory resource",
+			inputFailures: []ecs.Failure{
+				{Arn: aws.String("arn:aws:ecs:us-east-1:123:container-instance/abc"), Reason: aws.String("RESOURCE:MEMORY")},
+			},
+			expectedRetryable: true,
+			expectedError:     "ECS failed to place task: arn:aws:ecs:us-east-1:123:container-instance/abc: RESOURCE:MEMORY",
+		},
+		{
+			name: "fargate capacity",
+			inputFailures: []ecs.Failure{
+				{Reason: aws.String("Capacity is unavailable at this time. Please try again later or in a different availability zone")},
+			},
+			expectedRetryable: true,
+			expectedError:     "ECS failed to place task: Capacity is unavailable at this time. Please try again later or in a different availability zone",
+		},
+		{
+			name: "mixed retryable and permanent",
+			inputFailures: []ecs.Failure{
+				{Reason: aws.String("AGENT")},
+				{Reason: aws.String("MISSING"), Detail: aws.String("task definition not found")},
+			},
+			expectedRetryable: false,
+			expectedError:     "ECS failed to place task: AGENT; MISSING (task definition not found)",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := newRunTaskError(tc.inputFailures)
+			assert.Equal(t, tc.expectedRetryable, err.Retryable(), tc.name)
+			assert.Equal(t, tc.expectedError, err.Error(), tc.name)
+		})
+	}
+}
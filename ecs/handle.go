@@ -5,13 +5,19 @@ package ecs
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/nomad/client/lib/fifo"
-	"github.com/hashicorp/nomad/client/stats"
+	"github.com/hashicorp/nomad/drivers/shared/eventer"
 	"github.com/hashicorp/nomad/plugins/drivers"
 )
 
@@ -23,48 +29,164 @@ const (
 	ecsTaskStatusStopped        = "STOPPED"
 )
 
-type taskHandle struct {
-	arn       string
-	logger    hclog.Logger
-	ecsClient ecsClientInterface
+// ecsContainerReasonOOM is the prefix of the reason ECS attaches to a
+// container which was killed due to exceeding its memory limit.
+const ecsContainerReasonOOM = "OutOfMemoryError"
 
-	totalCpuStats  *stats.CpuStats
-	userCpuStats   *stats.CpuStats
-	systemCpuStats *stats.CpuStats
+const (
+	// maxStopTimeout is the maximum time, in seconds, ECS supports waiting
+	// for a container to exit after sending SIGTERM.
+	maxStopTimeout = 120
+
+	// ecsStopGracePeriod is the time allowed, in addition to the Nomad kill
+	// timeout, for ECS to deprovision the task once its containers have
+	// exited.
+	ecsStopGracePeriod = 30 * time.Second
+
+	// signalTimeout is the maximum time to wait for a signal to be sent
+	// using ECS Exec.
+	signalTimeout = 30 * time.Second
+
+	// stopTaskPollInterval is the interval at which the ECS task status is
+	// checked while waiting for it to stop.
+	stopTaskPollInterval = 5 * time.Second
+)
+
+type taskHandle struct {
+	arn        string
+	cluster    string
+	region     string
+	logger     hclog.Logger
+	ecsClient  ecsClientInterface
+	logsClient logsClientInterface
+	eventer    *eventer.Eventer
+	poller     *taskPoller
+
+	// logCursorPath is the file used to persist the log forwarding position.
+	logCursorPath string
+
+	// registeredTaskDefinition is the ARN of the task definition registered
+	// by the driver for this task, if any.
+	registeredTaskDefinition string
+
+	// capacityProvider is the capacity provider used to place the ECS task,
+	// if any.
+	capacityProvider string
+
+	// execEnabled is whether the ECS task was run with ECS Exec enabled,
+	// execContainer is the container commands are run in and
+	// signalContainer is the container signals are sent to. The containers
+	// may be empty if the task has a single container, and signals are sent
+	// to the exec container unless a signal container is set.
+	execEnabled     bool
+	execContainer   string
+	signalContainer string
+
+	// roleARN is the role the task assumes using its workload identity, if
+	// any, whose credentials ecsClient uses.
+	roleARN string
+
+	// stopTimeout is the time ECS waits for the containers to exit after
+	// being stopped, if set by the task stop_timeout.
+	stopTimeout time.Duration
 
 	// stateLock syncs access to all fields below
 	stateLock sync.RWMutex
 
 	taskConfig  *drivers.TaskConfig
+	network     *drivers.DriverNetwork
 	procState   drivers.TaskState
 	startedAt   time.Time
 	completedAt time.Time
 	exitResult  *drivers.ExitResult
 	doneCh      chan struct{}
 
+	// snapshot is the latest description of the ECS task, from which the
+	// task status driver attributes are built. It is nil until the task has
+	// been described.
+	snapshot *ecs.Task
+
+	// taskDefinition and essential are read from the task definition of the
+	// ECS task. They are only accessed by the run loop.
+	taskDefinition *ecs.TaskDefinition
+	essential      map[string]struct{}
+
+	// logsCancel stops the log forwarder, which closes logsDoneCh once it has
+	// flushed the remaining events. Both are nil if no container logs are
+	// being forwarded. They are only accessed by the run loop.
+	logsCancel context.CancelFunc
+	logsDoneCh chan struct{}
+
+	// lastObservation is the previously observed ECS task state, used to
+	// emit task events on transitions. It is only accessed by the run loop.
+	lastObservation *taskObservation
+
+	// unhealthy fails the task once ECS reports it as UNHEALTHY too many
+	// consecutive times. It is only accessed by the run loop.
+	unhealthy unhealthyPolicy
+
 	// detach from ecs task instead of killing it if true.
 	detach bool
 
+	// killTimeout is the Nomad kill timeout passed when stopping the task,
+	// which bounds the wait for the ECS task to stop along with
+	// ecsStopGracePeriod.
+	killTimeout time.Duration
+
+	// stopErr is the error stopping the ECS task, if any.
+	stopErr error
+
+	// stopPollInterval is the interval at which the ECS task status is
+	// checked while waiting for it to stop.
+	stopPollInterval time.Duration
+
 	ctx    context.Context
 	cancel context.CancelFunc
+
+	// destroyCtx is cancelled when the handle is destroyed, abandoning any
+	// wait for the ECS task to stop so the run loop exits promptly.
+	destroyCtx    context.Context
+	destroyCancel context.CancelFunc
 }
 
-func newTaskHandle(logger hclog.Logger, ts TaskState, taskConfig *drivers.TaskConfig, ecsClient ecsClientInterface) *taskHandle {
+func newTaskHandle(logger hclog.Logger, ts TaskState, taskConfig *drivers.TaskConfig,
+	ecsClient ecsClientInterface, logsClient logsClientInterface, eventer *eventer.Eventer,
+	poller *taskPoller) *taskHandle {
 	ctx, cancel := context.WithCancel(context.Background())
+	destroyCtx, destroyCancel := context.WithCancel(context.Background())
 	logger = logger.Named("handle").With("arn", ts.ARN)
 
 	h := &taskHandle{
-		arn:        ts.ARN,
-		ecsClient:  ecsClient,
-		taskConfig: taskConfig,
-		procState:  drivers.TaskStateRunning,
-		startedAt:  ts.StartedAt,
-		exitResult: &drivers.ExitResult{},
-		logger:     logger,
-		doneCh:     make(chan struct{}),
-		detach:     false,
-		ctx:        ctx,
-		cancel:     cancel,
+		arn:           ts.ARN,
+		cluster:       ts.Cluster,
+		region:        ts.Region,
+		ecsClient:     ecsClient,
+		logsClient:    logsClient,
+		eventer:       eventer,
+		poller:        poller,
+		logCursorPath: ts.LogCursorPath,
+
+		registeredTaskDefinition: ts.RegisteredTaskDefinition,
+		capacityProvider:         ts.CapacityProvider,
+		unhealthy:                unhealthyPolicy{threshold: ts.UnhealthyThreshold},
+		execEnabled:              ts.EnableExecuteCommand,
+		execContainer:            ts.ExecContainer,
+		signalContainer:          ts.SignalContainer,
+		roleARN:                  ts.RoleARN,
+		stopTimeout:              time.Duration(ts.StopTimeout) * time.Second,
+		taskConfig:               taskConfig,
+		network:                  ts.Network,
+		procState:                drivers.TaskStateRunning,
+		startedAt:                ts.StartedAt,
+		exitResult:               &drivers.ExitResult{},
+		logger:                   logger,
+		doneCh:                   make(chan struct{}),
+		detach:                   false,
+		stopPollInterval:         stopTaskPollInterval,
+		ctx:                      ctx,
+		cancel:                   cancel,
+		destroyCtx:               destroyCtx,
+		destroyCancel:            destroyCancel,
 	}
 
 	return h
@@ -74,16 +196,39 @@ func (h *taskHandle) TaskStatus() *drivers.TaskStatus {
 	h.stateLock.RLock()
 	defer h.stateLock.RUnlock()
 
+	// Exec and signals are only supported for tasks run with ECS Exec, but
+	// driver capabilities apply to all tasks, so report it per task.
+	attrs := map[string]string{
+		attrARN:            h.arn,
+		attrCluster:        h.cluster,
+		attrExecuteCommand: strconv.FormatBool(h.execEnabled),
+	}
+	if h.region != "" {
+		attrs[attrRegion] = h.region
+	}
+	if h.roleARN != "" {
+		attrs[attrRoleARN] = h.roleARN
+	}
+	if h.network != nil {
+		attrs[attrPrivateIP] = h.network.IP
+	}
+	if h.capacityProvider != "" {
+		attrs[attrCapacityProvider] = h.capacityProvider
+	}
+	if h.snapshot != nil {
+		for k, v := range taskAttributes(h.snapshot) {
+			attrs[k] = v
+		}
+	}
+
 	return &drivers.TaskStatus{
-		ID:          h.taskConfig.ID,
-		Name:        h.taskConfig.Name,
-		State:       h.procState,
-		StartedAt:   h.startedAt,
-		CompletedAt: h.completedAt,
-		ExitResult:  h.exitResult,
-		DriverAttributes: map[string]string{
-			"arn": h.arn,
-		},
+		ID:               h.taskConfig.ID,
+		Name:             h.taskConfig.Name,
+		State:            h.procState,
+		StartedAt:        h.startedAt,
+		CompletedAt:      h.completedAt,
+		ExitResult:       h.exitResult,
+		DriverAttributes: attrs,
 	}
 }
 
@@ -101,7 +246,8 @@ func (h *taskHandle) run() {
 	}
 	h.stateLock.Unlock()
 
-	// Open the tasks StdoutPath so we can write task health status updates.
+	// Open the tasks StdoutPath so we can write the container logs, or task
+	// health status updates if the logs are not available.
 	f, err := fifo.OpenWriter(h.taskConfig.StdoutPath)
 	if err != nil {
 		h.handleRunError(err, "failed to open task stdout path")
@@ -115,33 +261,81 @@ func (h *taskHandle) run() {
 		}
 	}()
 
+	// Open the tasks StderrPath so we can write log forwarding errors.
+	ef, err := fifo.OpenWriter(h.taskConfig.StderrPath)
+	if err != nil {
+		h.handleRunError(err, "failed to open task stderr path")
+		return
+	}
+
+	defer func() {
+		if err := ef.Close(); err != nil {
+			h.logger.Error("failed to close task stderr handle correctly", "error", err)
+		}
+	}()
+
+	// Ensure the log forwarder has flushed before the output handles are
+	// closed.
+	defer h.stopLogForwarder()
+
+	// Subscribe to the driver poller which describes the ECS task status
+	// in batches with all other tasks of the cluster. Tasks which assume a
+	// role are only batched with those of the same role, as their clients
+	// use its credentials.
+	batch := clusterRef{Region: h.region, Cluster: h.cluster}.String()
+	if h.roleARN != "" {
+		batch += "/" + h.roleARN
+	}
+	updates := h.poller.Subscribe(batch, h.ecsClient, h.arn)
+	defer h.poller.Unsubscribe(h.arn)
+
 	// Block until stopped.
 	for h.ctx.Err() == nil {
 		select {
-		case <-time.After(5 * time.Second):
-
-			status, err := h.ecsClient.DescribeTaskStatus(h.ctx, h.arn)
-			if err != nil {
-				h.handleRunError(err, "failed to find ECS task")
+		case update := <-updates:
+			if update.Err != nil {
+				h.handleRunError(update.Err, "failed to find ECS task")
 				return
 			}
+			task := update.Task
+			status := aws.StringValue(task.LastStatus)
+			h.emitTransitionEvents(task)
+			h.setSnapshot(task)
+
+			if h.logsDoneCh == nil {
+				h.startLogForwarder(task, f, ef)
+			}
 
 			// Write the health status before checking what it is ensures the
 			// alloc logs include the health during the ECS tasks terminal
-			// phase.
-			now := time.Now().Format(time.RFC3339)
-			if _, err := fmt.Fprintf(f, "[%s] - client is remotely monitoring ECS task: %v with status %v\n",
-				now, h.arn, status); err != nil {
-				h.handleRunError(err, "failed to write to stdout")
+			// phase. This is skipped when the container logs are forwarded, so
+			// the application output is not interleaved with status updates.
+			if h.logsDoneCh == nil {
+				now := time.Now().Format(time.RFC3339)
+				if _, err := fmt.Fprintf(f, "[%s] - client is remotely monitoring ECS task: %v with status %v\n",
+					now, h.arn, status); err != nil {
+					h.handleRunError(err, "failed to write to stdout")
+				}
 			}
 
 			// ECS task has terminal status phase, meaning the task is going to
 			// stop. If we are in this phase, the driver should exit and pass
-			// this to the servers so that a new allocation, and ECS task can
-			// be started.
-			if status == ecsTaskStatusDeactivating || status == ecsTaskStatusStopping ||
-				status == ecsTaskStatusDeprovisioning || status == ecsTaskStatusStopped {
-				h.handleRunError(fmt.Errorf("ECS task status in terminal phase"), "task status: "+status)
+			// the exit result to the servers so that the restart and
+			// reschedule policies can act on it. The exit codes are only
+			// trustworthy once the essential containers have stopped, so keep
+			// polling until this is the case.
+			if isTerminalStatus(status) {
+				result, ok := exitResultFromTask(task, h.essentialContainers(task))
+				if !ok && status != ecsTaskStatusStopped {
+					h.logger.Debug("waiting for essential containers to stop", "status", status)
+					continue
+				}
+				h.handleTaskExit(result)
+				return
+			}
+
+			if h.unhealthy.observe(task.HealthStatus) {
+				h.handleUnhealthy(task)
 				return
 			}
 
@@ -149,24 +343,35 @@ func (h *taskHandle) run() {
 		}
 	}
 
-	h.stateLock.Lock()
-	defer h.stateLock.Unlock()
-
-	// Only stop task if we're not detaching.
-	if !h.detach {
-		if err := h.stopTask(); err != nil {
+	h.stateLock.RLock()
+	detach, killTimeout := h.detach, h.killTimeout
+	h.stateLock.RUnlock()
+
+	// Only stop task if we're not detaching. The state lock is not held while
+	// waiting for the task to stop, so the status can still be inspected.
+	if !detach {
+		if err := h.stopTask(stopWait(killTimeout)); err != nil {
+			h.stateLock.Lock()
+			h.stopErr = err
+			h.stateLock.Unlock()
 			h.handleRunError(err, "failed to stop ECS task correctly")
 			return
 		}
 	}
 
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
+
 	h.procState = drivers.TaskStateExited
 	h.exitResult.ExitCode = 0
 	h.exitResult.Signal = 0
 	h.completedAt = time.Now()
 }
 
-func (h *taskHandle) stop(detach bool) {
+// stop signals the run loop to stop, or detach from, the ECS task. The kill
+// timeout bounds the wait for the ECS task to stop; zero keeps any timeout
+// passed previously.
+func (h *taskHandle) stop(detach bool, killTimeout time.Duration) {
 	h.stateLock.Lock()
 	defer h.stateLock.Unlock()
 
@@ -174,13 +379,269 @@ func (h *taskHandle) stop(detach bool) {
 	if !h.detach && detach {
 		h.detach = detach
 	}
+	if killTimeout > 0 {
+		h.killTimeout = killTimeout
+	}
 	h.cancel()
 }
 
+// destroy abandons any wait for the ECS task to stop.
+func (h *taskHandle) destroy() {
+	h.destroyCancel()
+}
+
+// stopTimeoutFor returns the time to wait for the containers to exit once the
+// ECS task is stopped with the kill timeout. ECS only kills the containers
+// once the task stop_timeout elapses, so it is used if longer than the kill
+// timeout, which Nomad only passes to the driver when stopping the task.
+func (h *taskHandle) stopTimeoutFor(killTimeout time.Duration) time.Duration {
+	if h.stopTimeout <= killTimeout {
+		return killTimeout
+	}
+
+	h.logger.Warn("ecs task stop_timeout exceeds the kill_timeout", "stop_timeout", h.stopTimeout,
+		"kill_timeout", killTimeout)
+	h.emitEvent(fmt.Sprintf("ECS task stop_timeout of %s exceeds the kill_timeout of %s",
+		h.stopTimeout, killTimeout), nil)
+	return h.stopTimeout
+}
+
+// stopWait returns the maximum time waited for the ECS task to stop after
+// being stopped with the kill timeout.
+func stopWait(killTimeout time.Duration) time.Duration {
+	return killTimeout + ecsStopGracePeriod
+}
+
+// getStopErr returns the error stopping the ECS task, if any.
+func (h *taskHandle) getStopErr() error {
+	h.stateLock.RLock()
+	defer h.stateLock.RUnlock()
+	return h.stopErr
+}
+
+// emitTransitionEvents emits a task event for each lifecycle, health or stop
+// reason change since the ECS task was last observed.
+func (h *taskHandle) emitTransitionEvents(task *ecs.Task) {
+	cur := newTaskObservation(task)
+	for _, msg := range transitionMessages(h.lastObservation, cur) {
+		h.emitEvent(msg, taskEventAnnotations(h.arn, task))
+	}
+	h.lastObservation = &cur
+}
+
+// emitEvent sends a task event, logging any failure to do so.
+func (h *taskHandle) emitEvent(msg string, annotations map[string]string) {
+	if err := emitTaskEvent(h.eventer, h.taskConfig, msg, annotations); err != nil {
+		h.logger.Warn("failed to emit task event", "message", msg, "error", err)
+	}
+}
+
+// setSnapshot records the latest description of the ECS task.
+func (h *taskHandle) setSnapshot(task *ecs.Task) {
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
+	h.snapshot = task
+}
+
+// registerStats registers the ECS task with the stats collector once it has
+// been described, unless the handle has been destroyed. It is called for
+// every stats interval of every stream, so the collector is not left without
+// the task if another stream of the same task ends.
+func (h *taskHandle) registerStats(c *statsCollector) {
+	h.stateLock.RLock()
+	defer h.stateLock.RUnlock()
+
+	if h.destroyCtx.Err() != nil {
+		return
+	}
+	if target, ok := newStatsTarget(clusterRef{Region: h.region, Cluster: h.cluster}, h.snapshot); ok {
+		c.Register(h.arn, target)
+	}
+}
+
+// unregisterStats removes the ECS task from the stats collector once the
+// handle has been destroyed. The state lock orders it after any registration
+// in progress, which otherwise could add the task back.
+func (h *taskHandle) unregisterStats(c *statsCollector) {
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
+	c.Unregister(h.arn)
+}
+
+// handleUnhealthy stops the ECS task once it has been reported as UNHEALTHY
+// too many consecutive times, and fails the Nomad task so the restart policy
+// can act on it.
+func (h *taskHandle) handleUnhealthy(task *ecs.Task) {
+	msg := fmt.Sprintf("ECS task reported UNHEALTHY %d consecutive times", h.unhealthy.consecutive)
+	h.logger.Warn("ecs task unhealthy, stopping it", "consecutive", h.unhealthy.consecutive)
+	h.emitEvent(msg+", stopping it", taskEventAnnotations(h.arn, task))
+
+	if err := h.stopTask(stopWait(0)); err != nil {
+		h.logger.Error("failed to stop unhealthy ecs task", "error", err)
+	}
+
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
+
+	h.procState = drivers.TaskStateExited
+	h.exitResult = &drivers.ExitResult{ExitCode: 1, Err: errors.New(msg)}
+	h.completedAt = time.Now()
+}
+
+// handleTaskExit records the exit result of an ECS task which has reached its
+// terminal phase without being stopped by the driver.
+func (h *taskHandle) handleTaskExit(result *drivers.ExitResult) {
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
+
+	h.logger.Info("ecs task exited", "exit_code", result.ExitCode,
+		"oom_killed", result.OOMKilled, "error", result.Err)
+
+	h.procState = drivers.TaskStateExited
+	h.exitResult = result
+	h.completedAt = time.Now()
+}
+
+// essentialContainers returns the names of the containers which are marked
+// as essential within the task definition of the passed task. The result is
+// cached as the task definition of a running task cannot change. If the task
+// definition cannot be read, nil is returned, meaning all containers are
+// treated as essential.
+func (h *taskHandle) essentialContainers(task *ecs.Task) map[string]struct{} {
+	if h.essential != nil {
+		return h.essential
+	}
+
+	def, err := h.describeTaskDefinition(task)
+	if err != nil {
+		h.logger.Warn("failed to describe task definition, treating all containers as essential",
+			"error", err)
+		return nil
+	}
+
+	h.essential = make(map[string]struct{})
+	for _, c := range def.ContainerDefinitions {
+		// Containers are essential unless explicitly marked otherwise.
+		if c.Essential == nil || *c.Essential {
+			h.essential[aws.StringValue(c.Name)] = struct{}{}
+		}
+	}
+	return h.essential
+}
+
+// describeTaskDefinition returns the task definition of the passed task. The
+// result is cached as the task definition of a running task cannot change.
+func (h *taskHandle) describeTaskDefinition(task *ecs.Task) (*ecs.TaskDefinition, error) {
+	if h.taskDefinition != nil {
+		return h.taskDefinition, nil
+	}
+
+	def, err := h.ecsClient.DescribeTaskDefinition(h.ctx, aws.StringValue(task.TaskDefinitionArn))
+	if err != nil {
+		return nil, err
+	}
+	h.taskDefinition = def
+	return def, nil
+}
+
+// startLogForwarder starts forwarding the CloudWatch logs of all containers
+// using the awslogs log driver to the task stdout. If the task definition
+// cannot be read, this will be retried on the next call.
+func (h *taskHandle) startLogForwarder(task *ecs.Task, stdout, stderr io.Writer) {
+	if h.logsClient == nil {
+		return
+	}
+
+	def, err := h.describeTaskDefinition(task)
+	if err != nil {
+		h.logger.Warn("failed to describe task definition, unable to forward logs", "error", err)
+		return
+	}
+
+	streams := logStreamsFromTaskDefinition(def, h.arn)
+	if len(streams) == 0 {
+		// Clear the client so the run loop does not repeatedly attempt to
+		// start the forwarder.
+		h.logger.Debug("no awslogs container log configuration found, not forwarding logs")
+		h.logsClient = nil
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.logsCancel = cancel
+	h.logsDoneCh = make(chan struct{})
+
+	fwd := newLogForwarder(h.logger, h.logsClient, streams, h.logCursorPath, stdout, stderr)
+	go func() {
+		defer close(h.logsDoneCh)
+		fwd.run(ctx)
+	}()
+}
+
+// stopLogForwarder stops the log forwarder, if running, and waits for it to
+// flush the remaining log events.
+func (h *taskHandle) stopLogForwarder() {
+	if h.logsCancel == nil {
+		return
+	}
+	h.logsCancel()
+	<-h.logsDoneCh
+}
+
+// exitResultFromTask builds the Nomad exit result from an ECS task
+// description. The exit code is taken from the essential containers, with the
+// first non-zero exit code taking precedence. If essential is nil, all
+// containers are considered. The returned bool indicates whether every
+// essential container has reported an exit code; when false, the result is a
+// best effort based on the task stop code and reason.
+func exitResultFromTask(task *ecs.Task, essential map[string]struct{}) (*drivers.ExitResult, bool) {
+	result := &drivers.ExitResult{}
+	exited, total := 0, 0
+
+	for _, c := range task.Containers {
+		if essential != nil {
+			if _, ok := essential[aws.StringValue(c.Name)]; !ok {
+				continue
+			}
+		}
+		total++
+
+		if strings.Contains(aws.StringValue(c.Reason), ecsContainerReasonOOM) {
+			result.OOMKilled = true
+		}
+		if c.ExitCode == nil {
+			continue
+		}
+		exited++
+		if result.ExitCode == 0 {
+			result.ExitCode = int(*c.ExitCode)
+		}
+	}
+
+	// If none of the essential containers exited with a code, the task
+	// failed before they could run, such as failing to pull the image.
+	// Surface the ECS reason to the operator.
+	if exited == 0 {
+		result.ExitCode = 1
+		result.Err = fmt.Errorf("ECS task stopped (%s): %s", task.StopCode,
+			aws.StringValue(task.StoppedReason))
+	}
+
+	return result, total > 0 && exited == total
+}
+
+// isTerminalStatus returns whether the ECS task status is within the terminal
+// lifecycle phase.
+func isTerminalStatus(status string) bool {
+	return status == ecsTaskStatusDeactivating || status == ecsTaskStatusStopping ||
+		status == ecsTaskStatusDeprovisioning || status == ecsTaskStatusStopped
+}
+
 // handleRunError is a convenience function to easily and correctly handle
 // terminal errors during the task run lifecycle.
 func (h *taskHandle) handleRunError(err error, context string) {
 	h.stateLock.Lock()
+	h.procState = drivers.TaskStateExited
 	h.completedAt = time.Now()
 	h.exitResult.ExitCode = 1
 	h.exitResult.Err = fmt.Errorf("%s: %v", context, err)
@@ -188,17 +649,47 @@ func (h *taskHandle) handleRunError(err error, context string) {
 }
 
 // stopTask is used to stop the ECS task, and monitor its status until it
-// reaches the stopped state.
-func (h *taskHandle) stopTask() error {
-	if err := h.ecsClient.StopTask(context.TODO(), h.arn); err != nil {
+// reaches the stopped state. ECS sends SIGTERM to the containers and kills
+// them once the stop timeout of the task definition elapses, so the wait
+// should allow for the Nomad kill timeout plus the time ECS needs to
+// deprovision the task. A task event is emitted if the task does not stop in
+// time.
+func (h *taskHandle) stopTask(wait time.Duration) error {
+	// The request to stop the task is not abandoned when the handle is
+	// destroyed, so force destroying a running task still stops it.
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), wait)
+	defer stopCancel()
+	if err := h.ecsClient.StopTask(stopCtx, h.arn); err != nil {
 		return err
 	}
 
+	ctx, cancel := context.WithTimeout(h.destroyCtx, wait)
+	defer cancel()
+
+	ticker := time.NewTicker(h.stopPollInterval)
+	defer ticker.Stop()
+
+	var status string
 	for {
 		select {
-		case <-time.After(5 * time.Second):
-			status, err := h.ecsClient.DescribeTaskStatus(context.TODO(), h.arn)
+		case <-ctx.Done():
+			if h.destroyCtx.Err() != nil {
+				h.logger.Debug("task destroyed, no longer waiting for ecs task to stop", "status", status)
+				return nil
+			}
+			err := fmt.Errorf("ECS task did not stop within %s, last status %q", wait, status)
+			h.logger.Error("timed out waiting for ecs task to stop", "wait", wait, "status", status)
+			h.emitEvent(fmt.Sprintf("ECS task did not stop within %s", wait),
+				map[string]string{eventAnnotationARN: h.arn})
+			return err
+
+		case <-ticker.C:
+			var err error
+			status, err = h.ecsClient.DescribeTaskStatus(ctx, h.arn)
 			if err != nil {
+				if ctx.Err() != nil {
+					continue
+				}
 				return err
 			}
 
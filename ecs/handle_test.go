@@ -0,0 +1,197 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/drivers/shared/eventer"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_exitResultFromTask(t *testing.T) {
+	testCases := []struct {
+		name              string
+		inputTask         *ecs.Task
+		inputEssential    map[string]struct{}
+		expectedExitCode  int
+		expectedOOMKilled bool
+		expectedErr       bool
+		expectedComplete  bool
+	}{
+		{
+			name: "essential container success",
+			inputTask: &ecs.Task{
+				StopCode: ecs.TaskStopCodeEssentialContainerExited,
+				Containers: []ecs.Container{
+					{Name: aws.String("app"), ExitCode: aws.Int64(0)},
+					{Name: aws.String("sidecar"), ExitCode: aws.Int64(137)},
+				},
+			},
+			inputEssential:   map[string]struct{}{"app": {}},
+			expectedExitCode: 0,
+			expectedComplete: true,
+		},
+		{
+			name: "essential container failure",
+			inputTask: &ecs.Task{
+				StopCode: ecs.TaskStopCodeEssentialContainerExited,
+				Containers: []ecs.Container{
+					{Name: aws.String("app"), ExitCode: aws.Int64(0)},
+					{Name: aws.String("worker"), ExitCode: aws.Int64(2)},
+				},
+			},
+			inputEssential:   nil,
+			expectedExitCode: 2,
+			expectedComplete: true,
+		},
+		{
+			name: "essential container oom",
+			inputTask: &ecs.Task{
+				StopCode: ecs.TaskStopCodeEssentialContainerExited,
+				Containers: []ecs.Container{
+					{
+						Name:     aws.String("app"),
+						ExitCode: aws.Int64(137),
+						Reason:   aws.String("OutOfMemoryError: Container killed due to memory usage"),
+					},
+				},
+			},
+			inputEssential:    map[string]struct{}{"app": {}},
+			expectedExitCode:  137,
+			expectedOOMKilled: true,
+			expectedComplete:  true,
+		},
+		{
+			name: "essential container still running",
+			inputTask: &ecs.Task{
+				Containers: []ecs.Container{
+					{Name: aws.String("app"), ExitCode: aws.Int64(0)},
+					{Name: aws.String("worker")},
+				},
+			},
+			inputEssential:   nil,
+			expectedExitCode: 0,
+			expectedComplete: false,
+		},
+		{
+			name: "task failed to start",
+			inputTask: &ecs.Task{
+				StopCode:      ecs.TaskStopCodeTaskFailedToStart,
+				StoppedReason: aws.String("CannotPullContainerError"),
+				Containers: []ecs.Container{
+					{Name: aws.String("app")},
+				},
+			},
+			inputEssential:   map[string]struct{}{"app": {}},
+			expectedExitCode: 1,
+			expectedErr:      true,
+			expectedComplete: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, complete := exitResultFromTask(tc.inputTask, tc.inputEssential)
+			assert.Equal(t, tc.expectedExitCode, result.ExitCode, tc.name)
+			assert.Equal(t, tc.expectedOOMKilled, result.OOMKilled, tc.name)
+			assert.Equal(t, tc.expectedErr, result.Err != nil, tc.name)
+			assert.Equal(t, tc.expectedComplete, complete, tc.name)
+		})
+	}
+}
+
+func Test_taskHandle_stopTimeoutFor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	e := eventer.NewEventer(ctx, hclog.NewNullLogger())
+	events, err := e.TaskEvents(ctx)
+	require.NoError(t, err)
+
+	h := newTaskHandle(hclog.NewNullLogger(), TaskState{ARN: "arn", StopTimeout: 45},
+		&drivers.TaskConfig{ID: "alloc/server/1", Name: "server"}, newMockECSClient(), nil, e, nil)
+	assert.Equal(t, time.Minute, h.stopTimeoutFor(time.Minute))
+
+	// A stop_timeout longer than the kill_timeout is waited for, as ECS does
+	// not kill the containers before it elapses.
+	assert.Equal(t, 45*time.Second, h.stopTimeoutFor(5*time.Second))
+	select {
+	case event := <-events:
+		assert.Equal(t, "ECS task stop_timeout of 45s exceeds the kill_timeout of 5s", event.Message)
+	case <-time.After(time.Second):
+		t.Fatal("expected task event")
+	}
+}
+
+func Test_taskHandle_stopTask(t *testing.T) {
+	testCases := []struct {
+		name          string
+		inputIgnored  bool
+		inputDestroy  bool
+		expectedError string
+		expectedEvent string
+	}{
+		{
+			name: "stopped",
+		},
+		{
+			name:          "timed out",
+			inputIgnored:  true,
+			expectedError: `ECS task did not stop within 50ms, last status "RUNNING"`,
+			expectedEvent: "ECS task did not stop within 50ms",
+		},
+		{
+			name:         "destroyed",
+			inputIgnored: true,
+			inputDestroy: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			client := newMockECSClient()
+			client.ignoreStopTask = tc.inputIgnored
+			client.tasks["arn"] = &ecs.Task{TaskArn: aws.String("arn"), LastStatus: aws.String("RUNNING")}
+
+			e := eventer.NewEventer(ctx, hclog.NewNullLogger())
+			events, err := e.TaskEvents(ctx)
+			require.NoError(t, err)
+
+			h := newTaskHandle(hclog.NewNullLogger(), TaskState{ARN: "arn"},
+				&drivers.TaskConfig{ID: "alloc/server/1", Name: "server"}, client, nil, e, nil)
+			h.stopPollInterval = time.Millisecond
+			if tc.inputDestroy {
+				h.destroy()
+			}
+
+			err = h.stopTask(50 * time.Millisecond)
+			assert.Equal(t, []string{"arn"}, client.stopTaskARNs)
+
+			if tc.expectedError == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tc.expectedError)
+
+			select {
+			case event := <-events:
+				assert.Equal(t, tc.expectedEvent, event.Message)
+				assert.Equal(t, "arn", event.Annotations[eventAnnotationARN])
+			case <-time.After(time.Second):
+				t.Fatal("expected task event")
+			}
+		})
+	}
+}
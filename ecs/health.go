@@ -0,0 +1,96 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+)
+
+// These are the task status driver attribute keys reporting the ECS health.
+// The container attributes are formatted with the container name.
+const (
+	attrHealthStatus          = "health_status"
+	attrContainerHealthStatus = "container.%s.health_status"
+)
+
+// taskHealth is the health ECS reports for a task and each of its containers
+// which has a health check.
+type taskHealth struct {
+	Status     string
+	Containers map[string]string
+}
+
+func newTaskHealth(task *ecs.Task) taskHealth {
+	health := taskHealth{
+		Status:     string(task.HealthStatus),
+		Containers: make(map[string]string),
+	}
+	for _, c := range task.Containers {
+		if c.HealthStatus != "" {
+			health.Containers[aws.StringValue(c.Name)] = string(c.HealthStatus)
+		}
+	}
+	return health
+}
+
+// attributes returns the health as task status driver attributes.
+func (h taskHealth) attributes() map[string]string {
+	attrs := make(map[string]string, len(h.Containers)+1)
+	if h.Status != "" {
+		attrs[attrHealthStatus] = h.Status
+	}
+	for name, status := range h.Containers {
+		attrs[fmt.Sprintf(attrContainerHealthStatus, name)] = status
+	}
+	return attrs
+}
+
+// containerHealthMessages returns the task event messages describing the
+// changes in container health between the previous and current observations.
+// The messages are sorted by container name so they are emitted in a stable
+// order.
+func containerHealthMessages(prev, cur map[string]string) []string {
+	names := make([]string, 0, len(cur))
+	for name := range cur {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var msgs []string
+	for _, name := range names {
+		if before, ok := prev[name]; ok && before != cur[name] {
+			msgs = append(msgs, fmt.Sprintf("ECS container %s health changed from %s to %s",
+				name, before, cur[name]))
+		}
+	}
+	return msgs
+}
+
+// unhealthyPolicy fails the Nomad task once ECS reports the task as UNHEALTHY
+// a number of consecutive times, so that the restart policy can act on it.
+type unhealthyPolicy struct {
+	// threshold is the number of consecutive UNHEALTHY reports after which
+	// the task is failed. Zero disables the policy.
+	threshold int
+
+	consecutive int
+}
+
+// observe records the reported task health and returns whether the
+// threshold has been reached.
+func (p *unhealthyPolicy) observe(status ecs.HealthStatus) bool {
+	if p.threshold <= 0 {
+		return false
+	}
+	if status != ecs.HealthStatusUnhealthy {
+		p.consecutive = 0
+		return false
+	}
+	p.consecutive++
+	return p.consecutive >= p.threshold
+}
@@ -0,0 +1,72 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_taskHealth_attributes(t *testing.T) {
+	task := &ecs.Task{
+		HealthStatus: ecs.HealthStatusUnhealthy,
+		Containers: []ecs.Container{
+			{Name: aws.String("web"), HealthStatus: ecs.HealthStatusUnhealthy},
+			{Name: aws.String("sidecar"), HealthStatus: ecs.HealthStatusHealthy},
+			{Name: aws.String("init")},
+		},
+	}
+
+	assert.Equal(t, map[string]string{
+		"health_status":                   "UNHEALTHY",
+		"container.web.health_status":     "UNHEALTHY",
+		"container.sidecar.health_status": "HEALTHY",
+	}, newTaskHealth(task).attributes())
+
+	assert.Empty(t, newTaskHealth(&ecs.Task{}).attributes())
+}
+
+func Test_unhealthyPolicy_observe(t *testing.T) {
+	testCases := []struct {
+		name           string
+		inputThreshold int
+		inputStatuses  []ecs.HealthStatus
+		expected       []bool
+	}{
+		{
+			name:           "disabled",
+			inputThreshold: 0,
+			inputStatuses:  []ecs.HealthStatus{ecs.HealthStatusUnhealthy, ecs.HealthStatusUnhealthy},
+			expected:       []bool{false, false},
+		},
+		{
+			name:           "consecutive",
+			inputThreshold: 2,
+			inputStatuses:  []ecs.HealthStatus{ecs.HealthStatusHealthy, ecs.HealthStatusUnhealthy, ecs.HealthStatusUnhealthy},
+			expected:       []bool{false, false, true},
+		},
+		{
+			name:           "reset by healthy report",
+			inputThreshold: 2,
+			inputStatuses: []ecs.HealthStatus{
+				ecs.HealthStatusUnhealthy, ecs.HealthStatusHealthy, ecs.HealthStatusUnhealthy,
+			},
+			expected: []bool{false, false, false},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := unhealthyPolicy{threshold: tc.inputThreshold}
+			var actual []bool
+			for _, status := range tc.inputStatuses {
+				actual = append(actual, p.observe(status))
+			}
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// defaultIdentityDuration is the default duration of the role sessions
+	// assumed using workload identities, which is the maximum permitted by
+	// roles which do not raise it.
+	defaultIdentityDuration = time.Hour
+
+	// identityTokenEnv and identityTokenFile are the environment variable
+	// and secrets file Nomad writes the default workload identity to. Named
+	// identities are suffixed with their name.
+	identityTokenEnv  = "NOMAD_TOKEN"
+	identityTokenFile = "nomad_token"
+
+	// maxRoleSessionNameLength is the maximum length of an STS role session
+	// name.
+	maxRoleSessionNameLength = 64
+)
+
+// WorkloadIdentityConfig is the configuration of the IAM roles which tasks
+// assume using their Nomad workload identity. Workload identities are only
+// used if the block is present, in which case the duration is always set due
+// to its default.
+type WorkloadIdentityConfig struct {
+	// RoleARN is a template rendered for each task to map it to the role it
+	// assumes, unless the task config sets its own role_arn.
+	RoleARN  string `codec:"role_arn"`
+	Duration string `codec:"duration"`
+
+	roleARN  *template.Template
+	duration time.Duration
+}
+
+// enabled returns whether the workload_identity block is present.
+func (c *WorkloadIdentityConfig) enabled() bool {
+	return c.Duration != ""
+}
+
+// parse validates the workload identity configuration, parsing any values
+// which cannot be decoded directly.
+func (c *WorkloadIdentityConfig) parse() error {
+	c.duration = defaultIdentityDuration
+	if c.Duration != "" {
+		duration, err := time.ParseDuration(c.Duration)
+		if err != nil {
+			return fmt.Errorf("failed to parse workload_identity duration: %v", err)
+		}
+		if duration < defaultAssumeRoleDuration || duration > maxAssumeRoleDuration {
+			return fmt.Errorf("workload_identity duration must be between %s and %s",
+				defaultAssumeRoleDuration, maxAssumeRoleDuration)
+		}
+		c.duration = duration
+	}
+
+	if c.RoleARN != "" {
+		tmpl, err := template.New("role_arn").Option("missingkey=error").Parse(c.RoleARN)
+		if err != nil {
+			return fmt.Errorf("failed to parse workload_identity role_arn: %v", err)
+		}
+
+		// Render the template with placeholder data so that references to
+		// unknown fields are rejected when the config is set.
+		if err := tmpl.Execute(&bytes.Buffer{}, startedByData{}); err != nil {
+			return fmt.Errorf("failed to render workload_identity role_arn: %v", err)
+		}
+		c.roleARN = tmpl
+	}
+	return nil
+}
+
+// taskRole returns the ARN of the role the task assumes using its workload
+// identity, which is either set within the task config or mapped from the
+// Nomad task by the role_arn template. It is empty if the task uses the
+// credentials of the driver.
+func (c *WorkloadIdentityConfig) taskRole(t ECSTaskConfig, cfg *drivers.TaskConfig) (string, error) {
+	if !c.enabled() {
+		if t.RoleARN != "" || t.Identity != "" {
+			return "", errors.New("role_arn and identity require the plugin workload_identity block")
+		}
+		return "", nil
+	}
+
+	if t.RoleARN != "" {
+		return t.RoleARN, nil
+	}
+	if c.roleARN == nil {
+		if t.Identity != "" {
+			return "", errors.New("identity requires a role_arn within the task or plugin workload_identity block")
+		}
+		return "", nil
+	}
+
+	var buf bytes.Buffer
+	if err := c.roleARN.Execute(&buf, newStartedByData(cfg)); err != nil {
+		return "", fmt.Errorf("failed to render workload_identity role_arn: %v", err)
+	}
+	role := strings.TrimSpace(buf.String())
+	if role == "" {
+		return "", errors.New("workload_identity role_arn rendered an empty role ARN")
+	}
+	return role, nil
+}
+
+// identityToken returns a token function which reads the workload identity
+// JWT of the task, either from the task environment or the secrets
+// directory, depending on how the identity block of the task exposes it. The
+// name selects a named identity, or the default identity if empty.
+func identityToken(cfg *drivers.TaskConfig, name string) func() (string, error) {
+	env, file := identityTokenEnv, identityTokenFile
+	if name != "" {
+		env = identityTokenEnv + "_" + name
+		file = "nomad_" + name + ".jwt"
+	}
+
+	return func() (string, error) {
+		if token := cfg.Env[env]; token != "" {
+			return token, nil
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(cfg.TaskDir().SecretsDir, file))
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("workload identity not found in %s or secrets/%s, "+
+				"the task identity block must set env or file", env, file)
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+}
+
+// identitySessionName returns the role session name of the task, allowing
+// CloudTrail events to be traced back to the allocation.
+func identitySessionName(cfg *drivers.TaskConfig) string {
+	name := invalidStartedByChars.ReplaceAllString("nomad-"+cfg.AllocID, "_")
+	if len(name) > maxRoleSessionNameLength {
+		name = name[:maxRoleSessionNameLength]
+	}
+	return name
+}
+
+// taskClient returns the client used for the requests made on behalf of the
+// task, which uses the credentials of the role the task assumes using its
+// workload identity, or the shared client of the cluster if it has none. The
+// credentials are returned so that they can be checked before the task is
+// run, and are nil if the task has no role.
+func (d *Driver) taskClient(ref clusterRef, cfg *drivers.TaskConfig,
+	role, identity string) (ecsClientInterface, aws.CredentialsProvider) {
+	if role == "" {
+		return d.clients.get(ref), nil
+	}
+
+	creds := newWebIdentityRoleProvider(d.stsClient, AssumeRoleConfig{
+		RoleARN:     role,
+		SessionName: identitySessionName(cfg),
+		duration:    d.config.WorkloadIdentity.duration,
+	}, identityToken(cfg, identity))
+	return d.clients.withCredentials(ref, creds), creds
+}
+
+// taskLogsClient returns the client used to forward the container logs of the
+// task, which uses the same credentials as the task client, as well as the
+// task region for containers which do not set the awslogs-region option.
+func (d *Driver) taskLogsClient(region string, creds aws.CredentialsProvider) logsClientInterface {
+	if d.logsClient == nil {
+		return nil
+	}
+	return d.logsClient.withCredentials(region, creds)
+}
@@ -0,0 +1,420 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// identityAudience is the audience STS requires of web identity tokens.
+const identityAudience = "sts.amazonaws.com"
+
+// oidcStandIn is a local stand-in for the Nomad OIDC discovery endpoints,
+// signing workload identities with its key and serving the JWKS which STS
+// verifies them with.
+type oidcStandIn struct {
+	*httptest.Server
+
+	key *rsa.PrivateKey
+}
+
+func newOIDCStandIn(t *testing.T) *oidcStandIn {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	o := &oidcStandIn{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":   o.URL,
+			"jwks_uri": o.URL + "/.well-known/jwks.json",
+		})
+	})
+	mux.HandleFunc("/.well-known/jwks.json", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": "nomad",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	o.Server = httptest.NewServer(mux)
+	t.Cleanup(o.Close)
+	return o
+}
+
+// sign returns a workload identity of the Nomad job, signed by the issuer.
+func (o *oidcStandIn) sign(t *testing.T, namespace, job string) string {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "nomad"})
+	require.NoError(t, err)
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":             o.URL,
+		"aud":             identityAudience,
+		"exp":             time.Now().Add(time.Hour).Unix(),
+		"nomad_namespace": namespace,
+		"nomad_job_id":    job,
+	})
+	require.NoError(t, err)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, o.key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// verifier returns an STS stand-in verifier which validates tokens using the
+// discovered JWKS of the issuer, as STS does for IAM OIDC providers, and only
+// allows each role to be assumed by the Nomad job its trust policy names as
+// namespace/job.
+func (o *oidcStandIn) verifier(trust map[string]string) func(token, roleARN string) *stsFault {
+	return func(token, roleARN string) *stsFault {
+		claims, err := o.verify(token)
+		if err != nil {
+			return &stsFault{Code: "InvalidIdentityToken", Message: err.Error()}
+		}
+		if trust[roleARN] != fmt.Sprintf("%v/%v", claims["nomad_namespace"], claims["nomad_job_id"]) {
+			return &stsFault{Code: "AccessDenied", Message: "Not authorized to perform sts:AssumeRoleWithWebIdentity"}
+		}
+		return nil
+	}
+}
+
+func (o *oidcStandIn) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, err
+	}
+	if claims["iss"] != o.URL {
+		return nil, errors.New("untrusted issuer")
+	}
+	if claims["aud"] != identityAudience {
+		return nil, errors.New("incorrect audience")
+	}
+	if exp, _ := claims["exp"].(float64); time.Unix(int64(exp), 0).Before(time.Now()) {
+		return nil, errors.New("token expired")
+	}
+
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := getJSON(o.URL+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []struct {
+			N string `json:"n"`
+			E string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJSON(discovery.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	for _, k := range jwks.Keys {
+		n, _ := base64.RawURLEncoding.DecodeString(k.N)
+		e, _ := base64.RawURLEncoding.DecodeString(k.E)
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil {
+			return claims, nil
+		}
+	}
+	return nil, errors.New("invalid signature")
+}
+
+func getJSON(url string, v interface{}) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// ecsStandIn is a local stand-in for ECS which records the access key used
+// to sign each request.
+type ecsStandIn struct {
+	*httptest.Server
+
+	lock      sync.Mutex
+	accessKey map[string]string
+}
+
+// accessKeyPattern matches the access key of a SigV4 Authorization header.
+var accessKeyPattern = regexp.MustCompile(`Credential=([^/]+)/`)
+
+func newECSStandIn(t *testing.T) *ecsStandIn {
+	e := &ecsStandIn{accessKey: make(map[string]string)}
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AmazonEC2ContainerServiceV20141113.")
+		var key string
+		if m := accessKeyPattern.FindStringSubmatch(r.Header.Get("Authorization")); m != nil {
+			key = m[1]
+		}
+		e.lock.Lock()
+		e.accessKey[target] = key
+		e.lock.Unlock()
+
+		task := `{"taskArn":"arn:aws:ecs:us-east-1:123456789012:task/nomad/abc","lastStatus":"RUNNING"}`
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		switch target {
+		case "RunTask", "DescribeTasks":
+			fmt.Fprintf(w, `{"tasks":[%s]}`, task)
+		case "StopTask":
+			fmt.Fprintf(w, `{"task":%s}`, task)
+		default:
+			fmt.Fprint(w, `{}`)
+		}
+	}))
+	t.Cleanup(e.Close)
+	return e
+}
+
+func (e *ecsStandIn) AccessKeys() map[string]string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	out := make(map[string]string, len(e.accessKey))
+	for k, v := range e.accessKey {
+		out[k] = v
+	}
+	return out
+}
+
+func Test_WorkloadIdentityConfig_parse(t *testing.T) {
+	testCases := []struct {
+		name          string
+		inputConfig   WorkloadIdentityConfig
+		expectedError string
+	}{
+		{
+			name:        "template",
+			inputConfig: WorkloadIdentityConfig{RoleARN: "arn:aws:iam::123456789012:role/{{.Namespace}}-{{.JobID}}", Duration: "1h"},
+		},
+		{
+			name:          "unknown field",
+			inputConfig:   WorkloadIdentityConfig{RoleARN: "arn:aws:iam::123456789012:role/{{.Job}}", Duration: "1h"},
+			expectedError: "failed to render workload_identity role_arn",
+		},
+		{
+			name:          "duration too short",
+			inputConfig:   WorkloadIdentityConfig{Duration: "5m"},
+			expectedError: "workload_identity duration must be between 15m0s and 12h0m0s",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.inputConfig.parse()
+			if tc.expectedError != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func Test_WorkloadIdentityConfig_taskRole(t *testing.T) {
+	cfg := &drivers.TaskConfig{Namespace: "default", JobID: "web"}
+
+	mapped := WorkloadIdentityConfig{RoleARN: "arn:aws:iam::123456789012:role/nomad-{{.Namespace}}-{{.JobID}}", Duration: "1h"}
+	require.NoError(t, mapped.parse())
+	unmapped := WorkloadIdentityConfig{Duration: "1h"}
+	require.NoError(t, unmapped.parse())
+
+	testCases := []struct {
+		name          string
+		inputConfig   WorkloadIdentityConfig
+		inputTask     ECSTaskConfig
+		expectedRole  string
+		expectedError string
+	}{
+		{
+			name: "disabled",
+		},
+		{
+			name:          "disabled with task role",
+			inputTask:     ECSTaskConfig{RoleARN: "arn:aws:iam::123456789012:role/web"},
+			expectedError: "role_arn and identity require the plugin workload_identity block",
+		},
+		{
+			name:         "mapped from job",
+			inputConfig:  mapped,
+			expectedRole: "arn:aws:iam::123456789012:role/nomad-default-web",
+		},
+		{
+			name:         "task role takes precedence",
+			inputConfig:  mapped,
+			inputTask:    ECSTaskConfig{RoleARN: "arn:aws:iam::123456789012:role/web"},
+			expectedRole: "arn:aws:iam::123456789012:role/web",
+		},
+		{
+			name:        "not mapped",
+			inputConfig: unmapped,
+		},
+		{
+			name:          "identity without role",
+			inputConfig:   unmapped,
+			inputTask:     ECSTaskConfig{Identity: "aws"},
+			expectedError: "identity requires a role_arn within the task or plugin workload_identity block",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			role, err := tc.inputConfig.taskRole(tc.inputTask, cfg)
+			if tc.expectedError != "" {
+				require.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedRole, role)
+		})
+	}
+}
+
+func Test_identityToken(t *testing.T) {
+	cfg := &drivers.TaskConfig{
+		Name:     "web",
+		AllocDir: t.TempDir(),
+		Env:      map[string]string{"NOMAD_TOKEN": "env-token"},
+	}
+
+	// The environment is used when the identity sets env.
+	token, err := identityToken(cfg, "")()
+	require.NoError(t, err)
+	assert.Equal(t, "env-token", token)
+
+	// Named identities are otherwise read from the secrets directory.
+	_, err = identityToken(cfg, "aws")()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "NOMAD_TOKEN_aws or secrets/nomad_aws.jwt")
+
+	secrets := cfg.TaskDir().SecretsDir
+	require.NoError(t, os.MkdirAll(secrets, 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(secrets, "nomad_aws.jwt"), []byte("file-token\n"), 0600))
+	token, err = identityToken(cfg, "aws")()
+	require.NoError(t, err)
+	assert.Equal(t, "file-token", token)
+}
+
+func Test_Driver_taskClient(t *testing.T) {
+	oidc := newOIDCStandIn(t)
+	stsSrv := newSTSStandIn(t, oidc.verifier(map[string]string{
+		"arn:aws:iam::123456789012:role/nomad-default-web": "default/web",
+	}))
+	ecsSrv := newECSStandIn(t)
+
+	config := &DriverConfig{WorkloadIdentity: WorkloadIdentityConfig{
+		RoleARN:  "arn:aws:iam::123456789012:role/nomad-{{.Namespace}}-{{.JobID}}",
+		Duration: "1h",
+	}}
+	require.NoError(t, config.parse())
+	d := &Driver{
+		config:    config,
+		clients:   newECSClientPool(testAWSConfig(ecsSrv.URL), "nomad"),
+		stsClient: sts.New(testAWSConfig(stsSrv.URL)),
+	}
+
+	newTask := func(job string) *drivers.TaskConfig {
+		cfg := &drivers.TaskConfig{
+			AllocID:   "2b5d6a6c-3c1d-4d0a-9f0e-1c3c2a1b0f4e",
+			Name:      "server",
+			Namespace: "default",
+			JobID:     job,
+			AllocDir:  t.TempDir(),
+		}
+		secrets := cfg.TaskDir().SecretsDir
+		require.NoError(t, os.MkdirAll(secrets, 0700))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(secrets, identityTokenFile),
+			[]byte(oidc.sign(t, "default", job)), 0600))
+		return cfg
+	}
+
+	// The requests made for the task are signed using the credentials of
+	// the role mapped from its job.
+	cfg := newTask("web")
+	role, err := config.WorkloadIdentity.taskRole(ECSTaskConfig{}, cfg)
+	require.NoError(t, err)
+	client, creds := d.taskClient(clusterRef{}, cfg, role, "")
+	require.NotNil(t, creds)
+	_, err = creds.Retrieve(context.Background())
+	require.NoError(t, err)
+
+	task, err := client.RunTask(context.Background(), TaskConfig{Task: ECSTaskConfig{
+		TaskDefinition: "web:1",
+		NetworkConfiguration: TaskNetworkConfiguration{
+			TaskAWSVPCConfiguration: TaskAWSVPCConfiguration{Subnets: []string{"subnet-1"}},
+		},
+	}})
+	require.NoError(t, err)
+	_, err = client.DescribeTask(context.Background(), *task.TaskArn)
+	require.NoError(t, err)
+	require.NoError(t, client.StopTask(context.Background(), *task.TaskArn))
+
+	assert.Equal(t, map[string]string{
+		"RunTask":       "AKID1",
+		"DescribeTasks": "AKID1",
+		"StopTask":      "AKID1",
+	}, ecsSrv.AccessKeys())
+
+	req := stsSrv.Requests()[0]
+	assert.Equal(t, "arn:aws:iam::123456789012:role/nomad-default-web", req["RoleArn"])
+	assert.Equal(t, "nomad-2b5d6a6c-3c1d-4d0a-9f0e-1c3c2a1b0f4e", req["RoleSessionName"])
+	assert.Equal(t, "3600", req["DurationSeconds"])
+
+	// A job may not assume the role of another job.
+	cfg = newTask("api")
+	_, creds = d.taskClient(clusterRef{}, cfg, "arn:aws:iam::123456789012:role/nomad-default-web", "")
+	_, err = creds.Retrieve(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "AccessDenied")
+
+	// Tasks without a role use the shared client of the cluster.
+	client, creds = d.taskClient(clusterRef{}, cfg, "", "")
+	assert.Nil(t, creds)
+	assert.Equal(t, d.clients.get(clusterRef{}), client)
+}
@@ -0,0 +1,190 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/hashicorp/nomad/client/taskenv"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// injectedNomadEnv are the variables Nomad sets describing the job, task
+// group, task, allocation and region which are injected into the ECS task.
+// Other NOMAD_ variables are not injected, as they either hold tokens, such
+// as the workload identity, or describe the Nomad client host, such as the
+// allocation directory and host ports, which are meaningless within ECS.
+var injectedNomadEnv = map[string]struct{}{
+	taskenv.Namespace:    {},
+	taskenv.Region:       {},
+	taskenv.Datacenter:   {},
+	taskenv.JobID:        {},
+	taskenv.JobName:      {},
+	taskenv.JobParentID:  {},
+	taskenv.GroupName:    {},
+	taskenv.TaskName:     {},
+	taskenv.AllocID:      {},
+	taskenv.ShortAllocID: {},
+	taskenv.AllocName:    {},
+	taskenv.AllocIndex:   {},
+}
+
+// nomadEnvPrefix is the prefix of the variables Nomad sets within the task
+// environment.
+const nomadEnvPrefix = "NOMAD_"
+
+// injectedEnv returns the subset of the Nomad task environment which is
+// injected into the ECS task. Alongside the allowed NOMAD_ variables and the
+// job metadata, this includes the variables set by the jobspec env block and
+// templates, apart from the Vault token.
+func injectedEnv(env map[string]string) map[string]string {
+	injected := make(map[string]string, len(env))
+	for k, v := range env {
+		if k == taskenv.VaultToken {
+			continue
+		}
+		if strings.HasPrefix(k, nomadEnvPrefix) && !strings.HasPrefix(k, taskenv.MetaPrefix) {
+			if _, ok := injectedNomadEnv[k]; !ok {
+				continue
+			}
+		}
+		injected[k] = v
+	}
+	return injected
+}
+
+// fargateTaskSize is a Fargate task CPU value along with the memory values,
+// in MiB, which are valid in combination with it.
+type fargateTaskSize struct {
+	CPU       int64
+	MinMemory int64
+	MaxMemory int64
+	Increment int64
+}
+
+// fargateTaskSizes are the supported Fargate task CPU and memory
+// combinations, ordered by CPU.
+var fargateTaskSizes = []fargateTaskSize{
+	{CPU: 256, MinMemory: 512, MaxMemory: 2048, Increment: 512},
+	{CPU: 512, MinMemory: 1024, MaxMemory: 4096, Increment: 1024},
+	{CPU: 1024, MinMemory: 2048, MaxMemory: 8192, Increment: 1024},
+	{CPU: 2048, MinMemory: 4096, MaxMemory: 16384, Increment: 1024},
+	{CPU: 4096, MinMemory: 8192, MaxMemory: 30720, Increment: 1024},
+	{CPU: 8192, MinMemory: 16384, MaxMemory: 61440, Increment: 4096},
+	{CPU: 16384, MinMemory: 32768, MaxMemory: 122880, Increment: 8192},
+}
+
+// fargateResources rounds the CPU units and memory up to the smallest valid
+// Fargate task size which satisfies both.
+func fargateResources(cpu, memory int64) (int64, int64, error) {
+	for _, size := range fargateTaskSizes {
+		if cpu > size.CPU || memory > size.MaxMemory {
+			continue
+		}
+
+		m := size.MinMemory
+		for m < memory {
+			m += size.Increment
+		}
+
+		// The 256 CPU size supports 512 MiB, and then 1 GiB increments.
+		if size.CPU == 256 && m == 1536 {
+			m = 2048
+		}
+		return size.CPU, m, nil
+	}
+	return 0, 0, fmt.Errorf("no Fargate task size supports %d CPU units and %d MiB memory", cpu, memory)
+}
+
+// nomadTaskResources returns the CPU and memory allocated to the Nomad task.
+// The Nomad CPU shares, in MHz, are used directly as ECS CPU units and the
+// memory is the hard limit when memory oversubscription is in use.
+func nomadTaskResources(cfg *drivers.TaskConfig) (int64, int64) {
+	if cfg.Resources == nil || cfg.Resources.NomadResources == nil {
+		return 0, 0
+	}
+
+	res := cfg.Resources.NomadResources
+	memory := res.Memory.MemoryMB
+	if res.Memory.MemoryMaxMB > memory {
+		memory = res.Memory.MemoryMaxMB
+	}
+	return res.Cpu.CpuShares, memory
+}
+
+// injectNomadTask copies the allowed environment of the Nomad task into a
+// container override for every container of the ECS task, and sets the task
+// level CPU and memory from the Nomad task resources. Values set explicitly
+// within the jobspec task config take precedence.
+func injectNomadTask(ctx context.Context, client ecsClientInterface, cfg *drivers.TaskConfig, task *ECSTaskConfig) error {
+	containers, err := taskContainerNames(ctx, client, *task)
+	if err != nil {
+		return err
+	}
+
+	injected := injectedEnv(cfg.Env)
+	for _, name := range containers {
+		idx := -1
+		for i := range task.ContainerOverrides {
+			if task.ContainerOverrides[i].Name == name {
+				idx = i
+			}
+		}
+		if idx == -1 {
+			task.ContainerOverrides = append(task.ContainerOverrides, TaskContainerOverride{Name: name})
+			idx = len(task.ContainerOverrides) - 1
+		}
+
+		override := &task.ContainerOverrides[idx]
+		env := make(map[string]string, len(injected)+len(override.Environment))
+		for k, v := range injected {
+			env[k] = v
+		}
+		for k, v := range override.Environment {
+			env[k] = v
+		}
+		override.Environment = env
+	}
+
+	cpu, memory := nomadTaskResources(cfg)
+	if task.CPU > 0 {
+		cpu = task.CPU
+	}
+	if task.Memory > 0 {
+		memory = task.Memory
+	}
+	if task.usesFargate() && (cpu > 0 || memory > 0) {
+		if cpu, memory, err = fargateResources(cpu, memory); err != nil {
+			return err
+		}
+	}
+	task.CPU = cpu
+	task.Memory = memory
+	return nil
+}
+
+// taskContainerNames returns the names of the containers of the ECS task,
+// describing the task definition if it is not described inline.
+func taskContainerNames(ctx context.Context, client ecsClientInterface, task ECSTaskConfig) ([]string, error) {
+	var names []string
+
+	if len(task.ContainerDefinitions) > 0 {
+		for _, cd := range task.ContainerDefinitions {
+			names = append(names, cd.Name)
+		}
+		return names, nil
+	}
+
+	def, err := client.DescribeTaskDefinition(ctx, task.TaskDefinition)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe task definition %q: %v", task.TaskDefinition, err)
+	}
+	for _, cd := range def.ContainerDefinitions {
+		names = append(names, aws.StringValue(cd.Name))
+	}
+	return names, nil
+}
@@ -0,0 +1,145 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_fargateResources(t *testing.T) {
+	testCases := []struct {
+		name           string
+		inputCPU       int64
+		inputMemory    int64
+		expectedCPU    int64
+		expectedMemory int64
+		expectedError  string
+	}{
+		{
+			name:           "nomad defaults",
+			inputCPU:       100,
+			inputMemory:    300,
+			expectedCPU:    256,
+			expectedMemory: 512,
+		},
+		{
+			name:           "exact size",
+			inputCPU:       1024,
+			inputMemory:    4096,
+			expectedCPU:    1024,
+			expectedMemory: 4096,
+		},
+		{
+			name:           "memory rounded to increment",
+			inputCPU:       512,
+			inputMemory:    1100,
+			expectedCPU:    512,
+			expectedMemory: 2048,
+		},
+		{
+			name:           "smallest size skips 1536",
+			inputCPU:       256,
+			inputMemory:    1500,
+			expectedCPU:    256,
+			expectedMemory: 2048,
+		},
+		{
+			name:           "memory requires more cpu",
+			inputCPU:       256,
+			inputMemory:    6000,
+			expectedCPU:    1024,
+			expectedMemory: 6144,
+		},
+		{
+			name:           "memory only",
+			inputMemory:    512,
+			expectedCPU:    256,
+			expectedMemory: 512,
+		},
+		{
+			name:          "too large",
+			inputCPU:      20000,
+			inputMemory:   1024,
+			expectedError: "no Fargate task size supports 20000 CPU units and 1024 MiB memory",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cpu, memory, err := fargateResources(tc.inputCPU, tc.inputMemory)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedCPU, cpu)
+			assert.Equal(t, tc.expectedMemory, memory)
+		})
+	}
+}
+
+func Test_injectNomadTask(t *testing.T) {
+	client := newMockECSClient()
+	client.taskDefinitions["web:1"] = &ecs.TaskDefinition{
+		ContainerDefinitions: []ecs.ContainerDefinition{
+			{Name: aws.String("web")},
+			{Name: aws.String("sidecar")},
+		},
+	}
+
+	cfg := &drivers.TaskConfig{
+		Env: map[string]string{
+			"NOMAD_ALLOC_ID":    "6d9c1a3e",
+			"NOMAD_META_owner":  "web-team",
+			"NOMAD_ALLOC_DIR":   "/var/nomad/alloc/6d9c1a3e/alloc",
+			"NOMAD_SECRETS_DIR": "/var/nomad/alloc/6d9c1a3e/web/secrets",
+			"NOMAD_TOKEN":       "eyJhbGciOiJSUzI1NiJ9",
+			"VAULT_TOKEN":       "hvs.secret",
+			"LOG_LEVEL":         "info",
+		},
+		Resources: &drivers.Resources{
+			NomadResources: &structs.AllocatedTaskResources{
+				Cpu:    structs.AllocatedCpuResources{CpuShares: 500},
+				Memory: structs.AllocatedMemoryResources{MemoryMB: 256, MemoryMaxMB: 1024},
+			},
+		},
+	}
+	task := ECSTaskConfig{
+		LaunchType:     "FARGATE",
+		TaskDefinition: "web:1",
+		ContainerOverrides: []TaskContainerOverride{
+			{Name: "web", Environment: map[string]string{"LOG_LEVEL": "debug"}},
+		},
+	}
+
+	require.NoError(t, injectNomadTask(context.Background(), client, cfg, &task))
+
+	// Tokens and host paths are not injected, and the explicit container
+	// override environment takes precedence.
+	require.Len(t, task.ContainerOverrides, 2)
+	assert.Equal(t, "web", task.ContainerOverrides[0].Name)
+	assert.Equal(t, map[string]string{"NOMAD_ALLOC_ID": "6d9c1a3e", "NOMAD_META_owner": "web-team", "LOG_LEVEL": "debug"},
+		map[string]string(task.ContainerOverrides[0].Environment))
+	assert.Equal(t, "sidecar", task.ContainerOverrides[1].Name)
+	assert.Equal(t, map[string]string{"NOMAD_ALLOC_ID": "6d9c1a3e", "NOMAD_META_owner": "web-team", "LOG_LEVEL": "info"},
+		map[string]string(task.ContainerOverrides[1].Environment))
+
+	// The memory hard limit is rounded to a valid Fargate size.
+	assert.Equal(t, int64(512), task.CPU)
+	assert.Equal(t, int64(1024), task.Memory)
+
+	// An explicit task memory takes precedence over the Nomad resources.
+	task = ECSTaskConfig{LaunchType: "EC2", TaskDefinition: "web:1", Memory: 2000}
+	require.NoError(t, injectNomadTask(context.Background(), client, cfg, &task))
+	assert.Equal(t, int64(500), task.CPU)
+	assert.Equal(t, int64(2000), task.Memory)
+}
@@ -0,0 +1,123 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+)
+
+// ecsAttachmentDetailENIID is the attachment detail key holding the ID of the
+// task ENI.
+const ecsAttachmentDetailENIID = "networkInterfaceId"
+
+// These are the task status driver attribute keys describing the ECS task.
+const (
+	attrARN                  = "arn"
+	attrCluster              = "cluster"
+	attrClusterARN           = "cluster_arn"
+	attrRegion               = "region"
+	attrTaskDefinitionARN    = "task_definition_arn"
+	attrLaunchType           = "launch_type"
+	attrCapacityProvider     = "capacity_provider"
+	attrPlatformVersion      = "platform_version"
+	attrAvailabilityZone     = "availability_zone"
+	attrENIID                = "eni_id"
+	attrPrivateIP            = "private_ip"
+	attrContainerInstanceARN = "container_instance_arn"
+	attrLastStatus           = "last_status"
+	attrDesiredStatus        = "desired_status"
+	attrStopCode             = "stop_code"
+	attrStoppedReason        = "stopped_reason"
+	attrPullStartedAt        = "pull_started_at"
+	attrPullStoppedAt        = "pull_stopped_at"
+	attrStartedAt            = "started_at"
+	attrStoppingAt           = "stopping_at"
+	attrStoppedAt            = "stopped_at"
+	attrExecuteCommand       = "execute_command"
+	attrRoleARN              = "role_arn"
+)
+
+// These are the task status driver attribute keys describing each container
+// of the ECS task, formatted with the container name.
+const (
+	attrContainerLastStatus  = "container.%s.last_status"
+	attrContainerImageDigest = "container.%s.image_digest"
+	attrContainerRuntimeID   = "container.%s.runtime_id"
+	attrContainerExitCode    = "container.%s.exit_code"
+	attrContainerReason      = "container.%s.reason"
+)
+
+// taskAttributes flattens the ECS task description into task status driver
+// attributes, so that operators can debug the task using nomad alloc status
+// rather than the AWS console. Empty fields are omitted.
+func taskAttributes(task *ecs.Task) map[string]string {
+	attrs := make(map[string]string)
+	set := func(key, value string) {
+		if value != "" {
+			attrs[key] = value
+		}
+	}
+	setTime := func(key string, t *time.Time) {
+		if t != nil {
+			attrs[key] = t.UTC().Format(time.RFC3339)
+		}
+	}
+
+	set(attrARN, aws.StringValue(task.TaskArn))
+	set(attrClusterARN, aws.StringValue(task.ClusterArn))
+	set(attrTaskDefinitionARN, aws.StringValue(task.TaskDefinitionArn))
+	set(attrLaunchType, string(task.LaunchType))
+	set(attrCapacityProvider, aws.StringValue(task.CapacityProviderName))
+	set(attrPlatformVersion, aws.StringValue(task.PlatformVersion))
+	set(attrAvailabilityZone, aws.StringValue(task.AvailabilityZone))
+	set(attrENIID, taskAttachmentDetail(task, ecsAttachmentDetailENIID))
+	set(attrPrivateIP, taskENIAddress(task))
+	set(attrContainerInstanceARN, aws.StringValue(task.ContainerInstanceArn))
+	set(attrLastStatus, aws.StringValue(task.LastStatus))
+	set(attrDesiredStatus, aws.StringValue(task.DesiredStatus))
+	set(attrStopCode, string(task.StopCode))
+	set(attrStoppedReason, aws.StringValue(task.StoppedReason))
+	setTime(attrPullStartedAt, task.PullStartedAt)
+	setTime(attrPullStoppedAt, task.PullStoppedAt)
+	setTime(attrStartedAt, task.StartedAt)
+	setTime(attrStoppingAt, task.StoppingAt)
+	setTime(attrStoppedAt, task.StoppedAt)
+
+	for _, c := range task.Containers {
+		name := aws.StringValue(c.Name)
+		set(fmt.Sprintf(attrContainerLastStatus, name), aws.StringValue(c.LastStatus))
+		set(fmt.Sprintf(attrContainerImageDigest, name), aws.StringValue(c.ImageDigest))
+		set(fmt.Sprintf(attrContainerRuntimeID, name), aws.StringValue(c.RuntimeId))
+		set(fmt.Sprintf(attrContainerReason, name), aws.StringValue(c.Reason))
+		if c.ExitCode != nil {
+			attrs[fmt.Sprintf(attrContainerExitCode, name)] = strconv.FormatInt(*c.ExitCode, 10)
+		}
+	}
+
+	for k, v := range newTaskHealth(task).attributes() {
+		attrs[k] = v
+	}
+	return attrs
+}
+
+// taskAttachmentDetail returns the value of the detail of the ECS task ENI
+// attachment, or an empty string if the task has no such attachment.
+func taskAttachmentDetail(task *ecs.Task, name string) string {
+	for _, a := range task.Attachments {
+		if aws.StringValue(a.Type) != ecsAttachmentTypeENI {
+			continue
+		}
+		for _, kv := range a.Details {
+			if aws.StringValue(kv.Name) == name {
+				return aws.StringValue(kv.Value)
+			}
+		}
+	}
+	return ""
+}
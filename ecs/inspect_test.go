@@ -0,0 +1,104 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/assert"
+)
+
+func testInspectTask() *ecs.Task {
+	started := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	return &ecs.Task{
+		TaskArn:           aws.String("arn:aws:ecs:us-east-1:123456789012:task/nomad/1"),
+		ClusterArn:        aws.String("arn:aws:ecs:us-east-1:123456789012:cluster/nomad"),
+		TaskDefinitionArn: aws.String("arn:aws:ecs:us-east-1:123456789012:task-definition/web:1"),
+		LaunchType:        ecs.LaunchTypeFargate,
+		PlatformVersion:   aws.String("1.4.0"),
+		AvailabilityZone:  aws.String("us-east-1a"),
+		LastStatus:        aws.String("STOPPED"),
+		DesiredStatus:     aws.String("STOPPED"),
+		HealthStatus:      ecs.HealthStatusUnknown,
+		StopCode:          ecs.TaskStopCodeEssentialContainerExited,
+		StoppedReason:     aws.String("Essential container in task exited"),
+		PullStartedAt:     aws.Time(started.Add(-time.Minute)),
+		PullStoppedAt:     aws.Time(started.Add(-30 * time.Second)),
+		StartedAt:         aws.Time(started),
+		StoppedAt:         aws.Time(started.Add(time.Hour)),
+		Attachments: []ecs.Attachment{{
+			Type: aws.String(ecsAttachmentTypeENI),
+			Details: []ecs.KeyValuePair{
+				{Name: aws.String(ecsAttachmentDetailENIID), Value: aws.String("eni-0a1b2c3d")},
+				{Name: aws.String(ecsAttachmentDetailPrivateIPv4), Value: aws.String("10.0.1.23")},
+			},
+		}},
+		Containers: []ecs.Container{{
+			Name:        aws.String("web"),
+			LastStatus:  aws.String("STOPPED"),
+			ImageDigest: aws.String("sha256:4b1f"),
+			RuntimeId:   aws.String("6d9c1a3e-1234"),
+			ExitCode:    aws.Int64(137),
+			Reason:      aws.String("OutOfMemoryError: Container killed due to memory usage"),
+		}},
+	}
+}
+
+func Test_taskAttributes(t *testing.T) {
+	assert.Equal(t, map[string]string{
+		"arn":                        "arn:aws:ecs:us-east-1:123456789012:task/nomad/1",
+		"cluster_arn":                "arn:aws:ecs:us-east-1:123456789012:cluster/nomad",
+		"task_definition_arn":        "arn:aws:ecs:us-east-1:123456789012:task-definition/web:1",
+		"launch_type":                "FARGATE",
+		"platform_version":           "1.4.0",
+		"availability_zone":          "us-east-1a",
+		"eni_id":                     "eni-0a1b2c3d",
+		"private_ip":                 "10.0.1.23",
+		"last_status":                "STOPPED",
+		"desired_status":             "STOPPED",
+		"stop_code":                  "EssentialContainerExited",
+		"stopped_reason":             "Essential container in task exited",
+		"pull_started_at":            "2021-06-01T11:59:00Z",
+		"pull_stopped_at":            "2021-06-01T11:59:30Z",
+		"started_at":                 "2021-06-01T12:00:00Z",
+		"stopped_at":                 "2021-06-01T13:00:00Z",
+		"health_status":              "UNKNOWN",
+		"container.web.last_status":  "STOPPED",
+		"container.web.image_digest": "sha256:4b1f",
+		"container.web.runtime_id":   "6d9c1a3e-1234",
+		"container.web.exit_code":    "137",
+		"container.web.reason":       "OutOfMemoryError: Container killed due to memory usage",
+	}, taskAttributes(testInspectTask()))
+}
+
+func Test_taskHandle_TaskStatus(t *testing.T) {
+	h := newTaskHandle(hclog.NewNullLogger(), TaskState{
+		ARN:              "arn:aws:ecs:us-east-1:123456789012:task/nomad/1",
+		Cluster:          "nomad",
+		CapacityProvider: "FARGATE",
+		Network:          &drivers.DriverNetwork{IP: "10.0.1.23"},
+	}, &drivers.TaskConfig{ID: "alloc/web/1", Name: "web"}, nil, nil, nil, nil)
+
+	// Before the task is described, only the state known from starting it
+	// is available.
+	assert.Equal(t, map[string]string{
+		"arn":               "arn:aws:ecs:us-east-1:123456789012:task/nomad/1",
+		"cluster":           "nomad",
+		"capacity_provider": "FARGATE",
+		"private_ip":        "10.0.1.23",
+		"execute_command":   "false",
+	}, h.TaskStatus().DriverAttributes)
+
+	h.setSnapshot(testInspectTask())
+	attrs := h.TaskStatus().DriverAttributes
+	assert.Equal(t, "nomad", attrs["cluster"])
+	assert.Equal(t, "FARGATE", attrs["capacity_provider"])
+	assert.Equal(t, "eni-0a1b2c3d", attrs["eni_id"])
+	assert.Equal(t, "137", attrs["container.web.exit_code"])
+}
@@ -0,0 +1,390 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	// These are the ECS container log configuration options used to identify
+	// the CloudWatch log stream of a container using the awslogs driver.
+	awslogsDriver             = "awslogs"
+	awslogsOptionGroup        = "awslogs-group"
+	awslogsOptionRegion       = "awslogs-region"
+	awslogsOptionStreamPrefix = "awslogs-stream-prefix"
+
+	// logCursorFile is the name of the file, within the task directory, used
+	// to persist the log forwarding cursors. Nomad only persists the driver
+	// state returned when the task is started, so the cursors, which advance
+	// as events are forwarded, cannot be stored within it. The file is
+	// created empty when the task is started.
+	logCursorFile = "ecs-log-cursors.json"
+
+	// logPollInterval is the interval at which CloudWatch is queried for new
+	// log events.
+	logPollInterval = 2 * time.Second
+
+	// logFlushTimeout is the maximum time spent reading the remaining log
+	// events once the forwarder has been stopped.
+	logFlushTimeout = 10 * time.Second
+)
+
+// logsClientInterface encapsulates the AWS functionality required to forward
+// ECS container logs from CloudWatch.
+type logsClientInterface interface {
+
+	// GetLogEvents returns the log events of the stream which follow the
+	// passed cursor, along with the cursor to use for the next call. A stream
+	// which does not yet exist is treated as empty.
+	GetLogEvents(ctx context.Context, stream logStream, cursor logCursor) ([]logEvent, logCursor, error)
+}
+
+// logStream identifies the CloudWatch log stream of a single ECS container.
+type logStream struct {
+	Container string
+	Region    string
+	Group     string
+	Stream    string
+}
+
+// logEvent is a single log line read from CloudWatch.
+type logEvent struct {
+	Timestamp int64
+	Message   string
+}
+
+// logCursor tracks the position within a log stream up to which events have
+// been forwarded. If the token is rejected, such as once it expires, reading
+// resumes from the last timestamp, skipping the events forwarded with it.
+type logCursor struct {
+	NextToken     string
+	LastTimestamp int64
+
+	// LastTimestampEvents is the number of events forwarded with the last
+	// timestamp, as multiple events may share the same millisecond.
+	LastTimestampEvents int
+}
+
+// logStreamsFromTaskDefinition returns the CloudWatch log streams for all
+// containers in the task definition which use the awslogs log driver. The
+// stream name follows the ECS convention of prefix/container-name/task-id,
+// therefore containers without a stream prefix are skipped.
+func logStreamsFromTaskDefinition(def *ecs.TaskDefinition, taskARN string) []logStream {
+	taskID := taskARN[strings.LastIndex(taskARN, "/")+1:]
+
+	var streams []logStream
+	for _, c := range def.ContainerDefinitions {
+		if c.LogConfiguration == nil || string(c.LogConfiguration.LogDriver) != awslogsDriver {
+			continue
+		}
+
+		opts := c.LogConfiguration.Options
+		if opts[awslogsOptionGroup] == "" || opts[awslogsOptionStreamPrefix] == "" {
+			continue
+		}
+
+		name := aws.StringValue(c.Name)
+		streams = append(streams, logStream{
+			Container: name,
+			Region:    opts[awslogsOptionRegion],
+			Group:     opts[awslogsOptionGroup],
+			Stream:    fmt.Sprintf("%s/%s/%s", opts[awslogsOptionStreamPrefix], name, taskID),
+		})
+	}
+	return streams
+}
+
+// logForwarder tails the CloudWatch log streams of an ECS task and writes
+// the events to the Nomad task stdout. Errors encountered while reading logs
+// are written to the task stderr so they are visible to operators.
+type logForwarder struct {
+	logger     hclog.Logger
+	client     logsClientInterface
+	streams    []logStream
+	cursorPath string
+	stdout     io.Writer
+	stderr     io.Writer
+
+	// cursors is keyed by container name and only accessed by run.
+	cursors map[string]logCursor
+}
+
+func newLogForwarder(logger hclog.Logger, client logsClientInterface, streams []logStream,
+	cursorPath string, stdout, stderr io.Writer) *logForwarder {
+	logger = logger.Named("logs")
+
+	// The cursor file is created when the task is started, so failing to
+	// read it means the position was lost. Rather than writing the streams
+	// again from their start, forwarding resumes from now.
+	cursors, err := loadLogCursors(cursorPath)
+	if err != nil {
+		logger.Warn("failed to read log cursors, forwarding logs from now", "error", err)
+		fmt.Fprintf(stderr, "[%s] - failed to read CloudWatch log position, earlier logs are not forwarded: %v\n",
+			time.Now().Format(time.RFC3339), err)
+		now := time.Now().UnixNano() / int64(time.Millisecond)
+		for _, stream := range streams {
+			cursors[stream.Container] = logCursor{LastTimestamp: now}
+		}
+	}
+
+	return &logForwarder{
+		logger:     logger,
+		client:     client,
+		streams:    streams,
+		cursorPath: cursorPath,
+		stdout:     stdout,
+		stderr:     stderr,
+		cursors:    cursors,
+	}
+}
+
+// run forwards log events until the context is cancelled, at which point any
+// remaining events are flushed before returning.
+func (f *logForwarder) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), logFlushTimeout)
+			f.poll(flushCtx)
+			cancel()
+			return
+		case <-time.After(logPollInterval):
+			f.poll(ctx)
+		}
+	}
+}
+
+// poll reads and writes all the available events of every stream and then
+// persists the updated cursors.
+func (f *logForwarder) poll(ctx context.Context) {
+	updated := false
+
+	for _, stream := range f.streams {
+		for {
+			cursor := f.cursors[stream.Container]
+			events, next, err := f.client.GetLogEvents(ctx, stream, cursor)
+			if err != nil {
+				f.logger.Warn("failed to read log events", "container", stream.Container, "error", err)
+				fmt.Fprintf(f.stderr, "[%s] - failed to read CloudWatch logs for container %s: %v\n",
+					time.Now().Format(time.RFC3339), stream.Container, err)
+				break
+			}
+
+			for _, e := range events {
+				f.write(stream, e)
+			}
+			f.cursors[stream.Container] = next
+
+			// CloudWatch returns the same token once the end of the stream
+			// has been reached.
+			if len(events) == 0 || next == cursor {
+				break
+			}
+			updated = true
+		}
+	}
+
+	if updated {
+		if err := saveLogCursors(f.cursorPath, f.cursors); err != nil {
+			f.logger.Warn("failed to persist log cursors", "error", err)
+		}
+	}
+}
+
+func (f *logForwarder) write(stream logStream, e logEvent) {
+	msg := e.Message
+	if !strings.HasSuffix(msg, "\n") {
+		msg += "\n"
+	}
+
+	// Only prefix the container name when the output of multiple containers
+	// is interleaved.
+	if len(f.streams) > 1 {
+		msg = fmt.Sprintf("[%s] %s", stream.Container, msg)
+	}
+
+	if _, err := io.WriteString(f.stdout, msg); err != nil {
+		f.logger.Error("failed to write log event to stdout", "error", err)
+	}
+}
+
+// loadLogCursors reads the persisted log cursors. The returned cursors are
+// empty, rather than nil, if there is an error or no path.
+func loadLogCursors(path string) (map[string]logCursor, error) {
+	cursors := make(map[string]logCursor)
+	if path == "" {
+		return cursors, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cursors, err
+	}
+	if err := json.Unmarshal(data, &cursors); err != nil {
+		return make(map[string]logCursor), fmt.Errorf("failed to decode %s: %v", path, err)
+	}
+	return cursors, nil
+}
+
+// saveLogCursors atomically persists the log cursors.
+func saveLogCursors(path string, cursors map[string]logCursor) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(cursors)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// logCursorPath returns the path of the log cursor file within the task
+// directory.
+func logCursorPath(taskDir string) string {
+	if taskDir == "" {
+		return ""
+	}
+	return filepath.Join(taskDir, logCursorFile)
+}
+
+type awsLogsClient struct {
+	cfg aws.Config
+
+	// clients are keyed by region, as the awslogs driver may be configured
+	// to write to a region other than that of the ECS cluster.
+	clients map[string]*cloudwatchlogs.Client
+	lock    sync.Mutex
+}
+
+func newAwsLogsClient(cfg aws.Config) *awsLogsClient {
+	return &awsLogsClient{
+		cfg:     cfg,
+		clients: make(map[string]*cloudwatchlogs.Client),
+	}
+}
+
+// withCredentials returns a client which defaults to the region and uses the
+// credentials, if set, or otherwise the client itself if it already does.
+func (c *awsLogsClient) withCredentials(region string, creds aws.CredentialsProvider) *awsLogsClient {
+	if creds == nil && (region == "" || region == c.cfg.Region) {
+		return c
+	}
+
+	cfg := c.cfg.Copy()
+	if region != "" {
+		cfg.Region = region
+	}
+	if creds != nil {
+		cfg.Credentials = creds
+	}
+	return newAwsLogsClient(cfg)
+}
+
+func (c *awsLogsClient) client(region string) *cloudwatchlogs.Client {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if region == "" {
+		region = c.cfg.Region
+	}
+	if client, ok := c.clients[region]; ok {
+		return client
+	}
+
+	cfg := c.cfg.Copy()
+	cfg.Region = region
+	client := cloudwatchlogs.New(cfg)
+	c.clients[region] = client
+	return client
+}
+
+// GetLogEvents satisfies the ecs.logsClientInterface GetLogEvents interface
+// function.
+func (c *awsLogsClient) GetLogEvents(ctx context.Context, stream logStream, cursor logCursor) ([]logEvent, logCursor, error) {
+	resp, err := c.getLogEvents(ctx, stream, cursor)
+
+	// Tokens expire, so a rejected token falls back to reading from the last
+	// timestamp.
+	var awsErr awserr.Error
+	if cursor.NextToken != "" && errors.As(err, &awsErr) &&
+		awsErr.Code() == cloudwatchlogs.ErrCodeInvalidParameterException {
+		cursor.NextToken = ""
+		resp, err = c.getLogEvents(ctx, stream, cursor)
+	}
+	if err != nil {
+		if errors.As(err, &awsErr) && awsErr.Code() == cloudwatchlogs.ErrCodeResourceNotFoundException {
+			return nil, cursor, nil
+		}
+		return nil, cursor, err
+	}
+
+	next := cursor
+	next.NextToken = aws.StringValue(resp.NextForwardToken)
+
+	// Reading from a timestamp includes the events already forwarded with
+	// it, which are returned first.
+	skip := 0
+	if cursor.NextToken == "" {
+		skip = cursor.LastTimestampEvents
+	}
+
+	events := make([]logEvent, 0, len(resp.Events))
+	for _, e := range resp.Events {
+		ts := aws.Int64Value(e.Timestamp)
+		if ts == cursor.LastTimestamp && skip > 0 {
+			skip--
+			continue
+		}
+		events = append(events, logEvent{Timestamp: ts, Message: aws.StringValue(e.Message)})
+
+		switch {
+		case ts > next.LastTimestamp:
+			next.LastTimestamp = ts
+			next.LastTimestampEvents = 1
+		case ts == next.LastTimestamp:
+			next.LastTimestampEvents++
+		}
+	}
+	return events, next, nil
+}
+
+// getLogEvents reads the log events of the stream following the cursor token,
+// or from the cursor timestamp if it has no token.
+func (c *awsLogsClient) getLogEvents(ctx context.Context, stream logStream,
+	cursor logCursor) (*cloudwatchlogs.GetLogEventsResponse, error) {
+	input := cloudwatchlogs.GetLogEventsInput{
+		LogGroupName:  aws.String(stream.Group),
+		LogStreamName: aws.String(stream.Stream),
+		StartFromHead: aws.Bool(true),
+	}
+	if cursor.NextToken != "" {
+		input.NextToken = aws.String(cursor.NextToken)
+	} else if cursor.LastTimestamp > 0 {
+		input.StartTime = aws.Int64(cursor.LastTimestamp)
+	}
+	return c.client(stream.Region).GetLogEventsRequest(&input).Send(ctx)
+}
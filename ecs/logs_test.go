@@ -0,0 +1,213 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockLogsClient serves log events from memory, using the index of the next
+// event as the cursor token. A cursor without a token reads from its last
+// timestamp.
+type mockLogsClient struct {
+	events map[string][]logEvent
+}
+
+func (m *mockLogsClient) GetLogEvents(_ context.Context, stream logStream, cursor logCursor) ([]logEvent, logCursor, error) {
+	events := m.events[stream.Stream]
+
+	start := 0
+	if cursor.NextToken != "" {
+		start = len(cursor.NextToken)
+	} else {
+		for start < len(events) && events[start].Timestamp < cursor.LastTimestamp {
+			start++
+		}
+	}
+	end := start + 2
+	if end > len(events) {
+		end = len(events)
+	}
+	return events[start:end], logCursor{NextToken: string(bytes.Repeat([]byte("f"), end))}, nil
+}
+
+func Test_logStreamsFromTaskDefinition(t *testing.T) {
+	def := &ecs.TaskDefinition{
+		ContainerDefinitions: []ecs.ContainerDefinition{
+			{
+				Name: aws.String("web"),
+				LogConfiguration: &ecs.LogConfiguration{
+					LogDriver: ecs.LogDriverAwslogs,
+					Options: map[string]string{
+						"awslogs-group":         "/ecs/demo",
+						"awslogs-region":        "us-east-1",
+						"awslogs-stream-prefix": "ecs",
+					},
+				},
+			},
+			{
+				Name: aws.String("no-prefix"),
+				LogConfiguration: &ecs.LogConfiguration{
+					LogDriver: ecs.LogDriverAwslogs,
+					Options:   map[string]string{"awslogs-group": "/ecs/demo"},
+				},
+			},
+			{Name: aws.String("no-logs")},
+		},
+	}
+
+	expected := []logStream{
+		{Container: "web", Region: "us-east-1", Group: "/ecs/demo", Stream: "ecs/web/0123456789abcdef"},
+	}
+	actual := logStreamsFromTaskDefinition(def, "arn:aws:ecs:us-east-1:123:task/demo/0123456789abcdef")
+	assert.Equal(t, expected, actual)
+}
+
+func Test_logForwarder(t *testing.T) {
+	client := &mockLogsClient{events: map[string][]logEvent{
+		"ecs/web/1": {{Message: "one"}, {Message: "two"}, {Message: "three\n"}},
+	}}
+	streams := []logStream{{Container: "web", Stream: "ecs/web/1"}}
+	cursorPath := filepath.Join(t.TempDir(), logCursorFile)
+	require.NoError(t, saveLogCursors(cursorPath, map[string]logCursor{}))
+
+	// Forward all the available events and check the cursor is persisted.
+	var stdout, stderr bytes.Buffer
+	fwd := newLogForwarder(hclog.NewNullLogger(), client, streams, cursorPath, &stdout, &stderr)
+	fwd.poll(context.Background())
+	assert.Equal(t, "one\ntwo\nthree\n", stdout.String())
+	assert.Empty(t, stderr.String())
+	cursors, err := loadLogCursors(cursorPath)
+	require.NoError(t, err)
+	assert.Equal(t, logCursor{NextToken: "fff"}, cursors["web"])
+
+	// A new forwarder, such as after recovery, should only write new events.
+	client.events["ecs/web/1"] = append(client.events["ecs/web/1"], logEvent{Message: "four"})
+	stdout.Reset()
+	fwd = newLogForwarder(hclog.NewNullLogger(), client, streams, cursorPath, &stdout, &stderr)
+	fwd.poll(context.Background())
+	assert.Equal(t, "four\n", stdout.String())
+}
+
+func Test_logForwarder_lostCursors(t *testing.T) {
+	testCases := []struct {
+		name  string
+		setup func(path string) error
+	}{
+		{
+			name:  "missing",
+			setup: func(string) error { return nil },
+		},
+		{
+			name:  "corrupt",
+			setup: func(path string) error { return ioutil.WriteFile(path, []byte(`{"web":`), 0600) },
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			now := time.Now().UnixNano() / int64(time.Millisecond)
+			client := &mockLogsClient{events: map[string][]logEvent{
+				"ecs/web/1": {{Timestamp: now - 2000, Message: "one"}, {Timestamp: now - 1000, Message: "two"}},
+			}}
+			streams := []logStream{{Container: "web", Stream: "ecs/web/1"}}
+			cursorPath := filepath.Join(t.TempDir(), logCursorFile)
+			require.NoError(t, tc.setup(cursorPath))
+
+			// Without a cursor the existing events are not written again,
+			// and the lost position is reported on stderr.
+			var stdout, stderr bytes.Buffer
+			fwd := newLogForwarder(hclog.NewNullLogger(), client, streams, cursorPath, &stdout, &stderr)
+			fwd.poll(context.Background())
+			assert.Empty(t, stdout.String())
+			assert.Contains(t, stderr.String(), "failed to read CloudWatch log position")
+
+			// Events which follow are forwarded.
+			client.events["ecs/web/1"] = append(client.events["ecs/web/1"],
+				logEvent{Timestamp: now + 1000, Message: "three"})
+			fwd.poll(context.Background())
+			assert.Equal(t, "three\n", stdout.String())
+		})
+	}
+}
+
+func Test_awsLogsClient_GetLogEvents(t *testing.T) {
+	var requests []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		data, _ := ioutil.ReadAll(r.Body)
+		_ = json.Unmarshal(data, &body)
+		requests = append(requests, body)
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		if body["nextToken"] != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"__type":"InvalidParameterException","message":"The specified nextToken is invalid."}`)
+			return
+		}
+		fmt.Fprint(w, `{"nextForwardToken":"f/2","events":[
+			{"timestamp":1000,"message":"two"},
+			{"timestamp":1000,"message":"three"},
+			{"timestamp":1001,"message":"four"}]}`)
+	}))
+	defer srv.Close()
+
+	client := newAwsLogsClient(testAWSConfig(srv.URL))
+	stream := logStream{Container: "web", Group: "/ecs/demo", Stream: "ecs/web/1"}
+
+	// The expired token falls back to reading from the last timestamp,
+	// skipping the event already forwarded with it.
+	events, next, err := client.GetLogEvents(context.Background(), stream,
+		logCursor{NextToken: "f/1", LastTimestamp: 1000, LastTimestampEvents: 1})
+	require.NoError(t, err)
+	assert.Equal(t, []logEvent{{Timestamp: 1000, Message: "three"}, {Timestamp: 1001, Message: "four"}}, events)
+	assert.Equal(t, logCursor{NextToken: "f/2", LastTimestamp: 1001, LastTimestampEvents: 1}, next)
+
+	require.Len(t, requests, 2)
+	assert.Equal(t, "f/1", requests[0]["nextToken"])
+	assert.Nil(t, requests[1]["nextToken"])
+	assert.Equal(t, float64(1000), requests[1]["startTime"])
+}
+
+func Test_awsLogsClient_withCredentials(t *testing.T) {
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		fmt.Fprint(w, `{"nextForwardToken":"f/1","events":[]}`)
+	}))
+	defer srv.Close()
+
+	client := newAwsLogsClient(testAWSConfig(srv.URL))
+	assert.Same(t, client, client.withCredentials("us-east-1", nil))
+
+	// Logs are read using the task credentials, from the task region unless
+	// the container sets the awslogs-region option.
+	creds := aws.NewStaticCredentialsProvider("AKIDTASK", "SECRET", "")
+	taskClient := client.withCredentials("eu-west-1", creds)
+	_, _, err := taskClient.GetLogEvents(context.Background(), logStream{Group: "/ecs/demo", Stream: "ecs/web/1"}, logCursor{})
+	require.NoError(t, err)
+	assert.Contains(t, auth, "Credential=AKIDTASK/")
+	assert.Contains(t, auth, "/eu-west-1/logs/")
+
+	_, _, err = taskClient.GetLogEvents(context.Background(),
+		logStream{Region: "us-west-2", Group: "/ecs/demo", Stream: "ecs/web/1"}, logCursor{})
+	require.NoError(t, err)
+	assert.Contains(t, auth, "/us-west-2/logs/")
+}
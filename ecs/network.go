@@ -0,0 +1,141 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// ecsAttachmentTypeENI is the attachment type ECS uses to describe the
+	// elastic network interface of an awsvpc task.
+	ecsAttachmentTypeENI = "ElasticNetworkInterface"
+
+	// ecsAttachmentDetailPrivateIPv4 is the attachment detail key holding the
+	// private IPv4 address of the task ENI.
+	ecsAttachmentDetailPrivateIPv4 = "privateIPv4Address"
+
+	// networkWaitTimeout is the maximum time StartTask will wait for the ECS
+	// task ENI to be attached before continuing without a driver network.
+	networkWaitTimeout = 2 * time.Minute
+
+	// networkPollInterval is the interval at which the ECS task is described
+	// while waiting for the ENI to be attached.
+	networkPollInterval = 5 * time.Second
+)
+
+// waitForNetwork waits for the awsvpc ENI of the ECS task to be attached and
+// builds the Nomad driver network from it. A nil network and nil error are
+// returned when the task does not use the awsvpc network mode, or stops
+// before the ENI is attached.
+func waitForNetwork(ctx context.Context, client ecsClientInterface, arn string) (*drivers.DriverNetwork, error) {
+	ctx, cancel := context.WithTimeout(ctx, networkWaitTimeout)
+	defer cancel()
+
+	var def *ecs.TaskDefinition
+
+	for {
+		task, err := client.DescribeTask(ctx, arn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe ECS task: %v", err)
+		}
+
+		if def == nil {
+			if def, err = client.DescribeTaskDefinition(ctx, aws.StringValue(task.TaskDefinitionArn)); err != nil {
+				return nil, fmt.Errorf("failed to describe ECS task definition: %v", err)
+			}
+			if def.NetworkMode != ecs.NetworkModeAwsvpc {
+				return nil, nil
+			}
+		}
+
+		if net := driverNetworkFromTask(task, def); net != nil {
+			return net, nil
+		}
+		if isTerminalStatus(aws.StringValue(task.LastStatus)) {
+			return nil, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out waiting for ECS task ENI: %v", ctx.Err())
+		case <-time.After(networkPollInterval):
+		}
+	}
+}
+
+// lookupNetwork describes the ECS task once and builds the Nomad driver
+// network from its awsvpc ENI, without waiting for the ENI to be attached. A
+// nil network and nil error are returned when the task does not use the
+// awsvpc network mode or does not yet have an address.
+func lookupNetwork(ctx context.Context, client ecsClientInterface, arn string) (*drivers.DriverNetwork, error) {
+	task, err := client.DescribeTask(ctx, arn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe ECS task: %v", err)
+	}
+
+	def, err := client.DescribeTaskDefinition(ctx, aws.StringValue(task.TaskDefinitionArn))
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe ECS task definition: %v", err)
+	}
+	if def.NetworkMode != ecs.NetworkModeAwsvpc {
+		return nil, nil
+	}
+	return driverNetworkFromTask(task, def), nil
+}
+
+// driverNetworkFromTask builds the Nomad driver network using the address of
+// the ECS task ENI and the port mappings of the task definition containers.
+// Nil is returned if the task does not yet have an address.
+//
+// Port mappings are labelled using the container name and container port,
+// for example "web-8080", so they can be referenced by Nomad services using
+// address_mode = "driver".
+func driverNetworkFromTask(task *ecs.Task, def *ecs.TaskDefinition) *drivers.DriverNetwork {
+	ip := taskENIAddress(task)
+	if ip == "" {
+		return nil
+	}
+
+	portMap := make(map[string]int)
+	for _, c := range def.ContainerDefinitions {
+		for _, pm := range c.PortMappings {
+			if pm.ContainerPort == nil {
+				continue
+			}
+			label := fmt.Sprintf("%s-%d", aws.StringValue(c.Name), *pm.ContainerPort)
+			portMap[label] = int(*pm.ContainerPort)
+		}
+	}
+
+	return &drivers.DriverNetwork{
+		PortMap:       portMap,
+		IP:            ip,
+		AutoAdvertise: true,
+	}
+}
+
+// taskENIAddress returns the private address of the ECS task ENI. The IPv4
+// address is preferred, falling back to the IPv6 address for IPv6 only
+// subnets. An empty string is returned if the ENI is not yet attached.
+func taskENIAddress(task *ecs.Task) string {
+	for _, c := range task.Containers {
+		for _, ni := range c.NetworkInterfaces {
+			if ip := aws.StringValue(ni.PrivateIpv4Address); ip != "" {
+				return ip
+			}
+			if ip := aws.StringValue(ni.Ipv6Address); ip != "" {
+				return ip
+			}
+		}
+	}
+
+	return taskAttachmentDetail(task, ecsAttachmentDetailPrivateIPv4)
+}
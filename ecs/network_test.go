@@ -0,0 +1,125 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_driverNetworkFromTask(t *testing.T) {
+	def := &ecs.TaskDefinition{
+		NetworkMode: ecs.NetworkModeAwsvpc,
+		ContainerDefinitions: []ecs.ContainerDefinition{
+			{
+				Name: aws.String("web"),
+				PortMappings: []ecs.PortMapping{
+					{ContainerPort: aws.Int64(8080)},
+					{ContainerPort: aws.Int64(9090)},
+				},
+			},
+			{Name: aws.String("sidecar")},
+		},
+	}
+
+	testCases := []struct {
+		name            string
+		inputTask       *ecs.Task
+		expectedNetwork *drivers.DriverNetwork
+	}{
+		{
+			name:            "eni not attached",
+			inputTask:       &ecs.Task{},
+			expectedNetwork: nil,
+		},
+		{
+			name: "container ipv4 address",
+			inputTask: &ecs.Task{
+				Containers: []ecs.Container{
+					{NetworkInterfaces: []ecs.NetworkInterface{{PrivateIpv4Address: aws.String("10.0.1.10")}}},
+				},
+			},
+			expectedNetwork: &drivers.DriverNetwork{
+				PortMap:       map[string]int{"web-8080": 8080, "web-9090": 9090},
+				IP:            "10.0.1.10",
+				AutoAdvertise: true,
+			},
+		},
+		{
+			name: "container ipv6 address",
+			inputTask: &ecs.Task{
+				Containers: []ecs.Container{
+					{NetworkInterfaces: []ecs.NetworkInterface{{Ipv6Address: aws.String("2600:1f18::1")}}},
+				},
+			},
+			expectedNetwork: &drivers.DriverNetwork{
+				PortMap:       map[string]int{"web-8080": 8080, "web-9090": 9090},
+				IP:            "2600:1f18::1",
+				AutoAdvertise: true,
+			},
+		},
+		{
+			name: "attachment details address",
+			inputTask: &ecs.Task{
+				Attachments: []ecs.Attachment{
+					{
+						Type: aws.String("ElasticNetworkInterface"),
+						Details: []ecs.KeyValuePair{
+							{Name: aws.String("networkInterfaceId"), Value: aws.String("eni-0123")},
+							{Name: aws.String("privateIPv4Address"), Value: aws.String("10.0.1.11")},
+						},
+					},
+				},
+			},
+			expectedNetwork: &drivers.DriverNetwork{
+				PortMap:       map[string]int{"web-8080": 8080, "web-9090": 9090},
+				IP:            "10.0.1.11",
+				AutoAdvertise: true,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expectedNetwork, driverNetworkFromTask(tc.inputTask, def), tc.name)
+		})
+	}
+}
+
+func Test_lookupNetwork(t *testing.T) {
+	client := newMockECSClient()
+	client.taskDefinitions["web:1"] = &ecs.TaskDefinition{
+		NetworkMode: ecs.NetworkModeAwsvpc,
+		ContainerDefinitions: []ecs.ContainerDefinition{
+			{Name: aws.String("web"), PortMappings: []ecs.PortMapping{{ContainerPort: aws.Int64(8080)}}},
+		},
+	}
+	client.tasks["attached"] = &ecs.Task{
+		TaskArn:           aws.String("attached"),
+		TaskDefinitionArn: aws.String("web:1"),
+		Containers: []ecs.Container{
+			{NetworkInterfaces: []ecs.NetworkInterface{{PrivateIpv4Address: aws.String("10.0.1.10")}}},
+		},
+	}
+	client.tasks["pending"] = &ecs.Task{TaskArn: aws.String("pending"), TaskDefinitionArn: aws.String("web:1")}
+
+	net, err := lookupNetwork(context.Background(), client, "attached")
+	require.NoError(t, err)
+	assert.Equal(t, &drivers.DriverNetwork{
+		PortMap:       map[string]int{"web-8080": 8080},
+		IP:            "10.0.1.10",
+		AutoAdvertise: true,
+	}, net)
+
+	// A task without an ENI address is not waited for.
+	net, err = lookupNetwork(context.Background(), client, "pending")
+	require.NoError(t, err)
+	assert.Nil(t, net)
+}
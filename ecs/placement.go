@@ -0,0 +1,381 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// maxPlacementConstraints and maxPlacementStrategies are the maximum
+	// number of each which ECS accepts within a RunTask request.
+	maxPlacementConstraints = 10
+	maxPlacementStrategies  = 5
+
+	// maxPlacementExpressionLength is the maximum length of a cluster query
+	// language expression.
+	maxPlacementExpressionLength = 2000
+
+	// placementAttributePrefix prefixes the subjects and strategy fields which
+	// refer to container instance attributes.
+	placementAttributePrefix = "attribute:"
+)
+
+// These are the placement constraint and strategy types supported by ECS.
+const (
+	placementConstraintDistinctInstance = "distinctInstance"
+	placementConstraintMemberOf         = "memberOf"
+
+	placementStrategySpread  = "spread"
+	placementStrategyBinpack = "binpack"
+	placementStrategyRandom  = "random"
+)
+
+// placementSubjects are the cluster query language subjects, other than
+// attributes, which may be used within an expression.
+var placementSubjects = map[string]struct{}{
+	"agentConnected":    {},
+	"agentVersion":      {},
+	"ec2InstanceId":     {},
+	"registeredAt":      {},
+	"runningTasksCount": {},
+	"task:group":        {},
+}
+
+// placementOperatorArity describes the argument an operator expects.
+type placementOperatorArity int
+
+const (
+	placementArityNone placementOperatorArity = iota
+	placementArityValue
+	placementArityList
+)
+
+// placementOperators maps the cluster query language operators, including
+// their word forms, to the argument they expect.
+var placementOperators = map[string]placementOperatorArity{
+	"==":          placementArityValue,
+	"equals":      placementArityValue,
+	"!=":          placementArityValue,
+	"not_equals":  placementArityValue,
+	">":           placementArityValue,
+	">=":          placementArityValue,
+	"<":           placementArityValue,
+	"<=":          placementArityValue,
+	"=~":          placementArityValue,
+	"matches":     placementArityValue,
+	"!~":          placementArityValue,
+	"not_matches": placementArityValue,
+	"exists":      placementArityNone,
+	"!exists":     placementArityNone,
+	"not_exists":  placementArityNone,
+	"in":          placementArityList,
+	"!in":         placementArityList,
+	"not_in":      placementArityList,
+}
+
+// validatePlacement checks the placement constraints and strategies of the
+// task config, including parsing all the cluster query language expressions.
+func validatePlacement(t ECSTaskConfig) error {
+	if len(t.PlacementConstraints) == 0 && len(t.PlacementStrategies) == 0 {
+		return nil
+	}
+	if t.usesFargate() {
+		return errors.New("placement_constraint and placement_strategy are not supported by Fargate")
+	}
+
+	if len(t.PlacementConstraints) > maxPlacementConstraints {
+		return fmt.Errorf("at most %d placement_constraint blocks are supported", maxPlacementConstraints)
+	}
+	for _, c := range t.PlacementConstraints {
+		switch c.Type {
+		case placementConstraintDistinctInstance:
+			if c.Expression != "" {
+				return fmt.Errorf("placement_constraint %s does not support an expression", c.Type)
+			}
+		case placementConstraintMemberOf:
+			if c.Expression == "" {
+				return fmt.Errorf("placement_constraint %s requires an expression", c.Type)
+			}
+			if err := parsePlacementExpression(c.Expression); err != nil {
+				return fmt.Errorf("placement_constraint expression %q is invalid: %v", c.Expression, err)
+			}
+		default:
+			return fmt.Errorf("placement_constraint type must be %s or %s, got %q",
+				placementConstraintDistinctInstance, placementConstraintMemberOf, c.Type)
+		}
+	}
+
+	if len(t.PlacementStrategies) > maxPlacementStrategies {
+		return fmt.Errorf("at most %d placement_strategy blocks are supported", maxPlacementStrategies)
+	}
+	for _, s := range t.PlacementStrategies {
+		switch s.Type {
+		case placementStrategySpread:
+			if s.Field != "instanceId" && s.Field != "host" && !isPlacementAttribute(s.Field) {
+				return fmt.Errorf("placement_strategy %s field must be instanceId, host or an attribute, got %q",
+					s.Type, s.Field)
+			}
+		case placementStrategyBinpack:
+			if s.Field != "cpu" && s.Field != "memory" {
+				return fmt.Errorf("placement_strategy %s field must be cpu or memory, got %q", s.Type, s.Field)
+			}
+		case placementStrategyRandom:
+			if s.Field != "" {
+				return fmt.Errorf("placement_strategy %s does not support a field", s.Type)
+			}
+		default:
+			return fmt.Errorf("placement_strategy type must be %s, %s or %s, got %q",
+				placementStrategySpread, placementStrategyBinpack, placementStrategyRandom, s.Type)
+		}
+	}
+	return nil
+}
+
+// isPlacementAttribute returns whether the string refers to a container
+// instance attribute, such as attribute:ecs.availability-zone.
+func isPlacementAttribute(s string) bool {
+	return strings.HasPrefix(s, placementAttributePrefix) && len(s) > len(placementAttributePrefix)
+}
+
+// placementTokenKind identifies the type of a cluster query language token.
+type placementTokenKind int
+
+const (
+	placementTokenEOF placementTokenKind = iota
+	placementTokenWord
+	placementTokenQuoted
+	placementTokenSymbol
+)
+
+// placementToken is a single token of a cluster query language expression.
+// Pos is the byte offset of the token within the expression.
+type placementToken struct {
+	Kind placementTokenKind
+	Text string
+	Pos  int
+}
+
+// placementSymbols are the symbols of the cluster query language, ordered so
+// that the longest match is found first.
+var placementSymbols = []string{"==", "!=", "=~", "!~", ">=", "<=", "&&", "||", ">", "<", "!", "(", ")", "[", "]", ","}
+
+// placementWordTerminators are the characters which end an unquoted word.
+const placementWordTerminators = "()[],!=<>~&|'\""
+
+// tokenizePlacementExpression splits a cluster query language expression
+// into tokens.
+func tokenizePlacementExpression(expr string) ([]placementToken, error) {
+	var tokens []placementToken
+
+	for i := 0; i < len(expr); {
+		c := expr[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(expr[i+1:], c)
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated quote at position %d", i)
+			}
+			tokens = append(tokens, placementToken{Kind: placementTokenQuoted, Text: expr[i+1 : i+1+end], Pos: i})
+			i += end + 2
+
+		case strings.IndexByte(placementWordTerminators, c) >= 0:
+			matched := false
+			for _, sym := range placementSymbols {
+				if strings.HasPrefix(expr[i:], sym) {
+					tokens = append(tokens, placementToken{Kind: placementTokenSymbol, Text: sym, Pos: i})
+					i += len(sym)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected %q at position %d", string(c), i)
+			}
+
+		default:
+			start := i
+			for i < len(expr) && !strings.ContainsRune(" \t\n\r"+placementWordTerminators, rune(expr[i])) {
+				i++
+			}
+			tokens = append(tokens, placementToken{Kind: placementTokenWord, Text: expr[start:i], Pos: start})
+		}
+	}
+
+	return append(tokens, placementToken{Kind: placementTokenEOF, Pos: len(expr)}), nil
+}
+
+// placementParser is a recursive descent parser of the ECS cluster query
+// language. It only validates the expression and does not build a tree, as
+// the expression is evaluated by ECS.
+//
+//	expression := and-expr { ( "or" | "||" ) and-expr }
+//	and-expr   := unary { ( "and" | "&&" ) unary }
+//	unary      := ( "not" | "!" ) unary | "(" expression ")" | condition
+//	condition  := subject operator [ value | "[" value { "," value } "]" ]
+type placementParser struct {
+	tokens []placementToken
+	pos    int
+}
+
+// parsePlacementExpression validates a cluster query language expression.
+func parsePlacementExpression(expr string) error {
+	if len(expr) > maxPlacementExpressionLength {
+		return fmt.Errorf("expression exceeds %d characters", maxPlacementExpressionLength)
+	}
+
+	tokens, err := tokenizePlacementExpression(expr)
+	if err != nil {
+		return err
+	}
+
+	p := placementParser{tokens: tokens}
+	if err := p.expression(); err != nil {
+		return err
+	}
+	if tok := p.peek(); tok.Kind != placementTokenEOF {
+		return p.unexpected(tok)
+	}
+	return nil
+}
+
+func (p *placementParser) peek() placementToken {
+	return p.tokens[p.pos]
+}
+
+func (p *placementParser) next() placementToken {
+	tok := p.tokens[p.pos]
+	if tok.Kind != placementTokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// accept consumes the next token if it is an unquoted word or symbol
+// matching one of the passed texts.
+func (p *placementParser) accept(texts ...string) bool {
+	tok := p.peek()
+	if tok.Kind != placementTokenWord && tok.Kind != placementTokenSymbol {
+		return false
+	}
+	for _, t := range texts {
+		if tok.Text == t {
+			p.pos++
+			return true
+		}
+	}
+	return false
+}
+
+func (p *placementParser) unexpected(tok placementToken) error {
+	if tok.Kind == placementTokenEOF {
+		return errors.New("unexpected end of expression")
+	}
+	return fmt.Errorf("unexpected %q at position %d", tok.Text, tok.Pos)
+}
+
+func (p *placementParser) expression() error {
+	if err := p.and(); err != nil {
+		return err
+	}
+	for p.accept("or", "||") {
+		if err := p.and(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *placementParser) and() error {
+	if err := p.unary(); err != nil {
+		return err
+	}
+	for p.accept("and", "&&") {
+		if err := p.unary(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *placementParser) unary() error {
+	if p.accept("not", "!") {
+		return p.unary()
+	}
+	if p.accept("(") {
+		if err := p.expression(); err != nil {
+			return err
+		}
+		if !p.accept(")") {
+			return p.unexpected(p.peek())
+		}
+		return nil
+	}
+	return p.condition()
+}
+
+func (p *placementParser) condition() error {
+	subject := p.next()
+	if subject.Kind != placementTokenWord {
+		return p.unexpected(subject)
+	}
+	if _, ok := placementSubjects[subject.Text]; !ok && !isPlacementAttribute(subject.Text) {
+		return fmt.Errorf("unknown subject %q at position %d", subject.Text, subject.Pos)
+	}
+
+	op := p.next()
+	operator := op.Text
+	if op.Kind == placementTokenSymbol && op.Text == "!" {
+		// The negated exists and in operators are tokenized separately.
+		if word := p.next(); word.Kind == placementTokenWord {
+			operator += word.Text
+		}
+	}
+	if op.Kind != placementTokenWord && op.Kind != placementTokenSymbol {
+		return p.unexpected(op)
+	}
+	arity, ok := placementOperators[operator]
+	if !ok {
+		return fmt.Errorf("unknown operator %q at position %d", operator, op.Pos)
+	}
+
+	switch arity {
+	case placementArityValue:
+		return p.value()
+	case placementArityList:
+		return p.list()
+	}
+	return nil
+}
+
+func (p *placementParser) value() error {
+	tok := p.next()
+	if tok.Kind != placementTokenWord && tok.Kind != placementTokenQuoted {
+		return p.unexpected(tok)
+	}
+	return nil
+}
+
+func (p *placementParser) list() error {
+	if !p.accept("[") {
+		return p.unexpected(p.peek())
+	}
+	for {
+		if err := p.value(); err != nil {
+			return err
+		}
+		if p.accept("]") {
+			return nil
+		}
+		if !p.accept(",") {
+			return p.unexpected(p.peek())
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parsePlacementExpression(t *testing.T) {
+	testCases := []struct {
+		name          string
+		inputExpr     string
+		expectedError string
+	}{
+		{
+			name:      "attribute match",
+			inputExpr: "attribute:ecs.instance-type =~ t2.*",
+		},
+		{
+			name:      "attribute list",
+			inputExpr: "attribute:ecs.availability-zone in [us-east-1a, us-east-1b]",
+		},
+		{
+			name:      "quoted list",
+			inputExpr: "ec2InstanceId in ['i-abcd1234', \"i-wxyx7890\"]",
+		},
+		{
+			name:      "compound",
+			inputExpr: "attribute:ecs.instance-type =~ g2.* and attribute:ecs.availability-zone != us-east-1d",
+		},
+		{
+			name:      "negated group",
+			inputExpr: "not(task:group == database) && (runningTasksCount <= 2 || agentConnected == true)",
+		},
+		{
+			name:      "negated operators",
+			inputExpr: "attribute:gpu !exists or attribute:ecs.os-type !in [windows]",
+		},
+		{
+			name:      "word operators",
+			inputExpr: "agentVersion not_equals 1.5.0 and registeredAt >= 2021-01-01T00:00:00Z",
+		},
+		{
+			name:          "unknown subject",
+			inputExpr:     "instanceType == t2.micro",
+			expectedError: `unknown subject "instanceType" at position 0`,
+		},
+		{
+			name:          "unknown operator",
+			inputExpr:     "attribute:ecs.instance-type is t2.micro",
+			expectedError: `unknown operator "is" at position 28`,
+		},
+		{
+			name:          "missing value",
+			inputExpr:     "attribute:ecs.instance-type ==",
+			expectedError: "unexpected end of expression",
+		},
+		{
+			name:          "in without list",
+			inputExpr:     "attribute:ecs.availability-zone in us-east-1a",
+			expectedError: `unexpected "us-east-1a" at position 35`,
+		},
+		{
+			name:          "unbalanced parentheses",
+			inputExpr:     "(task:group == database",
+			expectedError: "unexpected end of expression",
+		},
+		{
+			name:          "trailing tokens",
+			inputExpr:     "task:group == database web",
+			expectedError: `unexpected "web" at position 23`,
+		},
+		{
+			name:          "unterminated quote",
+			inputExpr:     "task:group == 'database",
+			expectedError: "unterminated quote at position 14",
+		},
+		{
+			name:          "too long",
+			inputExpr:     "task:group == " + strings.Repeat("a", maxPlacementExpressionLength),
+			expectedError: "expression exceeds 2000 characters",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := parsePlacementExpression(tc.inputExpr)
+			if tc.expectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedError)
+			}
+		})
+	}
+}
+
+func Test_validatePlacement(t *testing.T) {
+	testCases := []struct {
+		name          string
+		inputConfig   ECSTaskConfig
+		expectedError string
+	}{
+		{
+			name: "valid",
+			inputConfig: ECSTaskConfig{
+				LaunchType: "EC2",
+				PlacementConstraints: []TaskPlacementConstraint{
+					{Type: "distinctInstance"},
+					{Type: "memberOf", Expression: "attribute:ecs.instance-type =~ t3.*"},
+				},
+				PlacementStrategies: []TaskPlacementStrategy{
+					{Type: "spread", Field: "attribute:ecs.availability-zone"},
+					{Type: "binpack", Field: "memory"},
+				},
+			},
+		},
+		{
+			name: "fargate",
+			inputConfig: ECSTaskConfig{
+				LaunchType:           "FARGATE",
+				PlacementConstraints: []TaskPlacementConstraint{{Type: "distinctInstance"}},
+			},
+			expectedError: "placement_constraint and placement_strategy are not supported by Fargate",
+		},
+		{
+			name: "invalid expression",
+			inputConfig: ECSTaskConfig{
+				LaunchType:           "EC2",
+				PlacementConstraints: []TaskPlacementConstraint{{Type: "memberOf", Expression: "attribute:ecs.instance-type = t3.micro"}},
+			},
+			expectedError: `placement_constraint expression "attribute:ecs.instance-type = t3.micro" is invalid: unexpected "=" at position 28`,
+		},
+		{
+			name: "member of without expression",
+			inputConfig: ECSTaskConfig{
+				LaunchType:           "EC2",
+				PlacementConstraints: []TaskPlacementConstraint{{Type: "memberOf"}},
+			},
+			expectedError: "placement_constraint memberOf requires an expression",
+		},
+		{
+			name: "unknown constraint type",
+			inputConfig: ECSTaskConfig{
+				LaunchType:           "EC2",
+				PlacementConstraints: []TaskPlacementConstraint{{Type: "distinct"}},
+			},
+			expectedError: `placement_constraint type must be distinctInstance or memberOf, got "distinct"`,
+		},
+		{
+			name: "binpack field",
+			inputConfig: ECSTaskConfig{
+				LaunchType:          "EC2",
+				PlacementStrategies: []TaskPlacementStrategy{{Type: "binpack", Field: "disk"}},
+			},
+			expectedError: `placement_strategy binpack field must be cpu or memory, got "disk"`,
+		},
+		{
+			name: "random field",
+			inputConfig: ECSTaskConfig{
+				LaunchType:          "EC2",
+				PlacementStrategies: []TaskPlacementStrategy{{Type: "random", Field: "cpu"}},
+			},
+			expectedError: "placement_strategy random does not support a field",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validatePlacement(tc.inputConfig)
+			if tc.expectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedError)
+			}
+		})
+	}
+}
+
+func Test_buildTaskInput_placement(t *testing.T) {
+	client := awsEcsClient{cluster: "nomad"}
+	input := client.buildTaskInput(TaskConfig{Task: ECSTaskConfig{
+		LaunchType:     "EC2",
+		TaskDefinition: "web:1",
+		PlacementConstraints: []TaskPlacementConstraint{
+			{Type: "distinctInstance"},
+			{Type: "memberOf", Expression: "attribute:ecs.instance-type =~ t3.*"},
+		},
+		PlacementStrategies: []TaskPlacementStrategy{{Type: "random"}},
+	}})
+
+	require.Len(t, input.PlacementConstraints, 2)
+	assert.Equal(t, ecs.PlacementConstraintTypeDistinctInstance, input.PlacementConstraints[0].Type)
+	assert.Nil(t, input.PlacementConstraints[0].Expression)
+	assert.Equal(t, "attribute:ecs.instance-type =~ t3.*", aws.StringValue(input.PlacementConstraints[1].Expression))
+
+	require.Len(t, input.PlacementStrategy, 1)
+	assert.Equal(t, ecs.PlacementStrategyTypeRandom, input.PlacementStrategy[0].Type)
+	assert.Nil(t, input.PlacementStrategy[0].Field)
+}
@@ -0,0 +1,296 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	// defaultPollInterval is the default interval at which the status of all
+	// ECS tasks is described.
+	defaultPollInterval = 5 * time.Second
+
+	// defaultPollJitter is the default maximum random duration added to each
+	// poll interval.
+	defaultPollJitter = 1 * time.Second
+
+	// maxPollBackoff is the maximum interval used when ECS is throttling the
+	// DescribeTasks requests.
+	maxPollBackoff = 2 * time.Minute
+)
+
+// taskUpdate is sent to the subscriber of an ECS task each time the task is
+// described. Err is set if ECS was unable to describe the task, such as when
+// the task no longer exists.
+type taskUpdate struct {
+	Task *ecs.Task
+	Err  error
+}
+
+// taskSubscription tracks a single ECS task which is being polled.
+type taskSubscription struct {
+	cluster string
+	client  ecsClientInterface
+	ch      chan taskUpdate
+
+	// version is the highest ECS task version delivered, used to discard
+	// out of order updates when the task is both polled and received as an
+	// event.
+	version int64
+
+	// polled is whether the task has been described at least once, and
+	// lastEvent is when a state change event for the task was last received.
+	// Polling is only paused for tasks which have been described and are
+	// receiving events.
+	polled    bool
+	lastEvent time.Time
+}
+
+// send delivers the update without blocking. If the subscriber has not yet
+// consumed the previous update, it is replaced as only the latest state of
+// the task is of interest.
+func (s *taskSubscription) send(u taskUpdate) {
+	if u.Task != nil && u.Task.Version != nil {
+		if *u.Task.Version < s.version {
+			return
+		}
+		s.version = *u.Task.Version
+	}
+
+	for {
+		select {
+		case s.ch <- u:
+			return
+		default:
+		}
+		select {
+		case <-s.ch:
+		default:
+		}
+	}
+}
+
+// taskPoller describes the status of all ECS tasks managed by the driver,
+// batching the ARNs of each cluster into as few DescribeTasks requests as
+// possible, and fans the results out to the subscribed task handles.
+type taskPoller struct {
+	logger hclog.Logger
+
+	// lock syncs access to all fields below
+	lock     sync.Mutex
+	subs     map[string]*taskSubscription
+	interval time.Duration
+	jitter   time.Duration
+
+	// backoff is the current interval, which grows when ECS throttles
+	// requests and shrinks back towards interval as requests succeed.
+	backoff time.Duration
+
+	// quietPeriod is the duration without state change events for a task
+	// after which it is polled again. A zero quietPeriod means no event
+	// source is configured.
+	quietPeriod time.Duration
+}
+
+func newTaskPoller(logger hclog.Logger) *taskPoller {
+	return &taskPoller{
+		logger:   logger.Named("poller"),
+		subs:     make(map[string]*taskSubscription),
+		interval: defaultPollInterval,
+		jitter:   defaultPollJitter,
+		backoff:  defaultPollInterval,
+	}
+}
+
+// SetInterval updates the poll interval and jitter.
+func (p *taskPoller) SetInterval(interval, jitter time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.interval = interval
+	p.jitter = jitter
+	p.backoff = interval
+}
+
+// SetQuietPeriod configures the duration without state change events for a
+// task after which polling of the task resumes.
+func (p *taskPoller) SetQuietPeriod(period time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.quietPeriod = period
+}
+
+// Publish delivers an ECS task received from an event source to its
+// subscriber, pausing polling of the task until no events have been received
+// for it within the quiet period. It returns whether the task is subscribed.
+func (p *taskPoller) Publish(task *ecs.Task) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	sub, ok := p.subs[aws.StringValue(task.TaskArn)]
+	if ok {
+		sub.lastEvent = time.Now()
+		sub.send(taskUpdate{Task: task})
+	}
+	return ok
+}
+
+// eventsActive returns whether the task has been described and state change
+// events have been received for it within the quiet period. The caller must
+// hold the lock.
+func (p *taskPoller) eventsActive(sub *taskSubscription) bool {
+	return sub.polled && p.quietPeriod > 0 && time.Since(sub.lastEvent) < p.quietPeriod
+}
+
+// Subscribe registers the ECS task for polling, returning the channel on
+// which updates will be delivered. The cluster, which includes the region,
+// identifies the client, as all tasks of a cluster are described together.
+func (p *taskPoller) Subscribe(cluster string, client ecsClientInterface, arn string) <-chan taskUpdate {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	sub := &taskSubscription{cluster: cluster, client: client, ch: make(chan taskUpdate, 1)}
+	p.subs[arn] = sub
+	return sub.ch
+}
+
+// Unsubscribe stops polling the ECS task.
+func (p *taskPoller) Unsubscribe(arn string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.subs, arn)
+}
+
+// run polls the ECS tasks until the context is cancelled.
+func (p *taskPoller) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.nextInterval()):
+			p.poll(ctx)
+		}
+	}
+}
+
+// nextInterval returns the duration to wait before the next poll, including
+// a random jitter to avoid synchronised bursts of requests.
+func (p *taskPoller) nextInterval() time.Duration {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	next := p.backoff
+	if p.jitter > 0 {
+		next += time.Duration(rand.Int63n(int64(p.jitter)))
+	}
+	return next
+}
+
+// poll describes all the subscribed ECS tasks and delivers the results.
+func (p *taskPoller) poll(ctx context.Context) {
+	throttled := false
+
+	for _, batch := range p.batches() {
+		tasks, failures, err := batch.client.DescribeTasks(ctx, batch.arns)
+		if err != nil {
+			// Request errors are not delivered to the subscribers as they
+			// are not specific to the tasks and will be retried on the next
+			// poll.
+			if aws.IsErrorThrottle(err) {
+				throttled = true
+				p.logger.Warn("ECS is throttling DescribeTasks requests", "cluster", batch.cluster)
+			} else {
+				p.logger.Error("failed to describe ECS tasks", "cluster", batch.cluster, "error", err)
+			}
+			continue
+		}
+
+		p.deliver(batch.arns, func(arn string) taskUpdate {
+			if task, ok := tasks[arn]; ok {
+				return taskUpdate{Task: task}
+			}
+			if reason, ok := failures[arn]; ok {
+				return taskUpdate{Err: fmt.Errorf("failed to describe ECS task: %s", reason)}
+			}
+			return taskUpdate{Err: fmt.Errorf("ECS did not return task")}
+		})
+	}
+
+	p.adjustBackoff(throttled)
+}
+
+// adjustBackoff doubles the poll interval when requests are being throttled,
+// and halves it back towards the configured interval otherwise.
+func (p *taskPoller) adjustBackoff(throttled bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if throttled {
+		p.backoff *= 2
+		if p.backoff > maxPollBackoff {
+			p.backoff = maxPollBackoff
+		}
+		return
+	}
+
+	p.backoff /= 2
+	if p.backoff < p.interval {
+		p.backoff = p.interval
+	}
+}
+
+// pollBatch is a set of ECS task ARNs, belonging to the same cluster, which
+// are described using a single request.
+type pollBatch struct {
+	cluster string
+	client  ecsClientInterface
+	arns    []string
+}
+
+// batches groups the subscribed ARNs by cluster, splitting each cluster into
+// batches of at most maxDescribeTasks ARNs. Tasks which are receiving state
+// change events are excluded.
+func (p *taskPoller) batches() []pollBatch {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var batches []pollBatch
+	current := make(map[string]int)
+
+	for arn, sub := range p.subs {
+		if p.eventsActive(sub) {
+			continue
+		}
+		idx, ok := current[sub.cluster]
+		if !ok || len(batches[idx].arns) >= maxDescribeTasks {
+			batches = append(batches, pollBatch{cluster: sub.cluster, client: sub.client})
+			idx = len(batches) - 1
+			current[sub.cluster] = idx
+		}
+		batches[idx].arns = append(batches[idx].arns, arn)
+	}
+	return batches
+}
+
+// deliver sends the update built for each ARN to its subscriber, if it is
+// still subscribed.
+func (p *taskPoller) deliver(arns []string, update func(arn string) taskUpdate) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, arn := range arns {
+		if sub, ok := p.subs[arn]; ok {
+			sub.polled = true
+			sub.send(update(arn))
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_taskPoller_batches(t *testing.T) {
+	p := newTaskPoller(hclog.NewNullLogger())
+	clientA, clientB := newMockECSClient(), newMockECSClient()
+
+	for i := 0; i < 150; i++ {
+		p.Subscribe("cluster-a", clientA, fmt.Sprintf("arn-a-%d", i))
+	}
+	p.Subscribe("cluster-b", clientB, "arn-b-0")
+
+	batches := p.batches()
+	assert.Len(t, batches, 3)
+
+	counts := make(map[string]int)
+	for _, b := range batches {
+		assert.LessOrEqual(t, len(b.arns), maxDescribeTasks)
+		counts[b.cluster] += len(b.arns)
+	}
+	assert.Equal(t, map[string]int{"cluster-a": 150, "cluster-b": 1}, counts)
+}
+
+func Test_taskPoller_poll(t *testing.T) {
+	p := newTaskPoller(hclog.NewNullLogger())
+	client := newMockECSClient()
+	client.tasks["arn-running"] = &ecs.Task{TaskArn: aws.String("arn-running"), LastStatus: aws.String("RUNNING")}
+
+	running := p.Subscribe("cluster", client, "arn-running")
+	missing := p.Subscribe("cluster", client, "arn-missing")
+
+	p.poll(context.Background())
+	assert.Len(t, client.describeTasksCalls, 1)
+
+	update := <-running
+	assert.NoError(t, update.Err)
+	assert.Equal(t, "RUNNING", aws.StringValue(update.Task.LastStatus))
+
+	update = <-missing
+	assert.Error(t, update.Err)
+
+	// Only the latest update should be held for a slow subscriber.
+	p.poll(context.Background())
+	client.tasks["arn-running"].LastStatus = aws.String("STOPPED")
+	p.poll(context.Background())
+	update = <-running
+	assert.Equal(t, "STOPPED", aws.StringValue(update.Task.LastStatus))
+	select {
+	case <-running:
+		t.Fatal("expected a single pending update")
+	default:
+	}
+}
+
+func Test_taskPoller_backoff(t *testing.T) {
+	p := newTaskPoller(hclog.NewNullLogger())
+	p.SetInterval(time.Second, 0)
+
+	client := newMockECSClient()
+	client.describeTasksErr = awserr.New("ThrottlingException", "Rate exceeded", nil)
+	p.Subscribe("cluster", client, "arn")
+
+	p.poll(context.Background())
+	p.poll(context.Background())
+	assert.Equal(t, 4*time.Second, p.nextInterval())
+
+	client.describeTasksErr = nil
+	p.poll(context.Background())
+	assert.Equal(t, 2*time.Second, p.nextInterval())
+	p.poll(context.Background())
+	p.poll(context.Background())
+	assert.Equal(t, time.Second, p.nextInterval())
+}
+
+func Test_taskPoller_events(t *testing.T) {
+	p := newTaskPoller(hclog.NewNullLogger())
+	p.SetQuietPeriod(time.Minute)
+	client := newMockECSClient()
+	client.tasks["arn-1"] = &ecs.Task{TaskArn: aws.String("arn-1"), LastStatus: aws.String("RUNNING")}
+
+	// A task is described at least once, even if events are received for it
+	// before it is first polled.
+	p.Subscribe("cluster", client, "arn-1")
+	assert.True(t, p.Publish(client.tasks["arn-1"]))
+	assert.Len(t, p.batches(), 1)
+	p.poll(context.Background())
+
+	// Once described, polling of the task is paused while events are
+	// received for it, but not for other tasks.
+	assert.True(t, p.Publish(client.tasks["arn-1"]))
+	assert.Empty(t, p.batches())
+
+	p.Subscribe("cluster", client, "arn-2")
+	batches := p.batches()
+	assert.Len(t, batches, 1)
+	assert.Equal(t, []string{"arn-2"}, batches[0].arns)
+
+	assert.False(t, p.Publish(&ecs.Task{TaskArn: aws.String("arn-unknown")}))
+}
@@ -0,0 +1,275 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	// ecsTaskStateChangeDetailType is the EventBridge detail type of the
+	// events ECS emits when the state of a task changes.
+	ecsTaskStateChangeDetailType = "ECS Task State Change"
+
+	// defaultQueueWaitTime is the default duration of each SQS long poll.
+	defaultQueueWaitTime = 20 * time.Second
+
+	// defaultQueueQuietPeriod is the default duration without any events
+	// being received for a task after which the driver resumes polling it.
+	defaultQueueQuietPeriod = 1 * time.Minute
+
+	// queueErrorBackoff is the duration to wait before receiving messages
+	// again after an error.
+	queueErrorBackoff = 5 * time.Second
+
+	// maxQueueMessages is the maximum number of messages which can be
+	// received or deleted within a single SQS request.
+	maxQueueMessages = 10
+
+	// defaultQueueMaxReceiveCount is the default number of times an event
+	// for a task which no consumer routes is received before it is deleted.
+	defaultQueueMaxReceiveCount = 5
+)
+
+// queueClientInterface encapsulates the AWS functionality required to
+// consume ECS task state change events from an SQS queue.
+type queueClientInterface interface {
+
+	// ReceiveMessages long polls the queue for messages, waiting at most the
+	// passed duration for messages to arrive.
+	ReceiveMessages(ctx context.Context, wait time.Duration) ([]queueMessage, error)
+
+	// DeleteMessages removes the messages identified by the receipt handles
+	// from the queue, so they are not delivered again.
+	DeleteMessages(ctx context.Context, receiptHandles []string) error
+}
+
+// queueMessage is a single message received from the queue.
+type queueMessage struct {
+	ReceiptHandle string
+	Body          string
+
+	// ReceiveCount is the number of times the message has been received,
+	// including this time.
+	ReceiveCount int
+}
+
+// eventBridgeEvent is the envelope of an EventBridge event, as delivered to
+// an SQS queue target.
+type eventBridgeEvent struct {
+	DetailType string          `json:"detail-type"`
+	Source     string          `json:"source"`
+	Detail     json.RawMessage `json:"detail"`
+}
+
+// parseTaskStateChange decodes an EventBridge ECS task state change event.
+// The event detail has the same shape as the DescribeTasks task object. The
+// returned bool is false if the message is not a task state change event.
+func parseTaskStateChange(body string) (*ecs.Task, bool, error) {
+	var event eventBridgeEvent
+	if err := json.Unmarshal([]byte(body), &event); err != nil {
+		return nil, false, fmt.Errorf("failed to decode event: %v", err)
+	}
+	if event.DetailType != ecsTaskStateChangeDetailType {
+		return nil, false, nil
+	}
+
+	var task ecs.Task
+	if err := json.Unmarshal(event.Detail, &task); err != nil {
+		return nil, false, fmt.Errorf("failed to decode task state change: %v", err)
+	}
+	if aws.StringValue(task.TaskArn) == "" {
+		return nil, false, fmt.Errorf("task state change does not include a task ARN")
+	}
+	return &task, true, nil
+}
+
+// eventConsumer receives ECS task state change events from an SQS queue and
+// publishes them to the task poller, which routes them to the task handles.
+type eventConsumer struct {
+	logger hclog.Logger
+	client queueClientInterface
+	poller *taskPoller
+	wait   time.Duration
+
+	// maxReceiveCount is the number of times an event which is not routed
+	// to a task handle is received before it is deleted.
+	maxReceiveCount int
+
+	// startedBy is the startedBy field of every ECS task run by the driver,
+	// if the same for all tasks, allowing the events of other tasks to be
+	// identified.
+	startedBy string
+}
+
+func newEventConsumer(logger hclog.Logger, client queueClientInterface, poller *taskPoller,
+	cfg EventQueueConfig, startedBy string) *eventConsumer {
+	return &eventConsumer{
+		logger:          logger.Named("events"),
+		client:          client,
+		poller:          poller,
+		wait:            cfg.waitTime,
+		maxReceiveCount: cfg.MaxReceiveCount,
+		startedBy:       startedBy,
+	}
+}
+
+// run consumes the queue until the context is cancelled.
+func (c *eventConsumer) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := c.consume(ctx); err != nil {
+			c.logger.Error("failed to consume ECS task events", "error", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(queueErrorBackoff):
+			}
+		}
+	}
+}
+
+// consume receives a single batch of messages and publishes any task state
+// changes. Messages are deleted from the queue once routed to a task handle,
+// while those for tasks this client does not manage are left to become
+// visible again, so other Nomad clients consuming the queue receive them and
+// a task which is still starting does not miss its events. The events of
+// tasks which were not run by the driver are deleted, as are those received
+// the maximum number of times, which no consumer owns. A task which misses
+// its events is polled once the quiet period has passed.
+func (c *eventConsumer) consume(ctx context.Context) error {
+	msgs, err := c.client.ReceiveMessages(ctx, c.wait)
+	if err != nil {
+		return err
+	}
+
+	handles := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		task, ok, err := parseTaskStateChange(msg.Body)
+		if err != nil {
+			// Messages which cannot be parsed will never be parseable, so
+			// are deleted rather than being redelivered.
+			c.logger.Warn("failed to parse queue message", "error", err)
+			handles = append(handles, msg.ReceiptHandle)
+			continue
+		}
+		if !ok {
+			handles = append(handles, msg.ReceiptHandle)
+			continue
+		}
+
+		arn := aws.StringValue(task.TaskArn)
+		if !c.poller.Publish(task) {
+			switch {
+			case !c.isDriverTask(task):
+				c.logger.Trace("deleting ECS task state change for task not run by the driver", "arn", arn)
+				handles = append(handles, msg.ReceiptHandle)
+			case c.maxReceiveCount > 0 && msg.ReceiveCount >= c.maxReceiveCount:
+				c.logger.Debug("deleting ECS task state change for unknown task", "arn", arn,
+					"receive_count", msg.ReceiveCount)
+				handles = append(handles, msg.ReceiptHandle)
+			default:
+				c.logger.Trace("ignoring ECS task state change for unknown task", "arn", arn)
+			}
+			continue
+		}
+		c.logger.Trace("routed ECS task state change", "arn", arn,
+			"status", aws.StringValue(task.LastStatus))
+		handles = append(handles, msg.ReceiptHandle)
+	}
+
+	return c.client.DeleteMessages(ctx, handles)
+}
+
+// isDriverTask returns whether the ECS task may have been run by the driver.
+// Task state change events do not always include the task tags, so a task
+// is only known not to have been run by the driver if its tags are included
+// and none are Nomad tags, or its startedBy field differs from that of
+// every task run by the driver.
+func (c *eventConsumer) isDriverTask(task *ecs.Task) bool {
+	if len(task.Tags) > 0 {
+		for _, tag := range task.Tags {
+			if strings.HasPrefix(aws.StringValue(tag.Key), nomadTagPrefix) {
+				return true
+			}
+		}
+		return false
+	}
+	return c.startedBy == "" || aws.StringValue(task.StartedBy) == c.startedBy
+}
+
+type awsQueueClient struct {
+	queueURL  string
+	sqsClient *sqs.Client
+}
+
+// ReceiveMessages satisfies the ecs.queueClientInterface ReceiveMessages
+// interface function.
+func (c awsQueueClient) ReceiveMessages(ctx context.Context, wait time.Duration) ([]queueMessage, error) {
+	input := sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(c.queueURL),
+		MaxNumberOfMessages: aws.Int64(maxQueueMessages),
+		WaitTimeSeconds:     aws.Int64(int64(wait / time.Second)),
+		AttributeNames: []sqs.QueueAttributeName{
+			sqs.QueueAttributeName(sqs.MessageSystemAttributeNameApproximateReceiveCount),
+		},
+	}
+
+	resp, err := c.sqsClient.ReceiveMessageRequest(&input).Send(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]queueMessage, 0, len(resp.Messages))
+	for _, m := range resp.Messages {
+		count, _ := strconv.Atoi(m.Attributes[string(sqs.MessageSystemAttributeNameApproximateReceiveCount)])
+		msgs = append(msgs, queueMessage{
+			ReceiptHandle: aws.StringValue(m.ReceiptHandle),
+			Body:          aws.StringValue(m.Body),
+			ReceiveCount:  count,
+		})
+	}
+	return msgs, nil
+}
+
+// DeleteMessages satisfies the ecs.queueClientInterface DeleteMessages
+// interface function.
+func (c awsQueueClient) DeleteMessages(ctx context.Context, receiptHandles []string) error {
+	for start := 0; start < len(receiptHandles); start += maxQueueMessages {
+		end := start + maxQueueMessages
+		if end > len(receiptHandles) {
+			end = len(receiptHandles)
+		}
+
+		entries := make([]sqs.DeleteMessageBatchRequestEntry, 0, end-start)
+		for i, h := range receiptHandles[start:end] {
+			entries = append(entries, sqs.DeleteMessageBatchRequestEntry{
+				Id:            aws.String(fmt.Sprint(i)),
+				ReceiptHandle: aws.String(h),
+			})
+		}
+
+		input := sqs.DeleteMessageBatchInput{
+			QueueUrl: aws.String(c.queueURL),
+			Entries:  entries,
+		}
+		resp, err := c.sqsClient.DeleteMessageBatchRequest(&input).Send(ctx)
+		if err != nil {
+			return err
+		}
+		if len(resp.Failed) > 0 {
+			return fmt.Errorf("failed to delete %v queue messages: %s", len(resp.Failed),
+				aws.StringValue(resp.Failed[0].Message))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sqsStandIn is a minimal local implementation of the SQS query API,
+// supporting only the ReceiveMessage and DeleteMessageBatch actions.
+type sqsStandIn struct {
+	lock     sync.Mutex
+	messages map[string]string
+	receives map[string]int
+	next     int
+}
+
+func newSQSStandIn() *sqsStandIn {
+	return &sqsStandIn{messages: make(map[string]string), receives: make(map[string]int)}
+}
+
+func (s *sqsStandIn) send(body string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.messages[fmt.Sprintf("receipt-%d", s.next)] = body
+	s.next++
+}
+
+func (s *sqsStandIn) len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.messages)
+}
+
+func (s *sqsStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var b strings.Builder
+	switch action := r.Form.Get("Action"); action {
+	case "ReceiveMessage":
+		b.WriteString("<ReceiveMessageResponse><ReceiveMessageResult>")
+		for handle, body := range s.messages {
+			s.receives[handle]++
+			sum := md5.Sum([]byte(body))
+			b.WriteString("<Message><MessageId>" + handle + "</MessageId>")
+			b.WriteString("<ReceiptHandle>" + handle + "</ReceiptHandle>")
+			b.WriteString("<MD5OfBody>" + hex.EncodeToString(sum[:]) + "</MD5OfBody><Body>")
+			_ = xml.EscapeText(&b, []byte(body))
+			b.WriteString("</Body>")
+			if r.Form.Get("AttributeName.1") == "ApproximateReceiveCount" {
+				fmt.Fprintf(&b, "<Attribute><Name>ApproximateReceiveCount</Name><Value>%d</Value></Attribute>",
+					s.receives[handle])
+			}
+			b.WriteString("</Message>")
+		}
+		b.WriteString("</ReceiveMessageResult></ReceiveMessageResponse>")
+	case "DeleteMessageBatch":
+		b.WriteString("<DeleteMessageBatchResponse><DeleteMessageBatchResult>")
+		for i := 1; r.Form.Get(fmt.Sprintf("DeleteMessageBatchRequestEntry.%d.Id", i)) != ""; i++ {
+			prefix := fmt.Sprintf("DeleteMessageBatchRequestEntry.%d.", i)
+			delete(s.messages, r.Form.Get(prefix+"ReceiptHandle"))
+			b.WriteString("<DeleteMessageBatchResultEntry><Id>" + r.Form.Get(prefix+"Id") +
+				"</Id></DeleteMessageBatchResultEntry>")
+		}
+		b.WriteString("</DeleteMessageBatchResult></DeleteMessageBatchResponse>")
+	default:
+		http.Error(w, "unsupported action "+action, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/xml")
+	_, _ = w.Write([]byte(b.String()))
+}
+
+func testTaskStateChange(arn, status string, version int) string {
+	return fmt.Sprintf(`{
+  "version": "0",
+  "detail-type": "ECS Task State Change",
+  "source": "aws.ecs",
+  "detail": {
+    "taskArn": %q,
+    "lastStatus": %q,
+    "desiredStatus": "RUNNING",
+    "startedBy": "nomad-ecs-driver",
+    "version": %d,
+    "createdAt": "2021-05-12T10:00:00.000Z",
+    "containers": [{"name": "web", "lastStatus": %q}]
+  }
+}`, arn, status, version, status)
+}
+
+func Test_parseTaskStateChange(t *testing.T) {
+	task, ok, err := parseTaskStateChange(testTaskStateChange("arn-1", "RUNNING", 3))
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "arn-1", aws.StringValue(task.TaskArn))
+	assert.Equal(t, "RUNNING", aws.StringValue(task.LastStatus))
+	assert.Equal(t, int64(3), aws.Int64Value(task.Version))
+	assert.Equal(t, "web", aws.StringValue(task.Containers[0].Name))
+
+	_, ok, err = parseTaskStateChange(`{"detail-type": "ECS Container Instance State Change", "detail": {}}`)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	_, _, err = parseTaskStateChange(`not json`)
+	assert.Error(t, err)
+}
+
+func Test_eventConsumer(t *testing.T) {
+	standIn := newSQSStandIn()
+	srv := httptest.NewServer(standIn)
+	defer srv.Close()
+
+	client := awsQueueClient{
+		queueURL:  srv.URL + "/123456789012/ecs-events",
+		sqsClient: sqs.New(testAWSConfig(srv.URL)),
+	}
+
+	poller := newTaskPoller(hclog.NewNullLogger())
+	poller.SetQuietPeriod(time.Minute)
+	updates := poller.Subscribe("cluster", newMockECSClient(), "arn-1")
+
+	standIn.send(testTaskStateChange("arn-1", "RUNNING", 2))
+	standIn.send(testTaskStateChange("arn-other", "RUNNING", 1))
+	standIn.send(`not json`)
+
+	consumer := newEventConsumer(hclog.NewNullLogger(), client, poller, EventQueueConfig{}, defaultStartedBy)
+	require.NoError(t, consumer.consume(context.Background()))
+
+	// The event for the subscribed task is routed and deleted along with the
+	// unparseable message, while the event for the unknown task is left for
+	// other consumers of the queue.
+	select {
+	case update := <-updates:
+		assert.Equal(t, "RUNNING", aws.StringValue(update.Task.LastStatus))
+	default:
+		t.Fatal("expected task update")
+	}
+	assert.Equal(t, 1, standIn.len())
+
+	// An out of order event is discarded.
+	standIn.send(testTaskStateChange("arn-1", "PENDING", 1))
+	require.NoError(t, consumer.consume(context.Background()))
+	select {
+	case update := <-updates:
+		t.Fatalf("unexpected task update with status %s", aws.StringValue(update.Task.LastStatus))
+	default:
+	}
+}
+
+func Test_eventConsumer_unknownTasks(t *testing.T) {
+	standIn := newSQSStandIn()
+	srv := httptest.NewServer(standIn)
+	defer srv.Close()
+
+	client := awsQueueClient{
+		queueURL:  srv.URL + "/123456789012/ecs-events",
+		sqsClient: sqs.New(testAWSConfig(srv.URL)),
+	}
+
+	standIn.send(testTaskStateChange("arn-other-node", "RUNNING", 1))
+	standIn.send(`{"detail-type": "ECS Task State Change", "detail": {"taskArn": "arn-service", "startedBy": "ecs-svc/1234"}}`)
+	standIn.send(`{"detail-type": "ECS Task State Change", "detail": {"taskArn": "arn-tagged",
+  "startedBy": "nomad-ecs-driver", "tags": [{"key": "team", "value": "web"}]}}`)
+
+	poller := newTaskPoller(hclog.NewNullLogger())
+	consumer := newEventConsumer(hclog.NewNullLogger(), client, poller,
+		EventQueueConfig{MaxReceiveCount: 3}, defaultStartedBy)
+
+	// The events of tasks which were not run by the driver are deleted, while
+	// that of a task which may be run by another client is left in the queue.
+	require.NoError(t, consumer.consume(context.Background()))
+	assert.Equal(t, 1, standIn.len())
+
+	// The event of a task which no client owns is deleted once it has been
+	// received the maximum number of times.
+	require.NoError(t, consumer.consume(context.Background()))
+	assert.Equal(t, 1, standIn.len())
+	require.NoError(t, consumer.consume(context.Background()))
+	assert.Equal(t, 0, standIn.len())
+}
@@ -0,0 +1,182 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+)
+
+const (
+	// defaultStartupTimeout is the default maximum time StartTask waits for
+	// the ECS task to become ready.
+	defaultStartupTimeout = 10 * time.Minute
+
+	// readinessPollInterval is the interval at which the ECS task is
+	// described while waiting for it to become ready.
+	readinessPollInterval = 5 * time.Second
+
+	// ecsTaskStatusRunning is the ECS task status once all containers have
+	// started.
+	ecsTaskStatusRunning = "RUNNING"
+)
+
+// startupTimeout returns the maximum time to wait for the ECS task to become
+// ready. The option is checked when the config is validated.
+func (c ECSTaskConfig) startupTimeout() time.Duration {
+	if timeout, err := time.ParseDuration(c.StartupTimeout); err == nil && timeout > 0 {
+		return timeout
+	}
+	return defaultStartupTimeout
+}
+
+// hasHealthCheck returns whether any of the container definitions has a
+// health check, without which ECS never reports the task as healthy.
+func hasHealthCheck(defs []TaskContainerDefinition) bool {
+	for _, d := range defs {
+		if d.HealthCheck != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// readinessGate waits for a newly run ECS task to become ready, so that Nomad
+// only considers the task running once the ECS task is.
+type readinessGate struct {
+	// timeout is the maximum time to wait for the task to become ready.
+	timeout time.Duration
+
+	// requireHealthy additionally requires the task health status, which
+	// is derived from the essential container health checks, to be HEALTHY.
+	requireHealthy bool
+
+	pollInterval time.Duration
+}
+
+func newReadinessGate(cfg ECSTaskConfig) readinessGate {
+	return readinessGate{
+		timeout:        cfg.startupTimeout(),
+		requireHealthy: cfg.WaitForHealthy,
+		pollInterval:   readinessPollInterval,
+	}
+}
+
+// ready returns whether the ECS task has passed the gate.
+func (g readinessGate) ready(task *ecs.Task) bool {
+	if aws.StringValue(task.LastStatus) != ecsTaskStatusRunning {
+		return false
+	}
+	return !g.requireHealthy || task.HealthStatus == ecs.HealthStatusHealthy
+}
+
+// wait describes the ECS task until it is ready and returns it, passing each
+// description to observe. An error including the reason reported by ECS is
+// returned if the task stops, or does not become ready within the timeout.
+// Describing the task may fail with a transient error, or report the task as
+// missing until ECS is consistent, so these are retried until the timeout.
+func (g readinessGate) wait(ctx context.Context, client ecsClientInterface, arn string,
+	observe func(*ecs.Task)) (*ecs.Task, error) {
+	ctx, cancel := context.WithTimeout(ctx, g.timeout)
+	defer cancel()
+
+	var (
+		last    *ecs.Task
+		lastErr error
+	)
+
+	for {
+		task, err := client.DescribeTask(ctx, arn)
+		switch {
+		case err != nil && ctx.Err() != nil:
+		case err != nil && !isTransientDescribeError(err):
+			return nil, fmt.Errorf("failed to describe ECS task: %v", err)
+		case err != nil:
+			lastErr = err
+		case task != nil:
+			last = task
+			observe(task)
+
+			if g.ready(task) {
+				return task, nil
+			}
+			if isTerminalStatus(aws.StringValue(task.LastStatus)) {
+				return nil, fmt.Errorf("ECS task stopped before becoming ready: %s", taskStopReason(task))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, g.timeoutError(last, lastErr)
+		case <-time.After(g.pollInterval):
+		}
+	}
+}
+
+// isTransientDescribeError returns whether describing a newly run ECS task
+// may succeed if retried, either because ECS does not yet report the task or
+// because the request failed with a transient error.
+func isTransientDescribeError(err error) bool {
+	var descErr *describeTaskError
+	if errors.As(err, &descErr) {
+		return descErr.Reason == ecsFailureReasonMissing
+	}
+	return isTransientRunTaskError(err)
+}
+
+// timeoutError describes the state of the ECS task when it failed to become
+// ready in time. If the task was never described, the last error describing
+// it is included instead.
+func (g readinessGate) timeoutError(task *ecs.Task, describeErr error) error {
+	if task == nil {
+		if describeErr != nil {
+			return fmt.Errorf("ECS task did not become ready within %s: %v", g.timeout, describeErr)
+		}
+		return fmt.Errorf("ECS task did not become ready within %s", g.timeout)
+	}
+
+	msg := fmt.Sprintf("ECS task did not become ready within %s: last status %q",
+		g.timeout, aws.StringValue(task.LastStatus))
+	if g.requireHealthy {
+		msg += fmt.Sprintf(", health %q", task.HealthStatus)
+	}
+	if reason := containerReasons(task); reason != "" {
+		msg += ": " + reason
+	}
+	return errors.New(msg)
+}
+
+// taskStopReason describes why ECS stopped the task, including the reasons
+// of any containers, such as failing to pull the image.
+func taskStopReason(task *ecs.Task) string {
+	reason := aws.StringValue(task.StoppedReason)
+	if reason == "" {
+		reason = "no reason given"
+	}
+	if task.StopCode != "" {
+		reason = fmt.Sprintf("(%s) %s", task.StopCode, reason)
+	}
+	if containers := containerReasons(task); containers != "" {
+		reason += ": " + containers
+	}
+	return reason
+}
+
+// containerReasons joins the reasons ECS reported for each container, which
+// explain why the container has not started or has stopped.
+func containerReasons(task *ecs.Task) string {
+	var reasons []string
+	for _, c := range task.Containers {
+		if r := aws.StringValue(c.Reason); r != "" {
+			reasons = append(reasons, fmt.Sprintf("%s: %s", aws.StringValue(c.Name), r))
+		}
+	}
+	return strings.Join(reasons, "; ")
+}
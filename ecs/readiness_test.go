@@ -0,0 +1,130 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testReadinessTask(status string, health ecs.HealthStatus) *ecs.Task {
+	return &ecs.Task{
+		TaskArn:      aws.String("arn"),
+		LastStatus:   aws.String(status),
+		HealthStatus: health,
+		Containers:   []ecs.Container{{Name: aws.String("web")}},
+	}
+}
+
+func Test_readinessGate_wait(t *testing.T) {
+	stopped := testReadinessTask(ecsTaskStatusStopped, ecs.HealthStatusUnknown)
+	stopped.StopCode = ecs.TaskStopCodeTaskFailedToStart
+	stopped.StoppedReason = aws.String("Task failed to start")
+	stopped.Containers[0].Reason = aws.String("CannotPullContainerError: pull image manifest has been retried 5 time(s)")
+
+	pending := testReadinessTask("PENDING", ecs.HealthStatusUnknown)
+	pending.Containers[0].Reason = aws.String("ResourceInitializationError: unable to pull secrets")
+
+	testCases := []struct {
+		name               string
+		inputProgression   []*ecs.Task
+		inputRequireHealth bool
+		expectedError      string
+		expectedObserved   []string
+	}{
+		{
+			name: "running",
+			inputProgression: []*ecs.Task{
+				testReadinessTask("PROVISIONING", ecs.HealthStatusUnknown),
+				testReadinessTask("PENDING", ecs.HealthStatusUnknown),
+				testReadinessTask("RUNNING", ecs.HealthStatusUnknown),
+			},
+			expectedObserved: []string{"PROVISIONING", "PENDING", "RUNNING"},
+		},
+		{
+			name: "missing after running",
+			inputProgression: []*ecs.Task{
+				nil,
+				nil,
+				testReadinessTask("PENDING", ecs.HealthStatusUnknown),
+				testReadinessTask("RUNNING", ecs.HealthStatusUnknown),
+			},
+			expectedObserved: []string{"PENDING", "RUNNING"},
+		},
+		{
+			name:             "never described",
+			inputProgression: []*ecs.Task{nil},
+			expectedError:    "ECS task did not become ready within 50ms: failed to describe ECS task: MISSING",
+		},
+		{
+			name:               "healthy",
+			inputRequireHealth: true,
+			inputProgression: []*ecs.Task{
+				testReadinessTask("RUNNING", ecs.HealthStatusUnknown),
+				testReadinessTask("RUNNING", ecs.HealthStatusHealthy),
+			},
+			expectedObserved: []string{"RUNNING"},
+		},
+		{
+			name:               "never healthy",
+			inputRequireHealth: true,
+			inputProgression: []*ecs.Task{
+				testReadinessTask("RUNNING", ecs.HealthStatusUnhealthy),
+			},
+			expectedError: `ECS task did not become ready within 50ms: last status "RUNNING", health "UNHEALTHY"`,
+		},
+		{
+			name:             "stuck pending",
+			inputProgression: []*ecs.Task{pending},
+			expectedError: `ECS task did not become ready within 50ms: last status "PENDING": ` +
+				`web: ResourceInitializationError: unable to pull secrets`,
+		},
+		{
+			name: "stopped",
+			inputProgression: []*ecs.Task{
+				testReadinessTask("PROVISIONING", ecs.HealthStatusUnknown),
+				stopped,
+			},
+			expectedError: "ECS task stopped before becoming ready: (TaskFailedToStart) Task failed to start: " +
+				"web: CannotPullContainerError: pull image manifest has been retried 5 time(s)",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newMockECSClient()
+			client.taskProgressions["arn"] = tc.inputProgression
+
+			gate := readinessGate{
+				timeout:        50 * time.Millisecond,
+				requireHealthy: tc.inputRequireHealth,
+				pollInterval:   time.Millisecond,
+			}
+			var observed []string
+			task, err := gate.wait(context.Background(), client, "arn", func(task *ecs.Task) {
+				if n := len(observed); n == 0 || observed[n-1] != aws.StringValue(task.LastStatus) {
+					observed = append(observed, aws.StringValue(task.LastStatus))
+				}
+			})
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.True(t, gate.ready(task))
+			assert.Equal(t, tc.expectedObserved, observed)
+		})
+	}
+}
+
+func Test_ECSTaskConfig_startupTimeout(t *testing.T) {
+	assert.Equal(t, defaultStartupTimeout, ECSTaskConfig{}.startupTimeout())
+	assert.Equal(t, 90*time.Second, ECSTaskConfig{StartupTimeout: "90s"}.startupTimeout())
+}
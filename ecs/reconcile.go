@@ -0,0 +1,228 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/drivers/shared/eventer"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// defaultOrphanInterval is the default interval at which the cluster is
+	// checked for orphaned ECS tasks.
+	defaultOrphanInterval = 5 * time.Minute
+
+	// defaultOrphanGracePeriod is the default minimum age of an ECS task, and
+	// of the reconciler itself, before a task is considered orphaned.
+	defaultOrphanGracePeriod = 10 * time.Minute
+)
+
+// orphanReconciler finds ECS tasks which were run by the driver on this
+// Nomad node but are not owned by any task handle, such as when the Nomad
+// client stopped between running the ECS task and persisting the handle, and
+// stops them.
+type orphanReconciler struct {
+	logger  hclog.Logger
+	eventer *eventer.Eventer
+
+	// clusters are checked for orphaned tasks, using the client returned
+	// for each.
+	clusters []clusterRef
+	client   func(clusterRef) ecsClientInterface
+
+	// owned returns whether the ECS task ARN is owned by a task handle.
+	owned func(arn string) bool
+
+	// nodeID returns the ID of the Nomad node, or an empty string if it is
+	// not yet known. Only ECS tasks tagged with the node ID are considered,
+	// as other Nomad clients may run tasks within the same cluster.
+	nodeID func() string
+
+	// startedBy filters the ECS tasks listed, if not empty.
+	startedBy string
+
+	gracePeriod time.Duration
+	dryRun      bool
+	started     time.Time
+}
+
+func newOrphanReconciler(logger hclog.Logger, clusters []clusterRef, client func(clusterRef) ecsClientInterface,
+	eventer *eventer.Eventer, owned func(string) bool, nodeID func() string, startedBy string,
+	cfg OrphanReconcilerConfig) *orphanReconciler {
+	return &orphanReconciler{
+		logger:      logger.Named("reconciler"),
+		clusters:    clusters,
+		client:      client,
+		eventer:     eventer,
+		owned:       owned,
+		nodeID:      nodeID,
+		startedBy:   startedBy,
+		gracePeriod: cfg.gracePeriod,
+		dryRun:      cfg.DryRun,
+		started:     time.Now(),
+	}
+}
+
+// run reconciles the clusters at the interval until the context is cancelled.
+func (r *orphanReconciler) run(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+			if _, err := r.reconcile(ctx); err != nil {
+				r.logger.Error("failed to reconcile orphaned ECS tasks", "error", err)
+			}
+		}
+	}
+}
+
+// reconcile stops, or reports when in dry run mode, every orphaned ECS task
+// within the clusters and returns their ARNs. A failure to reconcile one
+// cluster does not prevent the others being reconciled.
+func (r *orphanReconciler) reconcile(ctx context.Context) ([]string, error) {
+	// Allow time for Nomad to recover the existing tasks after the client
+	// restarts before considering any task orphaned.
+	if time.Since(r.started) < r.gracePeriod {
+		return nil, nil
+	}
+
+	nodeID := r.nodeID()
+	if nodeID == "" {
+		r.logger.Debug("skipping orphaned ECS task reconciliation until the node ID is known")
+		return nil, nil
+	}
+
+	var (
+		orphans []string
+		errs    []string
+	)
+	for _, ref := range r.clusters {
+		found, err := r.reconcileCluster(ctx, ref, nodeID)
+		orphans = append(orphans, found...)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", ref, err))
+		}
+	}
+	if len(errs) > 0 {
+		return orphans, errors.New(strings.Join(errs, "; "))
+	}
+	return orphans, nil
+}
+
+// reconcileCluster stops, or reports when in dry run mode, every orphaned ECS
+// task within the cluster and returns their ARNs.
+func (r *orphanReconciler) reconcileCluster(ctx context.Context, ref clusterRef, nodeID string) ([]string, error) {
+	client := r.client(ref)
+
+	arns, err := client.ListTasks(ctx, r.startedBy)
+	if err != nil {
+		// Not every allowed cluster needs to exist within every allowed
+		// region.
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == ecs.ErrCodeClusterNotFoundException {
+			r.logger.Trace("skipping orphaned ECS task reconciliation of missing cluster", "cluster", ref)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list ECS tasks: %v", err)
+	}
+
+	var candidates []string
+	for _, arn := range arns {
+		if !r.owned(arn) {
+			candidates = append(candidates, arn)
+		}
+	}
+
+	var orphans []string
+	for start := 0; start < len(candidates); start += maxDescribeTasks {
+		end := start + maxDescribeTasks
+		if end > len(candidates) {
+			end = len(candidates)
+		}
+
+		tasks, _, err := client.DescribeTasks(ctx, candidates[start:end])
+		if err != nil {
+			return orphans, fmt.Errorf("failed to describe ECS tasks: %v", err)
+		}
+
+		for _, arn := range candidates[start:end] {
+			task, ok := tasks[arn]
+			if !ok || !r.isOrphan(arn, task, nodeID) {
+				continue
+			}
+			orphans = append(orphans, arn)
+			r.handleOrphan(ctx, client, arn, task)
+		}
+	}
+	return orphans, nil
+}
+
+// isOrphan returns whether the ECS task was run by the driver on this node,
+// is older than the grace period and is still not owned by a task handle.
+// Ownership is checked again as the task may have been recovered since the
+// tasks were listed.
+func (r *orphanReconciler) isOrphan(arn string, task *ecs.Task, nodeID string) bool {
+	if taskTag(task, nomadTagNodeID) != nodeID {
+		return false
+	}
+	if aws.StringValue(task.DesiredStatus) != "RUNNING" {
+		return false
+	}
+	if task.CreatedAt == nil || time.Since(*task.CreatedAt) < r.gracePeriod {
+		return false
+	}
+	return !r.owned(arn)
+}
+
+// handleOrphan stops the orphaned ECS task unless in dry run mode. Every
+// action is logged and, as the allocation may still exist on the node, sent
+// as a task event for the Nomad task identified by the ECS task tags.
+func (r *orphanReconciler) handleOrphan(ctx context.Context, client ecsClientInterface, arn string, task *ecs.Task) {
+	logger := r.logger.With("arn", arn, "alloc_id", taskTag(task, nomadTagAllocID),
+		"task", taskTag(task, nomadTagTask))
+
+	msg := "Found orphaned ECS task"
+	if r.dryRun {
+		logger.Warn("found orphaned ECS task, not stopping as dry run is enabled")
+	} else if err := client.StopTask(ctx, arn); err != nil {
+		logger.Error("failed to stop orphaned ECS task", "error", err)
+		msg = fmt.Sprintf("Failed to stop orphaned ECS task: %v", err)
+	} else {
+		logger.Warn("stopped orphaned ECS task")
+		msg = "Stopped orphaned ECS task"
+	}
+
+	cfg := &drivers.TaskConfig{
+		AllocID: taskTag(task, nomadTagAllocID),
+		Name:    taskTag(task, nomadTagTask),
+	}
+	if cfg.AllocID == "" || cfg.Name == "" {
+		return
+	}
+	if err := emitTaskEvent(r.eventer, cfg, msg, taskEventAnnotations(arn, task)); err != nil {
+		logger.Warn("failed to emit task event", "error", err)
+	}
+}
+
+// taskTag returns the value of the ECS task tag, or an empty string if the
+// task does not have the tag.
+func taskTag(task *ecs.Task, key string) string {
+	for _, tag := range task.Tags {
+		if aws.StringValue(tag.Key) == key {
+			return aws.StringValue(tag.Value)
+		}
+	}
+	return ""
+}
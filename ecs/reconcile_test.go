@@ -0,0 +1,129 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testOrphanTask(arn, nodeID string, age time.Duration) *ecs.Task {
+	return &ecs.Task{
+		TaskArn:       aws.String(arn),
+		LastStatus:    aws.String("RUNNING"),
+		DesiredStatus: aws.String("RUNNING"),
+		StartedBy:     aws.String(defaultStartedBy),
+		CreatedAt:     aws.Time(time.Now().Add(-age)),
+		Tags: buildTags(map[string]string{
+			nomadTagNodeID:  nodeID,
+			nomadTagAllocID: "6d9c1a3e",
+			nomadTagTask:    "server",
+		}, nil),
+	}
+}
+
+func Test_orphanReconciler(t *testing.T) {
+	testCases := []struct {
+		name            string
+		inputDryRun     bool
+		inputNodeID     string
+		inputStarted    time.Duration
+		expectedOrphans []string
+		expectedStopped []string
+	}{
+		{
+			name:            "stops orphans",
+			inputNodeID:     "node-1",
+			inputStarted:    time.Hour,
+			expectedOrphans: []string{"orphan", "other-orphan"},
+			expectedStopped: []string{"orphan", "other-orphan"},
+		},
+		{
+			name:            "dry run",
+			inputDryRun:     true,
+			inputNodeID:     "node-1",
+			inputStarted:    time.Hour,
+			expectedOrphans: []string{"orphan", "other-orphan"},
+		},
+		{
+			name:         "node ID unknown",
+			inputStarted: time.Hour,
+		},
+		{
+			name:         "within grace period of start",
+			inputNodeID:  "node-1",
+			inputStarted: time.Minute,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newMockECSClient()
+			client.tasks["owned"] = testOrphanTask("owned", "node-1", time.Hour)
+			client.tasks["orphan"] = testOrphanTask("orphan", "node-1", time.Hour)
+			client.tasks["young"] = testOrphanTask("young", "node-1", time.Minute)
+			client.tasks["other-node"] = testOrphanTask("other-node", "node-2", time.Hour)
+
+			other := testOrphanTask("other-driver", "node-1", time.Hour)
+			other.StartedBy = aws.String("someone-else")
+			client.tasks["other-driver"] = other
+
+			owned := func(arn string) bool { return arn == "owned" }
+			nodeID := func() string { return tc.inputNodeID }
+			cfg := OrphanReconcilerConfig{DryRun: tc.inputDryRun, gracePeriod: 10 * time.Minute}
+
+			// The orphans of every cluster are found, skipping clusters which
+			// do not exist.
+			batch := newMockECSClient()
+			batch.tasks["other-orphan"] = testOrphanTask("other-orphan", "node-1", time.Hour)
+			missing := newMockECSClient()
+			missing.listTasksErr = awserr.New(ecs.ErrCodeClusterNotFoundException, "Cluster not found.", nil)
+			clients := map[clusterRef]*mockECSClient{
+				{Region: "us-east-1", Cluster: "default"}: client,
+				{Region: "us-east-1", Cluster: "batch"}:   batch,
+				{Region: "eu-west-1", Cluster: "default"}: missing,
+			}
+			clusters := []clusterRef{
+				{Region: "us-east-1", Cluster: "default"},
+				{Region: "us-east-1", Cluster: "batch"},
+				{Region: "eu-west-1", Cluster: "default"},
+			}
+			clientFn := func(ref clusterRef) ecsClientInterface { return clients[ref] }
+
+			r := newOrphanReconciler(hclog.NewNullLogger(), clusters, clientFn, nil, owned, nodeID,
+				defaultStartedBy, cfg)
+			r.started = time.Now().Add(-tc.inputStarted)
+
+			orphans, err := r.reconcile(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedOrphans, orphans)
+			assert.Equal(t, tc.expectedStopped, append(client.stopTaskARNs, batch.stopTaskARNs...))
+		})
+	}
+}
+
+func Test_OrphanReconcilerConfig_parse(t *testing.T) {
+	cfg := OrphanReconcilerConfig{Interval: "1m", GracePeriod: "15m"}
+	require.NoError(t, cfg.parse())
+	assert.True(t, cfg.enabled())
+	assert.Equal(t, time.Minute, cfg.interval)
+	assert.Equal(t, 15*time.Minute, cfg.gracePeriod)
+
+	cfg = OrphanReconcilerConfig{Interval: "1m", GracePeriod: "30s"}
+	require.NoError(t, cfg.parse())
+	assert.Equal(t, 30*time.Second, cfg.gracePeriod)
+
+	cfg = OrphanReconcilerConfig{Interval: "1m", GracePeriod: "0s"}
+	assert.EqualError(t, cfg.parse(), "orphan_reconciler grace_period must be greater than zero")
+
+	assert.False(t, (&OrphanReconcilerConfig{}).enabled())
+}
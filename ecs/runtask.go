@@ -0,0 +1,227 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	// runTaskAttempts is the maximum number of times a RunTask request is
+	// sent for a single client token when it fails with a transient error.
+	runTaskAttempts = 5
+
+	// runTaskBackoffBase and runTaskBackoffLimit bound the exponential
+	// backoff between RunTask attempts.
+	runTaskBackoffBase  = time.Second
+	runTaskBackoffLimit = 10 * time.Second
+
+	// runTaskAttemptTimeout is the timeout of a single RunTask attempt.
+	runTaskAttemptTimeout = 30 * time.Second
+
+	// maxClientTokenGenerations bounds the number of client tokens tried for
+	// a single Nomad task before giving up.
+	maxClientTokenGenerations = 100
+
+	// ecsErrCodeConflict is returned by RunTask when the client token has
+	// already been used with different parameters.
+	ecsErrCodeConflict = "ConflictException"
+
+	// ecsErrCodeServer is returned by ECS for server side errors.
+	ecsErrCodeServer = "ServerException"
+
+	// ecsErrCodeClient is returned by ECS for client side errors, including
+	// RunTask with a task definition which has been deregistered.
+	ecsErrCodeClient = "ClientException"
+)
+
+// idempotencyKey returns the key identifying the Nomad task, from which the
+// RunTask client tokens are derived.
+func idempotencyKey(allocID, taskName string) string {
+	return allocID + "/" + taskName
+}
+
+// clientToken derives the RunTask client token for the generation of the
+// idempotency key. The token is the hex encoded SHA-256 hash, which is the
+// 64 character maximum ECS allows.
+func clientToken(key string, generation int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%d", key, generation)))
+	return hex.EncodeToString(sum[:])
+}
+
+// isTransientRunTaskError returns whether the RunTask error is expected to
+// succeed if the request is retried. Placement failures are not transient,
+// as ECS reported a definitive reason the task could not be run.
+func isTransientRunTaskError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var runErr *runTaskError
+	if errors.As(err, &runErr) {
+		return false
+	}
+
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) && reqErr.StatusCode() >= 500 {
+		return true
+	}
+
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return errors.Is(err, context.DeadlineExceeded)
+	}
+	if aerr.Code() == ecsErrCodeServer {
+		return true
+	}
+	return aws.IsErrorThrottle(aerr) || aws.IsErrorRetryable(aerr)
+}
+
+// isClientTokenConflict returns whether the RunTask error was caused by the
+// client token having been used with different parameters.
+func isClientTokenConflict(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == ecsErrCodeConflict
+}
+
+// isInactiveTaskDefinitionError returns whether the RunTask error was caused
+// by the task definition having been deregistered since it was resolved.
+func isInactiveTaskDefinitionError(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == ecsErrCodeClient &&
+		strings.Contains(aerr.Message(), "TaskDefinition is inactive")
+}
+
+// taskRunner runs ECS tasks idempotently. Each Nomad task maps to a series
+// of client tokens, one per generation, so that retried requests return the
+// ECS task already run rather than running another, while a Nomad task which
+// is restarted within the same allocation moves on to a new generation once
+// the ECS task of the previous one has stopped.
+type taskRunner struct {
+	logger hclog.Logger
+
+	// owned returns whether the ECS task ARN is owned by a task handle.
+	owned func(arn string) bool
+
+	attempts     int
+	backoffBase  time.Duration
+	backoffLimit time.Duration
+
+	// generations holds the latest generation used for each idempotency
+	// key, so that restarted tasks do not need to step through the stopped
+	// ECS tasks of every previous generation. Entries are small and are
+	// kept for the life of the driver, as it is not told when an allocation
+	// will no longer be restarted.
+	lock        sync.Mutex
+	generations map[string]int
+}
+
+func newTaskRunner(logger hclog.Logger, owned func(string) bool) *taskRunner {
+	return &taskRunner{
+		logger:       logger.Named("runner"),
+		owned:        owned,
+		attempts:     runTaskAttempts,
+		backoffBase:  runTaskBackoffBase,
+		backoffLimit: runTaskBackoffLimit,
+		generations:  make(map[string]int),
+	}
+}
+
+// run runs the ECS task using a client token derived from the idempotency
+// key of the config. If the client token maps to an ECS task which has
+// stopped, or is already owned by another task handle, or was used with
+// different parameters, the next generation is tried.
+func (r *taskRunner) run(ctx context.Context, client ecsClientInterface, cfg TaskConfig) (*ecs.Task, error) {
+	if cfg.idempotencyKey == "" {
+		return r.runWithRetry(ctx, client, cfg)
+	}
+
+	logger := r.logger.With("key", cfg.idempotencyKey)
+	requested := time.Now()
+
+	for generation := r.generation(cfg.idempotencyKey); generation < maxClientTokenGenerations; generation++ {
+		cfg.clientToken = clientToken(cfg.idempotencyKey, generation)
+
+		task, err := r.runWithRetry(ctx, client, cfg)
+		if isClientTokenConflict(err) {
+			logger.Debug("client token used with different parameters, trying next generation",
+				"generation", generation)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		arn := aws.StringValue(task.TaskArn)
+		if aws.StringValue(task.DesiredStatus) == "STOPPED" || r.owned(arn) {
+			logger.Debug("client token maps to a previous ECS task, trying next generation",
+				"generation", generation, "arn", arn)
+			continue
+		}
+
+		r.setGeneration(cfg.idempotencyKey, generation)
+		if task.CreatedAt != nil && task.CreatedAt.Before(requested) {
+			logger.Info("adopting ECS task already run for client token", "generation", generation, "arn", arn)
+		}
+		return task, nil
+	}
+	return nil, fmt.Errorf("failed to run ECS task: no unused client token within %d generations",
+		maxClientTokenGenerations)
+}
+
+// runWithRetry sends the RunTask request, retrying transient errors with a
+// bounded exponential backoff. The client token is unchanged between
+// attempts, so an attempt which ran the task but failed to return it cannot
+// cause a second task to be run.
+func (r *taskRunner) runWithRetry(ctx context.Context, client ecsClientInterface, cfg TaskConfig) (*ecs.Task, error) {
+	backoff := r.backoffBase
+
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, runTaskAttemptTimeout)
+		task, err := client.RunTask(attemptCtx, cfg)
+		cancel()
+
+		if err == nil || attempt >= r.attempts || !isTransientRunTaskError(err) || ctx.Err() != nil {
+			return task, err
+		}
+
+		r.logger.Warn("transient error running ECS task, retrying", "attempt", attempt,
+			"backoff", backoff, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > r.backoffLimit {
+			backoff = r.backoffLimit
+		}
+	}
+}
+
+func (r *taskRunner) generation(key string) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.generations[key]
+}
+
+func (r *taskRunner) setGeneration(key string, generation int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.generations[key] = generation
+}
@@ -0,0 +1,227 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_clientToken(t *testing.T) {
+	token := clientToken("6d9c1a3e/server", 0)
+	assert.Len(t, token, 64)
+	assert.Equal(t, token, clientToken("6d9c1a3e/server", 0))
+	assert.NotEqual(t, token, clientToken("6d9c1a3e/server", 1))
+	assert.NotEqual(t, token, clientToken("6d9c1a3e/worker", 0))
+}
+
+func Test_isTransientRunTaskError(t *testing.T) {
+	testCases := []struct {
+		name     string
+		inputErr error
+		expected bool
+	}{
+		{
+			name:     "throttled",
+			inputErr: awserr.New("ThrottlingException", "Rate exceeded", nil),
+			expected: true,
+		},
+		{
+			name:     "server exception",
+			inputErr: awserr.New(ecsErrCodeServer, "internal error", nil),
+			expected: true,
+		},
+		{
+			name:     "server status code",
+			inputErr: awserr.NewRequestFailure(awserr.New("Unknown", "bad gateway", nil), 502, "1"),
+			expected: true,
+		},
+		{
+			name:     "client exception",
+			inputErr: awserr.NewRequestFailure(awserr.New("ClientException", "bad task definition", nil), 400, "1"),
+		},
+		{
+			name:     "client token conflict",
+			inputErr: awserr.New(ecsErrCodeConflict, "token reused", nil),
+		},
+		{
+			name:     "placement failure",
+			inputErr: newRunTaskError(nil),
+		},
+		{
+			name:     "validation",
+			inputErr: fmt.Errorf("failed to validate: %w", aws.ErrInvalidParams{Context: "RunTaskInput"}),
+		},
+		{
+			name:     "cancelled",
+			inputErr: context.Canceled,
+		},
+		{
+			name:     "attempt timed out",
+			inputErr: context.DeadlineExceeded,
+			expected: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, isTransientRunTaskError(tc.inputErr))
+		})
+	}
+}
+
+func Test_isInactiveTaskDefinitionError(t *testing.T) {
+	assert.True(t, isInactiveTaskDefinitionError(
+		awserr.NewRequestFailure(awserr.New(ecsErrCodeClient, "TaskDefinition is inactive", nil), 400, "1")))
+	assert.False(t, isInactiveTaskDefinitionError(awserr.New(ecsErrCodeClient, "bad task definition", nil)))
+	assert.False(t, isInactiveTaskDefinitionError(newRunTaskError(nil)))
+}
+
+func Test_taskRunner_run(t *testing.T) {
+	throttled := awserr.New("ThrottlingException", "Rate exceeded", nil)
+	key := idempotencyKey("6d9c1a3e", "server")
+
+	testCases := []struct {
+		name           string
+		inputErrs      []error
+		inputExisting  string
+		inputStopped   bool
+		inputOwned     bool
+		expectedTokens []string
+		expectedError  string
+	}{
+		{
+			name:           "runs task",
+			expectedTokens: []string{clientToken(key, 0)},
+		},
+		{
+			name:           "retries transient error",
+			inputErrs:      []error{throttled, nil},
+			expectedTokens: []string{clientToken(key, 0), clientToken(key, 0)},
+		},
+		{
+			name:      "retries are bounded",
+			inputErrs: []error{throttled, throttled, throttled},
+			expectedTokens: []string{
+				clientToken(key, 0), clientToken(key, 0), clientToken(key, 0),
+			},
+			expectedError: "ThrottlingException: Rate exceeded",
+		},
+		{
+			name:           "placement failure is not retried",
+			inputErrs:      []error{newRunTaskError(nil)},
+			expectedTokens: []string{clientToken(key, 0)},
+			expectedError:  "ECS did not return a task or any failures",
+		},
+		{
+			name:           "adopts task already run",
+			inputExisting:  "existing",
+			expectedTokens: []string{clientToken(key, 0)},
+		},
+		{
+			name:           "stopped task uses next generation",
+			inputExisting:  "existing",
+			inputStopped:   true,
+			expectedTokens: []string{clientToken(key, 0), clientToken(key, 1)},
+		},
+		{
+			name:           "owned task uses next generation",
+			inputExisting:  "existing",
+			inputOwned:     true,
+			expectedTokens: []string{clientToken(key, 0), clientToken(key, 1)},
+		},
+		{
+			name:           "conflict uses next generation",
+			inputErrs:      []error{awserr.New(ecsErrCodeConflict, "token reused", nil)},
+			expectedTokens: []string{clientToken(key, 0), clientToken(key, 1)},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newMockECSClient()
+			client.runTaskErrs = tc.inputErrs
+			if tc.inputExisting != "" {
+				task := testOrphanTask(tc.inputExisting, "node-1", 0)
+				if tc.inputStopped {
+					task.DesiredStatus = aws.String("STOPPED")
+				}
+				client.tasks[tc.inputExisting] = task
+				client.clientTokens[clientToken(key, 0)] = tc.inputExisting
+			}
+
+			owned := func(arn string) bool { return tc.inputOwned && arn == tc.inputExisting }
+			r := newTaskRunner(hclog.NewNullLogger(), owned)
+			r.attempts = 3
+			r.backoffBase = 0
+
+			task, err := r.run(context.Background(), client, TaskConfig{idempotencyKey: key})
+
+			var tokens []string
+			for _, cfg := range client.runTaskInputs {
+				tokens = append(tokens, cfg.clientToken)
+			}
+			assert.Equal(t, tc.expectedTokens, tokens)
+
+			if tc.expectedError != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+
+			if tc.inputExisting != "" && !tc.inputStopped && !tc.inputOwned {
+				assert.Equal(t, tc.inputExisting, aws.StringValue(task.TaskArn))
+			} else {
+				assert.NotEqual(t, tc.inputExisting, aws.StringValue(task.TaskArn))
+			}
+		})
+	}
+}
+
+func Test_taskRunner_run_restart(t *testing.T) {
+	client := newMockECSClient()
+	r := newTaskRunner(hclog.NewNullLogger(), func(string) bool { return false })
+	cfg := TaskConfig{idempotencyKey: idempotencyKey("6d9c1a3e", "server")}
+
+	// Running the task again while the first ECS task is running returns
+	// the same task, as when Nomad retries a start which timed out.
+	first, err := r.run(context.Background(), client, cfg)
+	require.NoError(t, err)
+	again, err := r.run(context.Background(), client, cfg)
+	require.NoError(t, err)
+	assert.Equal(t, first.TaskArn, again.TaskArn)
+
+	// Once the ECS task has stopped, restarting the Nomad task runs a new ECS
+	// task and subsequent restarts start from the latest generation.
+	require.NoError(t, client.StopTask(context.Background(), aws.StringValue(first.TaskArn)))
+	second, err := r.run(context.Background(), client, cfg)
+	require.NoError(t, err)
+	assert.NotEqual(t, first.TaskArn, second.TaskArn)
+	assert.Equal(t, 1, r.generation(cfg.idempotencyKey))
+
+	_, err = r.run(context.Background(), client, cfg)
+	require.NoError(t, err)
+	assert.Equal(t, clientToken(cfg.idempotencyKey, 1), client.runTaskInputs[len(client.runTaskInputs)-1].clientToken)
+}
+
+func Test_taskRunner_run_cancelled(t *testing.T) {
+	client := newMockECSClient()
+	client.runTaskErrs = []error{awserr.New("ThrottlingException", "Rate exceeded", nil)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r := newTaskRunner(hclog.NewNullLogger(), func(string) bool { return false })
+	_, err := r.run(ctx, client, TaskConfig{idempotencyKey: "6d9c1a3e/server"})
+	assert.Error(t, err)
+	assert.Len(t, client.runTaskInputs, 1)
+}
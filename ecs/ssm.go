@@ -0,0 +1,552 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"golang.org/x/net/websocket"
+)
+
+// These are the message types of the SSM session data channel.
+const (
+	ssmMessageInput         = "input_stream_data"
+	ssmMessageOutput        = "output_stream_data"
+	ssmMessageAcknowledge   = "acknowledge"
+	ssmMessageChannelClosed = "channel_closed"
+)
+
+// These are the payload types of the SSM session data channel stream
+// messages.
+const (
+	ssmPayloadOutput            uint32 = 1
+	ssmPayloadError             uint32 = 2
+	ssmPayloadSize              uint32 = 3
+	ssmPayloadHandshakeRequest  uint32 = 5
+	ssmPayloadHandshakeResponse uint32 = 6
+	ssmPayloadHandshakeComplete uint32 = 7
+	ssmPayloadStdErr            uint32 = 11
+	ssmPayloadExitCode          uint32 = 12
+)
+
+// These are the statuses of the actions requested by the agent during the
+// session handshake.
+const (
+	ssmActionSuccess     = 1
+	ssmActionUnsupported = 3
+)
+
+const (
+	// ssmSessionType is the only handshake action which the driver
+	// supports. Other actions, such as KMS encryption, are rejected.
+	ssmSessionType = "SessionType"
+
+	// ssmClientVersion is reported to the agent as the session client
+	// version, which determines the protocol features the agent uses.
+	ssmClientVersion = "1.2.0.0"
+
+	// ssmSchemaVersion is the version of the data channel message format.
+	ssmSchemaVersion = 1
+
+	// ssmHeaderLength is the length of the message header, excluding the
+	// header length field itself and the payload length.
+	ssmHeaderLength = 116
+
+	// ssmMessageTypeLength is the length of the space padded message type.
+	ssmMessageTypeLength = 32
+
+	// ssmAcknowledgeFlags are the flags set on acknowledge messages.
+	ssmAcknowledgeFlags = 3
+
+	// ssmInputChunkSize is the maximum size of each stdin message.
+	ssmInputChunkSize = 1024
+
+	// ssmEndOfTransmission is sent once stdin is closed. ECS Exec sessions
+	// are interactive, so the command reads stdin from a terminal, which
+	// treats the character as the end of input.
+	ssmEndOfTransmission = 0x04
+)
+
+// ssmMessage is a message of the SSM session data channel. Messages are sent
+// as binary websocket frames with a fixed length header.
+type ssmMessage struct {
+	MessageType    string
+	SchemaVersion  uint32
+	CreatedDate    time.Time
+	SequenceNumber int64
+	Flags          uint64
+	MessageID      [16]byte
+	PayloadType    uint32
+	Payload        []byte
+}
+
+// marshal encodes the message in the data channel format. All integers are
+// big endian, and the message ID is written as its least significant half
+// followed by its most significant half.
+func (m *ssmMessage) marshal() []byte {
+	buf := make([]byte, 4+ssmHeaderLength+len(m.Payload))
+	digest := sha256.Sum256(m.Payload)
+
+	binary.BigEndian.PutUint32(buf[0:4], ssmHeaderLength)
+	copy(buf[4:36], fmt.Sprintf("%-*s", ssmMessageTypeLength, m.MessageType))
+	binary.BigEndian.PutUint32(buf[36:40], m.SchemaVersion)
+	binary.BigEndian.PutUint64(buf[40:48], uint64(m.CreatedDate.UnixNano()/int64(time.Millisecond)))
+	binary.BigEndian.PutUint64(buf[48:56], uint64(m.SequenceNumber))
+	binary.BigEndian.PutUint64(buf[56:64], m.Flags)
+	copy(buf[64:72], m.MessageID[8:])
+	copy(buf[72:80], m.MessageID[:8])
+	copy(buf[80:112], digest[:])
+	binary.BigEndian.PutUint32(buf[112:116], m.PayloadType)
+	binary.BigEndian.PutUint32(buf[116:120], uint32(len(m.Payload)))
+	copy(buf[120:], m.Payload)
+	return buf
+}
+
+// unmarshalSSMMessage decodes a message in the data channel format.
+func unmarshalSSMMessage(buf []byte) (*ssmMessage, error) {
+	if len(buf) < 4+ssmHeaderLength {
+		return nil, fmt.Errorf("SSM message too short: %d bytes", len(buf))
+	}
+	headerLength := binary.BigEndian.Uint32(buf[0:4])
+	if headerLength != ssmHeaderLength {
+		return nil, fmt.Errorf("unsupported SSM message header length %d", headerLength)
+	}
+
+	m := ssmMessage{
+		MessageType:    strings.TrimRight(string(buf[4:36]), " \x00"),
+		SchemaVersion:  binary.BigEndian.Uint32(buf[36:40]),
+		CreatedDate:    time.Unix(0, int64(binary.BigEndian.Uint64(buf[40:48]))*int64(time.Millisecond)),
+		SequenceNumber: int64(binary.BigEndian.Uint64(buf[48:56])),
+		Flags:          binary.BigEndian.Uint64(buf[56:64]),
+		PayloadType:    binary.BigEndian.Uint32(buf[112:116]),
+	}
+	copy(m.MessageID[8:], buf[64:72])
+	copy(m.MessageID[:8], buf[72:80])
+
+	length := binary.BigEndian.Uint32(buf[116:120])
+	if uint64(len(buf)-120) < uint64(length) {
+		return nil, fmt.Errorf("SSM message payload truncated: expected %d bytes, got %d", length, len(buf)-120)
+	}
+	m.Payload = buf[120 : 120+length]
+
+	if digest := sha256.Sum256(m.Payload); string(digest[:]) != string(buf[80:112]) {
+		return nil, errors.New("SSM message payload digest mismatch")
+	}
+	return &m, nil
+}
+
+// newUUID returns a random version 4 UUID.
+func newUUID() [16]byte {
+	var id [16]byte
+	_, _ = rand.Read(id[:])
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return id
+}
+
+func formatUUID(id [16]byte) string {
+	h := hex.EncodeToString(id[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// ssmOpenDataChannel is the first message sent on the websocket, as text,
+// authenticating the client with the session token.
+type ssmOpenDataChannel struct {
+	MessageSchemaVersion string
+	RequestID            string `json:"RequestId"`
+	TokenValue           string
+	ClientID             string `json:"ClientId"`
+	ClientVersion        string
+}
+
+type ssmAcknowledge struct {
+	AcknowledgedMessageType           string
+	AcknowledgedMessageID             string `json:"AcknowledgedMessageId"`
+	AcknowledgedMessageSequenceNumber int64
+	IsSequentialMessage               bool
+}
+
+type ssmHandshakeRequest struct {
+	AgentVersion           string
+	RequestedClientActions []struct {
+		ActionType string
+	}
+}
+
+type ssmProcessedAction struct {
+	ActionType   string
+	ActionStatus int
+	Error        string `json:",omitempty"`
+}
+
+type ssmHandshakeResponse struct {
+	ClientVersion          string
+	ProcessedClientActions []ssmProcessedAction
+	Errors                 []string
+}
+
+type ssmTerminalSize struct {
+	Cols int `json:"cols"`
+	Rows int `json:"rows"`
+}
+
+// ssmSession is the client side of the data channel of an SSM session, as
+// started by ECS Exec. It bridges the stdin, stdout and stderr of a Nomad
+// exec to the command running in the ECS container.
+type ssmSession struct {
+	id   string
+	conn *websocket.Conn
+
+	// writeLock syncs sending messages and the outgoing sequence number
+	writeLock sync.Mutex
+	sequence  int64
+
+	// expected is the sequence number of the next output message, and
+	// pending holds any which arrived ahead of it. Both are only accessed by
+	// the receive loop.
+	expected int64
+	pending  map[int64]*ssmMessage
+}
+
+// dialSSMSession opens the data channel websocket of the session and
+// authenticates using the session token.
+func dialSSMSession(ctx context.Context, session *execSession) (*ssmSession, error) {
+	streamURL := aws.StringValue(session.StreamURL)
+	u, err := url.Parse(streamURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse exec session stream URL: %v", err)
+	}
+
+	origin := "https://" + u.Host
+	cfg, err := websocket.NewConfig(streamURL, origin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure exec session websocket: %v", err)
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	var conn net.Conn
+	if u.Scheme == "wss" {
+		dialer := tls.Dialer{Config: &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to exec session: %v", err)
+	}
+
+	ws, err := websocket.NewClient(cfg, conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to open exec session websocket: %v", err)
+	}
+
+	open, err := json.Marshal(ssmOpenDataChannel{
+		MessageSchemaVersion: "1.0",
+		RequestID:            formatUUID(newUUID()),
+		TokenValue:           aws.StringValue(session.TokenValue),
+		ClientID:             formatUUID(newUUID()),
+		ClientVersion:        ssmClientVersion,
+	})
+	if err == nil {
+		err = websocket.Message.Send(ws, string(open))
+	}
+	if err != nil {
+		_ = ws.Close()
+		return nil, fmt.Errorf("failed to open exec session data channel: %v", err)
+	}
+
+	return &ssmSession{
+		id:      aws.StringValue(session.SessionID),
+		conn:    ws,
+		pending: make(map[int64]*ssmMessage),
+	}, nil
+}
+
+// errNoExitCode is returned when the agent closes an exec session, having
+// delivered all output, without reporting the exit code of the command, which
+// older agents do not report.
+var errNoExitCode = errors.New("exec session closed without reporting the exit code")
+
+// run streams the exec input and output until the command exits or the
+// context is cancelled, returning the exit code of the command, or
+// errNoExitCode if the agent closes the session without one. A connection
+// which is lost before the agent closes the channel is an error, as the
+// command may not have finished.
+func (s *ssmSession) run(ctx context.Context, opts *drivers.ExecOptions) (int, error) {
+	defer s.conn.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		<-ctx.Done()
+		_ = s.conn.Close()
+	}()
+
+	// Input is held until the agent has completed the handshake or, for
+	// agents which do not handshake, sent output.
+	ready := make(chan struct{})
+	var readyOnce sync.Once
+	markReady := func() { readyOnce.Do(func() { close(ready) }) }
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ready:
+		}
+		if opts.Stdin != nil {
+			go s.forwardStdin(ctx, opts.Stdin)
+		}
+		if opts.ResizeCh != nil {
+			go s.forwardResize(ctx, opts.ResizeCh)
+		}
+	}()
+
+	var exitCode *int
+
+	for {
+		var buf []byte
+		if err := websocket.Message.Receive(s.conn, &buf); err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return 0, ctxErr
+			}
+			if errors.Is(err, io.EOF) && exitCode != nil {
+				return *exitCode, nil
+			}
+			return 0, fmt.Errorf("exec session %s disconnected before the command exited: %v", s.id, err)
+		}
+
+		msg, err := unmarshalSSMMessage(buf)
+		if err != nil {
+			return 0, err
+		}
+
+		switch msg.MessageType {
+		case ssmMessageChannelClosed:
+			switch {
+			case exitCode != nil:
+				return *exitCode, nil
+			case len(s.pending) > 0:
+				return 0, fmt.Errorf("exec session %s closed before all output was received", s.id)
+			default:
+				return 0, errNoExitCode
+			}
+
+		case ssmMessageOutput:
+			// A failure to acknowledge the message surfaces as an error on
+			// the next receive, unless the session has already ended.
+			_ = s.acknowledge(msg)
+			for _, m := range s.sequenced(msg) {
+				code, err := s.handleOutput(m, opts, markReady)
+				if err != nil {
+					return 0, err
+				}
+				if code != nil {
+					exitCode = code
+				}
+			}
+		}
+	}
+}
+
+// sequenced returns the output messages which can be processed in order
+// following the receipt of the message, discarding any duplicates.
+func (s *ssmSession) sequenced(msg *ssmMessage) []*ssmMessage {
+	if msg.SequenceNumber < s.expected {
+		return nil
+	}
+	s.pending[msg.SequenceNumber] = msg
+
+	var out []*ssmMessage
+	for {
+		next, ok := s.pending[s.expected]
+		if !ok {
+			return out
+		}
+		delete(s.pending, s.expected)
+		out = append(out, next)
+		s.expected++
+	}
+}
+
+// handleOutput processes an in order output message, returning the exit code
+// if the message reports it.
+func (s *ssmSession) handleOutput(msg *ssmMessage, opts *drivers.ExecOptions, markReady func()) (*int, error) {
+	switch msg.PayloadType {
+	case ssmPayloadOutput:
+		markReady()
+		if opts.Stdout != nil {
+			if _, err := opts.Stdout.Write(msg.Payload); err != nil {
+				return nil, fmt.Errorf("failed to write exec stdout: %v", err)
+			}
+		}
+	case ssmPayloadError, ssmPayloadStdErr:
+		markReady()
+		if opts.Stderr != nil {
+			if _, err := opts.Stderr.Write(msg.Payload); err != nil {
+				return nil, fmt.Errorf("failed to write exec stderr: %v", err)
+			}
+		}
+	case ssmPayloadHandshakeRequest:
+		return nil, s.handshake(msg.Payload)
+	case ssmPayloadHandshakeComplete:
+		markReady()
+	case ssmPayloadExitCode:
+		code, err := strconv.Atoi(strings.TrimSpace(string(msg.Payload)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse exec exit code %q: %v", msg.Payload, err)
+		}
+		return &code, nil
+	}
+	return nil, nil
+}
+
+// handshake responds to the agent handshake request, accepting the session
+// type and rejecting all other actions, such as KMS encryption, which the
+// driver does not support.
+func (s *ssmSession) handshake(payload []byte) error {
+	var req ssmHandshakeRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return fmt.Errorf("failed to decode exec session handshake: %v", err)
+	}
+
+	resp := ssmHandshakeResponse{ClientVersion: ssmClientVersion, Errors: []string{}}
+	for _, action := range req.RequestedClientActions {
+		processed := ssmProcessedAction{ActionType: action.ActionType, ActionStatus: ssmActionSuccess}
+		if action.ActionType != ssmSessionType {
+			processed.ActionStatus = ssmActionUnsupported
+			processed.Error = fmt.Sprintf("%s is not supported by the Nomad ECS driver", action.ActionType)
+		}
+		resp.ProcessedClientActions = append(resp.ProcessedClientActions, processed)
+	}
+
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	return s.sendInput(ssmPayloadHandshakeResponse, buf)
+}
+
+// acknowledge confirms receipt of the output message, without which the
+// agent resends it.
+func (s *ssmSession) acknowledge(msg *ssmMessage) error {
+	buf, err := json.Marshal(ssmAcknowledge{
+		AcknowledgedMessageType:           msg.MessageType,
+		AcknowledgedMessageID:             formatUUID(msg.MessageID),
+		AcknowledgedMessageSequenceNumber: msg.SequenceNumber,
+		IsSequentialMessage:               true,
+	})
+	if err != nil {
+		return err
+	}
+	return s.send(&ssmMessage{
+		MessageType: ssmMessageAcknowledge,
+		Flags:       ssmAcknowledgeFlags,
+		Payload:     buf,
+	})
+}
+
+// sendInput sends an input message with the next sequence number.
+func (s *ssmSession) sendInput(payloadType uint32, payload []byte) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	err := s.sendLocked(&ssmMessage{
+		MessageType:    ssmMessageInput,
+		SequenceNumber: s.sequence,
+		PayloadType:    payloadType,
+		Payload:        payload,
+	})
+	if err == nil {
+		s.sequence++
+	}
+	return err
+}
+
+func (s *ssmSession) send(msg *ssmMessage) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	return s.sendLocked(msg)
+}
+
+func (s *ssmSession) sendLocked(msg *ssmMessage) error {
+	msg.SchemaVersion = ssmSchemaVersion
+	msg.CreatedDate = time.Now()
+	msg.MessageID = newUUID()
+	if err := websocket.Message.Send(s.conn, msg.marshal()); err != nil {
+		return fmt.Errorf("failed to write exec session: %v", err)
+	}
+	return nil
+}
+
+// forwardStdin sends stdin to the command until it is closed, then signals
+// the end of input.
+func (s *ssmSession) forwardStdin(ctx context.Context, stdin io.Reader) {
+	buf := make([]byte, ssmInputChunkSize)
+	for {
+		n, err := stdin.Read(buf)
+		if n > 0 {
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			if sendErr := s.sendInput(ssmPayloadOutput, data); sendErr != nil {
+				return
+			}
+		}
+		if err != nil {
+			if ctx.Err() == nil && errors.Is(err, io.EOF) {
+				_ = s.sendInput(ssmPayloadOutput, []byte{ssmEndOfTransmission})
+			}
+			return
+		}
+	}
+}
+
+// forwardResize sends terminal size changes to the command.
+func (s *ssmSession) forwardResize(ctx context.Context, resizeCh <-chan drivers.TerminalSize) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case size, ok := <-resizeCh:
+			if !ok {
+				return
+			}
+			buf, err := json.Marshal(ssmTerminalSize{Cols: size.Width, Rows: size.Height})
+			if err != nil {
+				continue
+			}
+			if err := s.sendInput(ssmPayloadSize, buf); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,412 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// defaultStatsInterval is the default interval at which the task metrics
+	// are read from CloudWatch. Container Insights publishes metrics once a
+	// minute, so reading them more often has no benefit.
+	defaultStatsInterval = time.Minute
+
+	// statsLookback is how far back the latest datapoint of each metric is
+	// searched for, allowing for the delay before CloudWatch publishes it.
+	statsLookback = 5 * time.Minute
+
+	// statsPeriod is the period, in seconds, of the metric datapoints.
+	statsPeriod = 60
+
+	// statsMissingGrace is how long after a task is registered a warning is
+	// logged if no metrics have been found for it, allowing for the delay
+	// before Container Insights publishes the first datapoints.
+	statsMissingGrace = 10 * time.Minute
+
+	// maxMetricDataQueries is the maximum number of queries within a single
+	// GetMetricData request.
+	maxMetricDataQueries = 500
+
+	// containerInsightsNamespace is the CloudWatch namespace of the Container
+	// Insights metrics.
+	containerInsightsNamespace = "ECS/ContainerInsights"
+
+	// cpuUnitsPerCore is the number of ECS CPU units in one vCPU.
+	cpuUnitsPerCore = 1024
+)
+
+// These are the Container Insights metrics read for each task.
+const (
+	metricCPUUtilized    = "CpuUtilized"
+	metricMemoryUtilized = "MemoryUtilized"
+)
+
+// These are the dimensions of the Container Insights task level metrics.
+const (
+	dimensionClusterName          = "ClusterName"
+	dimensionTaskDefinitionFamily = "TaskDefinitionFamily"
+	dimensionTaskID               = "TaskId"
+)
+
+// metricsClientInterface encapsulates the AWS functionality required to read
+// ECS task metrics from CloudWatch.
+type metricsClientInterface interface {
+
+	// GetLatestMetrics returns the latest value of each query between start
+	// and end within the region, keyed by the query ID. Queries without any
+	// datapoints within the range are omitted.
+	GetLatestMetrics(ctx context.Context, region string, queries []metricQuery, start, end time.Time) (map[string]metricValue, error)
+}
+
+// metricQuery identifies a single task level Container Insights metric.
+type metricQuery struct {
+	ID         string
+	MetricName string
+	Dimensions map[string]string
+}
+
+// metricValue is the latest datapoint of a metric.
+type metricValue struct {
+	Timestamp time.Time
+	Value     float64
+}
+
+// statsTarget identifies the Container Insights metrics of an ECS task.
+type statsTarget struct {
+	Region  string
+	Cluster string
+	Family  string
+	TaskID  string
+}
+
+// newStatsTarget builds the metric dimensions of an ECS task from its
+// description. False is returned if the task has not been described with
+// its task definition yet.
+func newStatsTarget(ref clusterRef, task *ecs.Task) (statsTarget, bool) {
+	if task == nil {
+		return statsTarget{}, false
+	}
+	family := taskDefinitionFamilyFromARN(aws.StringValue(task.TaskDefinitionArn))
+	id := arnResourceID(aws.StringValue(task.TaskArn))
+	if family == "" || id == "" {
+		return statsTarget{}, false
+	}
+	return statsTarget{Region: ref.Region, Cluster: ref.Cluster, Family: family, TaskID: id}, true
+}
+
+func (t statsTarget) dimensions() map[string]string {
+	return map[string]string{
+		dimensionClusterName:          t.Cluster,
+		dimensionTaskDefinitionFamily: t.Family,
+		dimensionTaskID:               t.TaskID,
+	}
+}
+
+// taskDefinitionFamilyFromARN returns the family of a task definition ARN,
+// such as web from arn:aws:ecs:us-east-1:123456789012:task-definition/web:1.
+func taskDefinitionFamilyFromARN(arn string) string {
+	family := arnResourceID(arn)
+	if i := strings.LastIndex(family, ":"); i >= 0 {
+		family = family[:i]
+	}
+	return family
+}
+
+// arnResourceID returns the final path segment of the ARN resource, which
+// for ECS tasks is the task ID.
+func arnResourceID(arn string) string {
+	if i := strings.LastIndex(arn, "/"); i >= 0 {
+		return arn[i+1:]
+	}
+	return ""
+}
+
+// taskMetrics is the latest CPU and memory usage of an ECS task.
+type taskMetrics struct {
+	Timestamp time.Time
+
+	// CPUUnits is the number of ECS CPU units used.
+	CPUUnits float64
+
+	// MemoryMiB is the memory used, in MiB.
+	MemoryMiB float64
+}
+
+// resourceUsage converts the metrics into the Nomad resource usage. ECS CPU
+// units are used as MHz, matching how Nomad CPU resources are converted when
+// injected into the task.
+func (m *taskMetrics) resourceUsage() *drivers.ResourceUsage {
+	if m == nil {
+		return &drivers.ResourceUsage{
+			MemoryStats: &drivers.MemoryStats{},
+			CpuStats:    &drivers.CpuStats{},
+		}
+	}
+
+	memory := uint64(m.MemoryMiB * 1024 * 1024)
+	return &drivers.ResourceUsage{
+		MemoryStats: &drivers.MemoryStats{
+			RSS:      memory,
+			Usage:    memory,
+			Measured: []string{"RSS", "Usage"},
+		},
+		CpuStats: &drivers.CpuStats{
+			TotalTicks: m.CPUUnits,
+			Percent:    m.CPUUnits / cpuUnitsPerCore * 100,
+			Measured:   []string{"Total Ticks", "Percent"},
+		},
+	}
+}
+
+// statsCollector reads the CPU and memory usage of the ECS tasks for which
+// Nomad requests stats from CloudWatch Container Insights, batching the
+// metrics of all tasks into as few GetMetricData requests as possible.
+type statsCollector struct {
+	logger hclog.Logger
+	client metricsClientInterface
+
+	// lock syncs access to all fields below
+	lock    sync.Mutex
+	targets map[string]statsTarget
+	latest  map[string]*taskMetrics
+
+	// registered is when each task was registered, and missing records the
+	// tasks for which a warning has been logged as no metrics were found.
+	registered map[string]time.Time
+	missing    map[string]struct{}
+}
+
+func newStatsCollector(logger hclog.Logger, client metricsClientInterface) *statsCollector {
+	return &statsCollector{
+		logger:     logger.Named("stats"),
+		client:     client,
+		targets:    make(map[string]statsTarget),
+		latest:     make(map[string]*taskMetrics),
+		registered: make(map[string]time.Time),
+		missing:    make(map[string]struct{}),
+	}
+}
+
+// Register starts collecting the metrics of the ECS task.
+func (c *statsCollector) Register(arn string, target statsTarget) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.targets[arn] = target
+	if _, ok := c.registered[arn]; !ok {
+		c.registered[arn] = time.Now()
+	}
+}
+
+// Unregister stops collecting the metrics of the ECS task.
+func (c *statsCollector) Unregister(arn string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.targets, arn)
+	delete(c.latest, arn)
+	delete(c.registered, arn)
+	delete(c.missing, arn)
+}
+
+// Latest returns the latest metrics of the ECS task, or nil if none have
+// been collected.
+func (c *statsCollector) Latest(arn string) *taskMetrics {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.latest[arn]
+}
+
+// run collects the metrics at the interval until the context is cancelled.
+func (c *statsCollector) run(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+			if err := c.collect(ctx); err != nil {
+				c.logger.Warn("failed to collect ECS task metrics", "error", err)
+			}
+		}
+	}
+}
+
+// collect reads the latest metrics of every registered task, batching the
+// tasks of each region.
+func (c *statsCollector) collect(ctx context.Context) error {
+	c.lock.Lock()
+	arns := make([]string, 0, len(c.targets))
+	queries := make(map[string][]metricQuery)
+	for arn, target := range c.targets {
+		i := len(arns)
+		arns = append(arns, arn)
+		queries[target.Region] = append(queries[target.Region],
+			metricQuery{ID: fmt.Sprintf("cpu%d", i), MetricName: metricCPUUtilized, Dimensions: target.dimensions()},
+			metricQuery{ID: fmt.Sprintf("mem%d", i), MetricName: metricMemoryUtilized, Dimensions: target.dimensions()},
+		)
+	}
+	c.lock.Unlock()
+
+	end := time.Now()
+	start := end.Add(-statsLookback)
+	values := make(map[string]metricValue, len(arns)*2)
+	for region, regionQueries := range queries {
+		for i := 0; i < len(regionQueries); i += maxMetricDataQueries {
+			j := i + maxMetricDataQueries
+			if j > len(regionQueries) {
+				j = len(regionQueries)
+			}
+			batch, err := c.client.GetLatestMetrics(ctx, region, regionQueries[i:j], start, end)
+			if err != nil {
+				return err
+			}
+			for id, v := range batch {
+				values[id] = v
+			}
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for i, arn := range arns {
+		// The task may have been unregistered while the metrics were read.
+		if _, ok := c.targets[arn]; !ok {
+			continue
+		}
+		cpu, cpuOK := values[fmt.Sprintf("cpu%d", i)]
+		mem, memOK := values[fmt.Sprintf("mem%d", i)]
+		if !cpuOK && !memOK {
+			c.checkMissing(arn, end)
+			continue
+		}
+
+		m := &taskMetrics{CPUUnits: cpu.Value, MemoryMiB: mem.Value, Timestamp: cpu.Timestamp}
+		if mem.Timestamp.After(m.Timestamp) {
+			m.Timestamp = mem.Timestamp
+		}
+		c.latest[arn] = m
+	}
+	return nil
+}
+
+// checkMissing logs a warning, once per task, if no metrics have been found
+// for the task since it was registered, as the usage of the task is then
+// reported as zero. The caller must hold the lock.
+func (c *statsCollector) checkMissing(arn string, now time.Time) {
+	if _, ok := c.latest[arn]; ok {
+		return
+	}
+	if _, ok := c.missing[arn]; ok {
+		return
+	}
+	if now.Sub(c.registered[arn]) < statsMissingGrace {
+		return
+	}
+
+	c.missing[arn] = struct{}{}
+	target := c.targets[arn]
+	c.logger.Warn("no Container Insights metrics found for ECS task, usage is reported as zero; "+
+		"the cluster must have Container Insights with enhanced observability enabled",
+		"arn", arn, "cluster", target.Cluster, "region", target.Region,
+		"since", c.registered[arn].Format(time.RFC3339))
+}
+
+type awsMetricsClient struct {
+	cfg aws.Config
+
+	// clients are keyed by region, as tasks may run in clusters of regions
+	// other than that of the plugin config.
+	clients map[string]*cloudwatch.Client
+	lock    sync.Mutex
+}
+
+func newAwsMetricsClient(cfg aws.Config) *awsMetricsClient {
+	return &awsMetricsClient{
+		cfg:     cfg,
+		clients: make(map[string]*cloudwatch.Client),
+	}
+}
+
+func (c *awsMetricsClient) client(region string) *cloudwatch.Client {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if region == "" {
+		region = c.cfg.Region
+	}
+	if client, ok := c.clients[region]; ok {
+		return client
+	}
+
+	cfg := c.cfg.Copy()
+	cfg.Region = region
+	client := cloudwatch.New(cfg)
+	c.clients[region] = client
+	return client
+}
+
+// GetLatestMetrics satisfies the ecs.metricsClientInterface GetLatestMetrics
+// interface function.
+func (c *awsMetricsClient) GetLatestMetrics(ctx context.Context, region string, queries []metricQuery,
+	start, end time.Time) (map[string]metricValue, error) {
+	input := cloudwatch.GetMetricDataInput{
+		StartTime: aws.Time(start),
+		EndTime:   aws.Time(end),
+		ScanBy:    cloudwatch.ScanByTimestampDescending,
+	}
+	for _, q := range queries {
+		metric := cloudwatch.Metric{
+			Namespace:  aws.String(containerInsightsNamespace),
+			MetricName: aws.String(q.MetricName),
+		}
+		names := make([]string, 0, len(q.Dimensions))
+		for k := range q.Dimensions {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			metric.Dimensions = append(metric.Dimensions, cloudwatch.Dimension{
+				Name:  aws.String(k),
+				Value: aws.String(q.Dimensions[k]),
+			})
+		}
+		input.MetricDataQueries = append(input.MetricDataQueries, cloudwatch.MetricDataQuery{
+			Id: aws.String(q.ID),
+			MetricStat: &cloudwatch.MetricStat{
+				Metric: &metric,
+				Period: aws.Int64(statsPeriod),
+				Stat:   aws.String("Average"),
+			},
+		})
+	}
+
+	values := make(map[string]metricValue)
+	p := cloudwatch.NewGetMetricDataPaginator(c.client(region).GetMetricDataRequest(&input))
+	for p.Next(ctx) {
+		for _, r := range p.CurrentPage().MetricDataResults {
+			id := aws.StringValue(r.Id)
+			if _, ok := values[id]; ok || len(r.Values) == 0 || len(r.Timestamps) == 0 {
+				continue
+			}
+
+			// Results are ordered newest first.
+			values[id] = metricValue{Timestamp: r.Timestamps[0], Value: r.Values[0]}
+		}
+	}
+	if err := p.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
@@ -0,0 +1,231 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockMetricsClient returns the configured value for each query, keyed by
+// metric name and task ID, recording the size of every request.
+type mockMetricsClient struct {
+	values   map[string]float64
+	err      error
+	requests []string
+}
+
+func (m *mockMetricsClient) GetLatestMetrics(_ context.Context, region string, queries []metricQuery,
+	_, end time.Time) (map[string]metricValue, error) {
+	m.requests = append(m.requests, fmt.Sprintf("%s:%d", region, len(queries)))
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	out := make(map[string]metricValue)
+	for _, q := range queries {
+		key := q.MetricName + "/" + q.Dimensions[dimensionTaskID]
+		if v, ok := m.values[key]; ok {
+			out[q.ID] = metricValue{Timestamp: end, Value: v}
+		}
+	}
+	return out, nil
+}
+
+func Test_newStatsTarget(t *testing.T) {
+	testCases := []struct {
+		name          string
+		inputTask     *ecs.Task
+		expectedOK    bool
+		expectedValue statsTarget
+	}{
+		{
+			name:      "not described",
+			inputTask: nil,
+		},
+		{
+			name:      "no task definition",
+			inputTask: &ecs.Task{TaskArn: aws.String("arn:aws:ecs:us-east-1:123456789012:task/cluster/abc")},
+		},
+		{
+			name: "described",
+			inputTask: &ecs.Task{
+				TaskArn:           aws.String("arn:aws:ecs:us-east-1:123456789012:task/cluster/abc"),
+				TaskDefinitionArn: aws.String("arn:aws:ecs:us-east-1:123456789012:task-definition/web:12"),
+			},
+			expectedOK:    true,
+			expectedValue: statsTarget{Region: "us-east-1", Cluster: "cluster", Family: "web", TaskID: "abc"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			target, ok := newStatsTarget(clusterRef{Region: "us-east-1", Cluster: "cluster"}, tc.inputTask)
+			assert.Equal(t, tc.expectedOK, ok)
+			assert.Equal(t, tc.expectedValue, target)
+		})
+	}
+}
+
+func Test_taskMetrics_resourceUsage(t *testing.T) {
+	var empty *taskMetrics
+	assert.Equal(t, &drivers.ResourceUsage{
+		MemoryStats: &drivers.MemoryStats{},
+		CpuStats:    &drivers.CpuStats{},
+	}, empty.resourceUsage())
+
+	usage := (&taskMetrics{CPUUnits: 512, MemoryMiB: 256}).resourceUsage()
+	assert.Equal(t, uint64(256*1024*1024), usage.MemoryStats.RSS)
+	assert.Equal(t, uint64(256*1024*1024), usage.MemoryStats.Usage)
+	assert.Equal(t, float64(512), usage.CpuStats.TotalTicks)
+	assert.Equal(t, float64(50), usage.CpuStats.Percent)
+}
+
+func Test_statsCollector_collect(t *testing.T) {
+	client := &mockMetricsClient{
+		values: map[string]float64{
+			metricCPUUtilized + "/task0":    256,
+			metricMemoryUtilized + "/task0": 128,
+		},
+	}
+	collector := newStatsCollector(hclog.NewNullLogger(), client)
+
+	// No requests are made without any registered tasks.
+	require.NoError(t, collector.collect(context.Background()))
+	assert.Empty(t, client.requests)
+
+	// The metrics of all tasks of each region are batched into as few
+	// requests as the query limit allows.
+	for i := 0; i < 300; i++ {
+		collector.Register(fmt.Sprintf("arn%d", i),
+			statsTarget{Region: "us-east-1", Cluster: "cluster", Family: "web", TaskID: fmt.Sprintf("task%d", i)})
+	}
+	collector.Register("arn-west",
+		statsTarget{Region: "us-west-2", Cluster: "cluster", Family: "web", TaskID: "task-west"})
+	require.NoError(t, collector.collect(context.Background()))
+	assert.ElementsMatch(t, []string{"us-east-1:500", "us-east-1:100", "us-west-2:2"}, client.requests)
+
+	metrics := collector.Latest("arn0")
+	require.NotNil(t, metrics)
+	assert.Equal(t, float64(256), metrics.CPUUnits)
+	assert.Equal(t, float64(128), metrics.MemoryMiB)
+	assert.Nil(t, collector.Latest("arn1"))
+
+	// Previously collected metrics are kept if a collection fails, but
+	// removed once the task is unregistered.
+	client.err = errors.New("throttled")
+	assert.Error(t, collector.collect(context.Background()))
+	assert.NotNil(t, collector.Latest("arn0"))
+
+	collector.Unregister("arn0")
+	assert.Nil(t, collector.Latest("arn0"))
+
+	// Tasks without any metrics are only reported as missing once the grace
+	// period since they were registered has elapsed.
+	client.err = nil
+	require.NoError(t, collector.collect(context.Background()))
+	assert.Empty(t, collector.missing)
+
+	collector.registered["arn1"] = time.Now().Add(-statsMissingGrace)
+	require.NoError(t, collector.collect(context.Background()))
+	assert.Equal(t, map[string]struct{}{"arn1": {}}, collector.missing)
+}
+
+func Test_Driver_TaskStats_streams(t *testing.T) {
+	arn := "arn:aws:ecs:us-east-1:123456789012:task/cluster/abc"
+	collector := newStatsCollector(hclog.NewNullLogger(), &mockMetricsClient{})
+	d := &Driver{logger: hclog.NewNullLogger(), tasks: newTaskStore(), stats: collector}
+
+	h := newTaskHandle(hclog.NewNullLogger(), TaskState{ARN: arn, Cluster: "cluster", Region: "us-east-1"},
+		&drivers.TaskConfig{ID: "alloc/web/1", Name: "web"}, nil, nil, nil, nil)
+	h.setSnapshot(&ecs.Task{
+		TaskArn:           aws.String(arn),
+		TaskDefinitionArn: aws.String("arn:aws:ecs:us-east-1:123456789012:task-definition/web:12"),
+	})
+	d.tasks.Set("alloc/web/1", h)
+
+	registered := func() bool {
+		collector.lock.Lock()
+		defer collector.lock.Unlock()
+		_, ok := collector.targets[arn]
+		return ok
+	}
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ch1, err := d.TaskStats(ctx1, "alloc/web/1", 10*time.Millisecond)
+	require.NoError(t, err)
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	ch2, err := d.TaskStats(ctx2, "alloc/web/1", 10*time.Millisecond)
+	require.NoError(t, err)
+	<-ch1
+	<-ch2
+
+	// Closing one of the streams leaves the task registered for the other.
+	cancel1()
+	for range ch1 {
+	}
+	<-ch2
+	assert.True(t, registered())
+
+	// Once the handle is destroyed, the task is removed and the remaining
+	// stream does not register it again.
+	h.destroy()
+	h.unregisterStats(collector)
+	<-ch2
+	assert.False(t, registered())
+}
+
+func Test_StatsConfig_parse(t *testing.T) {
+	testCases := []struct {
+		name             string
+		inputInterval    string
+		expectedError    bool
+		expectedInterval time.Duration
+	}{
+		{
+			name:             "default",
+			inputInterval:    "1m",
+			expectedInterval: time.Minute,
+		},
+		{
+			name:             "longer",
+			inputInterval:    "5m",
+			expectedInterval: 5 * time.Minute,
+		},
+		{
+			name:          "too short",
+			inputInterval: "10s",
+			expectedError: true,
+		},
+		{
+			name:          "invalid",
+			inputInterval: "soon",
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := StatsConfig{Interval: tc.inputInterval}
+			err := cfg.parse()
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedInterval, cfg.interval)
+		})
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// defaultStartedBy is the default value of the ECS task startedBy field.
+	defaultStartedBy = "nomad-ecs-driver"
+
+	// maxStartedByLength is the maximum length of the ECS task startedBy
+	// field.
+	maxStartedByLength = 36
+
+	// maxTaskTags is the maximum number of tags ECS allows on a task.
+	maxTaskTags = 50
+
+	// maxTagKeyLength and maxTagValueLength are the maximum lengths of the
+	// key and value of a single tag.
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+
+	// reservedAWSTagPrefix prefixes the tag keys reserved for use by AWS.
+	reservedAWSTagPrefix = "aws:"
+
+	// nomadTagPrefix prefixes the tag keys set by the driver to identify the
+	// Nomad task running the ECS task.
+	nomadTagPrefix = "nomad:"
+)
+
+// These are the tag keys the driver uses to identify the Nomad task running
+// each ECS task.
+const (
+	nomadTagNamespace = nomadTagPrefix + "namespace"
+	nomadTagJobID     = nomadTagPrefix + "job_id"
+	nomadTagTaskGroup = nomadTagPrefix + "task_group"
+	nomadTagTask      = nomadTagPrefix + "task"
+	nomadTagAllocID   = nomadTagPrefix + "alloc_id"
+	nomadTagNodeID    = nomadTagPrefix + "node_id"
+)
+
+// nomadTagCount is the number of tags set by the driver on each task, which
+// reduces the number of tags available to the user.
+const nomadTagCount = 6
+
+// invalidStartedByChars matches the characters which are not permitted
+// within the ECS task startedBy field.
+var invalidStartedByChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// nomadTaskTags returns the tags identifying the Nomad task. Empty values are
+// omitted, as ECS does not permit them to be looked up meaningfully.
+func nomadTaskTags(cfg *drivers.TaskConfig) map[string]string {
+	tags := make(map[string]string)
+	for k, v := range map[string]string{
+		nomadTagNamespace: cfg.Namespace,
+		nomadTagJobID:     cfg.JobID,
+		nomadTagTaskGroup: cfg.TaskGroupName,
+		nomadTagTask:      cfg.Name,
+		nomadTagAllocID:   cfg.AllocID,
+		nomadTagNodeID:    cfg.NodeID,
+	} {
+		if v != "" {
+			tags[k] = v
+		}
+	}
+	return tags
+}
+
+// validateTags checks the user defined tags of the jobspec against the ECS
+// tagging rules, leaving space for the tags set by the driver.
+func validateTags(tags map[string]string) error {
+	if max := maxTaskTags - nomadTagCount; len(tags) > max {
+		return fmt.Errorf("at most %d tags are supported", max)
+	}
+	for k, v := range tags {
+		switch {
+		case k == "":
+			return fmt.Errorf("tag keys must not be empty")
+		case len(k) > maxTagKeyLength:
+			return fmt.Errorf("tag key %q exceeds %d characters", k, maxTagKeyLength)
+		case len(v) > maxTagValueLength:
+			return fmt.Errorf("tag %q value exceeds %d characters", k, maxTagValueLength)
+		case strings.HasPrefix(strings.ToLower(k), reservedAWSTagPrefix):
+			return fmt.Errorf("tag key %q uses the reserved %q prefix", k, reservedAWSTagPrefix)
+		case strings.HasPrefix(strings.ToLower(k), nomadTagPrefix):
+			return fmt.Errorf("tag key %q uses the %q prefix reserved for the driver", k, nomadTagPrefix)
+		}
+	}
+	return nil
+}
+
+// buildTags merges the driver and user defined tags into ECS tags, sorted by
+// key so the request is stable.
+func buildTags(nomadTags, userTags map[string]string) []ecs.Tag {
+	merged := make(map[string]string, len(nomadTags)+len(userTags))
+	for k, v := range userTags {
+		merged[k] = v
+	}
+	for k, v := range nomadTags {
+		merged[k] = v
+	}
+
+	keys := make([]string, 0, len(merged))
+	for k := range merged {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	tags := make([]ecs.Tag, 0, len(keys))
+	for _, k := range keys {
+		tags = append(tags, ecs.Tag{Key: aws.String(k), Value: aws.String(merged[k])})
+	}
+	return tags
+}
+
+// startedByData is the data available to the started_by template.
+type startedByData struct {
+	Namespace    string
+	JobID        string
+	JobName      string
+	TaskGroup    string
+	Task         string
+	AllocID      string
+	ShortAllocID string
+	NodeID       string
+}
+
+// newStartedByData returns the template data of the Nomad task. It is also
+// available to the workload_identity role_arn template.
+func newStartedByData(cfg *drivers.TaskConfig) startedByData {
+	shortAllocID := cfg.AllocID
+	if len(shortAllocID) > 8 {
+		shortAllocID = shortAllocID[:8]
+	}
+
+	return startedByData{
+		Namespace:    cfg.Namespace,
+		JobID:        cfg.JobID,
+		JobName:      cfg.JobName,
+		TaskGroup:    cfg.TaskGroupName,
+		Task:         cfg.Name,
+		AllocID:      cfg.AllocID,
+		ShortAllocID: shortAllocID,
+		NodeID:       cfg.NodeID,
+	}
+}
+
+// parseStartedByTemplate parses the started_by plugin option, which is a Go
+// template rendered for each task.
+func parseStartedByTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("started_by").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse started_by: %v", err)
+	}
+
+	// Render the template with placeholder data so that references to
+	// unknown fields are rejected when the config is set.
+	if err := tmpl.Execute(&bytes.Buffer{}, startedByData{}); err != nil {
+		return nil, fmt.Errorf("failed to render started_by: %v", err)
+	}
+	return tmpl, nil
+}
+
+// renderStartedBy renders the started_by template for the Nomad task. Any
+// characters ECS does not permit are replaced and the result is truncated to
+// the maximum length.
+func renderStartedBy(tmpl *template.Template, cfg *drivers.TaskConfig) (string, error) {
+	if tmpl == nil {
+		return defaultStartedBy, nil
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, newStartedByData(cfg)); err != nil {
+		return "", fmt.Errorf("failed to render started_by: %v", err)
+	}
+
+	startedBy := invalidStartedByChars.ReplaceAllString(buf.String(), "_")
+	if len(startedBy) > maxStartedByLength {
+		startedBy = startedBy[:maxStartedByLength]
+	}
+	if startedBy == "" {
+		return defaultStartedBy, nil
+	}
+	return startedBy, nil
+}
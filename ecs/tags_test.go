@@ -0,0 +1,156 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testNomadTaskConfig() *drivers.TaskConfig {
+	return &drivers.TaskConfig{
+		Namespace:     "default",
+		JobID:         "web",
+		JobName:       "web",
+		TaskGroupName: "frontend",
+		Name:          "server",
+		AllocID:       "6d9c1a3e-54f5-7b0a-2f4c-6f2c9d5c1e7a",
+		NodeID:        "0f6b3c1e-1a6b-9f1e-4d26-4b8c6e0a7b21",
+	}
+}
+
+func Test_validateTags(t *testing.T) {
+	tooMany := make(map[string]string)
+	for i := 0; i < maxTaskTags; i++ {
+		tooMany[strings.Repeat("k", i+1)] = "v"
+	}
+
+	testCases := []struct {
+		name          string
+		inputTags     map[string]string
+		expectedError string
+	}{
+		{
+			name:      "valid",
+			inputTags: map[string]string{"team": "platform", "cost-center": "1234"},
+		},
+		{
+			name:          "reserved aws prefix",
+			inputTags:     map[string]string{"AWS:team": "platform"},
+			expectedError: `tag key "AWS:team" uses the reserved "aws:" prefix`,
+		},
+		{
+			name:          "reserved nomad prefix",
+			inputTags:     map[string]string{"nomad:job_id": "other"},
+			expectedError: `tag key "nomad:job_id" uses the "nomad:" prefix reserved for the driver`,
+		},
+		{
+			name:          "reserved nomad prefix case",
+			inputTags:     map[string]string{"Nomad:job_id": "other"},
+			expectedError: `tag key "Nomad:job_id" uses the "nomad:" prefix reserved for the driver`,
+		},
+		{
+			name:          "long value",
+			inputTags:     map[string]string{"team": strings.Repeat("v", maxTagValueLength+1)},
+			expectedError: `tag "team" value exceeds 256 characters`,
+		},
+		{
+			name:          "too many",
+			inputTags:     tooMany,
+			expectedError: "at most 44 tags are supported",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateTags(tc.inputTags)
+			if tc.expectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedError)
+			}
+		})
+	}
+}
+
+func Test_renderStartedBy(t *testing.T) {
+	testCases := []struct {
+		name          string
+		inputTemplate string
+		expected      string
+	}{
+		{
+			name:     "default",
+			expected: "nomad-ecs-driver",
+		},
+		{
+			name:          "short alloc id",
+			inputTemplate: "nomad-{{.JobID}}-{{.ShortAllocID}}",
+			expected:      "nomad-web-6d9c1a3e",
+		},
+		{
+			name:          "invalid characters",
+			inputTemplate: "{{.Namespace}}/{{.JobID}}.{{.Task}}",
+			expected:      "default_web_server",
+		},
+		{
+			name:          "truncated",
+			inputTemplate: "nomad-{{.AllocID}}",
+			expected:      "nomad-6d9c1a3e-54f5-7b0a-2f4c-6f2c9d",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DriverConfig{StartedBy: tc.inputTemplate}
+			require.NoError(t, cfg.parse())
+
+			startedBy, err := renderStartedBy(cfg.startedBy, testNomadTaskConfig())
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, startedBy)
+		})
+	}
+
+	_, err := parseStartedByTemplate("{{.Unknown}}")
+	assert.Error(t, err)
+}
+
+func Test_buildTaskInput_tags(t *testing.T) {
+	client := awsEcsClient{cluster: "nomad"}
+	input := client.buildTaskInput(TaskConfig{
+		Task: ECSTaskConfig{
+			TaskDefinition:       "web:1",
+			Tags:                 map[string]string{"team": "platform"},
+			EnableECSManagedTags: true,
+			PropagateTags:        "TASK_DEFINITION",
+		},
+		startedBy: "nomad-web-6d9c1a3e",
+		nomadTags: nomadTaskTags(testNomadTaskConfig()),
+	})
+
+	assert.Equal(t, "nomad-web-6d9c1a3e", aws.StringValue(input.StartedBy))
+	assert.True(t, aws.BoolValue(input.EnableECSManagedTags))
+	assert.Equal(t, ecs.PropagateTagsTaskDefinition, input.PropagateTags)
+
+	tags := make(map[string]string)
+	for _, tag := range input.Tags {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	assert.Equal(t, map[string]string{
+		"nomad:namespace":  "default",
+		"nomad:job_id":     "web",
+		"nomad:task_group": "frontend",
+		"nomad:task":       "server",
+		"nomad:alloc_id":   "6d9c1a3e-54f5-7b0a-2f4c-6f2c9d5c1e7a",
+		"nomad:node_id":    "0f6b3c1e-1a6b-9f1e-4d26-4b8c6e0a7b21",
+		"team":             "platform",
+	}, tags)
+	assert.Equal(t, "nomad:alloc_id", aws.StringValue(input.Tags[0].Key))
+}
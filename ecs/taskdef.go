@@ -0,0 +1,361 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+)
+
+const (
+	// taskDefinitionFamilyPrefix is prepended to the family of all task
+	// definitions registered by the driver.
+	taskDefinitionFamilyPrefix = "nomad"
+
+	// taskDefinitionHashLength is the number of hex characters of the content
+	// hash included within the family name.
+	taskDefinitionHashLength = 16
+
+	// maxTaskDefinitionFamilyLength is the maximum length of an ECS task
+	// definition family.
+	maxTaskDefinitionFamilyLength = 255
+)
+
+// taskDefinitionReadOnlyFields are the fields of a described task definition
+// which are set by ECS, and therefore cannot be set when registering a copy.
+var taskDefinitionReadOnlyFields = []string{
+	"taskDefinitionArn",
+	"revision",
+	"status",
+	"requiresAttributes",
+	"compatibilities",
+	"registeredAt",
+	"registeredBy",
+	"deregisteredAt",
+	"deleteRequestedAt",
+}
+
+// invalidFamilyChars matches the characters which are not permitted within
+// an ECS task definition family.
+var invalidFamilyChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// buildTaskDefinitionInput converts the inline container definitions of the
+// jobspec into the input used to register an ECS task definition. The family
+// is derived from the job and task names, along with a hash of the content,
+// so that identical definitions map to the same family and can be reused.
+func buildTaskDefinitionInput(jobName, taskName string, cfg ECSTaskConfig) (*ecs.RegisterTaskDefinitionInput, error) {
+	input := ecs.RegisterTaskDefinitionInput{
+		NetworkMode: ecs.NetworkModeAwsvpc,
+	}
+
+	if cfg.ExecutionRoleARN != "" {
+		input.ExecutionRoleArn = aws.String(cfg.ExecutionRoleARN)
+	}
+	if cfg.TaskRoleARN != "" {
+		input.TaskRoleArn = aws.String(cfg.TaskRoleARN)
+	}
+
+	var cpu, memory int64
+	for _, c := range cfg.ContainerDefinitions {
+		input.ContainerDefinitions = append(input.ContainerDefinitions, buildContainerDefinition(c))
+		cpu += c.CPU
+		if c.Memory > 0 {
+			memory += c.Memory
+		} else {
+			memory += c.MemoryReservation
+		}
+	}
+
+	applyEntryPointOverrides(input.ContainerDefinitions, cfg.ContainerOverrides)
+	applyStopTimeout(input.ContainerDefinitions, cfg.StopTimeout)
+
+	// Fargate requires the task level resources to be set, which are
+	// calculated as the sum of the container resources unless set explicitly,
+	// and then rounded up to the smallest supported Fargate task size.
+	if cfg.CPU > 0 {
+		cpu = cfg.CPU
+	}
+	if cfg.Memory > 0 {
+		memory = cfg.Memory
+	}
+	if cfg.usesFargate() {
+		var err error
+		if cpu, memory, err = fargateResources(cpu, memory); err != nil {
+			return nil, err
+		}
+		input.RequiresCompatibilities = []ecs.Compatibility{ecs.CompatibilityFargate}
+		input.Cpu = aws.String(strconv.FormatInt(cpu, 10))
+		input.Memory = aws.String(strconv.FormatInt(memory, 10))
+	} else if cfg.LaunchType == "EC2" {
+		input.RequiresCompatibilities = []ecs.Compatibility{ecs.CompatibilityEc2}
+	}
+
+	if err := setTaskDefinitionFamily(&input, jobName, taskName); err != nil {
+		return nil, err
+	}
+	return &input, nil
+}
+
+// deriveTaskDefinitionInput builds the request used to register a copy of an
+// existing task definition with the container entrypoints and stop timeout
+// overridden. ECS does not support overriding either when running a task, so
+// this is the only way to change them without modifying the original
+// definition. The copy is made from the JSON object of the definition, so
+// that fields the AWS SDK does not support, such as the runtime platform and
+// ephemeral storage, are preserved.
+func deriveTaskDefinitionInput(jobName, taskName string, def map[string]interface{},
+	cfg ECSTaskConfig) (map[string]interface{}, error) {
+	input := make(map[string]interface{}, len(def))
+	for k, v := range def {
+		input[k] = v
+	}
+	for _, field := range taskDefinitionReadOnlyFields {
+		delete(input, field)
+	}
+
+	defs, _ := input["containerDefinitions"].([]interface{})
+	containers := make([]interface{}, 0, len(defs))
+	for _, d := range defs {
+		src, ok := d.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("failed to derive task definition: unexpected container definition %v", d)
+		}
+
+		container := make(map[string]interface{}, len(src))
+		for k, v := range src {
+			container[k] = v
+		}
+		for _, o := range cfg.ContainerOverrides {
+			if len(o.EntryPoint) > 0 && container["name"] == o.Name {
+				container["entryPoint"] = o.EntryPoint
+			}
+		}
+		if cfg.StopTimeout > 0 {
+			container["stopTimeout"] = cfg.StopTimeout
+		}
+		containers = append(containers, container)
+	}
+	input["containerDefinitions"] = containers
+
+	delete(input, "family")
+	hash, err := taskDefinitionHash(input)
+	if err != nil {
+		return nil, err
+	}
+	input["family"] = taskDefinitionFamily(jobName, taskName, hash)
+	return input, nil
+}
+
+// applyEntryPointOverrides sets the entrypoint of each container definition
+// which has an override specifying one.
+func applyEntryPointOverrides(defs []ecs.ContainerDefinition, overrides []TaskContainerOverride) {
+	for _, o := range overrides {
+		if len(o.EntryPoint) == 0 {
+			continue
+		}
+		for i := range defs {
+			if aws.StringValue(defs[i].Name) == o.Name {
+				defs[i].EntryPoint = o.EntryPoint
+			}
+		}
+	}
+}
+
+// applyStopTimeout sets the time, in seconds, ECS waits for each container to
+// exit after sending SIGTERM before killing it. Zero leaves the definitions
+// unchanged.
+func applyStopTimeout(defs []ecs.ContainerDefinition, seconds int64) {
+	if seconds <= 0 {
+		return
+	}
+	for i := range defs {
+		defs[i].StopTimeout = aws.Int64(seconds)
+	}
+}
+
+// hasEntryPointOverride returns whether any of the container overrides set
+// the entrypoint.
+func hasEntryPointOverride(overrides []TaskContainerOverride) bool {
+	for _, o := range overrides {
+		if len(o.EntryPoint) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// setTaskDefinitionFamily sets the family of the input from the job and task
+// names and a hash of the content. The content is hashed before setting the
+// family, so the hash is dependent only on the definition itself.
+func setTaskDefinitionFamily(input *ecs.RegisterTaskDefinitionInput, jobName, taskName string) error {
+	input.Family = nil
+
+	hash, err := taskDefinitionHash(input)
+	if err != nil {
+		return err
+	}
+	input.Family = aws.String(taskDefinitionFamily(jobName, taskName, hash))
+	return nil
+}
+
+// taskDefinitionHash returns the truncated hash of the JSON encoded task
+// definition, which is included within the family name.
+func taskDefinitionHash(input interface{}) (string, error) {
+	content, err := json.Marshal(input)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash task definition: %v", err)
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])[:taskDefinitionHashLength], nil
+}
+
+// buildContainerDefinition converts a single jobspec container definition
+// into its ECS equivalent.
+func buildContainerDefinition(c TaskContainerDefinition) ecs.ContainerDefinition {
+	def := ecs.ContainerDefinition{
+		Name:      aws.String(c.Name),
+		Image:     aws.String(c.Image),
+		Essential: aws.Bool(c.Essential),
+	}
+
+	if c.CPU > 0 {
+		def.Cpu = aws.Int64(c.CPU)
+	}
+	if c.Memory > 0 {
+		def.Memory = aws.Int64(c.Memory)
+	}
+	if c.MemoryReservation > 0 {
+		def.MemoryReservation = aws.Int64(c.MemoryReservation)
+	}
+
+	// Sort the environment so the content hash is stable.
+	def.Environment = sortedKeyValuePairs(c.Environment)
+
+	for _, pm := range c.PortMappings {
+		mapping := ecs.PortMapping{
+			ContainerPort: aws.Int64(pm.ContainerPort),
+			Protocol:      ecs.TransportProtocolTcp,
+		}
+		if pm.HostPort > 0 {
+			mapping.HostPort = aws.Int64(pm.HostPort)
+		}
+		if pm.Protocol == "udp" {
+			mapping.Protocol = ecs.TransportProtocolUdp
+		}
+		def.PortMappings = append(def.PortMappings, mapping)
+	}
+
+	if c.LogConfiguration != nil {
+		def.LogConfiguration = &ecs.LogConfiguration{
+			LogDriver: ecs.LogDriver(c.LogConfiguration.LogDriver),
+			Options:   c.LogConfiguration.Options,
+		}
+	}
+
+	if c.HealthCheck != nil {
+		hc := ecs.HealthCheck{Command: c.HealthCheck.Command}
+		if c.HealthCheck.Interval > 0 {
+			hc.Interval = aws.Int64(c.HealthCheck.Interval)
+		}
+		if c.HealthCheck.Timeout > 0 {
+			hc.Timeout = aws.Int64(c.HealthCheck.Timeout)
+		}
+		if c.HealthCheck.Retries > 0 {
+			hc.Retries = aws.Int64(c.HealthCheck.Retries)
+		}
+		if c.HealthCheck.StartPeriod > 0 {
+			hc.StartPeriod = aws.Int64(c.HealthCheck.StartPeriod)
+		}
+		def.HealthCheck = &hc
+	}
+
+	return def
+}
+
+// taskDefinitionFamily builds the family name of a registered task
+// definition, ensuring it only contains valid characters and that the hash
+// is never truncated.
+func taskDefinitionFamily(jobName, taskName, hash string) string {
+	name := fmt.Sprintf("%s-%s-%s", taskDefinitionFamilyPrefix, jobName, taskName)
+	name = invalidFamilyChars.ReplaceAllString(name, "_")
+
+	if max := maxTaskDefinitionFamilyLength - len(hash) - 1; len(name) > max {
+		name = name[:max]
+	}
+	return name + "-" + hash
+}
+
+// ensureTaskDefinition returns the ARN of an active task definition of the
+// family, calling register to register one if it does not already exist. As
+// the family includes a hash of the content, any active revision matches.
+func ensureTaskDefinition(ctx context.Context, client ecsClientInterface, family string,
+	register func() (*ecs.TaskDefinition, error)) (string, error) {
+
+	// Describing the family returns the latest revision. Any error is
+	// treated as the family not existing, as registering will surface any
+	// persistent problem.
+	if def, err := client.DescribeTaskDefinition(ctx, family); err == nil &&
+		def.Status == ecs.TaskDefinitionStatusActive {
+		return aws.StringValue(def.TaskDefinitionArn), nil
+	}
+
+	def, err := register()
+	if err != nil {
+		return "", fmt.Errorf("failed to register task definition %q: %v", family, err)
+	}
+	return aws.StringValue(def.TaskDefinitionArn), nil
+}
+
+// resolveTaskDefinition returns the task definition to run for the task
+// config. A task definition is registered, or reused, when the jobspec
+// describes the containers inline or overrides a container entrypoint. The
+// returned bool is true when the ARN refers to such a registered definition.
+func resolveTaskDefinition(ctx context.Context, client ecsClientInterface, jobName, taskName string,
+	cfg ECSTaskConfig) (string, bool, error) {
+	var (
+		family   string
+		register func() (*ecs.TaskDefinition, error)
+	)
+
+	switch {
+	case len(cfg.ContainerDefinitions) > 0:
+		input, err := buildTaskDefinitionInput(jobName, taskName, cfg)
+		if err != nil {
+			return "", false, err
+		}
+		family = aws.StringValue(input.Family)
+		register = func() (*ecs.TaskDefinition, error) {
+			return client.RegisterTaskDefinition(ctx, input)
+		}
+	case hasEntryPointOverride(cfg.ContainerOverrides) || cfg.StopTimeout > 0:
+		def, err := client.DescribeTaskDefinitionJSON(ctx, cfg.TaskDefinition)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to describe task definition %q: %v", cfg.TaskDefinition, err)
+		}
+		input, err := deriveTaskDefinitionInput(jobName, taskName, def, cfg)
+		if err != nil {
+			return "", false, err
+		}
+		family, _ = input["family"].(string)
+		register = func() (*ecs.TaskDefinition, error) {
+			return client.RegisterTaskDefinitionJSON(ctx, input)
+		}
+	default:
+		return cfg.TaskDefinition, false, nil
+	}
+
+	arn, err := ensureTaskDefinition(ctx, client, family, register)
+	if err != nil {
+		return "", false, err
+	}
+	return arn, true, nil
+}
@@ -0,0 +1,472 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package ecs
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_containerDefinitionConfig(t *testing.T) {
+	config := `
+config {
+  task {
+    launch_type        = "FARGATE"
+    execution_role_arn = "arn:aws:iam::123456789012:role/ecs-execution"
+
+    container_definition {
+      name   = "web"
+      image  = "nginx:1.21"
+      cpu    = 256
+      memory = 512
+
+      environment = {
+        LISTEN_PORT = "8080"
+      }
+
+      port_mapping {
+        container_port = 8080
+      }
+
+      log_configuration {
+        log_driver = "awslogs"
+        options = {
+          awslogs-group         = "/ecs/web"
+          awslogs-stream-prefix = "ecs"
+        }
+      }
+
+      health_check {
+        command  = ["CMD-SHELL", "curl -f http://localhost:8080/ || exit 1"]
+        interval = 10
+      }
+    }
+  }
+}`
+
+	var tc TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, config, &tc)
+	require.NoError(t, tc.validate())
+	require.Len(t, tc.Task.ContainerDefinitions, 1)
+
+	cd := tc.Task.ContainerDefinitions[0]
+	assert.Equal(t, "web", cd.Name)
+	assert.True(t, cd.Essential)
+	assert.Equal(t, int64(512), cd.Memory)
+	assert.Equal(t, "8080", cd.Environment["LISTEN_PORT"])
+	assert.Equal(t, int64(8080), cd.PortMappings[0].ContainerPort)
+	assert.Equal(t, "ecs", cd.LogConfiguration.Options["awslogs-stream-prefix"])
+	assert.Equal(t, int64(10), cd.HealthCheck.Interval)
+}
+
+func Test_TaskConfig_validate(t *testing.T) {
+	testCases := []struct {
+		name          string
+		inputConfig   ECSTaskConfig
+		expectedError string
+	}{
+		{
+			name:          "no definition",
+			inputConfig:   ECSTaskConfig{},
+			expectedError: "one of task_definition or container_definition must be set",
+		},
+		{
+			name: "both definitions",
+			inputConfig: ECSTaskConfig{
+				TaskDefinition:       "web:1",
+				ContainerDefinitions: []TaskContainerDefinition{{Name: "web"}},
+			},
+			expectedError: "task_definition and container_definition cannot both be set",
+		},
+		{
+			name: "duplicate container name",
+			inputConfig: ECSTaskConfig{
+				ContainerDefinitions: []TaskContainerDefinition{{Name: "web"}, {Name: "web"}},
+			},
+			expectedError: `duplicate container_definition name "web"`,
+		},
+		{
+			name:        "existing definition",
+			inputConfig: ECSTaskConfig{TaskDefinition: "web:1"},
+		},
+		{
+			name: "override unknown container",
+			inputConfig: ECSTaskConfig{
+				ContainerDefinitions: []TaskContainerDefinition{{Name: "web"}},
+				ContainerOverrides:   []TaskContainerOverride{{Name: "worker"}},
+			},
+			expectedError: `container_override "worker" does not match a container_definition`,
+		},
+		{
+			name: "duplicate override",
+			inputConfig: ECSTaskConfig{
+				TaskDefinition:     "web:1",
+				ContainerOverrides: []TaskContainerOverride{{Name: "web"}, {Name: "web"}},
+			},
+			expectedError: `duplicate container_override name "web"`,
+		},
+		{
+			name: "override reservation exceeds memory",
+			inputConfig: ECSTaskConfig{
+				TaskDefinition:     "web:1",
+				ContainerOverrides: []TaskContainerOverride{{Name: "web", Memory: 256, MemoryReservation: 512}},
+			},
+			expectedError: `container_override "web" memory_reservation must not exceed memory`,
+		},
+		{
+			name: "override invalid environment file",
+			inputConfig: ECSTaskConfig{
+				TaskDefinition:     "web:1",
+				ContainerOverrides: []TaskContainerOverride{{Name: "web", EnvironmentFiles: []string{"s3://bucket/web.env"}}},
+			},
+			expectedError: `container_override "web" environment_files must be S3 object ARNs, got "s3://bucket/web.env"`,
+		},
+		{
+			name:          "negative task cpu",
+			inputConfig:   ECSTaskConfig{TaskDefinition: "web:1", CPU: -1},
+			expectedError: "cpu and memory must not be negative",
+		},
+		{
+			name:          "stop timeout too long",
+			inputConfig:   ECSTaskConfig{TaskDefinition: "web:1", StopTimeout: 121},
+			expectedError: "stop_timeout must be between 0 and 120 seconds",
+		},
+		{
+			name:          "invalid startup timeout",
+			inputConfig:   ECSTaskConfig{TaskDefinition: "web:1", StartupTimeout: "10"},
+			expectedError: `failed to parse startup_timeout: time: missing unit in duration "10"`,
+		},
+		{
+			name: "wait for healthy without health check",
+			inputConfig: ECSTaskConfig{
+				ContainerDefinitions: []TaskContainerDefinition{{Name: "web", Image: "nginx:1.21"}},
+				WaitForHealthy:       true,
+			},
+			expectedError: "wait_for_healthy requires a container_definition with a health_check",
+		},
+		{
+			name:          "exec container without exec",
+			inputConfig:   ECSTaskConfig{TaskDefinition: "web:1", ExecContainer: "web"},
+			expectedError: "exec_container requires enable_execute_command",
+		},
+		{
+			name: "unknown exec container",
+			inputConfig: ECSTaskConfig{
+				ContainerDefinitions: []TaskContainerDefinition{{Name: "web", Image: "nginx:1.21"}},
+				EnableExecuteCommand: aws.Bool(true),
+				ExecContainer:        "sidecar",
+			},
+			expectedError: `exec_container "sidecar" does not match a container_definition`,
+		},
+		{
+			name:          "signal container without exec",
+			inputConfig:   ECSTaskConfig{TaskDefinition: "web:1", SignalContainer: "web"},
+			expectedError: "signal_container requires enable_execute_command",
+		},
+		{
+			name:          "unknown launch type",
+			inputConfig:   ECSTaskConfig{TaskDefinition: "web:1", LaunchType: "EXTERNAL"},
+			expectedError: `launch_type must be EC2 or FARGATE, got "EXTERNAL"`,
+		},
+		{
+			name: "launch type and capacity provider strategy",
+			inputConfig: ECSTaskConfig{
+				TaskDefinition:           "web:1",
+				LaunchType:               "FARGATE",
+				CapacityProviderStrategy: []TaskCapacityProviderStrategy{{CapacityProvider: "FARGATE"}},
+			},
+			expectedError: "launch_type and capacity_provider_strategy cannot both be set",
+		},
+		{
+			name: "multiple capacity provider bases",
+			inputConfig: ECSTaskConfig{
+				TaskDefinition: "web:1",
+				CapacityProviderStrategy: []TaskCapacityProviderStrategy{
+					{CapacityProvider: "FARGATE", Base: 1},
+					{CapacityProvider: "FARGATE_SPOT", Base: 1},
+				},
+			},
+			expectedError: "only one capacity_provider_strategy can set base",
+		},
+		{
+			name: "capacity provider weight out of range",
+			inputConfig: ECSTaskConfig{
+				TaskDefinition:           "web:1",
+				CapacityProviderStrategy: []TaskCapacityProviderStrategy{{CapacityProvider: "FARGATE", Weight: 1001}},
+			},
+			expectedError: `capacity_provider_strategy "FARGATE" weight must be between 0 and 1000`,
+		},
+		{
+			name: "fallback without fargate spot",
+			inputConfig: ECSTaskConfig{
+				TaskDefinition:           "web:1",
+				CapacityProviderStrategy: []TaskCapacityProviderStrategy{{CapacityProvider: "FARGATE", Weight: 1}},
+				FargateSpotFallback:      true,
+			},
+			expectedError: "fargate_spot_fallback requires a FARGATE_SPOT capacity_provider_strategy",
+		},
+		{
+			name: "fargate spot with fallback",
+			inputConfig: ECSTaskConfig{
+				TaskDefinition: "web:1",
+				CapacityProviderStrategy: []TaskCapacityProviderStrategy{
+					{CapacityProvider: "FARGATE", Base: 1, Weight: 1},
+					{CapacityProvider: "FARGATE_SPOT", Weight: 3},
+				},
+				FargateSpotFallback: true,
+			},
+		},
+		{
+			name: "existing definition with overrides",
+			inputConfig: ECSTaskConfig{
+				TaskDefinition: "web:1",
+				CPU:            512,
+				ContainerOverrides: []TaskContainerOverride{{
+					Name:             "web",
+					Command:          []string{"serve"},
+					EnvironmentFiles: []string{"arn:aws:s3:::bucket/web.env"},
+				}},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := TaskConfig{Task: tc.inputConfig}
+			err := cfg.validate()
+			if tc.expectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedError)
+			}
+		})
+	}
+}
+
+func Test_buildTaskDefinitionInput(t *testing.T) {
+	cfg := ECSTaskConfig{
+		LaunchType: "FARGATE",
+		ContainerDefinitions: []TaskContainerDefinition{
+			{
+				Name:        "web",
+				Image:       "nginx:1.21",
+				Essential:   true,
+				CPU:         256,
+				Memory:      512,
+				Environment: map[string]string{"B": "2", "A": "1"},
+			},
+		},
+	}
+
+	input, err := buildTaskDefinitionInput("my job", "web", cfg)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(aws.StringValue(input.Family), "nomad-my_job-web-"))
+	assert.Equal(t, "256", aws.StringValue(input.Cpu))
+	assert.Equal(t, "512", aws.StringValue(input.Memory))
+	assert.Equal(t, "A", aws.StringValue(input.ContainerDefinitions[0].Environment[0].Name))
+
+	// Identical content must result in the same family, whereas a change
+	// must result in a new family.
+	again, err := buildTaskDefinitionInput("my job", "web", cfg)
+	require.NoError(t, err)
+	assert.Equal(t, aws.StringValue(input.Family), aws.StringValue(again.Family))
+
+	cfg.ContainerDefinitions[0].Image = "nginx:1.22"
+	changed, err := buildTaskDefinitionInput("my job", "web", cfg)
+	require.NoError(t, err)
+	assert.NotEqual(t, aws.StringValue(input.Family), aws.StringValue(changed.Family))
+
+	// The container resources are rounded up to a valid Fargate task size,
+	// including when the containers do not set any.
+	cfg.ContainerDefinitions = append(cfg.ContainerDefinitions, TaskContainerDefinition{
+		Name: "sidecar", Image: "envoy:1.18", CPU: 128, MemoryReservation: 600,
+	})
+	rounded, err := buildTaskDefinitionInput("my job", "web", cfg)
+	require.NoError(t, err)
+	assert.Equal(t, "512", aws.StringValue(rounded.Cpu))
+	assert.Equal(t, "2048", aws.StringValue(rounded.Memory))
+
+	cfg.ContainerDefinitions = []TaskContainerDefinition{{Name: "web", Image: "nginx:1.21"}}
+	rounded, err = buildTaskDefinitionInput("my job", "web", cfg)
+	require.NoError(t, err)
+	assert.Equal(t, "256", aws.StringValue(rounded.Cpu))
+	assert.Equal(t, "512", aws.StringValue(rounded.Memory))
+
+	cfg.Memory = 200000
+	_, err = buildTaskDefinitionInput("my job", "web", cfg)
+	assert.EqualError(t, err, "no Fargate task size supports 0 CPU units and 200000 MiB memory")
+}
+
+func Test_ensureTaskDefinition(t *testing.T) {
+	client := newMockECSClient()
+	input := &ecs.RegisterTaskDefinitionInput{Family: aws.String("nomad-job-web-0123456789abcdef")}
+	register := func() (*ecs.TaskDefinition, error) {
+		return client.RegisterTaskDefinition(context.Background(), input)
+	}
+
+	arn, err := ensureTaskDefinition(context.Background(), client, *input.Family, register)
+	require.NoError(t, err)
+	assert.Len(t, client.registerTaskInputs, 1)
+
+	// The active revision is reused.
+	reused, err := ensureTaskDefinition(context.Background(), client, *input.Family, register)
+	require.NoError(t, err)
+	assert.Equal(t, arn, reused)
+	assert.Len(t, client.registerTaskInputs, 1)
+
+	// An inactive revision results in a new revision being registered.
+	require.NoError(t, client.DeregisterTaskDefinition(context.Background(), arn))
+	registered, err := ensureTaskDefinition(context.Background(), client, *input.Family, register)
+	require.NoError(t, err)
+	assert.NotEqual(t, arn, registered)
+	assert.Len(t, client.registerTaskInputs, 2)
+}
+
+func TestDriver_releaseTaskDefinition(t *testing.T) {
+	client := newMockECSClient()
+	d := NewPlugin(hclog.NewNullLogger()).(*Driver)
+	defer d.signalShutdown()
+	d.config.DeregisterTaskDefinitions = true
+	d.clients = &ecsClientPool{
+		newClient: func(clusterRef, aws.CredentialsProvider) ecsClientInterface { return client },
+		clients:   make(map[clusterRef]ecsClientInterface),
+	}
+
+	const arn = "arn:aws:ecs:us-east-1:123456789012:task-definition/nomad-job-web-0123456789abcdef:1"
+	resolve := func() (string, bool, error) { return arn, true, nil }
+
+	// A task definition used by a recovered task and one being started is
+	// not deregistered until neither uses it.
+	d.retainTaskDefinition(arn)
+	_, _, err := d.acquireTaskDefinition(resolve)
+	require.NoError(t, err)
+
+	d.releaseTaskDefinition(arn)
+	assert.Empty(t, client.deregisteredTaskDefs)
+	d.releaseTaskDefinition(arn)
+	assert.Equal(t, []string{arn}, client.deregisteredTaskDefs)
+
+	// A task definition which the driver did not register is not counted.
+	_, _, err = d.acquireTaskDefinition(func() (string, bool, error) { return "web:1", false, nil })
+	require.NoError(t, err)
+	assert.Empty(t, d.taskDefinitions)
+}
+
+func Test_resolveTaskDefinition(t *testing.T) {
+	client := newMockECSClient()
+	client.taskDefinitions["web:1"] = &ecs.TaskDefinition{
+		TaskDefinitionArn: aws.String("arn:aws:ecs:us-east-1:123456789012:task-definition/web:1"),
+		NetworkMode:       ecs.NetworkModeAwsvpc,
+		ContainerDefinitions: []ecs.ContainerDefinition{
+			{Name: aws.String("web"), Image: aws.String("nginx:1.21")},
+			{Name: aws.String("sidecar"), Image: aws.String("envoy:1.18")},
+		},
+	}
+
+	// The existing definition is used as is without an entrypoint override.
+	cfg := ECSTaskConfig{
+		TaskDefinition:     "web:1",
+		ContainerOverrides: []TaskContainerOverride{{Name: "web", Command: []string{"serve"}}},
+	}
+	arn, registered, err := resolveTaskDefinition(context.Background(), client, "job", "web", cfg)
+	require.NoError(t, err)
+	assert.False(t, registered)
+	assert.Equal(t, "web:1", arn)
+	assert.Empty(t, client.registerTaskInputs)
+
+	// Overriding the entrypoint registers a derived definition.
+	cfg.ContainerOverrides[0].EntryPoint = []string{"/bin/sh", "-c"}
+	arn, registered, err = resolveTaskDefinition(context.Background(), client, "job", "web", cfg)
+	require.NoError(t, err)
+	assert.True(t, registered)
+	assert.True(t, strings.Contains(arn, "task-definition/nomad-job-web-"))
+	require.Len(t, client.registerTaskJSON, 1)
+
+	input := client.registerTaskJSON[0]
+	containers := input["containerDefinitions"].([]interface{})
+	assert.Equal(t, "awsvpc", input["networkMode"])
+	assert.Equal(t, []string{"/bin/sh", "-c"}, containers[0].(map[string]interface{})["entryPoint"])
+	assert.NotContains(t, containers[1], "entryPoint")
+
+	// The original definition is left untouched.
+	assert.Nil(t, client.taskDefinitions["web:1"].ContainerDefinitions[0].EntryPoint)
+
+	// Setting the stop timeout registers a derived definition with the
+	// timeout set on every container.
+	cfg.ContainerOverrides[0].EntryPoint = nil
+	cfg.StopTimeout = 45
+	_, registered, err = resolveTaskDefinition(context.Background(), client, "job", "web", cfg)
+	require.NoError(t, err)
+	assert.True(t, registered)
+	require.Len(t, client.registerTaskJSON, 2)
+	for _, c := range client.registerTaskJSON[1]["containerDefinitions"].([]interface{}) {
+		assert.Equal(t, int64(45), c.(map[string]interface{})["stopTimeout"])
+	}
+	assert.Nil(t, client.taskDefinitions["web:1"].ContainerDefinitions[0].StopTimeout)
+}
+
+func Test_deriveTaskDefinitionInput(t *testing.T) {
+	var def map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+  "taskDefinitionArn": "arn:aws:ecs:us-east-1:123456789012:task-definition/web:3",
+  "family": "web",
+  "revision": 3,
+  "status": "ACTIVE",
+  "registeredAt": 1620813600,
+  "compatibilities": ["EC2", "FARGATE"],
+  "requiresAttributes": [{"name": "ecs.capability.task-eni"}],
+  "networkMode": "awsvpc",
+  "cpu": "1024",
+  "memory": "2048",
+  "runtimePlatform": {"cpuArchitecture": "ARM64", "operatingSystemFamily": "LINUX"},
+  "ephemeralStorage": {"sizeInGiB": 100},
+  "containerDefinitions": [
+    {"name": "web", "image": "nginx:1.21", "credentialSpecs": ["spec"]},
+    {"name": "sidecar", "image": "envoy:1.18"}
+  ],
+  "tags": [{"key": "team", "value": "web"}]
+}`), &def))
+
+	cfg := ECSTaskConfig{
+		ContainerOverrides: []TaskContainerOverride{{Name: "web", EntryPoint: []string{"/bin/sh", "-c"}}},
+		StopTimeout:        45,
+	}
+	input, err := deriveTaskDefinitionInput("job", "web", def, cfg)
+	require.NoError(t, err)
+
+	// Fields set by ECS are removed, while those the SDK does not support
+	// and the tags are preserved.
+	for _, field := range taskDefinitionReadOnlyFields {
+		assert.NotContains(t, input, field)
+	}
+	assert.Equal(t, def["runtimePlatform"], input["runtimePlatform"])
+	assert.Equal(t, def["ephemeralStorage"], input["ephemeralStorage"])
+	assert.Equal(t, def["tags"], input["tags"])
+	assert.True(t, strings.HasPrefix(input["family"].(string), "nomad-job-web-"))
+
+	containers := input["containerDefinitions"].([]interface{})
+	web := containers[0].(map[string]interface{})
+	assert.Equal(t, []string{"/bin/sh", "-c"}, web["entryPoint"])
+	assert.Equal(t, int64(45), web["stopTimeout"])
+	assert.Equal(t, []interface{}{"spec"}, web["credentialSpecs"])
+	sidecar := containers[1].(map[string]interface{})
+	assert.NotContains(t, sidecar, "entryPoint")
+	assert.Equal(t, int64(45), sidecar["stopTimeout"])
+
+	// The described definition is left untouched, and deriving it again
+	// results in the same family.
+	assert.NotContains(t, def["containerDefinitions"].([]interface{})[0], "entryPoint")
+	again, err := deriveTaskDefinitionInput("job", "web", def, cfg)
+	require.NoError(t, err)
+	assert.Equal(t, input["family"], again["family"])
+}